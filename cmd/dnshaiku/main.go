@@ -1,33 +1,351 @@
 package main
 
 import (
+	"bufio"
+	"encoding/csv"
+	"flag"
 	"fmt"
 	"github.com/fsnotify/fsnotify"
+	"github.com/go-yaml/yaml"
+	"github.com/miekg/dns"
 	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/dnshaiku"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net"
 	_ "net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
+const usage = `usage: dnshaiku [command] [flags]
+
+commands:
+  serve         run dnshaiku (default)
+  check-config  validate the config and zone, exiting non-zero on errors
+  query         resolve a name against a running dnshaiku
+  simulate      show which server client IPs would get from a registry fixture
+  replay        replay a query log against a timeline of server states
+  healthcheck   probe the health endpoints of a running dnshaiku
+`
+
 func main() {
-	logger.Info("Reading config")
-	viper.SetConfigFile(".env")
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	switch command {
+	case "serve":
+		serve(args)
+	case "check-config":
+		checkConfig(args)
+	case "query":
+		query(args)
+	case "simulate":
+		simulate(args)
+	case "replay":
+		replay(args)
+	case "healthcheck":
+		healthcheck(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// readConfig reads configFile and the environment into viper's global instance
+func readConfig(configFile string) {
+	viper.SetConfigFile(configFile)
 	viper.AutomaticEnv()
-	viper.SetDefault("PROMETHEUS_METRICS_PORT", "9102")
-	viper.SetDefault("HTTP_DATA_PORT", "8080")
-	viper.SetDefault("DNS_PORT", "10053")
-	viper.SetDefault("DNS_TTL", "10")
-	viper.SetDefault("TEST_MODE", false)
-	viper.SetDefault("HOSTNAME_TO_SERVE", "fsd.connect.vatsim.net")
-	viper.SetDefault("DEFAULT_FSD_SERVER", "")
-	viper.SetDefault("SENTRY_DSN", "")
-	viper.SetDefault("HTTP_ENDPOINT_PORT", "8081")
-	viper.SetDefault("FSD_SERVER_REMOVE_FAILURE_COUNT", 2)
+	dnshaiku.SetDefaults(viper.GetViper())
 	_ = viper.ReadInConfig()
+}
+
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configFile := flags.String("config", ".env", "config file, watched for changes")
+	_ = flags.Parse(args)
+
+	logger.Info("Reading config")
+	readConfig(*configFile)
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		logger.Info(fmt.Sprintf("Config file changed: %s", e.Name))
+		_ = dnshaiku.ReloadConfig(viper.GetViper())
 	})
 	viper.WatchConfig()
 	logger.Info("dnshaiku - if people can't connect...it was DNS")
-	dnshaiku.Main()
+	if err := dnshaiku.Main(); err != nil {
+		logger.Error(fmt.Sprintf("dnshaiku exited: %s", err))
+		os.Exit(1)
+	}
+	logger.Info("dnshaiku shut down cleanly")
+}
+
+func checkConfig(args []string) {
+	flags := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configFile := flags.String("config", ".env", "config file")
+	_ = flags.Parse(args)
+	readConfig(*configFile)
+	if _, err := dnshaiku.CheckConfig(viper.GetViper()); err != nil {
+		fmt.Fprintf(os.Stderr, "config is invalid:\n%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("config ok")
+}
+
+func query(args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	server := flags.String("server", "127.0.0.1:10053", "address of the dnshaiku to query")
+	qtype := flags.String("type", "A", "record type to query")
+	sourceIp := flags.String("ip", "", "answer as if the query came from this IP, the querying host must be in DNS_OVERRIDE_ALLOWED_SOURCES")
+	useECS := flags.Bool("ecs", false, "send -ip as an ECS option instead of the local source IP override option")
+	useTCP := flags.Bool("tcp", false, "query over TCP")
+	timeout := flags.Duration("timeout", 5*time.Second, "query timeout")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: dnshaiku query [flags] [name]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	options := dnshaiku.QueryOptions{
+		Server:  *server,
+		Name:    "fsd.connect.vatsim.net",
+		UseECS:  *useECS,
+		TCP:     *useTCP,
+		Timeout: *timeout,
+	}
+	if flags.NArg() > 0 {
+		options.Name = flags.Arg(0)
+	}
+	var found bool
+	if options.Qtype, found = dns.StringToType[strings.ToUpper(*qtype)]; !found {
+		fmt.Fprintf(os.Stderr, "unknown record type %q\n", *qtype)
+		os.Exit(2)
+	}
+	if *sourceIp != "" {
+		if options.SourceIp = net.ParseIP(*sourceIp); options.SourceIp == nil {
+			fmt.Fprintf(os.Stderr, "%q is not an IP address\n", *sourceIp)
+			os.Exit(2)
+		}
+	}
+	in, rtt, err := dnshaiku.Query(options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(in.String())
+	fmt.Printf(";; Query time: %s\n;; SERVER: %s\n", rtt, *server)
+	if in.Rcode != dns.RcodeSuccess {
+		os.Exit(1)
+	}
+}
+
+func simulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	configFile := flags.String("config", ".env", "config file, for GEOIP_DATABASE and selection settings")
+	fixtureFile := flags.String("fixture", "", "registry fixture, like test_data/*.yaml")
+	ipsFile := flags.String("ips", "", "file of client IPs, one per line, - for stdin. Defaults to the fixture's mockDnsQueries")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: dnshaiku simulate -fixture <file> [flags] [ip...]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if *fixtureFile == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	readConfig(*configFile)
+	config, err := dnshaiku.LoadConfig(viper.GetViper())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config is invalid:\n%s\n", err)
+		os.Exit(1)
+	}
+	yamlData, err := os.ReadFile(*fixtureFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fixture := common.TestingDataYaml{}
+	if err := yaml.Unmarshal(yamlData, &fixture); err != nil {
+		fmt.Fprintf(os.Stderr, "parsing %s: %s\n", *fixtureFile, err)
+		os.Exit(1)
+	}
+	ips := flags.Args()
+	if *ipsFile != "" {
+		ipsFromFile, err := readLines(*ipsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		ips = append(ips, ipsFromFile...)
+	}
+
+	queries, err := dnshaiku.Simulate(config, fixture, ips)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tCOUNTRY\tCITY\tSERVER\tSERVER IP\tMILES\tEXPECTED")
+	for _, q := range queries {
+		if !q.Matched() {
+			failed = true
+		}
+		if q.Error != "" {
+			fmt.Fprintf(w, "%s\t\t\terror: %s\t\t\t%s\n", q.Ip, q.Error, q.Expected)
+			continue
+		}
+		expected := q.Expected
+		if !q.Matched() {
+			expected += " MISMATCH"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.0f\t%s\n", q.Ip, q.Country, q.City, q.Server, q.ServerIp, q.DistanceMiles, expected)
+	}
+	_ = w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configFile := flags.String("config", ".env", "config file, for GEOIP_DATABASE and selection settings")
+	queryLogFile := flags.String("queries", "", "CSV query log of timestamp,ip rows")
+	timelineFile := flags.String("timeline", "", "YAML timeline of server states")
+	bucket := flags.Duration("bucket", time.Minute, "bucket size for per-server counts")
+	csvFile := flags.String("csv", "replay.csv", "file to write per-server counts for each bucket to, - for stdout")
+	_ = flags.Parse(args)
+	if *queryLogFile == "" || *timelineFile == "" {
+		fmt.Fprintln(flags.Output(), "usage: dnshaiku replay -queries <file> -timeline <file> [flags]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+
+	readConfig(*configFile)
+	config, err := dnshaiku.LoadConfig(viper.GetViper())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config is invalid:\n%s\n", err)
+		os.Exit(1)
+	}
+	queryLog, err := os.Open(*queryLogFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	queries, err := dnshaiku.ReadQueryLog(queryLog)
+	_ = queryLog.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading %s: %s\n", *queryLogFile, err)
+		os.Exit(1)
+	}
+	timelineData, err := os.Open(*timelineFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	timeline, err := dnshaiku.ReadTimeline(timelineData)
+	_ = timelineData.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading %s: %s\n", *timelineFile, err)
+		os.Exit(1)
+	}
+
+	result, err := dnshaiku.Replay(config, timeline, queries, *bucket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := writeReplayCSV(*csvFile, result); err != nil {
+		fmt.Fprintf(os.Stderr, "writing %s: %s\n", *csvFile, err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tCOUNTRY\tASSIGNED\tSHARE\tPEAK FILL\tPEAK AT\tSPILLED IN")
+	for _, server := range result.Servers {
+		share := 0.0
+		if answered := result.Queries - result.Failed; answered > 0 {
+			share = float64(server.Assignments) / float64(answered)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1f%%\t%.1f%%\t%s\t%d\n", server.Server, server.Country, server.Assignments,
+			share*100, server.PeakFill*100, server.PeakFillAt.Format(time.RFC3339), server.SpilledIn)
+	}
+	_ = w.Flush()
+	fmt.Printf("\n%d queries, %d spilled outside their closest country, %d failed\n", result.Queries, result.Spilled, result.Failed)
+}
+
+func writeReplayCSV(path string, result *dnshaiku.ReplayResult) error {
+	file := os.Stdout
+	if path != "-" {
+		var err error
+		if file, err = os.Create(path); err != nil {
+			return err
+		}
+		defer file.Close()
+	}
+	w := csv.NewWriter(file)
+	_ = w.Write([]string{"bucket_start", "server", "country", "assignments", "peak_fill"})
+	for _, bucket := range result.Buckets {
+		_ = w.Write([]string{
+			bucket.Start.Format(time.RFC3339),
+			bucket.Server,
+			bucket.Country,
+			strconv.Itoa(bucket.Assignments),
+			strconv.FormatFloat(bucket.PeakFill, 'f', 4, 64),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// readLines returns the non-blank lines of a file, or stdin if path is -
+func readLines(path string) ([]string, error) {
+	file := os.Stdin
+	if path != "-" {
+		var err error
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer file.Close()
+	}
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// healthcheck probes the health endpoints of a dnshaiku running in the same container. It exits
+// non-zero when unhealthy so it can be used as a Docker HEALTHCHECK in the scratch image.
+func healthcheck(args []string) {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	addr := flags.String("addr", "", "address of the metrics/health server (default 127.0.0.1:$PROMETHEUS_METRICS_PORT)")
+	endpoint := flags.String("endpoint", "readyz", "endpoint to probe, livez or readyz")
+	timeout := flags.Duration("timeout", 2*time.Second, "probe timeout")
+	_ = flags.Parse(args)
+	if *addr == "" {
+		port := os.Getenv("PROMETHEUS_METRICS_PORT")
+		if port == "" {
+			port = "9102"
+		}
+		*addr = fmt.Sprintf("127.0.0.1:%s", port)
+	}
+	if err := dnshaiku.HealthCheck(*addr, *endpoint, *timeout); err != nil {
+		fmt.Fprintf(os.Stderr, "unhealthy: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("healthy")
+	os.Exit(0)
 }
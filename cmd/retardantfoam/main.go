@@ -1,296 +1,131 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"errors"
+	"flag"
 	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/cloudflare/cloudflare-go"
-	"github.com/digitalocean/godo"
-	"github.com/go-yaml/yaml"
 	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
-	"log"
-	"net"
+	"github.com/vatsimnetwork/vatdns/internal/retardantfoam"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
-	"time"
+	"syscall"
 )
 
-var (
-	dnsServers sync.Map
-)
-
-type DnsServer struct {
-	Name    string `json:"name"`
-	Latency int64  `json:"latency"`
-	Result  string `json:"result"`
-	Pass    bool   `json:"pass"`
-}
-
-type retardantFoamDataFile struct {
-	IpServerFiles []ipServerFile `yaml:"ipServerFiles"`
-}
-
-type ipServerFile struct {
-	Name     string `yaml:"name"`
-	Region   string `yaml:"region"`
-	Bucket   string `yaml:"bucket"`
-	Contents string `yaml:"contents"`
-}
+const usage = `usage: retardantfoam [command] [flags]
 
-func failover() {
-	ctx := context.Background()
-	doSpacesKey := viper.GetString("DO_SPACES_KEY")
-	doSpacesSecret := viper.GetString("DO_SPACES_SECRET")
-	doSpacesRegion := viper.GetString("DO_SPACES_REGION")
-	// Push IP files to Spaces
-	retardantFoamData := retardantFoamDataFile{}
-	yamlData, err := os.ReadFile("retardantfoam.yaml")
-	if err != nil {
-		logger.Fatal("Reading retardantfoam.yaml failed")
-	}
-	_ = yaml.Unmarshal(yamlData, &retardantFoamData)
-	for _, v := range retardantFoamData.IpServerFiles {
-		creds := credentials.NewStaticCredentialsProvider(doSpacesKey, doSpacesSecret, "")
+commands:
+  once    check the last heartbeat, fail over if it is too old, then probe DNS and write a new one (default)
+  daemon  probe DNS on a schedule, failing over after sustained failures, with /metrics and /healthz
+  plan    read and probe everything, then print what would be uploaded, purged and written without doing it.
+          Exits 3 if the heartbeat is old enough for once to fail over, 1 on errors, else 0. Same as once -dry-run.
 
-		customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-			return aws.Endpoint{
-				URL: fmt.Sprintf("https://%s.digitaloceanspaces.com", v.Region),
-			}, nil
-		})
-		cfg, err := config.LoadDefaultConfig(ctx,
-			config.WithCredentialsProvider(creds),
-			config.WithEndpointResolverWithOptions(customResolver))
-		if err != nil {
-		}
-		// Create an Amazon S3 service client
-		doSpacesClient := s3.NewFromConfig(cfg)
-		_, err = doSpacesClient.PutObject(context.TODO(), &s3.PutObjectInput{
-			Bucket: aws.String(v.Bucket),
-			Key:    aws.String(v.Name),
-			Body:   bytes.NewBufferString(v.Contents),
-		})
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to upload %s to Spaces", v.Name))
-		} else {
-			logger.Info(fmt.Sprintf("Uploaded %s to Spaces", v.Name))
-		}
-	}
+operator commands, each recorded in vatdns-audit:
+  status          show the heartbeat's age, each protocol's blocker, the last probe round and recent transitions
+  disarm          write a protocol's heartbeat blocker with -reason, stopping it failing over
+  arm             remove a protocol's heartbeat blocker with -reason
+  force-failover  fail a protocol over now, needs -reason and -confirm
+  failback        restore a protocol's IP server files and DNS records now, needs -reason and -confirm
+`
 
-	api, err := cloudflare.NewWithAPIToken(viper.GetString("CLOUDFLARE_API_KEY"))
-	if err != nil {
-		log.Fatal(err)
+func main() {
+	command := "once"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
 	}
-	_, err = api.PurgeCache(ctx, viper.GetString("CLOUDFLARE_ZONE_ID"), cloudflare.PurgeCacheRequest{
-		Everything: true,
-	})
-	if err != nil {
-		logger.Error("Failed to flush Cloudflare cache.")
-	} else {
-		logger.Info("Flushed Cloudflare cache.")
-
-		customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-			return aws.Endpoint{
-				URL: fmt.Sprintf("https://%s.digitaloceanspaces.com", doSpacesRegion),
-			}, nil
-		})
-		creds := credentials.NewStaticCredentialsProvider(doSpacesKey, doSpacesSecret, "")
-		cfg, err := config.LoadDefaultConfig(ctx,
-			config.WithCredentialsProvider(creds),
-			config.WithEndpointResolverWithOptions(customResolver))
-		if err != nil {
-		}
-		// Create an Amazon S3 service client
-		doSpacesClient := s3.NewFromConfig(cfg)
-
-		_, err = doSpacesClient.PutObject(context.TODO(), &s3.PutObjectInput{
-			Bucket: aws.String(viper.GetString("DO_SPACES_BUCKET_NAME")),
-			Key:    aws.String("vatdns-heartbeat-blocker"),
-			Body:   bytes.NewBufferString(""),
-		})
-		if err != nil {
-			logger.Error("Failed to upload heartbeat blocker file to Spaces")
-		} else {
-			logger.Info("Heartbeat blocker file written to Spaces. Remove it to enable this tool again. Chances you will need to delete vatdns-heartbeat as well.")
-		}
+	switch command {
+	case "once":
+		once(args)
+	case "daemon":
+		daemon(args)
+	case "plan":
+		plan(args)
+	case "status", "arm", "disarm", "force-failover", "failback":
+		operator(command, args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", command, usage)
+		os.Exit(2)
 	}
 }
 
-func main() {
+// readConfig reads configFile and the environment, exiting if the config is invalid
+func readConfig(configFile string) *retardantfoam.Config {
 	logger.Info("Reading config")
-	viper.SetConfigFile(".env")
+	viper.SetConfigFile(configFile)
 	viper.AutomaticEnv()
-	viper.SetDefault("DO_API_KEY", "")
-	viper.SetDefault("DO_TAG", "")
-	viper.SetDefault("DO_SPACES_KEY", "")
-	viper.SetDefault("DO_SPACES_SECRET", "")
-	viper.SetDefault("DO_SPACES_REGION", "")
-	viper.SetDefault("DO_SPACES_BUCKET_NAME", "")
-	viper.SetDefault("CLOUDFLARE_API_KEY", "")
-	viper.SetDefault("CLOUDFLARE_LB_ID", "")
-	viper.SetDefault("CLOUDFLARE_ZONE_ID", "")
-	viper.SetDefault("CLOUDFLARE_ACCOUNT_ID", "")
-
+	retardantfoam.SetDefaults(viper.GetViper())
 	err := viper.ReadInConfig()
 	if err != nil {
 		panic(fmt.Errorf("fatal error config file: %w", err))
 	}
-
-	var wg = sync.WaitGroup{}
-	logger.Info("Reading config")
-	viper.SetConfigFile(".env")
-	viper.AutomaticEnv()
-	viper.SetDefault("DO_API_KEY", "")
-	viper.SetDefault("DO_TAG", nil)
-	err = viper.ReadInConfig()
-	if err != nil {
-		panic(fmt.Errorf("fatal error config file: %w", err))
-	}
-	logger.Info("retardantfoam - I put out fires...")
-	ctx := context.TODO()
-	doSpacesKey := viper.GetString("DO_SPACES_KEY")
-	doSpacesSecret := viper.GetString("DO_SPACES_SECRET")
-	doSpacesRegion := viper.GetString("DO_SPACES_REGION")
-	failoverTimeLimit := viper.GetInt64("FAILOVER_TIME_LIMIT")
-	creds := credentials.NewStaticCredentialsProvider(doSpacesKey, doSpacesSecret, "")
-
-	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			URL: fmt.Sprintf("https://%s.digitaloceanspaces.com", doSpacesRegion),
-		}, nil
-	})
-	cfg, err := config.LoadDefaultConfig(ctx,
-		config.WithCredentialsProvider(creds),
-		config.WithEndpointResolverWithOptions(customResolver))
+	c, err := retardantfoam.LoadConfig(viper.GetViper())
 	if err != nil {
+		logger.Fatal(fmt.Sprintf("Invalid config:\n%s", err))
 	}
-	// Create an Amazon S3 service client
-	doSpacesClient := s3.NewFromConfig(cfg)
+	return c
+}
 
-	_, err = doSpacesClient.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(viper.GetString("DO_SPACES_BUCKET_NAME")),
-		Key:    aws.String("vatdns-heartbeat-blocker"),
-	})
-	if err != nil {
-		var re s3.ResponseError
-		if errors.As(err, &re) {
-			if strings.Contains(re.Error(), "StatusCode: 404") {
-			} else {
-				logger.Fatal("Unable contact Spaces.")
-			}
-		}
-	} else {
-		logger.Fatal("Heartbeat blocker file exists in Spaces. Operation disabled. Please remove to enable.")
+func once(args []string) {
+	flags := flag.NewFlagSet("once", flag.ExitOnError)
+	configFile := flags.String("config", ".env", "config file")
+	dryRun := flags.Bool("dry-run", false, "print what would be done instead of doing it, like plan")
+	_ = flags.Parse(args)
+	c := readConfig(*configFile)
+	if *dryRun {
+		os.Exit(retardantfoam.RunPlan(c, os.Stdout, nil))
 	}
+	logger.Info("retardantfoam - I put out fires...")
+	os.Exit(retardantfoam.RunOnce(c))
+}
 
-	// Check for heartbeat file
-	heartbeatObj, err := doSpacesClient.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(viper.GetString("DO_SPACES_BUCKET_NAME")),
-		Key:    aws.String("vatdns-heartbeat"),
-	})
+func daemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configFile := flags.String("config", ".env", "config file")
+	_ = flags.Parse(args)
+	c := readConfig(*configFile)
+	logger.Info("retardantfoam - I put out fires...")
+	d, err := retardantfoam.NewDaemon(c)
 	if err != nil {
-		var re s3.ResponseError
-		if errors.As(err, &re) {
-			if strings.Contains(re.Error(), "StatusCode: 404") {
-				logger.Info("Initial file check 404, first run? This is usually fine.")
-			} else {
-				logger.Fatal("Unable contact Spaces.")
-			}
-		}
-	} else {
-		timeSinceLastHeartbeat := time.Now().Unix() - heartbeatObj.LastModified.Unix()
-		if timeSinceLastHeartbeat >= failoverTimeLimit {
-			logger.Error("Over failover time limit reached, pushing IP server list and flushing Cloudflare cache.")
-			failover()
-			os.Exit(0)
-		} else {
-			logger.Info(fmt.Sprintf("Failover time limit not reached. Currently %d seconds since last heartbeat.", timeSinceLastHeartbeat))
-		}
+		logger.Fatal(err.Error())
 	}
-
-	opt := &godo.ListOptions{
-		Page:    1,
-		PerPage: 200,
-	}
-
-	doClient := godo.NewFromToken(viper.GetString("DO_API_KEY"))
-	droplets, _, _ := doClient.Droplets.ListByTag(ctx, viper.GetString("DO_TAG"), opt)
-	logger.Info("Checked tag for Droplets")
-	for _, d := range droplets {
-		logger.Info(fmt.Sprintf("Checking DNS health of %s", d.Name))
-		d := d
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			start := time.Now().UnixNano() / int64(time.Millisecond)
-			r := &net.Resolver{
-				PreferGo: true,
-				Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-					dial := net.Dialer{
-						Timeout: time.Second * 1,
-					}
-					publicIPv4, _ := d.PublicIPv4()
-					return dial.DialContext(ctx, network, fmt.Sprintf("%s:%s", publicIPv4, viper.GetString("DNS_PORT")))
-				},
-			}
-			ip, err := r.LookupHost(context.Background(), "fsd.connect.vatsim.net")
-			finish := time.Now().UnixNano() / int64(time.Millisecond)
-			diff := finish - start
-			if err == nil {
-				logger.Info(fmt.Sprintf("Successfully queried %s: %dms", d.Name, diff))
-				dnsServers.Store(d.Name, DnsServer{
-					Name:    d.Name,
-					Latency: diff,
-					Result:  ip[0],
-					Pass:    true,
-				})
-			} else {
-				logger.Error(fmt.Sprintf("Error when checking %s: %s", d.Name, err))
-				dnsServers.Store(d.Name, DnsServer{
-					Name:    d.Name,
-					Latency: 0.0,
-					Result:  "",
-					Pass:    false,
-				})
-			}
-		}()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	if err := d.Run(ctx); err != nil {
+		logger.Fatal(err.Error())
 	}
-	wg.Wait()
-	atLeastOneHealthy := false
-
-	dnsHealthyCounter := 0
-	dnsHealthyCounter = 0
-	dnsServers.Range(func(k, v interface{}) bool {
-		fsdServerStruct := v.(DnsServer)
-		if fsdServerStruct.Pass == true {
-			atLeastOneHealthy = true
-			dnsHealthyCounter += 1
-		}
-		return true
-	})
-	if atLeastOneHealthy {
-		logger.Info(fmt.Sprintf("DNS is working. %d DNS servers healthy. Writing heartbeat file to Spaces.", dnsHealthyCounter))
+}
 
-		_, err = doSpacesClient.PutObject(context.TODO(), &s3.PutObjectInput{
-			Bucket: aws.String(viper.GetString("DO_SPACES_BUCKET_NAME")),
-			Key:    aws.String("vatdns-heartbeat"),
-			Body:   bytes.NewBufferString(""),
-		})
-		if err == nil {
-			logger.Info("Wrote heartbeat file to Spaces")
-		} else {
-			logger.Info("Failed writing heartbeat file to Spaces")
-			// Maybe post to Slack or something???
+func plan(args []string) {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	configFile := flags.String("config", ".env", "config file")
+	protocols := flags.String("protocol", "", "comma separated protocols to show the failover of even if healthy: dns, http, doh, dot")
+	_ = flags.Parse(args)
+	c := readConfig(*configFile)
+	show := make([]string, 0)
+	for _, protocol := range strings.Split(*protocols, ",") {
+		if protocol = strings.TrimSpace(protocol); protocol != "" {
+			show = append(show, protocol)
 		}
-	} else {
-		logger.Info("No healthy DNS servers.")
 	}
-	os.Exit(0)
+	os.Exit(retardantfoam.RunPlan(c, os.Stdout, show))
+}
+
+func operator(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	configFile := flags.String("config", ".env", "config file")
+	opts := retardantfoam.OperatorOptions{}
+	flags.StringVar(&opts.Protocol, "protocol", "dns", "protocol to act on: dns, http, doh or dot")
+	flags.StringVar(&opts.Reason, "reason", "", "why, kept in the blocker and audit record")
+	flags.StringVar(&opts.Operator, "operator", os.Getenv("USER"), "who is running this")
+	flags.BoolVar(&opts.Confirm, "confirm", false, "go ahead with force-failover or failback")
+	flags.BoolVar(&opts.JSON, "json", false, "print status as JSON")
+	_ = flags.Parse(args)
+	c := readConfig(*configFile)
+	os.Exit(retardantfoam.RunOperator(c, command, opts, os.Stdout))
 }
@@ -0,0 +1,270 @@
+// Package alerting sends notifications about operational events to webhooks and Slack.
+// Events are deduplicated by kind and subject, rate limited, rendered with text/template and sent
+// by a background goroutine so raising one never blocks the caller.
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+type Kind string
+
+const (
+	ServerDeregistered   Kind = "server_deregistered"
+	ServerReadded        Kind = "server_readded"
+	AllServersFull       Kind = "all_servers_full"
+	LowCapacity          Kind = "low_capacity"
+	FailoverTriggered    Kind = "failover_triggered"
+	FailbackTriggered    Kind = "failback_triggered"
+	HeartbeatWriteFailed Kind = "heartbeat_write_failed"
+)
+
+type Severity string
+
+const (
+	Info     Severity = "info"
+	Warning  Severity = "warning"
+	Critical Severity = "critical"
+)
+
+// Event is something an operator should hear about
+type Event struct {
+	Kind     Kind
+	Severity Severity
+	// Subject is what the event is about, such as a server name. Events are deduplicated by Kind and Subject.
+	Subject string
+	// Summary is a one line description, used as the message when there is no template for Kind
+	Summary string
+	Fields  map[string]string
+	// Source and Time are filled in by the Notifier if empty
+	Source string
+	Time   time.Time
+	// Suppressed is how many events like this one were deduplicated since the last one was sent
+	Suppressed int
+}
+
+// Sink is somewhere alerts are sent. Sinks are only called from the Notifier's sending goroutine.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, e *Event, text string) error
+}
+
+type Config struct {
+	// Source names the binary raising events, e.g. dnshaiku
+	Source string
+	// DedupWindow is how long an event is suppressed for after one with the same kind and subject is sent
+	DedupWindow time.Duration
+	// RateLimit is the most events sent a minute, 0 for no limit
+	RateLimit int
+	// Template renders every event's message, Templates overrides it per kind. Both are text/template
+	// executed with the Event, the default is the Summary.
+	Template  string
+	Templates map[Kind]string
+	// Timeout is how long a sink has to send one event
+	Timeout time.Duration
+	// BufferSize is how many events can be waiting to be sent before new ones are dropped
+	BufferSize int
+}
+
+const defaultTemplate = `[{{.Source}}] {{.Summary}}{{if .Suppressed}} ({{.Suppressed}} similar suppressed){{end}}`
+
+type queued struct {
+	event *Event
+	text  string
+}
+
+// Notifier deduplicates, rate limits and queues events for its sinks
+type Notifier struct {
+	config    Config
+	sinks     []Sink
+	templates map[Kind]*template.Template
+	fallback  *template.Template
+	events    chan queued
+	done      chan struct{}
+	now       func() time.Time
+
+	mu          sync.Mutex
+	closed      bool
+	lastSent    map[string]time.Time
+	suppressed  map[string]int
+	windowStart time.Time
+	windowSent  int
+
+	sent        atomic.Uint64
+	deduped     atomic.Uint64
+	rateLimited atomic.Uint64
+	dropped     atomic.Uint64
+	errors      atomic.Uint64
+}
+
+// Stats counts what has happened to events raised
+type Stats struct {
+	Sent        uint64
+	Deduped     uint64
+	RateLimited uint64
+	Dropped     uint64
+	Errors      uint64
+}
+
+// New starts a Notifier sending to sinks. An error is returned if a template doesn't parse.
+func New(config Config, sinks ...Sink) (*Notifier, error) {
+	if config.Template == "" {
+		config.Template = defaultTemplate
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.BufferSize < 1 {
+		config.BufferSize = 64
+	}
+	fallback, err := template.New("alert").Option("missingkey=zero").Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template: %w", err)
+	}
+	n := &Notifier{
+		config:     config,
+		sinks:      sinks,
+		templates:  make(map[Kind]*template.Template),
+		fallback:   fallback,
+		events:     make(chan queued, config.BufferSize),
+		done:       make(chan struct{}),
+		now:        time.Now,
+		lastSent:   make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	for kind, text := range config.Templates {
+		kindTemplate, err := template.New(string(kind)).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s template: %w", kind, err)
+		}
+		n.templates[kind] = kindTemplate
+	}
+	go n.run()
+	return n, nil
+}
+
+// Notify raises e. It never blocks: events are dropped when deduplicated, over the rate limit, when
+// the buffer is full or after Close. A nil Notifier, or one without sinks, discards everything.
+func (n *Notifier) Notify(e Event) {
+	if n == nil || len(n.sinks) == 0 {
+		return
+	}
+	if e.Source == "" {
+		e.Source = n.config.Source
+	}
+	if e.Time.IsZero() {
+		e.Time = n.now()
+	}
+	if e.Severity == "" {
+		e.Severity = Warning
+	}
+	key := fmt.Sprintf("%s/%s", e.Kind, e.Subject)
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		n.dropped.Add(1)
+		return
+	}
+	if last, found := n.lastSent[key]; found && e.Time.Sub(last) < n.config.DedupWindow {
+		n.suppressed[key]++
+		n.mu.Unlock()
+		n.deduped.Add(1)
+		return
+	}
+	if n.config.RateLimit > 0 {
+		if e.Time.Sub(n.windowStart) >= time.Minute {
+			n.windowStart = e.Time
+			n.windowSent = 0
+		}
+		if n.windowSent >= n.config.RateLimit {
+			n.mu.Unlock()
+			n.rateLimited.Add(1)
+			return
+		}
+		n.windowSent++
+	}
+	n.lastSent[key] = e.Time
+	e.Suppressed = n.suppressed[key]
+	delete(n.suppressed, key)
+	text, err := n.render(&e)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Rendering %s alert failed, sending the summary: %s", e.Kind, err))
+		text = e.Summary
+	}
+	select {
+	case n.events <- queued{event: &e, text: text}:
+	default:
+		n.dropped.Add(1)
+	}
+	n.mu.Unlock()
+}
+
+func (n *Notifier) render(e *Event) (string, error) {
+	eventTemplate, found := n.templates[e.Kind]
+	if !found {
+		eventTemplate = n.fallback
+	}
+	var text bytes.Buffer
+	if err := eventTemplate.Execute(&text, e); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for q := range n.events {
+		for _, sink := range n.sinks {
+			ctx, cancel := context.WithTimeout(context.Background(), n.config.Timeout)
+			err := sink.Send(ctx, q.event, q.text)
+			cancel()
+			if err != nil {
+				n.errors.Add(1)
+				logger.Error(fmt.Sprintf("Sending %s alert to %s failed: %s", q.event.Kind, sink.Name(), err))
+				continue
+			}
+			n.sent.Add(1)
+		}
+	}
+}
+
+// Close stops accepting events and waits for queued ones to be sent until ctx is done
+func (n *Notifier) Close(ctx context.Context) error {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.events)
+	}
+	n.mu.Unlock()
+	select {
+	case <-n.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d alerts not sent: %w", len(n.events), ctx.Err())
+	}
+}
+
+// Stats returns counts of what has happened to events so far. A nil Notifier has none.
+func (n *Notifier) Stats() Stats {
+	if n == nil {
+		return Stats{}
+	}
+	return Stats{
+		Sent:        n.sent.Load(),
+		Deduped:     n.deduped.Load(),
+		RateLimited: n.rateLimited.Load(),
+		Dropped:     n.dropped.Load(),
+		Errors:      n.errors.Load(),
+	}
+}
@@ -0,0 +1,174 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is a local webhook endpoint recording the bodies posted to it
+type receiver struct {
+	mu     sync.Mutex
+	bodies []map[string]interface{}
+	status int
+}
+
+func newReceiver(t *testing.T) (*receiver, *httptest.Server) {
+	rec := &receiver{status: http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		rec.mu.Lock()
+		rec.bodies = append(rec.bodies, body)
+		status := rec.status
+		rec.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return rec, server
+}
+
+func (r *receiver) received() []map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]map[string]interface{}{}, r.bodies...)
+}
+
+func closeNotifier(t *testing.T, n *Notifier) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, n.Close(ctx))
+}
+
+func TestWebhookSink(t *testing.T) {
+	rec, server := newReceiver(t)
+	n, err := New(Config{Source: "dnshaiku"}, NewWebhookSink(server.URL))
+	require.NoError(t, err)
+	n.Notify(Event{
+		Kind:    ServerDeregistered,
+		Subject: "fsd.uk.vatsim.net",
+		Summary: "fsd.uk.vatsim.net removed after 2 failed polls",
+		Fields:  map[string]string{"server": "fsd.uk.vatsim.net"},
+	})
+	closeNotifier(t, n)
+
+	bodies := rec.received()
+	require.Len(t, bodies, 1)
+	assert.Equal(t, "server_deregistered", bodies[0]["kind"])
+	assert.Equal(t, "warning", bodies[0]["severity"])
+	assert.Equal(t, "dnshaiku", bodies[0]["source"])
+	assert.Equal(t, "[dnshaiku] fsd.uk.vatsim.net removed after 2 failed polls", bodies[0]["text"])
+	assert.Equal(t, map[string]interface{}{"server": "fsd.uk.vatsim.net"}, bodies[0]["fields"])
+	assert.Equal(t, uint64(1), n.Stats().Sent)
+}
+
+func TestSlackSink(t *testing.T) {
+	rec, server := newReceiver(t)
+	n, err := New(Config{Source: "retardantfoam"}, NewSlackSink(server.URL, "#vatdns", "vatdns"))
+	require.NoError(t, err)
+	n.Notify(Event{
+		Kind:     FailoverTriggered,
+		Severity: Critical,
+		Summary:  "Failing over",
+		Fields:   map[string]string{"since_heartbeat": "600s", "healthy": "0"},
+	})
+	closeNotifier(t, n)
+
+	bodies := rec.received()
+	require.Len(t, bodies, 1)
+	assert.Equal(t, "#vatdns", bodies[0]["channel"])
+	attachment := bodies[0]["attachments"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "danger", attachment["color"])
+	assert.Equal(t, "[retardantfoam] Failing over", attachment["text"])
+	fields := attachment["fields"].([]interface{})
+	require.Len(t, fields, 2)
+	assert.Equal(t, "healthy", fields[0].(map[string]interface{})["title"])
+}
+
+func TestNotifierDeduplicates(t *testing.T) {
+	rec, server := newReceiver(t)
+	n, err := New(Config{Source: "dnshaiku", DedupWindow: time.Minute}, NewWebhookSink(server.URL))
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	n.Notify(Event{Kind: ServerDeregistered, Subject: "fsd.uk.vatsim.net", Summary: "uk gone"})
+	n.Notify(Event{Kind: ServerDeregistered, Subject: "fsd.uk.vatsim.net", Summary: "uk gone"})
+	n.Notify(Event{Kind: ServerDeregistered, Subject: "fsd.uk.vatsim.net", Summary: "uk gone"})
+	// A different subject isn't a duplicate
+	n.Notify(Event{Kind: ServerDeregistered, Subject: "fsd.ger.vatsim.net", Summary: "ger gone"})
+	now = now.Add(2 * time.Minute)
+	n.Notify(Event{Kind: ServerDeregistered, Subject: "fsd.uk.vatsim.net", Summary: "uk gone"})
+	closeNotifier(t, n)
+
+	bodies := rec.received()
+	require.Len(t, bodies, 3)
+	assert.Equal(t, "[dnshaiku] uk gone (2 similar suppressed)", bodies[2]["text"])
+	assert.Equal(t, uint64(2), n.Stats().Deduped)
+}
+
+func TestNotifierRateLimits(t *testing.T) {
+	rec, server := newReceiver(t)
+	n, err := New(Config{RateLimit: 2}, NewWebhookSink(server.URL))
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+
+	for _, subject := range []string{"a", "b", "c"} {
+		n.Notify(Event{Kind: ServerReadded, Subject: subject})
+	}
+	now = now.Add(time.Minute)
+	n.Notify(Event{Kind: ServerReadded, Subject: "d"})
+	closeNotifier(t, n)
+
+	assert.Len(t, rec.received(), 3)
+	assert.Equal(t, uint64(1), n.Stats().RateLimited)
+}
+
+func TestNotifierTemplates(t *testing.T) {
+	rec, server := newReceiver(t)
+	templatesFile := filepath.Join(t.TempDir(), "templates.yaml")
+	require.NoError(t, os.WriteFile(templatesFile, []byte(`low_capacity: "Only {{.Fields.free}} slots free across {{.Fields.servers}} servers"`+"\n"), 0o644))
+	n, err := NewFromSettings("dnshaiku", Settings{
+		WebhookURL:    server.URL,
+		Template:      "{{.Severity}}: {{.Summary}}",
+		TemplatesFile: templatesFile,
+	})
+	require.NoError(t, err)
+	n.Notify(Event{Kind: LowCapacity, Fields: map[string]string{"free": "12", "servers": "3"}})
+	n.Notify(Event{Kind: AllServersFull, Severity: Critical, Summary: "No servers accepting connections"})
+	closeNotifier(t, n)
+
+	bodies := rec.received()
+	require.Len(t, bodies, 2)
+	assert.Equal(t, "Only 12 slots free across 3 servers", bodies[0]["text"])
+	assert.Equal(t, "critical: No servers accepting connections", bodies[1]["text"])
+
+	_, err = New(Config{Template: "{{.Summary"})
+	assert.Error(t, err)
+}
+
+func TestNotifierCountsSinkErrors(t *testing.T) {
+	rec, server := newReceiver(t)
+	rec.status = http.StatusInternalServerError
+	n, err := New(Config{}, NewWebhookSink(server.URL))
+	require.NoError(t, err)
+	n.Notify(Event{Kind: HeartbeatWriteFailed, Summary: "Heartbeat write failed"})
+	closeNotifier(t, n)
+	assert.Equal(t, uint64(1), n.Stats().Errors)
+	assert.Equal(t, uint64(0), n.Stats().Sent)
+
+	// Without sinks and after Close nothing is queued
+	var none *Notifier
+	none.Notify(Event{Kind: LowCapacity})
+	n.Notify(Event{Kind: LowCapacity})
+	assert.Equal(t, uint64(1), n.Stats().Dropped)
+}
@@ -0,0 +1,72 @@
+package alerting
+
+import (
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"os"
+	"sort"
+	"time"
+)
+
+// Settings are the ALERT_ config keys shared by dnshaiku and retardantfoam
+type Settings struct {
+	WebhookURL      string
+	SlackWebhookURL string
+	SlackChannel    string
+	SlackUsername   string
+	// DedupWindowSeconds is ALERT_DEDUP_WINDOW
+	DedupWindowSeconds int
+	// RateLimit is ALERT_RATE_LIMIT, the most alerts a minute
+	RateLimit int
+	Template  string
+	// TemplatesFile is a YAML map of event kind to template
+	TemplatesFile string
+}
+
+// NewFromSettings starts a Notifier for source with a sink for each URL set. With neither set the
+// Notifier discards every event.
+func NewFromSettings(source string, settings Settings) (*Notifier, error) {
+	templates, err := ReadTemplates(settings.TemplatesFile)
+	if err != nil {
+		return nil, err
+	}
+	sinks := make([]Sink, 0)
+	if settings.WebhookURL != "" {
+		sinks = append(sinks, NewWebhookSink(settings.WebhookURL))
+	}
+	if settings.SlackWebhookURL != "" {
+		sinks = append(sinks, NewSlackSink(settings.SlackWebhookURL, settings.SlackChannel, settings.SlackUsername))
+	}
+	return New(Config{
+		Source:      source,
+		DedupWindow: time.Duration(settings.DedupWindowSeconds) * time.Second,
+		RateLimit:   settings.RateLimit,
+		Template:    settings.Template,
+		Templates:   templates,
+	}, sinks...)
+}
+
+// ReadTemplates reads a YAML map of event kind to template from path. An empty path has none.
+func ReadTemplates(path string) (map[Kind]string, error) {
+	templates := make(map[Kind]string)
+	if path == "" {
+		return templates, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return templates, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
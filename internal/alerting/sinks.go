@@ -0,0 +1,138 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// postJSON posts body to url as JSON, treating anything but a 2xx as a failure
+func postJSON(ctx context.Context, client *http.Client, url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// WebhookSink posts each event as a JSON object to a URL
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// webhookPayload is the body WebhookSink posts
+type webhookPayload struct {
+	Kind       Kind              `json:"kind"`
+	Severity   Severity          `json:"severity"`
+	Source     string            `json:"source"`
+	Subject    string            `json:"subject,omitempty"`
+	Summary    string            `json:"summary"`
+	Text       string            `json:"text"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	Time       time.Time         `json:"time"`
+	Suppressed int               `json:"suppressed,omitempty"`
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{}}
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Send(ctx context.Context, e *Event, text string) error {
+	return postJSON(ctx, s.client, s.url, webhookPayload{
+		Kind:       e.Kind,
+		Severity:   e.Severity,
+		Source:     e.Source,
+		Subject:    e.Subject,
+		Summary:    e.Summary,
+		Text:       text,
+		Fields:     e.Fields,
+		Time:       e.Time,
+		Suppressed: e.Suppressed,
+	})
+}
+
+// SlackSink posts each event to a Slack incoming webhook as an attachment coloured by severity
+type SlackSink struct {
+	url      string
+	channel  string
+	username string
+	client   *http.Client
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type slackAttachment struct {
+	Color    string       `json:"color"`
+	Fallback string       `json:"fallback"`
+	Text     string       `json:"text"`
+	Fields   []slackField `json:"fields,omitempty"`
+	Ts       int64        `json:"ts"`
+}
+
+type slackMessage struct {
+	Channel     string            `json:"channel,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// NewSlackSink posts to the incoming webhook url. channel and username override the webhook's
+// defaults if set.
+func NewSlackSink(url string, channel string, username string) *SlackSink {
+	return &SlackSink{url: url, channel: channel, username: username, client: &http.Client{}}
+}
+
+func (s *SlackSink) Name() string {
+	return "slack"
+}
+
+func (s *SlackSink) Send(ctx context.Context, e *Event, text string) error {
+	color := "#439FE0"
+	switch e.Severity {
+	case Warning:
+		color = "warning"
+	case Critical:
+		color = "danger"
+	}
+	fields := make([]slackField, 0, len(e.Fields))
+	for _, key := range sortedKeys(e.Fields) {
+		fields = append(fields, slackField{Title: key, Value: e.Fields[key], Short: true})
+	}
+	return postJSON(ctx, s.client, s.url, slackMessage{
+		Channel:  s.channel,
+		Username: s.username,
+		Attachments: []slackAttachment{{
+			Color:    color,
+			Fallback: text,
+			Text:     text,
+			Fields:   fields,
+			Ts:       e.Time.Unix(),
+		}},
+	})
+}
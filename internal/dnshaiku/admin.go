@@ -0,0 +1,206 @@
+package dnshaiku
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminAuthConfigured reports whether any admin authentication method is set up. Without one the
+// admin API answers 404, until ADMIN_API_TOKEN is set on a reload.
+func adminAuthConfigured() bool {
+	return cfg().AdminApiToken != "" || cfg().AdminTLSClientCAFile != ""
+}
+
+// adminActor returns who is making an admin request, or an empty string if the request is not
+// authenticated. A verified client certificate or the bearer token from ADMIN_API_TOKEN is accepted.
+func adminActor(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return fmt.Sprintf("cert:%s", r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}
+	token := cfg().AdminApiToken
+	if token == "" {
+		return ""
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+		return ""
+	}
+	return "token"
+}
+
+// audit records an admin action. Every admin request is audited, reads and rejected ones included.
+func audit(r *http.Request, actor string, action string, outcome string, detail string) {
+	logger.Info(fmt.Sprintf("Admin audit | %s %s | %s", action, outcome, detail),
+		zap.Bool("audit", true),
+		zap.String("actor", actor),
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.String("action", action),
+		zap.String("outcome", outcome),
+	)
+}
+
+// requireAdmin wraps an admin handler with authentication and auditing of failed attempts
+func requireAdmin(action string, next func(w http.ResponseWriter, r *http.Request, actor string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthConfigured() {
+			audit(r, "anonymous", action, "disabled", "no admin authentication is configured")
+			http.NotFound(w, r)
+			return
+		}
+		actor := adminActor(r)
+		if actor == "" {
+			audit(r, "anonymous", action, "denied", "missing or invalid credentials")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r, actor)
+	}
+}
+
+// validateFSDServer checks a server submitted through the admin or test API before it is stored
+func validateFSDServer(fsdServer *common.FSDServer) error {
+	nameParts := strings.Split(fsdServer.Name, ".")
+	if len(nameParts) < 3 || nameParts[0] != "fsd" || nameParts[1] == "" {
+		return fmt.Errorf("name %q must look like fsd.<region>.vatsim.net", fsdServer.Name)
+	}
+	if ip := net.ParseIP(fsdServer.IpAddress); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("ip_address %q is not a valid IPv4 address", fsdServer.IpAddress)
+	}
+	if fsdServer.MaxUsers < 0 || fsdServer.CurrentUsers < 0 {
+		return errors.New("current_users and max_users must not be negative")
+	}
+	if fsdServer.RemainingSlots < 0 || fsdServer.RemainingSlots > fsdServer.MaxUsers {
+		return fmt.Errorf("remaining_slots must be between 0 and max_users (%d)", fsdServer.MaxUsers)
+	}
+	return nil
+}
+
+func decodeFSDServer(r *http.Request) (*common.FSDServer, error) {
+	fsdServerJson := &common.FSDServer{}
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(fsdServerJson); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if err := validateFSDServer(fsdServerJson); err != nil {
+		return nil, err
+	}
+	return fsdServerJson, nil
+}
+
+// storeFSDServer adds a server to the registry, or updates it in place so an existing polling
+// goroutine and Prometheus collector keep pointing at the live entry
+func storeFSDServer(fsdServerJson *common.FSDServer) *common.FSDServer {
+	existing, found := fsdServers.Load(fsdServerJson.Name)
+	if !found {
+		fsdServer := common.NewMockFSDServer(fsdServerJson)
+		fsdServers.Store(fsdServer.Name, fsdServer)
+		return fsdServer
+	}
+	fsdServer := existing.(*common.FSDServer)
+	fsdServer.IpAddress = fsdServerJson.IpAddress
+	fsdServer.CurrentUsers = fsdServerJson.CurrentUsers
+	fsdServer.MaxUsers = fsdServerJson.MaxUsers
+	fsdServer.RemainingSlots = fsdServerJson.RemainingSlots
+	fsdServer.AbleToUpdate = fsdServerJson.AbleToUpdate
+	return fsdServer
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// registerAdminHandlers adds the authenticated admin API to the data web server
+func registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/admin/servers", requireAdmin("servers", func(w http.ResponseWriter, r *http.Request, actor string) {
+		switch r.Method {
+		case http.MethodGet:
+			servers := make([]*common.FSDServer, 0)
+			fsdServers.Range(func(k, v interface{}) bool {
+				servers = append(servers, v.(*common.FSDServer))
+				return true
+			})
+			audit(r, actor, "server.list", "ok", fmt.Sprintf("%d servers", len(servers)))
+			writeJson(w, http.StatusOK, servers)
+		case http.MethodPost, http.MethodPut:
+			fsdServerJson, err := decodeFSDServer(r)
+			if err != nil {
+				audit(r, actor, "server.upsert", "rejected", err.Error())
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fsdServer := storeFSDServer(fsdServerJson)
+			audit(r, actor, "server.upsert", "ok", fmt.Sprintf("%s | %s | %d | %d | %d", fsdServer.Name, fsdServer.IpAddress, fsdServer.CurrentUsers, fsdServer.MaxUsers, fsdServer.RemainingSlots))
+			writeJson(w, http.StatusOK, fsdServer)
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			fsdServer, found := fsdServers.Load(name)
+			if !found {
+				audit(r, actor, "server.delete", "rejected", fmt.Sprintf("%q not found", name))
+				http.Error(w, "server not found", http.StatusNotFound)
+				return
+			}
+			if collector := fsdServer.(*common.FSDServer).PrometheusCollector; collector != nil {
+				metricsRegistry.Unregister(collector)
+			}
+			stopPolling(name)
+			forgetServerMetrics(name)
+			fsdServers.Delete(name)
+			audit(r, actor, "server.delete", "ok", name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			audit(r, actor, "servers", "rejected", "method not allowed")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/v1/explain", requireAdmin("explain", handleExplain))
+}
+
+// adminTLSConfig builds the TLS config for the data web server when ADMIN_TLS_CERT_FILE is set.
+// If ADMIN_TLS_CLIENT_CA_FILE is set client certificates signed by it authenticate admin requests.
+func adminTLSConfig() (*tls.Config, error) {
+	if cfg().AdminTLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg().AdminTLSCertFile, cfg().AdminTLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading admin TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile := cfg().AdminTLSClientCAFile; caFile != "" {
+		caPem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading admin client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.ClientCAs = pool
+		// Bearer tokens remain usable so a client certificate is optional at the TLS layer
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
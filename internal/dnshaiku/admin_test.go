@@ -0,0 +1,88 @@
+package dnshaiku
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminDeleteStopsPolling(t *testing.T) {
+	currentConfig.Store(&Config{AdminApiToken: "secret"})
+	common.SetPollingSettings(common.PollingSettings{PollingInterval: time.Hour, RemoveFailureCount: 2})
+	uk := common.NewMockFSDServer(&common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "198.51.100.1", MaxUsers: 300, RemainingSlots: 10, AbleToUpdate: true})
+	fsdServers.Store(uk.Name, uk)
+	t.Cleanup(func() {
+		currentConfig.Store(nil)
+		common.SetPollingSettings(common.PollingSettings{})
+		fsdServers.Delete(uk.Name)
+		pollerStops.Delete(uk.Name)
+	})
+
+	enableFsdServerProm := make(chan string, 1)
+	stop := make(chan struct{})
+	pollerStops.Store(uk.Name, stop)
+	stopped := make(chan struct{})
+	go func() {
+		uk.Polling(enableFsdServerProm, make(chan string), stop)
+		close(stopped)
+	}()
+
+	mux := http.NewServeMux()
+	registerAdminHandlers(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/v1/admin/servers?name=fsd.uk.vatsim.net", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the poller kept running after the server was deleted")
+	}
+	_, found := pollerStops.Load(uk.Name)
+	assert.False(t, found)
+}
+
+func TestDeregisterDeletedServer(t *testing.T) {
+	deregisterFsd := make(chan string, 1)
+	// A poller giving up on a server the admin API already deleted
+	deregisterFsd <- "fsd.gone.vatsim.net"
+	close(deregisterFsd)
+	assert.NotPanics(t, func() { handleFsdDeregister(deregisterFsd) })
+}
+
+func TestAdminApiEnabledByReload(t *testing.T) {
+	t.Cleanup(func() {
+		currentConfig.Store(nil)
+		common.SetPollingSettings(common.PollingSettings{})
+	})
+	currentConfig.Store(&Config{})
+	mux := http.NewServeMux()
+	registerAdminHandlers(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	list := func() int {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/admin/servers", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusNotFound, list(), "no admin authentication is configured")
+	v := testViper()
+	v.Set("ADMIN_API_TOKEN", "secret")
+	require.NoError(t, ReloadConfig(v))
+	assert.Equal(t, http.StatusOK, list())
+}
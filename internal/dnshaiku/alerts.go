@@ -0,0 +1,105 @@
+package dnshaiku
+
+import (
+	"context"
+	"fmt"
+	"github.com/vatsimnetwork/vatdns/internal/alerting"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sends operational alerts when ALERT_WEBHOOK_URL or ALERT_SLACK_WEBHOOK_URL are set, nil until Main starts it
+var alerts *alerting.Notifier
+
+// Servers removed after failing to poll, so finding them again can be alerted on
+var deregisteredServers sync.Map
+
+func newAlerts(c *Config) (*alerting.Notifier, error) {
+	if c.AlertWebhookURL == "" && c.AlertSlackWebhookURL == "" {
+		logger.Info("No ALERT_WEBHOOK_URL or ALERT_SLACK_WEBHOOK_URL set, alerts disabled")
+	}
+	return alerting.NewFromSettings("dnshaiku", alerting.Settings{
+		WebhookURL:         c.AlertWebhookURL,
+		SlackWebhookURL:    c.AlertSlackWebhookURL,
+		SlackChannel:       c.AlertSlackChannel,
+		SlackUsername:      c.AlertSlackUsername,
+		DedupWindowSeconds: c.AlertDedupWindow,
+		RateLimit:          c.AlertRateLimit,
+		Template:           c.AlertTemplate,
+		TemplatesFile:      c.AlertTemplatesFile,
+	})
+}
+
+// closeAlerts sends queued alerts, giving up after timeout
+func closeAlerts(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := alerts.Close(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Closing alerts: %s", err))
+	}
+}
+
+func alertServerDeregistered(name string, failures int) {
+	deregisteredServers.Store(name, time.Now())
+	alerts.Notify(alerting.Event{
+		Kind:    alerting.ServerDeregistered,
+		Subject: name,
+		Summary: fmt.Sprintf("%s was removed from the registry after failing to poll %d times", name, failures),
+		Fields:  map[string]string{"server": name},
+	})
+}
+
+// alertServerFound alerts if a server being added to the registry was removed earlier
+func alertServerFound(name string) {
+	removedAt, found := deregisteredServers.LoadAndDelete(name)
+	if !found {
+		return
+	}
+	alerts.Notify(alerting.Event{
+		Kind:     alerting.ServerReadded,
+		Severity: alerting.Info,
+		Subject:  name,
+		Summary:  fmt.Sprintf("%s is back in the registry, %s after it was removed", name, time.Since(removedAt.(time.Time)).Round(time.Second)),
+		Fields:   map[string]string{"server": name},
+	})
+}
+
+func alertAllServersFull(fallback string, server string) {
+	summary := registrySummary()
+	alerts.Notify(alerting.Event{
+		Kind:     alerting.AllServersFull,
+		Severity: alerting.Critical,
+		Summary:  fmt.Sprintf("None of the %d servers are accepting connections, falling back to %s (%s)", summary.Total, server, fallback),
+		Fields: map[string]string{
+			"servers":  strconv.Itoa(summary.Total),
+			"fallback": fallback,
+			"server":   server,
+		},
+	})
+}
+
+// checkCapacity alerts when the remaining slots across accepting servers fall under
+// ALERT_LOW_CAPACITY_RATIO of the network's max users
+func checkCapacity() {
+	summary := registrySummary()
+	ratio := cfg().AlertLowCapacityRatio
+	if summary.MaxUsers == 0 || ratio == 0 {
+		return
+	}
+	free := float64(summary.RemainingSlots) / float64(summary.MaxUsers)
+	if free >= ratio {
+		return
+	}
+	alerts.Notify(alerting.Event{
+		Kind:    alerting.LowCapacity,
+		Summary: fmt.Sprintf("%d slots free across %d accepting servers, %.1f%% of capacity", summary.RemainingSlots, summary.Accepting, free*100),
+		Fields: map[string]string{
+			"free":      strconv.Itoa(summary.RemainingSlots),
+			"max_users": strconv.Itoa(summary.MaxUsers),
+			"servers":   strconv.Itoa(summary.Total),
+			"accepting": strconv.Itoa(summary.Accepting),
+		},
+	})
+}
@@ -0,0 +1,53 @@
+package dnshaiku
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/internal/alerting"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCapacityAndRegistryAlerts(t *testing.T) {
+	var mu sync.Mutex
+	kinds := make([]string, 0)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		kinds = append(kinds, body["kind"].(string))
+		mu.Unlock()
+	}))
+	t.Cleanup(receiver.Close)
+	currentConfig.Store(&Config{AlertWebhookURL: receiver.URL, AlertLowCapacityRatio: 0.1})
+	notifier, err := newAlerts(cfg())
+	require.NoError(t, err)
+	alerts = notifier
+	fsdServers.Store("fsd.uk.vatsim.net", common.NewMockFSDServer(&common.FSDServer{
+		Name: "fsd.uk.vatsim.net", IpAddress: "198.51.100.1", MaxUsers: 300, RemainingSlots: 20, AbleToUpdate: true,
+	}))
+	t.Cleanup(func() {
+		alerts = nil
+		currentConfig.Store(nil)
+		fsdServers.Delete("fsd.uk.vatsim.net")
+	})
+
+	checkCapacity()
+	// Finding a server that was never removed isn't news
+	alertServerFound("fsd.uk.vatsim.net")
+	alertServerDeregistered("fsd.ger.vatsim.net", 2)
+	alertServerFound("fsd.ger.vatsim.net")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, notifier.Close(ctx))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{string(alerting.LowCapacity), string(alerting.ServerDeregistered), string(alerting.ServerReadded)}, kinds)
+}
@@ -0,0 +1,372 @@
+package dnshaiku
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+	"github.com/vatsimnetwork/vatdns/internal/alerting"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/telemetry"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Config is dnshaiku's typed config. Fields are loaded from the viper key in their config tag.
+// Fields tagged reload apply on a config file change, others are only read at startup and need a restart.
+type Config struct {
+	DnsPort               string  `config:"DNS_PORT"`
+	HttpEndpointPort      string  `config:"HTTP_ENDPOINT_PORT"`
+	HttpDataPort          string  `config:"HTTP_DATA_PORT"`
+	PrometheusMetricsPort string  `config:"PROMETHEUS_METRICS_PORT"`
+	GeoIPDatabase         string  `config:"GEOIP_DATABASE"`
+	SentryDsn             string  `config:"SENTRY_DSN" secret:"true"`
+	TestMode              bool    `config:"TEST_MODE"`
+	DoApiKey              string  `config:"DO_API_KEY" secret:"true"`
+	EnableCloudflare      bool    `config:"ENABLE_CLOUDFLARE"`
+	AdminTLSCertFile      string  `config:"ADMIN_TLS_CERT_FILE"`
+	AdminTLSKeyFile       string  `config:"ADMIN_TLS_KEY_FILE"`
+	AdminTLSClientCAFile  string  `config:"ADMIN_TLS_CLIENT_CA_FILE"`
+	QueryLogFile          string  `config:"QUERY_LOG_FILE"`
+	QueryLogMaxSizeMB     int     `config:"QUERY_LOG_MAX_SIZE_MB"`
+	QueryLogMaxBackups    int     `config:"QUERY_LOG_MAX_BACKUPS"`
+	QueryLogMaxAgeDays    int     `config:"QUERY_LOG_MAX_AGE_DAYS"`
+	QueryLogBufferSize    int     `config:"QUERY_LOG_BUFFER_SIZE"`
+	DnstapOutput          string  `config:"DNSTAP_OUTPUT"`
+	DnstapIdentity        string  `config:"DNSTAP_IDENTITY"`
+	TracingExporter       string  `config:"TRACING_EXPORTER"`
+	TracingEndpoint       string  `config:"TRACING_ENDPOINT"`
+	TracingInsecure       bool    `config:"TRACING_INSECURE"`
+	TracingSampleRatio    float64 `config:"TRACING_SAMPLE_RATIO"`
+	AlertWebhookURL       string  `config:"ALERT_WEBHOOK_URL" secret:"true"`
+	AlertSlackWebhookURL  string  `config:"ALERT_SLACK_WEBHOOK_URL" secret:"true"`
+	AlertSlackChannel     string  `config:"ALERT_SLACK_CHANNEL"`
+	AlertSlackUsername    string  `config:"ALERT_SLACK_USERNAME"`
+	AlertDedupWindow      int     `config:"ALERT_DEDUP_WINDOW"`
+	AlertRateLimit        int     `config:"ALERT_RATE_LIMIT"`
+	AlertTemplate         string  `config:"ALERT_TEMPLATE"`
+	AlertTemplatesFile    string  `config:"ALERT_TEMPLATES_FILE"`
+
+	DoTag                        string  `config:"DO_TAG" reload:"true"`
+	HostnameToServe              string  `config:"HOSTNAME_TO_SERVE" reload:"true"`
+	DnsTTL                       int     `config:"DNS_TTL" reload:"true"`
+	DefaultFSDServer             string  `config:"DEFAULT_FSD_SERVER" reload:"true"`
+	FSDSlotBuffer                int     `config:"FSD_SLOT_BUFFER" reload:"true"`
+	FSDServerPollingInterval     int     `config:"FSD_SERVER_POLLING_INTERVAL" reload:"true"`
+	FSDServerRemoveFailureCount  int     `config:"FSD_SERVER_REMOVE_FAILURE_COUNT" reload:"true"`
+	SelectionDistanceWeight      float64 `config:"SELECTION_DISTANCE_WEIGHT" reload:"true"`
+	ReadyMinAcceptingServers     int     `config:"READY_MIN_ACCEPTING_SERVERS" reload:"true"`
+	ShutdownDrainPeriod          int     `config:"SHUTDOWN_DRAIN_PERIOD" reload:"true"`
+	ShutdownTimeout              int     `config:"SHUTDOWN_TIMEOUT" reload:"true"`
+	DnsOverrideAllowedSources    string  `config:"DNS_OVERRIDE_ALLOWED_SOURCES" reload:"true"`
+	TrustedProxies               string  `config:"TRUSTED_PROXIES" reload:"true"`
+	TrustedProxiesCloudflare     bool    `config:"TRUSTED_PROXIES_CLOUDFLARE" reload:"true"`
+	TrustedProxiesCloudflareFile string  `config:"TRUSTED_PROXIES_CLOUDFLARE_FILE" reload:"true"`
+	AdminApiToken                string  `config:"ADMIN_API_TOKEN" reload:"true" secret:"true"`
+	QueryLogSampleRate           float64 `config:"QUERY_LOG_SAMPLE_RATE" reload:"true"`
+	AlertLowCapacityRatio        float64 `config:"ALERT_LOW_CAPACITY_RATIO" reload:"true"`
+
+	// Parsed from the above during validation
+	overrideAllowedSources []*net.IPNet
+	proxyTrust             *proxyTrust
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// cfg returns the running config. Until one is loaded an empty config is returned.
+func cfg() *Config {
+	if c := currentConfig.Load(); c != nil {
+		return c
+	}
+	return &Config{}
+}
+
+// withoutSecrets returns a copy of c with the fields tagged secret zeroed
+func (c *Config) withoutSecrets() *Config {
+	redacted := *c
+	rv := reflect.ValueOf(&redacted).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		if rv.Type().Field(i).Tag.Get("secret") == "true" {
+			rv.Field(i).Set(reflect.Zero(rv.Field(i).Type()))
+		}
+	}
+	return &redacted
+}
+
+// SetDefaults sets the default value of every config key on v
+func SetDefaults(v *viper.Viper) {
+	v.SetDefault("PROMETHEUS_METRICS_PORT", "9102")
+	v.SetDefault("HTTP_DATA_PORT", "8080")
+	v.SetDefault("DNS_PORT", "10053")
+	v.SetDefault("DNS_TTL", "10")
+	v.SetDefault("TEST_MODE", false)
+	v.SetDefault("HOSTNAME_TO_SERVE", "fsd.connect.vatsim.net")
+	v.SetDefault("DEFAULT_FSD_SERVER", "")
+	v.SetDefault("SENTRY_DSN", "")
+	v.SetDefault("HTTP_ENDPOINT_PORT", "8081")
+	v.SetDefault("GEOIP_DATABASE", "GeoLite2-City.mmdb")
+	v.SetDefault("DO_API_KEY", "")
+	v.SetDefault("DO_TAG", "")
+	v.SetDefault("ENABLE_CLOUDFLARE", false)
+	v.SetDefault("FSD_SLOT_BUFFER", 0)
+	v.SetDefault("FSD_SERVER_POLLING_INTERVAL", 5)
+	v.SetDefault("FSD_SERVER_REMOVE_FAILURE_COUNT", 2)
+	v.SetDefault("SELECTION_DISTANCE_WEIGHT", 0)
+	v.SetDefault("READY_MIN_ACCEPTING_SERVERS", 1)
+	v.SetDefault("SHUTDOWN_DRAIN_PERIOD", 5)
+	v.SetDefault("SHUTDOWN_TIMEOUT", 10)
+	v.SetDefault("DNS_OVERRIDE_ALLOWED_SOURCES", "")
+	v.SetDefault("TRUSTED_PROXIES", "")
+	v.SetDefault("TRUSTED_PROXIES_CLOUDFLARE", false)
+	v.SetDefault("TRUSTED_PROXIES_CLOUDFLARE_FILE", "")
+	v.SetDefault("ADMIN_API_TOKEN", "")
+	v.SetDefault("ADMIN_TLS_CERT_FILE", "")
+	v.SetDefault("ADMIN_TLS_KEY_FILE", "")
+	v.SetDefault("ADMIN_TLS_CLIENT_CA_FILE", "")
+	v.SetDefault("QUERY_LOG_FILE", "")
+	v.SetDefault("QUERY_LOG_MAX_SIZE_MB", 100)
+	v.SetDefault("QUERY_LOG_MAX_BACKUPS", 5)
+	v.SetDefault("QUERY_LOG_MAX_AGE_DAYS", 7)
+	v.SetDefault("QUERY_LOG_BUFFER_SIZE", 4096)
+	v.SetDefault("QUERY_LOG_SAMPLE_RATE", 1)
+	v.SetDefault("DNSTAP_OUTPUT", "")
+	v.SetDefault("DNSTAP_IDENTITY", "")
+	v.SetDefault("TRACING_EXPORTER", telemetry.ExporterNone)
+	v.SetDefault("TRACING_ENDPOINT", "")
+	v.SetDefault("TRACING_INSECURE", false)
+	v.SetDefault("TRACING_SAMPLE_RATIO", 0.01)
+	v.SetDefault("ALERT_WEBHOOK_URL", "")
+	v.SetDefault("ALERT_SLACK_WEBHOOK_URL", "")
+	v.SetDefault("ALERT_SLACK_CHANNEL", "")
+	v.SetDefault("ALERT_SLACK_USERNAME", "")
+	v.SetDefault("ALERT_DEDUP_WINDOW", 600)
+	v.SetDefault("ALERT_RATE_LIMIT", 10)
+	v.SetDefault("ALERT_TEMPLATE", "")
+	v.SetDefault("ALERT_TEMPLATES_FILE", "")
+	v.SetDefault("ALERT_LOW_CAPACITY_RATIO", 0.1)
+}
+
+// LoadConfig reads and validates a Config from v. All problems found are returned together.
+func LoadConfig(v *viper.Viper) (*Config, error) {
+	c := &Config{}
+	var errs error
+	rv := reflect.ValueOf(c).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		key := rv.Type().Field(i).Tag.Get("config")
+		if key == "" {
+			continue
+		}
+		field := rv.Field(i)
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			var value string
+			value, err = cast.ToStringE(v.Get(key))
+			field.SetString(value)
+		case reflect.Int:
+			var value int
+			value, err = cast.ToIntE(v.Get(key))
+			field.SetInt(int64(value))
+		case reflect.Bool:
+			var value bool
+			value, err = cast.ToBoolE(v.Get(key))
+			field.SetBool(value)
+		case reflect.Float64:
+			var value float64
+			value, err = cast.ToFloat64E(v.Get(key))
+			field.SetFloat(value)
+		}
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	var errs error
+	for key, port := range map[string]string{
+		"DNS_PORT":                c.DnsPort,
+		"HTTP_ENDPOINT_PORT":      c.HttpEndpointPort,
+		"HTTP_DATA_PORT":          c.HttpDataPort,
+		"PROMETHEUS_METRICS_PORT": c.PrometheusMetricsPort,
+	} {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			errs = errors.Join(errs, fmt.Errorf("%s: %q is not a valid port", key, port))
+		}
+	}
+	for key, value := range map[string]int{
+		"DNS_TTL":                     c.DnsTTL,
+		"FSD_SLOT_BUFFER":             c.FSDSlotBuffer,
+		"READY_MIN_ACCEPTING_SERVERS": c.ReadyMinAcceptingServers,
+		"SHUTDOWN_DRAIN_PERIOD":       c.ShutdownDrainPeriod,
+		"SHUTDOWN_TIMEOUT":            c.ShutdownTimeout,
+		"QUERY_LOG_MAX_SIZE_MB":       c.QueryLogMaxSizeMB,
+		"QUERY_LOG_MAX_BACKUPS":       c.QueryLogMaxBackups,
+		"QUERY_LOG_MAX_AGE_DAYS":      c.QueryLogMaxAgeDays,
+		"ALERT_DEDUP_WINDOW":          c.AlertDedupWindow,
+		"ALERT_RATE_LIMIT":            c.AlertRateLimit,
+	} {
+		if value < 0 {
+			errs = errors.Join(errs, fmt.Errorf("%s: must not be negative", key))
+		}
+	}
+	if c.FSDServerPollingInterval < 1 {
+		errs = errors.Join(errs, errors.New("FSD_SERVER_POLLING_INTERVAL: must be at least 1 second"))
+	}
+	if c.FSDServerRemoveFailureCount < 1 {
+		errs = errors.Join(errs, errors.New("FSD_SERVER_REMOVE_FAILURE_COUNT: must be at least 1"))
+	}
+	if c.SelectionDistanceWeight < 0 {
+		errs = errors.Join(errs, errors.New("SELECTION_DISTANCE_WEIGHT: must not be negative"))
+	}
+	if c.QueryLogSampleRate < 0 || c.QueryLogSampleRate > 1 {
+		errs = errors.Join(errs, errors.New("QUERY_LOG_SAMPLE_RATE: must be between 0 and 1"))
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		errs = errors.Join(errs, errors.New("TRACING_SAMPLE_RATIO: must be between 0 and 1"))
+	}
+	switch c.TracingExporter {
+	case telemetry.ExporterNone, telemetry.ExporterOTLPGRPC, telemetry.ExporterOTLPHTTP:
+	default:
+		errs = errors.Join(errs, fmt.Errorf("TRACING_EXPORTER: must be %s, %s or %s", telemetry.ExporterNone, telemetry.ExporterOTLPGRPC, telemetry.ExporterOTLPHTTP))
+	}
+	if c.AlertLowCapacityRatio < 0 || c.AlertLowCapacityRatio > 1 {
+		errs = errors.Join(errs, errors.New("ALERT_LOW_CAPACITY_RATIO: must be between 0 and 1"))
+	}
+	if _, err := alerting.ReadTemplates(c.AlertTemplatesFile); err != nil {
+		errs = errors.Join(errs, fmt.Errorf("ALERT_TEMPLATES_FILE: %w", err))
+	}
+	if c.QueryLogBufferSize < 1 {
+		errs = errors.Join(errs, errors.New("QUERY_LOG_BUFFER_SIZE: must be at least 1"))
+	}
+	if c.GeoIPDatabase == "" {
+		errs = errors.Join(errs, errors.New("GEOIP_DATABASE: must be set"))
+	}
+	if c.AdminTLSCertFile != "" && c.AdminTLSKeyFile == "" {
+		errs = errors.Join(errs, errors.New("ADMIN_TLS_KEY_FILE: must be set with ADMIN_TLS_CERT_FILE"))
+	}
+	if c.AdminTLSClientCAFile != "" && c.AdminTLSCertFile == "" {
+		errs = errors.Join(errs, errors.New("ADMIN_TLS_CLIENT_CA_FILE: client certificates need ADMIN_TLS_CERT_FILE"))
+	}
+	var err error
+	c.overrideAllowedSources, err = parseCIDRList(c.DnsOverrideAllowedSources)
+	if err != nil {
+		errs = errors.Join(errs, fmt.Errorf("DNS_OVERRIDE_ALLOWED_SOURCES: %w", err))
+	}
+	c.proxyTrust, err = loadProxyTrust(c.TrustedProxies, c.TrustedProxiesCloudflare, c.TrustedProxiesCloudflareFile)
+	if err != nil {
+		errs = errors.Join(errs, err)
+	}
+	return errs
+}
+
+// CheckConfig loads and validates the config from v, then checks the zone it would serve and that the
+// GeoIP database can be opened. All problems found are returned together.
+func CheckConfig(v *viper.Viper) (*Config, error) {
+	c, err := LoadConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	var errs error
+	hostname := dns.Fqdn(c.HostnameToServe)
+	if _, ok := dns.IsDomainName(hostname); !ok {
+		errs = errors.Join(errs, fmt.Errorf("HOSTNAME_TO_SERVE: %q is not a domain name", c.HostnameToServe))
+	} else if !dns.IsSubDomain(servedZone, hostname) {
+		errs = errors.Join(errs, fmt.Errorf("HOSTNAME_TO_SERVE: %q is outside the served zone %s", c.HostnameToServe, servedZone))
+	}
+	if c.DefaultFSDServer != "" {
+		if err := validateFSDServer(&common.FSDServer{Name: c.DefaultFSDServer, IpAddress: "192.0.2.1"}); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("DEFAULT_FSD_SERVER: %w", err))
+		}
+	}
+	for _, nameserver := range zoneNameservers {
+		if _, err := dns.NewRR(fmt.Sprintf("%s 60 IN NS %s", servedZone, nameserver)); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("zone %s: NS %s: %w", servedZone, nameserver, err))
+		}
+	}
+	reader, err := geoip2.Open(c.GeoIPDatabase)
+	if err != nil {
+		errs = errors.Join(errs, fmt.Errorf("GEOIP_DATABASE: %w", err))
+	} else {
+		_ = reader.Close()
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return c, nil
+}
+
+func (c *Config) drainPeriod() time.Duration {
+	return time.Duration(c.ShutdownDrainPeriod) * time.Second
+}
+
+func (c *Config) shutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+func (c *Config) pollingSettings() common.PollingSettings {
+	return common.PollingSettings{
+		SlotBuffer:         c.FSDSlotBuffer,
+		PollingInterval:    time.Duration(c.FSDServerPollingInterval) * time.Second,
+		RemoveFailureCount: c.FSDServerRemoveFailureCount,
+		TestMode:           c.TestMode,
+	}
+}
+
+// applyConfig makes c the running config
+func applyConfig(c *Config) {
+	currentConfig.Store(c)
+	common.SetPollingSettings(c.pollingSettings())
+	if queryLog != nil {
+		queryLog.SetSampleRate(c.QueryLogSampleRate)
+	}
+}
+
+// ReloadConfig re-reads the config from v and swaps it in if it is valid. Changes to settings that
+// are only read at startup are logged and kept at their running value until restart.
+func ReloadConfig(v *viper.Viper) error {
+	newConfig, err := LoadConfig(v)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Rejected config reload, keeping running config: %s", err))
+		return err
+	}
+	oldConfig := currentConfig.Load()
+	if oldConfig == nil {
+		applyConfig(newConfig)
+		return nil
+	}
+	oldValue := reflect.ValueOf(oldConfig).Elem()
+	newValue := reflect.ValueOf(newConfig).Elem()
+	for i := 0; i < newValue.NumField(); i++ {
+		field := newValue.Type().Field(i)
+		key := field.Tag.Get("config")
+		if key == "" || reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		change := fmt.Sprintf("%v -> %v", oldValue.Field(i).Interface(), newValue.Field(i).Interface())
+		if field.Tag.Get("secret") == "true" {
+			change = "(secret changed)"
+		}
+		if field.Tag.Get("reload") == "true" {
+			logger.Info(fmt.Sprintf("Config %s changed, applying: %s", key, change))
+		} else {
+			logger.Info(fmt.Sprintf("Config %s changed but requires a restart to apply: %s", key, change))
+			newValue.Field(i).Set(oldValue.Field(i))
+		}
+	}
+	applyConfig(newConfig)
+	return nil
+}
@@ -0,0 +1,72 @@
+package dnshaiku
+
+import (
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func testViper() *viper.Viper {
+	v := viper.New()
+	SetDefaults(v)
+	return v
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := LoadConfig(testViper())
+	assert.NoError(t, err)
+	assert.Equal(t, "10053", c.DnsPort)
+	assert.Equal(t, 10, c.DnsTTL)
+	assert.Equal(t, 5, c.FSDServerPollingInterval)
+}
+
+func TestLoadConfigRejectsInvalidValues(t *testing.T) {
+	v := testViper()
+	v.Set("DNS_PORT", "99999")
+	v.Set("FSD_SERVER_POLLING_INTERVAL", 0)
+	v.Set("DNS_OVERRIDE_ALLOWED_SOURCES", "not-a-cidr")
+	_, err := LoadConfig(v)
+	assert.ErrorContains(t, err, "DNS_PORT")
+	assert.ErrorContains(t, err, "FSD_SERVER_POLLING_INTERVAL")
+	assert.ErrorContains(t, err, "DNS_OVERRIDE_ALLOWED_SOURCES")
+
+	v = testViper()
+	v.Set("DNS_TTL", "ten")
+	_, err = LoadConfig(v)
+	assert.ErrorContains(t, err, "DNS_TTL")
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Cleanup(func() { currentConfig.Store(nil) })
+	v := testViper()
+	assert.NoError(t, ReloadConfig(v))
+	assert.Equal(t, 10, cfg().DnsTTL)
+
+	// Reloadable settings apply, restart-only settings keep their running value
+	v.Set("DNS_TTL", 30)
+	v.Set("DNS_PORT", "5353")
+	v.Set("DNS_OVERRIDE_ALLOWED_SOURCES", "127.0.0.1")
+	assert.NoError(t, ReloadConfig(v))
+	assert.Equal(t, 30, cfg().DnsTTL)
+	assert.Equal(t, "10053", cfg().DnsPort)
+	assert.True(t, overrideAllowed(IpToIpNET("127.0.0.1")))
+
+	// An invalid reload is rejected and the old config kept
+	v.Set("DNS_TTL", -1)
+	assert.Error(t, ReloadConfig(v))
+	assert.Equal(t, 30, cfg().DnsTTL)
+}
+
+func TestConfigHashLeavesOutSecrets(t *testing.T) {
+	t.Cleanup(func() { currentConfig.Store(nil) })
+	currentConfig.Store(&Config{DnsTTL: 10, AdminApiToken: "hunter2", SentryDsn: "https://key@sentry.example/1"})
+	withSecrets := configHash()
+	currentConfig.Store(&Config{DnsTTL: 10})
+	assert.Equal(t, configHash(), withSecrets, "the hash can't be used to check a guessed secret")
+	currentConfig.Store(&Config{DnsTTL: 30})
+	assert.NotEqual(t, configHash(), withSecrets)
+
+	c := &Config{AdminApiToken: "hunter2"}
+	assert.Empty(t, c.withoutSecrets().AdminApiToken)
+	assert.Equal(t, "hunter2", c.AdminApiToken, "the running config is left as it is")
+}
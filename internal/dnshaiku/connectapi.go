@@ -0,0 +1,94 @@
+package dnshaiku
+
+import (
+	"fmt"
+	"github.com/jftuga/geodist"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/pkg/connect"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Most servers /v1/connect will return in one response
+const maxConnectCount = 10
+
+func connectServer(candidate Candidate) connect.Server {
+	load := 0.0
+	if candidate.Server.MaxUsers > 0 {
+		load = float64(candidate.Server.CurrentUsers) / float64(candidate.Server.MaxUsers)
+	}
+	return connect.Server{
+		Name:          candidate.Server.Name,
+		IpAddresses:   []string{candidate.Server.IpAddress},
+		Region:        candidate.Server.Country,
+		DistanceMiles: candidate.DistanceMiles,
+		Load:          load,
+	}
+}
+
+// handleConnect serves /v1/connect, the JSON version of the plain text / endpoint
+func handleConnect(w http.ResponseWriter, r *http.Request) {
+	count := 1
+	if countParam := r.URL.Query().Get("count"); countParam != "" {
+		parsedCount, err := strconv.Atoi(countParam)
+		if err != nil || parsedCount < 1 || parsedCount > maxConnectCount {
+			writeJson(w, http.StatusBadRequest, connect.ErrorResponse{Error: fmt.Sprintf("count must be between 1 and %d", maxConnectCount)})
+			return
+		}
+		count = parsedCount
+	}
+	start := time.Now()
+	dnsRateCounter.Incr(1)
+	sourceIpParsed := httpClientIp(r)
+	response := connect.Response{
+		Version:    connect.Version,
+		Client:     connect.ClientLocation{Ip: sourceIpParsed.String()},
+		Alternates: make([]connect.Server, 0),
+		TTL:        cfg().DnsTTL,
+	}
+	record, err := geoLocate(r.Context(), sourceIpParsed)
+	if err != nil {
+		// Without a location there is nothing to rank by, the fallback server is returned alone
+		logger.Error(fmt.Sprintf("GeoIP lookup for %s failed: %s", sourceIpParsed, err))
+		server, err := pickFallback(r.Context(), &fsdServers, fallbackGeoIPFailed)
+		if err != nil {
+			connectUnavailable(w, r, start, sourceIpParsed, err)
+			return
+		}
+		response.Server = connectServer(Candidate{Server: server})
+		serverSelections.WithLabelValues(response.Server.Name, "").Inc()
+		writeJson(w, http.StatusOK, response)
+		logHttpQuery(start, r, sourceIpParsed, http.StatusOK, response.Server.Name, response.Server.IpAddresses[0])
+		return
+	}
+	sourceIpLatLng := geodist.Coord{Lat: record.Location.Latitude, Lon: record.Location.Longitude}
+	response.Client = connect.ClientLocation{
+		Ip:        sourceIpParsed.String(),
+		Country:   record.Country.IsoCode,
+		City:      record.City.Names["en"],
+		Latitude:  record.Location.Latitude,
+		Longitude: record.Location.Longitude,
+	}
+
+	selection, err := selectServer(r.Context(), &fsdServers, sourceIpLatLng)
+	if err != nil {
+		connectUnavailable(w, r, start, sourceIpParsed, err)
+		return
+	}
+	response.Server = connectServer(selection.Winner)
+	for i := 0; i < count-1 && i < len(selection.Alternates); i++ {
+		response.Alternates = append(response.Alternates, connectServer(selection.Alternates[i]))
+	}
+	serverSelections.WithLabelValues(response.Server.Name, record.Country.IsoCode).Inc()
+	writeJson(w, http.StatusOK, response)
+	logHttpQuery(start, r, sourceIpParsed, http.StatusOK, response.Server.Name, response.Server.IpAddresses[0])
+}
+
+// connectUnavailable answers a /v1/connect request there is no server for
+func connectUnavailable(w http.ResponseWriter, r *http.Request, start time.Time, sourceIp net.IP, err error) {
+	reportFailure("http", r.URL.Path, sourceIp, nil, err)
+	writeJson(w, http.StatusServiceUnavailable, connect.ErrorResponse{Error: "no servers available"})
+	logHttpQuery(start, r, sourceIp, http.StatusServiceUnavailable, "", "")
+}
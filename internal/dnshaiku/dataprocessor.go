@@ -5,15 +5,25 @@ import (
 	"context"
 	"fmt"
 	"github.com/digitalocean/godo"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
 	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"go.opentelemetry.io/otel/attribute"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
+// pollerStops holds a channel per polled server, closed to stop its polling goroutine
+var pollerStops sync.Map
+
+// stopPolling stops the polling goroutine for name, if it has one
+func stopPolling(name string) {
+	if stop, found := pollerStops.LoadAndDelete(name); found {
+		close(stop.(chan struct{}))
+	}
+}
+
 func dataProcessorManager() {
 	enableFsdServerProm := make(chan string)
 	go handleProm(enableFsdServerProm)
@@ -26,12 +36,25 @@ func dataProcessorManager() {
 		Page:    1,
 		PerPage: 200,
 	}
-	doClient := godo.NewFromToken(viper.GetString("DO_API_KEY"))
+	doClient := godo.NewFromToken(cfg().DoApiKey)
 	go func() {
 		for {
-			if viper.GetBool("TEST_MODE") == false {
+			if cfg().TestMode == false {
 				logger.Debug("Checking tag for Droplets")
-				droplets, _, _ := doClient.Droplets.ListByTag(ctx, viper.GetString("DO_TAG"), opt)
+				discoveryStart := time.Now()
+				discoveryCtx, span := tracer.Start(ctx, "discover_servers")
+				span.SetAttributes(attribute.String("do.tag", cfg().DoTag))
+				droplets, _, err := doClient.Droplets.ListByTag(discoveryCtx, cfg().DoTag, opt)
+				discoveryDuration.Observe(time.Since(discoveryStart).Seconds())
+				if err == nil {
+					lastDiscovery.Store(time.Now().Unix())
+					span.SetAttributes(attribute.Int("do.droplets", len(droplets)))
+					span.End()
+				} else {
+					discoveryErrors.Inc()
+					logger.Error(fmt.Sprintf("Listing Droplets by tag failed: %s", err))
+					endSpanWithError(span, err)
+				}
 				logger.Debug("Checked tag for Droplets")
 				for _, d := range droplets {
 					_, fsdInMap := fsdServers.Load(d.Name)
@@ -50,7 +73,7 @@ func dataProcessorManager() {
 					logger.Info(fmt.Sprintf("Found FSD server %s | %s", d.Name, d.Networks.V4[1].IPAddress))
 
 					// Are we alive check
-					c, err := net.Dial("tcp", fmt.Sprintf("%s:%s", d.Name, "6809"))
+					c, err := net.Dial("tcp", net.JoinHostPort(d.Name, "6809"))
 					if err != nil {
 						logger.Info(fmt.Sprintf("%s", err))
 						continue
@@ -63,22 +86,26 @@ func dataProcessorManager() {
 					} else {
 						logger.Info(fmt.Sprintf("FSD server %s passed initial health check, starting polling", d.Name))
 					}
+					alertServerFound(d.Name)
 					fsdServers.Store(d.Name, common.NewFSDServer(&d))
 					fsdServer, _ := fsdServers.Load(d.Name)
 					fsdServerStruct := fsdServer.(*common.FSDServer)
+					stop := make(chan struct{})
+					pollerStops.Store(d.Name, stop)
 					go func(dName string) {
-						fsdServerStruct.Polling(enableFsdServerProm, deregisterFsd)
+						fsdServerStruct.Polling(enableFsdServerProm, deregisterFsd, stop)
 					}(d.Name)
 				}
 				logger.Debug("Found all servers using tag, sleeping for a minute")
 			} else {
 				logger.Info("Running in test mode")
 			}
+			checkCapacity()
 			time.Sleep(60 * time.Second)
 		}
 	}()
 
-	if viper.GetBool("ENABLE_CLOUDFLARE") {
+	if cfg().EnableCloudflare {
 		go func() {
 			logger.Info("Cloudflare not fully implemented")
 			//api, err := cloudflare.NewWithAPIToken(viper.GetString("CLOUDFLARE_API_KEY"))
@@ -126,22 +153,27 @@ func handleProm(enableFsdServerProm chan string) {
 		fsdServerStruct := fsdServer.(*common.FSDServer)
 		fsdCollector := newFsdServersCollector(fsdServerStruct)
 		fsdServerStruct.PrometheusCollector = fsdCollector
-		prometheus.MustRegister(fsdCollector)
+		metricsRegistry.MustRegister(fsdCollector)
 	}
 }
 
 func handleFsdDeregister(deregisterFsd chan string) {
 	for fsdServer := range deregisterFsd {
+		pollerStops.Delete(fsdServer)
 		fsdServerMap, fsdFound := fsdServers.Load(fsdServer)
-		fsdServerStruct := fsdServerMap.(*common.FSDServer)
-		if fsdFound {
-			logger.Info(fmt.Sprintf("Found %s in fsd server list", fsdServer))
-		} else {
+		if !fsdFound {
+			// Deleted through the admin API while its poller was giving up on it
 			logger.Info(fmt.Sprintf("Failed to find %s in fsd server list", fsdServer))
 			continue
 		}
-		prometheus.Unregister(fsdServerStruct.PrometheusCollector)
+		logger.Info(fmt.Sprintf("Found %s in fsd server list", fsdServer))
+		fsdServerStruct := fsdServerMap.(*common.FSDServer)
+		if fsdServerStruct.PrometheusCollector != nil {
+			metricsRegistry.Unregister(fsdServerStruct.PrometheusCollector)
+		}
+		forgetServerMetrics(fsdServer)
 		fsdServers.Delete(fsdServer)
+		alertServerDeregistered(fsdServer, fsdServerStruct.UpdateFailureCount)
 		_, fsdFound = fsdServers.Load(fsdServer)
 		if fsdFound == false {
 			logger.Info(fmt.Sprintf("Removed %s from fsd server list", fsdServer))
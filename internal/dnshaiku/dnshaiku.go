@@ -1,29 +1,45 @@
 package dnshaiku
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/getsentry/sentry-go"
 	"github.com/oschwald/geoip2-golang"
 	"github.com/paulbellamy/ratecounter"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/telemetry"
 	"github.com/vatsimnetwork/vatdns/pkg/common"
-	"log"
 	"net"
 	"net/http"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
+// geoLocator looks up where an IP is. *geoip2.Reader is the real one, tests use a fake.
+type geoLocator interface {
+	City(ipAddress net.IP) (*geoip2.City, error)
+}
+
 var (
 	fsdServers     sync.Map
-	db             *geoip2.Reader
+	db             geoLocator
 	dnsRateCounter *ratecounter.RateCounter
-	dnsIpOverride  string
 	publicIp       string
 )
 
-func Main() {
+// Main runs dnshaiku until SIGTERM or SIGINT, when it drains and shuts down all listeners.
+// An error is returned if a listener could not be started or failed while serving.
+func Main() error {
+	config, err := LoadConfig(viper.GetViper())
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	applyConfig(config)
+
 	// Get public IP for machine from interfaces...hope this works. Works on Droplets.
 	// We need this for when someone queries what IPs to make an HTTP request to for
 	// fsd-http.connect.vatsim.net
@@ -36,13 +52,62 @@ func Main() {
 			}
 		}
 	}
-	err := sentry.Init(sentry.ClientOptions{
-		Dsn:              viper.GetString("SENTRY_DSN"),
+	err = sentry.Init(sentry.ClientOptions{
+		Dsn:              cfg().SentryDsn,
 		TracesSampleRate: 0,
 	})
 	if err != nil {
 		logger.Info(fmt.Sprintf("sentry.Init: %s", err))
 	}
+	shutdownTracing, err := telemetry.Setup(context.Background(), telemetry.Config{
+		Exporter:       cfg().TracingExporter,
+		Endpoint:       cfg().TracingEndpoint,
+		Insecure:       cfg().TracingInsecure,
+		SampleRatio:    cfg().TracingSampleRatio,
+		ServiceName:    "dnshaiku",
+		ServiceVersion: Version,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg().shutdownTimeout())
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error(fmt.Sprintf("Flushing traces failed: %s", err))
+		}
+	}()
+	alerts, err = newAlerts(cfg())
+	if err != nil {
+		return err
+	}
+	defer closeAlerts(cfg().shutdownTimeout())
+	queryLog, err = newQueryLog(cfg())
+	if err != nil {
+		return err
+	}
+	defer closeQueryLog(cfg().shutdownTimeout())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	shutdownTimeout := cfg().shutdownTimeout()
+	sup := newSupervisor()
+
+	// Starts a Prometheus exporter endpoint to be scraped, along with health endpoints for orchestration.
+	// This comes up first so /livez answers while we wait for FSD servers.
+	registerHealthHandlers(http.DefaultServeMux)
+	http.Handle("/metrics", metricsHandler())
+	metricsServer := newHttpListener("metrics", fmt.Sprintf(":%s", cfg().PrometheusMetricsPort), http.DefaultServeMux, nil)
+	// Handle admin and test data submission. Started before waiting for servers so they can be
+	// submitted through it.
+	dataWebServer, err := newDataWebServer()
+	if err != nil {
+		return err
+	}
+	if err := sup.start(metricsServer, dataWebServer); err != nil {
+		return errors.Join(err, sup.shutdown(0, shutdownTimeout))
+	}
+
 	// Starts dataprocessor and waits for data before starting
 	go dataProcessorManager()
 	for {
@@ -57,15 +122,26 @@ func Main() {
 		if activeServers > 0 {
 			break
 		}
+		select {
+		case <-ctx.Done():
+			logger.Info("Received shutdown signal before any FSD servers were found")
+			return sup.shutdown(0, shutdownTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
-	// Handle various web things
-	go StartDataWebServer()
+
 	// Starts a tcp+udp DNS server
-	go StartDnsServer()
+	dnsServers, err := newDnsServers()
+	if err != nil {
+		return errors.Join(err, sup.shutdown(0, shutdownTimeout))
+	}
 	// Starts an HTTP server to return an IP to connect to
-	go StartWebServer()
-	// Starts a Prometheus exporter endpoint to be scraped
-	go http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", viper.GetString("PROMETHEUS_METRICS_PORT")), nil))
-
+	webServer, err := newWebServer()
+	if err != nil {
+		return errors.Join(err, sup.shutdown(0, shutdownTimeout))
+	}
+	if err := sup.start(append(dnsServers, webServer)...); err != nil {
+		return errors.Join(err, sup.shutdown(0, shutdownTimeout))
+	}
+	return sup.wait(ctx)
 }
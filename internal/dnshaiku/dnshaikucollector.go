@@ -2,7 +2,6 @@ package dnshaiku
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-	"time"
 )
 
 type RateCollector struct {
@@ -24,7 +23,5 @@ func (collector *RateCollector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (collector *RateCollector) Collect(ch chan<- prometheus.Metric) {
-	m1 := prometheus.MustNewConstMetric(collector.DnsRate, prometheus.CounterValue, float64(dnsRateCounter.Rate()))
-	m1 = prometheus.NewMetricWithTimestamp(time.Now(), m1)
-	ch <- m1
+	ch <- prometheus.MustNewConstMetric(collector.DnsRate, prometheus.GaugeValue, float64(dnsRateCounter.Rate()))
 }
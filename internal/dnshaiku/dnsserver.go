@@ -1,89 +1,93 @@
 package dnshaiku
 
 import (
+	"context"
 	"fmt"
 	"github.com/miekg/dns"
 	"github.com/oschwald/geoip2-golang"
 	"github.com/paulbellamy/ratecounter"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
-	"log"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
 func HandleDnsRequest(w dns.ResponseWriter, r *dns.Msg) {
-	for _, extra := range r.Extra {
-		switch extra.(type) {
-		case *dns.OPT:
-			for _, o := range extra.(*dns.OPT).Option {
-				switch e := o.(type) {
-				case *dns.EDNS0_SUBNET:
-					if e.Address != nil {
-						logger.Info(fmt.Sprintf("edns subnet found %s/%d", e.Address, e.SourceNetmask))
-					}
-				}
-			}
-		}
+	start := time.Now()
+	ctx, span := tracer.Start(context.Background(), "dns.query", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	sourceIp, ecs := dnsClientIp(w.RemoteAddr(), r)
+	span.SetAttributes(attribute.String("network.transport", w.RemoteAddr().Network()))
+	if len(r.Question) > 0 {
+		span.SetAttributes(
+			attribute.String("dns.qname", r.Question[0].Name),
+			attribute.String("dns.qtype", dns.TypeToString[r.Question[0].Qtype]),
+		)
+	}
+	if ecs != nil {
+		span.SetAttributes(attribute.String("dns.ecs", fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)))
 	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.SetEdns0(4096, true)
 	m.Compress = false
+	if ecs != nil {
+		// Echo the ECS option back, scoped to the prefix we were given
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			SourceScope:   ecs.SourceNetmask,
+			Address:       ecs.Address,
+		})
+	}
+	var server *common.FSDServer
 	switch r.Opcode {
 	case dns.OpcodeQuery:
-		ParseQuery(m, w.RemoteAddr())
+		var err error
+		server, err = ParseQuery(ctx, m, sourceIp)
+		if err != nil {
+			reportFailure("dns", r.Question[0].Name, sourceIp, nil, err)
+			span.RecordError(err)
+			m = new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+		}
+	}
+	span.SetAttributes(attribute.String("dns.rcode", dns.RcodeToString[m.Rcode]))
+	if server != nil {
+		setServerAttributes(span, server.Name, server.IpAddress)
 	}
 	err := w.WriteMsg(m)
 	if err != nil {
+		span.RecordError(err)
 		return
 	}
+	observeDnsRequest(w.RemoteAddr().Network(), r, m, time.Since(start))
+	logDnsQuery(start, w, r, m, sourceIp, ecs, server)
 }
 
-func StartDnsServer() {
+// newDnsServers loads the GeoIP database and returns the UDP and TCP DNS listeners
+func newDnsServers() ([]listener, error) {
 	_rpsCounter := ratecounter.NewRateCounter(1 * time.Second)
 	dnsRateCounter = _rpsCounter
 	rateCollector := newRateCollector()
-	prometheus.MustRegister(rateCollector)
-	geoip2DB, err := geoip2.Open("GeoLite2-City.mmdb")
+	metricsRegistry.MustRegister(rateCollector)
+	geoip2DB, err := geoip2.Open(cfg().GeoIPDatabase)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("opening GeoIP database: %w", err)
 	}
 	db = geoip2DB
 
-	dns.HandleFunc("fsd.connect.vatsim.net", HandleDnsRequest)
-	dns.HandleFunc("fsd-http.connect.vatsim.net", HandleDnsRequest)
-	dns.HandleFunc("connect.vatsim.net", HandleDnsRequest)
-	go func() {
-		// Starts UDP DNS server
-		serverUDP := &dns.Server{Addr: fmt.Sprintf(":%s", viper.GetString("DNS_PORT")), Net: "udp"}
-		logger.Info(fmt.Sprintf("Starting UDP DNS server on port %s", viper.GetString("DNS_PORT")))
-		err := serverUDP.ListenAndServe()
-		defer func(server *dns.Server) {
-			err := server.Shutdown()
-			if err != nil {
-
-			}
-		}(serverUDP)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Failed to start server: %s", err.Error()))
-		}
-	}()
-	go func() {
-		// Starts TCP DNS server
-		serverTCP := &dns.Server{Addr: fmt.Sprintf(":%s", viper.GetString("DNS_PORT")), Net: "tcp"}
-		logger.Info(fmt.Sprintf("Starting TCP DNS server on port %s", viper.GetString("DNS_PORT")))
-		err := serverTCP.ListenAndServe()
-		defer func(server *dns.Server) {
-			err := server.Shutdown()
-			if err != nil {
-
-			}
-		}(serverTCP)
-		if err != nil {
-			logger.Fatal(fmt.Sprintf("Failed to start server: %s", err.Error()))
-		}
-	}()
-	logger.Info(fmt.Sprintf("Default FSD server returned %s", viper.GetString("DEFAULT_FSD_SERVER")))
+	dnsMux := dns.NewServeMux()
+	dnsMux.HandleFunc("fsd.connect.vatsim.net", recoverDns(HandleDnsRequest))
+	dnsMux.HandleFunc("fsd-http.connect.vatsim.net", recoverDns(HandleDnsRequest))
+	dnsMux.HandleFunc(servedZone, recoverDns(HandleDnsRequest))
+	logger.Info(fmt.Sprintf("Starting UDP and TCP DNS servers on port %s", cfg().DnsPort))
+	logger.Info(fmt.Sprintf("Default FSD server returned %s", cfg().DefaultFSDServer))
+	return []listener{
+		newDnsListener("dns-udp", fmt.Sprintf(":%s", cfg().DnsPort), "udp", dnsMux),
+		newDnsListener("dns-tcp", fmt.Sprintf(":%s", cfg().DnsPort), "tcp", dnsMux),
+	}, nil
 }
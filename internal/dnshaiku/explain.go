@@ -0,0 +1,198 @@
+package dnshaiku
+
+import (
+	"fmt"
+	"github.com/jftuga/geodist"
+	"github.com/miekg/dns"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Explanation is returned by /v1/explain to reconstruct why a client was sent to a server
+type Explanation struct {
+	Ip         string               `json:"ip"`
+	Qname      string               `json:"qname"`
+	GeoIP      ExplainedGeoIP       `json:"geoip"`
+	Candidates []ExplainedCandidate `json:"candidates"`
+	Overrides  []string             `json:"overrides"`
+	Winner     string               `json:"winner"`
+	WinnerIp   string               `json:"winner_ip"`
+	Reason     string               `json:"reason"`
+}
+
+type ExplainedGeoIP struct {
+	Found     bool    `json:"found"`
+	Error     string  `json:"error,omitempty"`
+	Country   string  `json:"country,omitempty"`
+	City      string  `json:"city,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type ExplainedCandidate struct {
+	Name               string  `json:"name"`
+	IpAddress          string  `json:"ip_address"`
+	Country            string  `json:"country"`
+	DistanceMiles      float64 `json:"distance_miles"`
+	CurrentUsers       int     `json:"current_users"`
+	MaxUsers           int     `json:"max_users"`
+	RemainingSlots     int     `json:"remaining_slots"`
+	Accepting          bool    `json:"accepting"`
+	NotAcceptingReason string  `json:"not_accepting_reason,omitempty"`
+	// Rank is the position the server would be handed out in, 0 if it is not accepting
+	Rank  int     `json:"rank"`
+	Tier  int     `json:"tier"`
+	Score float64 `json:"score"`
+}
+
+// explainSelection runs the same ranking as PickServerToReturn for a location without reserving a slot
+func explainSelection(servers *sync.Map, sourceIpLatLng geodist.Coord, explanation *Explanation) {
+	ranked := rankServers(servers, sourceIpLatLng)
+	for i, candidate := range ranked {
+		explanation.Candidates = append(explanation.Candidates, explainCandidate(candidate, i+1))
+	}
+	// Servers out of rotation are listed after the ranked ones, closest first
+	notAccepting := make([]ExplainedCandidate, 0)
+	servers.Range(func(k, v interface{}) bool {
+		fsdServerStruct := v.(*common.FSDServer)
+		if fsdServerStruct.AcceptingConnections() == 1 {
+			return true
+		}
+		miles, _, _ := geodist.VincentyDistance(sourceIpLatLng, geodist.Coord{Lat: fsdServerStruct.Latitude, Lon: fsdServerStruct.Longitude})
+		notAccepting = append(notAccepting, explainCandidate(Candidate{Server: fsdServerStruct, DistanceMiles: miles}, 0))
+		return true
+	})
+	sort.Slice(notAccepting, func(i, j int) bool {
+		return notAccepting[i].DistanceMiles < notAccepting[j].DistanceMiles
+	})
+	explanation.Candidates = append(explanation.Candidates, notAccepting...)
+
+	if len(ranked) == 0 {
+		fsdServer, fallback := fallbackServer(servers)
+		if fsdServer == nil {
+			explanation.Reason = "There are no servers in the registry"
+			return
+		}
+		explanation.Winner = fsdServer.Name
+		explanation.WinnerIp = fsdServer.IpAddress
+		switch fallback {
+		case "default":
+			explanation.Overrides = append(explanation.Overrides, fmt.Sprintf("DEFAULT_FSD_SERVER %q", fsdServer.Name))
+			explanation.Reason = "No servers are accepting connections so the default FSD server was returned"
+		case "most_slots":
+			explanation.Reason = fmt.Sprintf("No servers are accepting connections and DEFAULT_FSD_SERVER is not in the registry, so %s was returned as the server with the most remaining slots", fsdServer.Name)
+		default:
+			explanation.Reason = fmt.Sprintf("No servers are accepting connections or polling, and DEFAULT_FSD_SERVER is not in the registry, so %s was returned", fsdServer.Name)
+		}
+		return
+	}
+
+	winner := ranked[0]
+	explanation.Winner = winner.Server.Name
+	explanation.WinnerIp = winner.Server.IpAddress
+	closest := winner
+	sameCountry := 0
+	for _, candidate := range ranked {
+		if candidate.Tier == 0 {
+			sameCountry++
+			if candidate.DistanceMiles < closest.DistanceMiles {
+				closest = candidate
+			}
+		}
+	}
+	weight := cfg().SelectionDistanceWeight
+	switch {
+	case sameCountry == 1:
+		explanation.Reason = fmt.Sprintf("%s is the closest server accepting connections (%.0f miles) and the only one in %s",
+			winner.Server.Name, winner.DistanceMiles, winner.Server.Country)
+	case weight == 0:
+		explanation.Reason = fmt.Sprintf("The closest server accepting connections is %s (%.0f miles) in %s. %s has the most remaining slots (%d) of the %d servers accepting connections there",
+			closest.Server.Name, closest.DistanceMiles, winner.Server.Country, winner.Server.Name, winner.Server.RemainingSlots, sameCountry)
+	default:
+		// The runner up is in the same country, since there is more than one there
+		runnerUp := ranked[1]
+		explanation.Reason = fmt.Sprintf("The closest server accepting connections is %s (%.0f miles) in %s. %s has the highest score of the %d servers accepting connections there, remaining slots less SELECTION_DISTANCE_WEIGHT (%g) slots per mile: %s, ahead of %s with %s",
+			closest.Server.Name, closest.DistanceMiles, winner.Server.Country, winner.Server.Name, sameCountry, weight,
+			explainScore(winner, weight), runnerUp.Server.Name, explainScore(runnerUp, weight))
+	}
+}
+
+// explainScore spells out a tier 0 candidate's score from its slot and distance terms
+func explainScore(candidate Candidate, weight float64) string {
+	return fmt.Sprintf("%d slots less %.1f for %.0f miles is %.1f",
+		candidate.Server.RemainingSlots, weight*candidate.DistanceMiles, candidate.DistanceMiles, candidate.Score)
+}
+
+func explainCandidate(candidate Candidate, rank int) ExplainedCandidate {
+	return ExplainedCandidate{
+		Name:               candidate.Server.Name,
+		IpAddress:          candidate.Server.IpAddress,
+		Country:            candidate.Server.Country,
+		DistanceMiles:      candidate.DistanceMiles,
+		CurrentUsers:       candidate.Server.CurrentUsers,
+		MaxUsers:           candidate.Server.MaxUsers,
+		RemainingSlots:     candidate.Server.RemainingSlots,
+		Accepting:          candidate.Server.AcceptingConnections() == 1,
+		NotAcceptingReason: candidate.Server.NotAcceptingReason(),
+		Rank:               rank,
+		Tier:               candidate.Tier,
+		Score:              candidate.Score,
+	}
+}
+
+// handleExplain serves the admin /v1/explain?ip=<addr>[&qname=] endpoint
+func handleExplain(w http.ResponseWriter, r *http.Request, actor string) {
+	ip := net.ParseIP(r.URL.Query().Get("ip"))
+	if ip == nil {
+		audit(r, actor, "explain", "rejected", fmt.Sprintf("%q is not an IP address", r.URL.Query().Get("ip")))
+		http.Error(w, "ip must be an IP address", http.StatusBadRequest)
+		return
+	}
+	qname := dns.Fqdn(strings.ToLower(r.URL.Query().Get("qname")))
+	if qname == "." {
+		qname = dns.Fqdn(cfg().HostnameToServe)
+	}
+	explanation := Explanation{
+		Ip:         ip.String(),
+		Qname:      qname,
+		Candidates: make([]ExplainedCandidate, 0),
+		Overrides:  make([]string, 0),
+	}
+	audit(r, actor, "explain", "ok", fmt.Sprintf("%s %s", ip, qname))
+
+	if qname == "fsd-http.connect.vatsim.net." {
+		explanation.Overrides = append(explanation.Overrides, "fsd-http.connect.vatsim.net is answered with this instance's public IP")
+		explanation.Winner = "dnshaiku"
+		explanation.WinnerIp = publicIp
+		explanation.Reason = "The HTTP endpoint hostname always resolves to the dnshaiku instance answering"
+		writeJson(w, http.StatusOK, explanation)
+		return
+	}
+
+	if db == nil {
+		explanation.GeoIP.Error = "GeoIP database not loaded"
+		explanation.Reason = "GeoIP lookup failed"
+		writeJson(w, http.StatusOK, explanation)
+		return
+	}
+	record, err := geoLocate(r.Context(), ip)
+	if err != nil {
+		explanation.GeoIP.Error = err.Error()
+		explanation.Reason = "GeoIP lookup failed"
+		writeJson(w, http.StatusOK, explanation)
+		return
+	}
+	explanation.GeoIP = ExplainedGeoIP{
+		Found:     record.Location.Latitude != 0 || record.Location.Longitude != 0,
+		Country:   record.Country.IsoCode,
+		City:      record.City.Names["en"],
+		Latitude:  record.Location.Latitude,
+		Longitude: record.Location.Longitude,
+	}
+	explainSelection(&fsdServers, geodist.Coord{Lat: record.Location.Latitude, Lon: record.Location.Longitude}, &explanation)
+	writeJson(w, http.StatusOK, explanation)
+}
@@ -3,7 +3,6 @@ package dnshaiku
 import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vatsimnetwork/vatdns/pkg/common"
-	"time"
 )
 
 type FsdServersCollector struct {
@@ -44,20 +43,14 @@ func (collector FsdServersCollector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (collector FsdServersCollector) Collect(ch chan<- prometheus.Metric) {
-
-	//Note that you can pass CounterValue, GaugeValue, or UntypedValue types here.
-	fsdServer, _ := fsdServers.Load(collector.Name)
+	fsdServer, found := fsdServers.Load(collector.Name)
+	if !found {
+		// Removed between being scraped and being unregistered
+		return
+	}
 	fsdServerStruct := fsdServer.(*common.FSDServer)
-	m1 := prometheus.MustNewConstMetric(collector.CurrentUsers, prometheus.CounterValue, float64(fsdServerStruct.CurrentUsers))
-	m2 := prometheus.MustNewConstMetric(collector.MaxUsers, prometheus.CounterValue, float64(fsdServerStruct.MaxUsers))
-	m3 := prometheus.MustNewConstMetric(collector.AcceptingConnections, prometheus.CounterValue, float64(fsdServerStruct.AcceptingConnections()))
-	m4 := prometheus.MustNewConstMetric(collector.RemainingSlots, prometheus.CounterValue, float64(fsdServerStruct.RemainingSlots))
-	m1 = prometheus.NewMetricWithTimestamp(time.Now(), m1)
-	m2 = prometheus.NewMetricWithTimestamp(time.Now(), m2)
-	m3 = prometheus.NewMetricWithTimestamp(time.Now(), m3)
-	m4 = prometheus.NewMetricWithTimestamp(time.Now(), m4)
-	ch <- m1
-	ch <- m2
-	ch <- m3
-	ch <- m4
+	ch <- prometheus.MustNewConstMetric(collector.CurrentUsers, prometheus.GaugeValue, float64(fsdServerStruct.CurrentUsers))
+	ch <- prometheus.MustNewConstMetric(collector.MaxUsers, prometheus.GaugeValue, float64(fsdServerStruct.MaxUsers))
+	ch <- prometheus.MustNewConstMetric(collector.AcceptingConnections, prometheus.GaugeValue, float64(fsdServerStruct.AcceptingConnections()))
+	ch <- prometheus.MustNewConstMetric(collector.RemainingSlots, prometheus.GaugeValue, float64(fsdServerStruct.RemainingSlots))
 }
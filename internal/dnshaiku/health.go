@@ -0,0 +1,195 @@
+package dnshaiku
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Version is set at build time with -ldflags "-X github.com/vatsimnetwork/vatdns/internal/dnshaiku.Version=..."
+var Version = "dev"
+
+// Listeners that must be bound before dnshaiku reports itself as ready
+var requiredListeners = []string{"dns-udp", "dns-tcp", "http-endpoint", "http-data"}
+
+var (
+	startTime     = time.Now()
+	boundListener sync.Map
+	lastDiscovery atomic.Int64
+)
+
+type StatusResponse struct {
+	Version       string          `json:"version"`
+	Uptime        string          `json:"uptime"`
+	UptimeSeconds int64           `json:"uptime_seconds"`
+	ConfigHash    string          `json:"config_hash"`
+	Ready         bool            `json:"ready"`
+	NotReady      []string        `json:"not_ready,omitempty"`
+	GeoIPLoaded   bool            `json:"geoip_loaded"`
+	Listeners     map[string]bool `json:"listeners"`
+	Registry      RegistrySummary `json:"registry"`
+	LastDiscovery *time.Time      `json:"last_discovery,omitempty"`
+	Servers       []ServerStatus  `json:"servers"`
+}
+
+type RegistrySummary struct {
+	Total          int `json:"total"`
+	Accepting      int `json:"accepting"`
+	CurrentUsers   int `json:"current_users"`
+	MaxUsers       int `json:"max_users"`
+	RemainingSlots int `json:"remaining_slots"`
+}
+
+type ServerStatus struct {
+	Name           string     `json:"name"`
+	IpAddress      string     `json:"ip_address"`
+	Accepting      bool       `json:"accepting"`
+	RemainingSlots int        `json:"remaining_slots"`
+	LastPolled     *time.Time `json:"last_polled,omitempty"`
+}
+
+func markListenerBound(name string) {
+	boundListener.Store(name, true)
+}
+
+func markListenerClosed(name string) {
+	boundListener.Store(name, false)
+}
+
+func listenerBound(name string) bool {
+	bound, ok := boundListener.Load(name)
+	return ok && bound.(bool)
+}
+
+func registrySummary() RegistrySummary {
+	summary := RegistrySummary{}
+	fsdServers.Range(func(k, v interface{}) bool {
+		fsdServerStruct := v.(*common.FSDServer)
+		summary.Total++
+		summary.CurrentUsers += fsdServerStruct.CurrentUsers
+		summary.MaxUsers += fsdServerStruct.MaxUsers
+		if fsdServerStruct.AcceptingConnections() == 1 {
+			summary.Accepting++
+			summary.RemainingSlots += fsdServerStruct.RemainingSlots
+		}
+		return true
+	})
+	return summary
+}
+
+// readiness returns the reasons dnshaiku should not be taking traffic yet. An empty slice means ready.
+func readiness() []string {
+	notReady := make([]string, 0)
+	if draining.Load() {
+		notReady = append(notReady, "shutting down")
+	}
+	if db == nil {
+		notReady = append(notReady, "GeoIP database not loaded")
+	}
+	for _, name := range requiredListeners {
+		if !listenerBound(name) {
+			notReady = append(notReady, fmt.Sprintf("listener %s not bound", name))
+		}
+	}
+	minAccepting := cfg().ReadyMinAcceptingServers
+	if accepting := registrySummary().Accepting; accepting < minAccepting {
+		notReady = append(notReady, fmt.Sprintf("%d servers accepting connections, need %d", accepting, minAccepting))
+	}
+	return notReady
+}
+
+// configHash fingerprints the running config so two instances can be compared. Secrets are left out,
+// since /status is public and a short hash of a guessable token could be checked offline.
+func configHash() string {
+	settings, err := json.Marshal(cfg().withoutSecrets())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(settings)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func buildStatus() StatusResponse {
+	uptime := time.Since(startTime).Truncate(time.Second)
+	notReady := readiness()
+	status := StatusResponse{
+		Version:       Version,
+		Uptime:        uptime.String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		ConfigHash:    configHash(),
+		Ready:         len(notReady) == 0,
+		NotReady:      notReady,
+		GeoIPLoaded:   db != nil,
+		Listeners:     make(map[string]bool),
+		Registry:      registrySummary(),
+		Servers:       make([]ServerStatus, 0),
+	}
+	for _, name := range requiredListeners {
+		status.Listeners[name] = listenerBound(name)
+	}
+	if discovered := lastDiscovery.Load(); discovered != 0 {
+		t := time.Unix(discovered, 0).UTC()
+		status.LastDiscovery = &t
+	}
+	fsdServers.Range(func(k, v interface{}) bool {
+		fsdServerStruct := v.(*common.FSDServer)
+		serverStatus := ServerStatus{
+			Name:           fsdServerStruct.Name,
+			IpAddress:      fsdServerStruct.IpAddress,
+			Accepting:      fsdServerStruct.AcceptingConnections() == 1,
+			RemainingSlots: fsdServerStruct.RemainingSlots,
+		}
+		if !fsdServerStruct.LastPolled.IsZero() {
+			t := fsdServerStruct.LastPolled.UTC()
+			serverStatus.LastPolled = &t
+		}
+		status.Servers = append(status.Servers, serverStatus)
+		return true
+	})
+	return status
+}
+
+// registerHealthHandlers adds /livez, /readyz and /status to the given mux
+func registerHealthHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		notReady := readiness()
+		if len(notReady) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			for _, reason := range notReady {
+				w.Write([]byte(reason + "\n"))
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(buildStatus())
+	})
+}
+
+// HealthCheck probes a running dnshaiku's health endpoint, returning an error if it is not healthy.
+// Used by `dnshaiku healthcheck` as a Docker HEALTHCHECK.
+func HealthCheck(addr string, endpoint string, timeout time.Duration) error {
+	client := http.Client{
+		Timeout: timeout,
+	}
+	resp, err := client.Get(fmt.Sprintf("http://%s/%s", addr, endpoint))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	return nil
+}
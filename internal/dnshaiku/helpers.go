@@ -1,22 +1,158 @@
 package dnshaiku
 
 import (
+	_ "embed"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 )
 
+//go:embed cloudflare_ips.txt
+var builtinCloudflareRanges string
+
+// proxyTrust holds the proxies whose forwarding headers we believe
+type proxyTrust struct {
+	trusted    []*net.IPNet
+	cloudflare []*net.IPNet
+}
+
+// IpToIpNET parses an IP address that may have a port and IPv6 brackets or zone attached,
+// e.g. 192.0.2.1:53, [2001:db8::1]:53 or fe80::1%eth0. Returns nil if it isn't an IP.
 func IpToIpNET(ip string) net.IP {
-	return net.ParseIP(strings.Split(ip, ":")[0])
+	ip = strings.TrimSpace(ip)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if zone := strings.IndexByte(ip, '%'); zone != -1 {
+		ip = ip[:zone]
+	}
+	return net.ParseIP(ip)
+}
+
+// parseCIDRLines parses a file of CIDRs, one per line, ignoring blank lines and # comments
+func parseCIDRLines(contents string) ([]*net.IPNet, error) {
+	entries := make([]string, 0)
+	for _, line := range strings.Split(contents, "\n") {
+		if comment := strings.IndexByte(line, '#'); comment != -1 {
+			line = line[:comment]
+		}
+		entries = append(entries, strings.TrimSpace(line))
+	}
+	return parseCIDRList(strings.Join(entries, ","))
+}
+
+// loadProxyTrust builds the trusted proxy set from TRUSTED_PROXIES, a comma separated CIDR list, and
+// optionally Cloudflare's ranges, from TRUSTED_PROXIES_CLOUDFLARE_FILE or the built-in list.
+func loadProxyTrust(trustedProxies string, trustCloudflare bool, cloudflareFile string) (*proxyTrust, error) {
+	trusted, err := parseCIDRList(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	pt := &proxyTrust{trusted: trusted}
+	if !trustCloudflare {
+		return pt, nil
+	}
+	ranges := builtinCloudflareRanges
+	if cloudflareFile != "" {
+		contents, err := os.ReadFile(cloudflareFile)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES_CLOUDFLARE_FILE: %w", err)
+		}
+		ranges = string(contents)
+	}
+	pt.cloudflare, err = parseCIDRLines(ranges)
+	if err != nil {
+		return nil, fmt.Errorf("cloudflare ranges: %w", err)
+	}
+	return pt, nil
+}
+
+func (pt *proxyTrust) isTrusted(ip net.IP) bool {
+	return ipInNets(ip, pt.trusted) || ipInNets(ip, pt.cloudflare)
+}
+
+// forwardedFor returns the for= addresses of RFC 7239 Forwarded headers, client first
+func forwardedFor(header http.Header) []string {
+	hops := make([]string, 0)
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// xForwardedFor returns the addresses of X-Forwarded-For headers, client first
+func xForwardedFor(header http.Header) []string {
+	hops := make([]string, 0)
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// clientIp works out the real client of a request. Forwarding headers are only believed when they
+// were added by a trusted proxy: the chain from Forwarded (or X-Forwarded-For) plus the connecting
+// peer is walked right to left, skipping trusted hops, and the first untrusted hop is the client.
+// A Cloudflare hop hands over to CF-Connecting-IP. X-Real-Ip is used if a trusted peer sent no chain.
+func (pt *proxyTrust) clientIp(r *http.Request) net.IP {
+	remote := IpToIpNET(r.RemoteAddr)
+	if remote == nil || !pt.isTrusted(remote) {
+		return remote
+	}
+	chain := forwardedFor(r.Header)
+	if len(chain) == 0 {
+		chain = xForwardedFor(r.Header)
+	}
+	if len(chain) == 0 {
+		if realIp := IpToIpNET(r.Header.Get("X-Real-Ip")); realIp != nil && !ipInNets(remote, pt.cloudflare) {
+			return realIp
+		}
+	}
+
+	client := remote
+	hop := remote
+	for i := len(chain); ; i-- {
+		if ipInNets(hop, pt.cloudflare) {
+			if cfIp := IpToIpNET(r.Header.Get("CF-Connecting-IP")); cfIp != nil {
+				return cfIp
+			}
+		}
+		if !pt.isTrusted(hop) {
+			return hop
+		}
+		client = hop
+		if i == 0 {
+			break
+		}
+		hop = IpToIpNET(chain[i-1])
+		if hop == nil {
+			// Garbage or an obfuscated identifier, nothing further left can be trusted
+			break
+		}
+	}
+	return client
 }
 
+// GetUserIPAddressHTTP returns the address of the client making an HTTP request, taking trusted proxies into account
 func GetUserIPAddressHTTP(r *http.Request) string {
-	IPAddress := r.Header.Get("X-Real-Ip")
-	if IPAddress == "" {
-		IPAddress = r.Header.Get("X-Forwarded-For")
+	pt := cfg().proxyTrust
+	if pt == nil {
+		pt = &proxyTrust{}
 	}
-	if IPAddress == "" {
-		IPAddress = r.RemoteAddr
+	client := pt.clientIp(r)
+	if client == nil {
+		return ""
 	}
-	return IPAddress
+	return client.String()
 }
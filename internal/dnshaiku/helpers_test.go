@@ -0,0 +1,89 @@
+package dnshaiku
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestIpToIpNET(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:53", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]:53", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{"unknown", "<nil>"},
+		{"", "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			assert.Equal(t, tt.want, IpToIpNET(tt.in).String())
+		})
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	trusted, _ := parseCIDRList("10.0.0.0/8, 2001:db8:ffff::/48")
+	cloudflare, _ := parseCIDRLines(builtinCloudflareRanges)
+	pt := &proxyTrust{trusted: trusted, cloudflare: cloudflare}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		want       string
+	}{
+		{"direct client", "198.51.100.7:5555", nil, "198.51.100.7"},
+		{"direct IPv6 client", "[2001:db8:1::7]:5555", nil, "2001:db8:1::7"},
+		{"untrusted peer spoofing headers", "198.51.100.7:5555", map[string][]string{
+			"X-Forwarded-For":  {"203.0.113.9"},
+			"X-Real-Ip":        {"203.0.113.9"},
+			"Cf-Connecting-Ip": {"203.0.113.9"},
+			"Forwarded":        {"for=203.0.113.9"},
+		}, "198.51.100.7"},
+		{"trusted proxy with X-Real-Ip", "10.0.0.2:80", map[string][]string{"X-Real-Ip": {"203.0.113.9"}}, "203.0.113.9"},
+		{"trusted proxy with XFF", "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"XFF chain skips trusted hops", "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7, 10.0.0.3"}}, "198.51.100.7"},
+		{"XFF spread over headers", "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 203.0.113.9", "10.0.0.3"}}, "203.0.113.9"},
+		{"XFF with IPv6 and ports", "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"[2001:db8:1::7]:1234, 10.0.0.3:80"}}, "2001:db8:1::7"},
+		{"XFF garbage stops at trusted hop", "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"203.0.113.9, garbage, 10.0.0.3"}}, "10.0.0.3"},
+		{"all hops trusted", "10.0.0.2:80", map[string][]string{"X-Forwarded-For": {"10.0.0.4, 10.0.0.3"}}, "10.0.0.4"},
+		{"Forwarded preferred over XFF", "10.0.0.2:80", map[string][]string{
+			"Forwarded":       {`for=203.0.113.9;proto=https, for="[2001:db8:ffff::1]:443"`},
+			"X-Forwarded-For": {"198.51.100.7"},
+		}, "203.0.113.9"},
+		{"Forwarded quoted IPv6", "[2001:db8:ffff::2]:80", map[string][]string{"Forwarded": {`For="[2001:db8:1::7]:4711"`}}, "2001:db8:1::7"},
+		{"Forwarded obfuscated identifier", "10.0.0.2:80", map[string][]string{"Forwarded": {"for=_hidden, for=10.0.0.3"}}, "10.0.0.3"},
+		{"Cloudflare peer", "162.158.1.1:443", map[string][]string{
+			"Cf-Connecting-Ip": {"203.0.113.9"},
+			"X-Forwarded-For":  {"198.51.100.7"},
+		}, "203.0.113.9"},
+		{"Cloudflare behind trusted load balancer", "10.0.0.2:80", map[string][]string{
+			"Cf-Connecting-Ip": {"2001:db8:1::7"},
+			"X-Forwarded-For":  {"2001:db8:1::7, 172.64.0.5"},
+		}, "2001:db8:1::7"},
+		{"spoofed Cloudflare hop through load balancer", "10.0.0.2:80", map[string][]string{
+			"Cf-Connecting-Ip": {"203.0.113.9"},
+			"X-Forwarded-For":  {"172.64.0.5, 198.51.100.7"},
+		}, "198.51.100.7"},
+		{"Cloudflare peer without CF-Connecting-IP", "162.158.1.1:443", map[string][]string{"X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, values := range tt.headers {
+				for _, v := range values {
+					r.Header.Add(k, v)
+				}
+			}
+			assert.Equal(t, tt.want, pt.clientIp(r).String())
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package dnshaiku
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// dnshaiku's metrics are registered here rather than the global registry, served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	dnsRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_dnshaiku_dns_requests_total",
+		Help: "DNS requests answered, by transport, query type, response code and name.",
+	}, []string{"transport", "qtype", "rcode", "qname"})
+	dnsRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vatdns_dnshaiku_dns_request_duration_seconds",
+		Help:    "Time taken to answer DNS requests, by transport.",
+		Buckets: []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1},
+	}, []string{"transport"})
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_dnshaiku_http_requests_total",
+		Help: "HTTP endpoint requests answered, by path and status code.",
+	}, []string{"path", "code"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vatdns_dnshaiku_http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP endpoint requests, by path.",
+		Buckets: []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1},
+	}, []string{"path"})
+	serverSelections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_dnshaiku_server_selections_total",
+		Help: "FSD servers handed out, by server and the client's GeoIP country.",
+	}, []string{"server", "client_country"})
+	geoipFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vatdns_dnshaiku_geoip_failures_total",
+		Help: "GeoIP lookups that failed.",
+	})
+	selectionFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_dnshaiku_selection_fallbacks_total",
+		Help: "Requests not given a server by location, by why and which fallback was used: default, most_slots, any or none.",
+	}, []string{"reason", "fallback"})
+	panicsRecovered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_dnshaiku_panics_recovered_total",
+		Help: "Panics recovered in request handlers, by handler.",
+	}, []string{"handler"})
+	discoveryDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "vatdns_dnshaiku_discovery_duration_seconds",
+		Help:    "Time taken to list FSD servers by DigitalOcean tag.",
+		Buckets: prometheus.DefBuckets,
+	})
+	discoveryErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vatdns_dnshaiku_discovery_errors_total",
+		Help: "Failed attempts to list FSD servers by DigitalOcean tag.",
+	})
+	pollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vatdns_dnshaiku_poll_duration_seconds",
+		Help:    "Time taken to poll an FSD server's metrics.",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2},
+	}, []string{"server"})
+	pollErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_dnshaiku_poll_errors_total",
+		Help: "Failed polls of an FSD server's metrics.",
+	}, []string{"server"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		dnsRequests,
+		dnsRequestDuration,
+		httpRequests,
+		httpRequestDuration,
+		serverSelections,
+		geoipFailures,
+		selectionFallbacks,
+		panicsRecovered,
+		discoveryDuration,
+		discoveryErrors,
+		pollDuration,
+		pollErrors,
+		newRegistryCollector(),
+		newQueryLogCollector(),
+	)
+	common.SetPollObserver(observePoll)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// metricQname keeps the qname label to the names we serve so it can't be used to create series
+func metricQname(qname string) string {
+	switch qname {
+	case dns.Fqdn(cfg().HostnameToServe), "fsd.connect.vatsim.net.", "fsd-http.connect.vatsim.net.", servedZone:
+		return qname
+	}
+	return "other"
+}
+
+func observeDnsRequest(transport string, r *dns.Msg, m *dns.Msg, duration time.Duration) {
+	qtype := "none"
+	qname := "none"
+	if len(r.Question) > 0 {
+		qtype = dns.TypeToString[r.Question[0].Qtype]
+		qname = metricQname(dns.CanonicalName(r.Question[0].Name))
+	}
+	dnsRequests.WithLabelValues(transport, qtype, dns.RcodeToString[m.Rcode], qname).Inc()
+	dnsRequestDuration.WithLabelValues(transport).Observe(duration.Seconds())
+}
+
+func observePoll(server string, duration time.Duration, err error) {
+	pollDuration.WithLabelValues(server).Observe(duration.Seconds())
+	if err != nil {
+		pollErrors.WithLabelValues(server).Inc()
+	}
+}
+
+// forgetServerMetrics removes the series of a server that has left the registry
+func forgetServerMetrics(server string) {
+	pollDuration.DeleteLabelValues(server)
+	pollErrors.DeleteLabelValues(server)
+	serverSelections.DeletePartialMatch(prometheus.Labels{"server": server})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentHttp counts, times and traces requests to the HTTP endpoint, continuing any trace
+// in the request headers. Paths other than the ones served are counted as other.
+func instrumentHttp(handler http.Handler, paths ...string) http.Handler {
+	known := make(map[string]bool)
+	for _, path := range paths {
+		known[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		path := r.URL.Path
+		if !known[path] {
+			path = "other"
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, fmt.Sprintf("%s %s", r.Method, path), trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", path),
+		)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+		httpRequests.WithLabelValues(path, strconv.Itoa(recorder.status)).Inc()
+		httpRequestDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+	})
+}
+
+// registryCollector exports the number of FSD servers known and accepting connections
+type registryCollector struct {
+	servers *prometheus.Desc
+}
+
+func newRegistryCollector() *registryCollector {
+	return &registryCollector{
+		servers: prometheus.NewDesc("vatdns_dnshaiku_registry_servers",
+			"FSD servers in the registry, by whether they are accepting connections.",
+			[]string{"accepting"}, nil,
+		),
+	}
+}
+
+func (collector *registryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.servers
+}
+
+func (collector *registryCollector) Collect(ch chan<- prometheus.Metric) {
+	summary := registrySummary()
+	ch <- prometheus.MustNewConstMetric(collector.servers, prometheus.GaugeValue, float64(summary.Accepting), "true")
+	ch <- prometheus.MustNewConstMetric(collector.servers, prometheus.GaugeValue, float64(summary.Total-summary.Accepting), "false")
+}
+
+// queryLogCollector exports what has happened to query log entries
+type queryLogCollector struct {
+	entries  *prometheus.Desc
+	errors   *prometheus.Desc
+	buffered *prometheus.Desc
+}
+
+func newQueryLogCollector() *queryLogCollector {
+	return &queryLogCollector{
+		entries: prometheus.NewDesc("vatdns_dnshaiku_query_log_entries_total",
+			"Query log entries, by whether they were written, sampled out or dropped because the buffer was full.",
+			[]string{"outcome"}, nil,
+		),
+		errors: prometheus.NewDesc("vatdns_dnshaiku_query_log_errors_total",
+			"Query log sink write errors.",
+			nil, nil,
+		),
+		buffered: prometheus.NewDesc("vatdns_dnshaiku_query_log_buffered",
+			"Query log entries waiting to be written.",
+			nil, nil,
+		),
+	}
+}
+
+func (collector *queryLogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.entries
+	ch <- collector.errors
+	ch <- collector.buffered
+}
+
+func (collector *queryLogCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := queryLog.Stats()
+	ch <- prometheus.MustNewConstMetric(collector.entries, prometheus.CounterValue, float64(stats.Written), "written")
+	ch <- prometheus.MustNewConstMetric(collector.entries, prometheus.CounterValue, float64(stats.SampledOut), "sampled_out")
+	ch <- prometheus.MustNewConstMetric(collector.entries, prometheus.CounterValue, float64(stats.Dropped), "dropped")
+	ch <- prometheus.MustNewConstMetric(collector.errors, prometheus.CounterValue, float64(stats.Errors))
+	ch <- prometheus.MustNewConstMetric(collector.buffered, prometheus.GaugeValue, float64(stats.Buffered))
+}
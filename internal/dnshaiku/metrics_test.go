@@ -0,0 +1,65 @@
+package dnshaiku
+
+import (
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFsdServersCollectorExportsGauges(t *testing.T) {
+	fsdServers.Store("fsd.uk.vatsim.net", common.NewMockFSDServer(&common.FSDServer{
+		Name: "fsd.uk.vatsim.net", IpAddress: "192.0.2.1", CurrentUsers: 10, MaxUsers: 300, RemainingSlots: 290, AbleToUpdate: true,
+	}))
+	t.Cleanup(func() { fsdServers.Delete("fsd.uk.vatsim.net") })
+
+	expected := `
+# HELP vatdns_dnshaiku_current_users Current amount of users connected server.
+# TYPE vatdns_dnshaiku_current_users gauge
+vatdns_dnshaiku_current_users{server="fsd.uk.vatsim.net"} 10
+# HELP vatdns_dnshaiku_remaining_slots Remaining slots on a server
+# TYPE vatdns_dnshaiku_remaining_slots gauge
+vatdns_dnshaiku_remaining_slots{server="fsd.uk.vatsim.net"} 290
+`
+	collector := newFsdServersCollector(&common.FSDServer{Name: "fsd.uk.vatsim.net"})
+	assert.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"vatdns_dnshaiku_current_users", "vatdns_dnshaiku_remaining_slots"))
+
+	// A server removed before its collector is unregistered exports nothing rather than panicking
+	gone := newFsdServersCollector(&common.FSDServer{Name: "fsd.gone.vatsim.net"})
+	assert.Equal(t, 0, testutil.CollectAndCount(gone))
+}
+
+func TestObserveDnsRequest(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("FSD.connect.vatsim.net.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(r)
+	observeDnsRequest("udp", r, m, time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(dnsRequests.WithLabelValues("udp", "A", "NOERROR", "fsd.connect.vatsim.net.")))
+
+	// Names we don't serve share one series
+	r.SetQuestion("random-1234.example.com.", dns.TypeAAAA)
+	m.SetRcode(r, dns.RcodeRefused)
+	observeDnsRequest("tcp", r, m, time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(dnsRequests.WithLabelValues("tcp", "AAAA", "REFUSED", "other")))
+}
+
+func TestInstrumentHttp(t *testing.T) {
+	handler := instrumentHttp(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/connect" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("{}"))
+	}), "/", "/v1/connect")
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/connect", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/wp-login.php", nil))
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("/v1/connect", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(httpRequests.WithLabelValues("other", "404")))
+}
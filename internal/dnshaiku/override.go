@@ -0,0 +1,108 @@
+package dnshaiku
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// EDNS0 local option carrying the raw 4 or 16 byte source IP to geolocate instead of the requester.
+// 65001 is in the local/experimental range reserved by RFC 6891.
+const EDNS0SourceIpOverride = 65001
+
+// parseCIDRList parses a comma separated list of CIDRs or bare IPs
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// overrideAllowed reports whether a DNS request from source may override the IP used for geolocation
+func overrideAllowed(source net.IP) bool {
+	return ipInNets(source, cfg().overrideAllowedSources)
+}
+
+// dnsOverrideIp returns the IP a DNS request asked to be geolocated as, from either the
+// EDNS0SourceIpOverride local option or an ECS option, along with the ECS option if one was used.
+// Returns nil if the request carries no override.
+func dnsOverrideIp(r *dns.Msg) (net.IP, *dns.EDNS0_SUBNET) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, nil
+	}
+	var ecsIp net.IP
+	var ecs *dns.EDNS0_SUBNET
+	for _, o := range opt.Option {
+		switch e := o.(type) {
+		case *dns.EDNS0_LOCAL:
+			if e.Code == EDNS0SourceIpOverride && (len(e.Data) == net.IPv4len || len(e.Data) == net.IPv6len) {
+				return net.IP(e.Data), nil
+			}
+		case *dns.EDNS0_SUBNET:
+			if e.Address != nil {
+				ecsIp = e.Address
+				ecs = e
+			}
+		}
+	}
+	return ecsIp, ecs
+}
+
+// dnsClientIp works out which IP a DNS request should be geolocated as. Overrides are only honoured
+// from sources in DNS_OVERRIDE_ALLOWED_SOURCES, otherwise the requester's address is used.
+func dnsClientIp(remoteAddr net.Addr, r *dns.Msg) (net.IP, *dns.EDNS0_SUBNET) {
+	sourceIp := IpToIpNET(remoteAddr.String())
+	overrideIp, ecs := dnsOverrideIp(r)
+	if overrideIp == nil {
+		return sourceIp, nil
+	}
+	if !overrideAllowed(sourceIp) {
+		logger.Debug(fmt.Sprintf("Ignoring source IP override %s from %s", overrideIp, sourceIp))
+		return sourceIp, nil
+	}
+	return overrideIp, ecs
+}
+
+// httpClientIp works out which IP an HTTP request should be geolocated as. The ?ip= parameter
+// is only honoured on requests carrying admin credentials.
+func httpClientIp(r *http.Request) net.IP {
+	if ipParam := r.URL.Query().Get("ip"); ipParam != "" {
+		if overrideIp := net.ParseIP(ipParam); overrideIp != nil && adminActor(r) != "" {
+			return overrideIp
+		}
+	}
+	return IpToIpNET(GetUserIPAddressHTTP(r))
+}
@@ -1,16 +1,25 @@
 package dnshaiku
 
 import (
+	"context"
 	"fmt"
 	"github.com/jftuga/geodist"
 	"github.com/miekg/dns"
-	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
-	"log"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
 	"net"
 )
 
-func ParseQuery(m *dns.Msg, sourceIp net.Addr) {
+// The zone dnshaiku is authoritative for and its nameservers
+const servedZone = "connect.vatsim.net."
+
+// TODO: This should get turned into a variable or tags driven thing.
+var zoneNameservers = []string{"prod-vatdns-hj146.server.vatsim.net.", "prod-vatdns-ad137.server.vatsim.net."}
+
+// ParseQuery answers the questions in m for a client at sourceIpParsed. The FSD server handed out is
+// returned, or nil if no question asked for one. An error is returned if there was no server to hand out.
+func ParseQuery(ctx context.Context, m *dns.Msg, sourceIpParsed net.IP) (*common.FSDServer, error) {
+	var server *common.FSDServer
 	m.RecursionAvailable = false
 	m.RecursionDesired = false
 	m.Authoritative = true
@@ -19,27 +28,28 @@ func ParseQuery(m *dns.Msg, sourceIp net.Addr) {
 		switch q.Qtype {
 		case dns.TypeA:
 			if q.Name != "fsd-http.connect.vatsim.net." {
-				sourceIpParsed := net.IP{}
-				if dnsIpOverride == "" {
-					sourceIpParsed = IpToIpNET(sourceIp.String())
+				var country string
+				record, err := geoLocate(ctx, sourceIpParsed)
+				if err != nil {
+					logger.Error(fmt.Sprintf("GeoIP lookup for %s failed: %s", sourceIpParsed, err))
+					server, err = pickFallback(ctx, &fsdServers, fallbackGeoIPFailed)
 				} else {
-					sourceIpParsed = net.ParseIP(dnsIpOverride)
+					country = record.Country.IsoCode
+					sourceIpLatLng := geodist.Coord{Lat: record.Location.Latitude, Lon: record.Location.Longitude}
+					server, err = PickServerToReturn(ctx, sourceIpLatLng)
 				}
-				record, err := db.City(sourceIpParsed)
 				if err != nil {
-					log.Panic(err)
+					return nil, err
 				}
-				sourceIpLatLng := geodist.Coord{Lat: record.Location.Latitude, Lon: record.Location.Longitude}
-				server := PickServerToReturn(sourceIpLatLng)
+				serverSelections.WithLabelValues(server.Name, country).Inc()
 
-				rr, err := dns.NewRR(fmt.Sprintf("%s %s IN A %s", q.Name, viper.GetString("DNS_TTL"), server.IpAddress))
+				rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A %s", q.Name, cfg().DnsTTL, server.IpAddress))
 
 				if err == nil {
 					m.Answer = append(m.Answer, rr)
 				}
-				logger.Info(fmt.Sprintf("DNS | IP: %s Served: %s", sourceIpParsed.String(), server.Name))
 			} else {
-				rr, err := dns.NewRR(fmt.Sprintf("%s %s IN A %s", q.Name, viper.GetString("DNS_TTL"), publicIp))
+				rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A %s", q.Name, cfg().DnsTTL, publicIp))
 				if err == nil {
 					m.Answer = append(m.Answer, rr)
 				}
@@ -48,10 +58,9 @@ func ParseQuery(m *dns.Msg, sourceIp net.Addr) {
 		case dns.TypeSOA:
 			logger.Info("Served SOA record request")
 			record := new(dns.SOA)
-			// TODO: This should get turned into a variable or tags driven thing.
-			record.Hdr = dns.RR_Header{Name: "connect.vatsim.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 1}
-			record.Ns = "prod-vatdns-hj146.server.vatsim.net."
-			record.Mbox = "prod-vatdns-ad137.server.vatsim.net."
+			record.Hdr = dns.RR_Header{Name: servedZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 1}
+			record.Ns = zoneNameservers[0]
+			record.Mbox = zoneNameservers[1]
 			record.Serial = 1
 			record.Refresh = 3600
 			record.Retry = 600
@@ -60,11 +69,8 @@ func ParseQuery(m *dns.Msg, sourceIp net.Addr) {
 			m.Answer = append(m.Answer, record)
 		case dns.TypeNS:
 			logger.Info("Served NS record request")
-			// TODO: This should get turned into a variable or tags driven thing.
-			vatdnsServers := []string{"prod-vatdns-hj146.server.vatsim.net", "prod-vatdns-ad137.server.vatsim.net"}
-			for _, server := range vatdnsServers {
-				// TODO: This should get turned into a variable or tags driven thing.
-				rr, err := dns.NewRR(fmt.Sprintf("%s %s IN NS %s", "connect.vatsim.net", "60", server))
+			for _, server := range zoneNameservers {
+				rr, err := dns.NewRR(fmt.Sprintf("%s %s IN NS %s", servedZone, "60", server))
 				if err == nil {
 					m.Answer = append(m.Answer, rr)
 				}
@@ -72,4 +78,5 @@ func ParseQuery(m *dns.Msg, sourceIp net.Addr) {
 		}
 
 	}
+	return server, nil
 }
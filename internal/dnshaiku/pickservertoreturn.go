@@ -1,74 +1,179 @@
 package dnshaiku
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/jftuga/geodist"
-	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
 	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"go.opentelemetry.io/otel/attribute"
 	"sort"
+	"sync"
 )
 
-func PickServerToReturn(sourceIpLatLng geodist.Coord) *common.FSDServer {
+// Candidate is an FSD server considered for a request, with its distance from the requester.
+// Candidates are ordered by Tier, lowest first, then by Score, highest first.
+type Candidate struct {
+	Server        *common.FSDServer
+	DistanceMiles float64
+	// Tier is 0 for servers in the same country as the closest server and 1 for everything else
+	Tier int
+	// Score is remaining slots less SELECTION_DISTANCE_WEIGHT slots per mile in tier 0, and negative distance in tier 1
+	Score float64
+}
+
+// rankServers returns the servers accepting connections in the order they should be handed out.
+// Servers in the same country as the closest server come first, by most remaining slots less
+// SELECTION_DISTANCE_WEIGHT slots per mile, followed by every other server by distance.
+func rankServers(servers *sync.Map, sourceIpLatLng geodist.Coord) []Candidate {
 	// Slices are easier for sorting
-	initialServers := make([]common.FSDServer, 0)
-	finalServers := make([]common.FSDServer, 0)
+	initialServers := make([]Candidate, 0)
 
 	// Get servers into a slice, skipping those that are not accepting connections
-	fsdServers.Range(func(k, v interface{}) bool {
+	servers.Range(func(k, v interface{}) bool {
 		fsdServerStruct := v.(*common.FSDServer)
 		if fsdServerStruct.AcceptingConnections() == 0 {
 			return true
 		}
 		miles, _, _ := geodist.VincentyDistance(sourceIpLatLng, geodist.Coord{Lat: fsdServerStruct.Latitude, Lon: fsdServerStruct.Longitude})
-		initialServers = append(initialServers, common.FSDServer{
-			Name:           fsdServerStruct.Name,
-			Distance:       miles,
-			RemainingSlots: fsdServerStruct.RemainingSlots,
-			IpAddress:      fsdServerStruct.IpAddress,
-			Country:        fsdServerStruct.Country,
+		initialServers = append(initialServers, Candidate{
+			Server:        fsdServerStruct,
+			DistanceMiles: miles,
 		})
 		return true
 	})
-
 	if len(initialServers) == 0 {
-		logger.Error("No servers possible for a request, using default FSD server")
-		fsdServer, _ := fsdServers.Load(viper.GetString("DEFAULT_FSD_SERVER"))
-		fsdServerStruct := fsdServer.(*common.FSDServer)
-		return fsdServerStruct
-
+		return initialServers
 	}
 
 	// Sort slice of servers by distance from request
-	sort.Slice(initialServers, func(i, j int) bool {
-		return initialServers[i].Distance < initialServers[j].Distance
+	sort.SliceStable(initialServers, func(i, j int) bool {
+		return initialServers[i].DistanceMiles < initialServers[j].DistanceMiles
 	})
 
 	// Get country for first server to be returned based upon distance
-	// and populate a new slice with other servers in that country
-	firstServer := initialServers[0].Country
-	for _, server := range initialServers {
-		if server.Country == firstServer {
-			finalServers = append(finalServers, server)
+	// and split out the other servers in that country
+	firstServer := initialServers[0].Server.Country
+	distanceWeight := cfg().SelectionDistanceWeight
+	finalServers := make([]Candidate, 0, len(initialServers))
+	otherServers := make([]Candidate, 0)
+	for _, candidate := range initialServers {
+		if candidate.Server.Country == firstServer {
+			candidate.Tier = 0
+			candidate.Score = float64(candidate.Server.RemainingSlots) - distanceWeight*candidate.DistanceMiles
+			finalServers = append(finalServers, candidate)
+		} else {
+			candidate.Tier = 1
+			candidate.Score = -candidate.DistanceMiles
+			otherServers = append(otherServers, candidate)
 		}
 	}
 
-	// Sort slice by remaining slots
-	sort.Slice(finalServers, func(i, j int) bool {
-		return finalServers[i].RemainingSlots > finalServers[j].RemainingSlots
+	// Sort the closest country by remaining slots, weighted by distance if configured
+	sort.SliceStable(finalServers, func(i, j int) bool {
+		return finalServers[i].Score > finalServers[j].Score
+	})
+
+	return append(finalServers, otherServers...)
+}
+
+// Why a request was given a fallback server rather than one picked by location
+const (
+	fallbackNoAcceptingServers = "no_accepting_servers"
+	fallbackGeoIPFailed        = "geoip_failed"
+)
+
+// errNoServers is returned when the registry has no server to hand out at all
+var errNoServers = errors.New("no FSD servers in the registry")
+
+// fallbackServer picks a server without the requester's location. DEFAULT_FSD_SERVER is used if it is
+// in the registry, then the server that last polled successfully with the most remaining slots, then
+// any server. The step used is returned with the server, nil is returned if the registry is empty.
+func fallbackServer(servers *sync.Map) (*common.FSDServer, string) {
+	if fsdServer, found := servers.Load(cfg().DefaultFSDServer); found {
+		return fsdServer.(*common.FSDServer), "default"
+	}
+	var mostSlots, anyServer *common.FSDServer
+	servers.Range(func(k, v interface{}) bool {
+		fsdServerStruct := v.(*common.FSDServer)
+		if anyServer == nil || fsdServerStruct.Name < anyServer.Name {
+			anyServer = fsdServerStruct
+		}
+		if fsdServerStruct.AbleToUpdate && (mostSlots == nil || fsdServerStruct.RemainingSlots > mostSlots.RemainingSlots) {
+			mostSlots = fsdServerStruct
+		}
+		return true
 	})
+	if mostSlots != nil {
+		return mostSlots, "most_slots"
+	}
+	if anyServer != nil {
+		return anyServer, "any"
+	}
+	return nil, "none"
+}
+
+// pickFallback returns a server from fallbackServer for a request that could not be given one by
+// location, or errNoServers
+func pickFallback(ctx context.Context, servers *sync.Map, reason string) (*common.FSDServer, error) {
+	_, span := tracer.Start(ctx, "select_fallback_server")
+	defer span.End()
+	fsdServerStruct, fallback := fallbackServer(servers)
+	selectionFallbacks.WithLabelValues(reason, fallback).Inc()
+	span.SetAttributes(attribute.String("vatdns.fallback_reason", reason), attribute.String("vatdns.fallback", fallback))
+	if fsdServerStruct == nil {
+		logger.Error(fmt.Sprintf("No server to return for a request (%s)", reason))
+		endSpanWithError(span, errNoServers)
+		return nil, errNoServers
+	}
+	logger.Error(fmt.Sprintf("No server picked by location for a request (%s), returning %s (%s)", reason, fsdServerStruct.Name, fallback))
+	if reason == fallbackNoAcceptingServers {
+		alertAllServersFull(fallback, fsdServerStruct.Name)
+	}
+	setServerAttributes(span, fsdServerStruct.Name, fsdServerStruct.IpAddress)
+	return fsdServerStruct, nil
+}
+
+// Selection is the server picked for a requester and the other servers accepting connections, in the
+// order they would have been picked
+type Selection struct {
+	Winner Candidate
+	// Alternates is empty when Winner is a fallback server
+	Alternates []Candidate
+}
+
+// selectServer picks the best server from servers for a requester and reserves a slot on it.
+// Value returned should be the closest server to a user with the most available slots. If no
+// server is accepting connections the fallbackServer chain is used.
+func selectServer(ctx context.Context, servers *sync.Map, sourceIpLatLng geodist.Coord) (Selection, error) {
+	ctx, span := tracer.Start(ctx, "select_server")
+	defer span.End()
+	ranked := rankServers(servers, sourceIpLatLng)
+	setSelectionAttributes(span, ranked)
+	if len(ranked) == 0 {
+		fsdServerStruct, err := pickFallback(ctx, servers, fallbackNoAcceptingServers)
+		if err != nil {
+			return Selection{}, err
+		}
+		miles, _, _ := geodist.VincentyDistance(sourceIpLatLng, geodist.Coord{Lat: fsdServerStruct.Latitude, Lon: fsdServerStruct.Longitude})
+		return Selection{Winner: Candidate{Server: fsdServerStruct, DistanceMiles: miles}, Alternates: make([]Candidate, 0)}, nil
+	}
+	fsdServerStruct := ranked[0].Server
+	fsdServerStruct.RemainingSlots -= 1
+	setServerAttributes(span, fsdServerStruct.Name, fsdServerStruct.IpAddress)
+	return Selection{Winner: ranked[0], Alternates: ranked[1:]}, nil
+}
 
-	// If no servers in the final slice return random otherwise return first element of finalServers
-	// Value returned from finalServers should be the closest server to a user with the most available slots
-	if len(finalServers) == 0 {
-		logger.Error("No server found for request returning random")
-		fsdServer, _ := fsdServers.Load(initialServers[0].Name)
-		fsdServerStruct := fsdServer.(*common.FSDServer)
-		fsdServerStruct.RemainingSlots -= 1
-		return fsdServerStruct
-	} else {
-		fsdServer, _ := fsdServers.Load(finalServers[0].Name)
-		fsdServerStruct := fsdServer.(*common.FSDServer)
-		fsdServerStruct.RemainingSlots -= 1
-		return fsdServerStruct
+// pickServer returns the server selectServer picks
+func pickServer(ctx context.Context, servers *sync.Map, sourceIpLatLng geodist.Coord) (*common.FSDServer, error) {
+	selection, err := selectServer(ctx, servers, sourceIpLatLng)
+	if err != nil {
+		return nil, err
 	}
+	return selection.Winner.Server, nil
+}
+
+func PickServerToReturn(ctx context.Context, sourceIpLatLng geodist.Coord) (*common.FSDServer, error) {
+	return pickServer(ctx, &fsdServers, sourceIpLatLng)
 }
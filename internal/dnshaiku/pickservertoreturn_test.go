@@ -0,0 +1,205 @@
+package dnshaiku
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jftuga/geodist"
+	"github.com/paulbellamy/ratecounter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"github.com/vatsimnetwork/vatdns/pkg/connect"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var london = geodist.Coord{Lat: 51.5072, Lon: -0.1276}
+
+func mockServers(servers ...common.FSDServer) *sync.Map {
+	registry := &sync.Map{}
+	for _, server := range servers {
+		server := server
+		registry.Store(server.Name, common.NewMockFSDServer(&server))
+	}
+	return registry
+}
+
+func TestRankServersPrefersClosestCountryByRemainingSlots(t *testing.T) {
+	registry := mockServers(
+		common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "192.0.2.1", MaxUsers: 300, RemainingSlots: 10, AbleToUpdate: true},
+		common.FSDServer{Name: "fsd.uk2.vatsim.net", IpAddress: "192.0.2.2", MaxUsers: 300, RemainingSlots: 200, AbleToUpdate: true},
+		common.FSDServer{Name: "fsd.ger.vatsim.net", IpAddress: "192.0.2.3", MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: true},
+		common.FSDServer{Name: "fsd.usa-e.vatsim.net", IpAddress: "192.0.2.4", MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: true},
+		common.FSDServer{Name: "fsd.ams.vatsim.net", IpAddress: "192.0.2.5", MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: false},
+	)
+	ranked := rankServers(registry, london)
+	names := make([]string, 0)
+	for _, candidate := range ranked {
+		names = append(names, candidate.Server.Name)
+	}
+	assert.Equal(t, []string{"fsd.uk2.vatsim.net", "fsd.uk.vatsim.net", "fsd.ger.vatsim.net", "fsd.usa-e.vatsim.net"}, names)
+	assert.Equal(t, 0, ranked[1].Tier)
+	assert.Equal(t, 1, ranked[2].Tier)
+}
+
+func TestPickServerReservesSlot(t *testing.T) {
+	registry := mockServers(
+		common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "192.0.2.1", MaxUsers: 300, RemainingSlots: 10, AbleToUpdate: true},
+	)
+	server, err := pickServer(context.Background(), registry, london)
+	assert.NoError(t, err)
+	assert.Equal(t, "fsd.uk.vatsim.net", server.Name)
+	assert.Equal(t, 9, server.RemainingSlots)
+}
+
+func TestSelectServerAlternates(t *testing.T) {
+	registry := mockServers(
+		common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "192.0.2.1", MaxUsers: 300, RemainingSlots: 10, AbleToUpdate: true},
+		common.FSDServer{Name: "fsd.uk2.vatsim.net", IpAddress: "192.0.2.2", MaxUsers: 300, RemainingSlots: 200, AbleToUpdate: true},
+		common.FSDServer{Name: "fsd.ger.vatsim.net", IpAddress: "192.0.2.3", MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: true},
+	)
+	selection, err := selectServer(context.Background(), registry, london)
+	require.NoError(t, err)
+	assert.Equal(t, "fsd.uk2.vatsim.net", selection.Winner.Server.Name)
+	assert.Equal(t, 199, selection.Winner.Server.RemainingSlots)
+	require.Len(t, selection.Alternates, 2)
+	assert.Equal(t, "fsd.uk.vatsim.net", selection.Alternates[0].Server.Name)
+	assert.Equal(t, 10, selection.Alternates[0].Server.RemainingSlots, "only the winner has a slot reserved")
+
+	// A fallback server has no alternates
+	registry = mockServers(common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "192.0.2.1", MaxUsers: 300, RemainingSlots: 10})
+	selection, err = selectServer(context.Background(), registry, london)
+	require.NoError(t, err)
+	assert.Equal(t, "fsd.uk.vatsim.net", selection.Winner.Server.Name)
+	assert.Empty(t, selection.Alternates)
+}
+
+func TestHandleConnect(t *testing.T) {
+	previousDb, previousCounter := db, dnsRateCounter
+	db = staticLocator{"192.0.2.10": {country: "GB", lat: 51.5072, lon: -0.1276}}
+	dnsRateCounter = ratecounter.NewRateCounter(time.Second)
+	registry := mockServers(
+		common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "198.51.100.1", MaxUsers: 300, CurrentUsers: 150, RemainingSlots: 150, AbleToUpdate: true},
+		common.FSDServer{Name: "fsd.ger.vatsim.net", IpAddress: "198.51.100.2", MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: true},
+	)
+	registry.Range(func(k, v interface{}) bool {
+		fsdServers.Store(k, v)
+		return true
+	})
+	t.Cleanup(func() {
+		db, dnsRateCounter = previousDb, previousCounter
+		fsdServers.Delete("fsd.uk.vatsim.net")
+		fsdServers.Delete("fsd.ger.vatsim.net")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/connect?count=2", nil)
+	req.RemoteAddr = "192.0.2.10:1234"
+	rec := httptest.NewRecorder()
+	handleConnect(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	response := connect.Response{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, "fsd.uk.vatsim.net", response.Server.Name)
+	assert.Equal(t, 0.5, response.Server.Load)
+	require.Len(t, response.Alternates, 1)
+	assert.Equal(t, "fsd.ger.vatsim.net", response.Alternates[0].Name)
+	uk, _ := fsdServers.Load("fsd.uk.vatsim.net")
+	assert.Equal(t, 149, uk.(*common.FSDServer).RemainingSlots)
+}
+
+func TestExplainSelectionDoesNotReserve(t *testing.T) {
+	registry := mockServers(
+		common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "192.0.2.1", MaxUsers: 300, RemainingSlots: 10, AbleToUpdate: true},
+		common.FSDServer{Name: "fsd.ger.vatsim.net", IpAddress: "192.0.2.3", MaxUsers: 0, AbleToUpdate: true},
+	)
+	explanation := Explanation{}
+	explainSelection(registry, london, &explanation)
+	assert.Equal(t, "fsd.uk.vatsim.net", explanation.Winner)
+	assert.Len(t, explanation.Candidates, 2)
+	assert.Equal(t, 1, explanation.Candidates[0].Rank)
+	assert.False(t, explanation.Candidates[1].Accepting)
+	assert.Equal(t, "max users is 0", explanation.Candidates[1].NotAcceptingReason)
+	uk, _ := registry.Load("fsd.uk.vatsim.net")
+	assert.Equal(t, 10, uk.(*common.FSDServer).RemainingSlots)
+}
+
+func TestExplainSelectionWithDistanceWeight(t *testing.T) {
+	currentConfig.Store(&Config{SelectionDistanceWeight: 1})
+	t.Cleanup(func() { currentConfig.Store(nil) })
+	registry := &sync.Map{}
+	registry.Store("fsd.uk.vatsim.net", &common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "192.0.2.1", Country: "uk", Latitude: 51.5072, Longitude: -0.1276, MaxUsers: 300, RemainingSlots: 100, AbleToUpdate: true})
+	registry.Store("fsd.uk2.vatsim.net", &common.FSDServer{Name: "fsd.uk2.vatsim.net", IpAddress: "192.0.2.2", Country: "uk", Latitude: 53.4808, Longitude: -2.2426, MaxUsers: 300, RemainingSlots: 200, AbleToUpdate: true})
+
+	explanation := Explanation{}
+	explainSelection(registry, london, &explanation)
+	// uk2 has more slots but is too far away for them to count
+	assert.Equal(t, "fsd.uk.vatsim.net", explanation.Winner)
+	assert.Equal(t, "fsd.uk.vatsim.net", explanation.Candidates[0].Name)
+	assert.Equal(t, 100.0, explanation.Candidates[0].Score)
+	assert.NotContains(t, explanation.Reason, "most remaining slots")
+	assert.Contains(t, explanation.Reason, "fsd.uk.vatsim.net has the highest score of the 2 servers accepting connections there, remaining slots less SELECTION_DISTANCE_WEIGHT (1) slots per mile: 100 slots less 0.0 for 0 miles is 100.0, ahead of fsd.uk2.vatsim.net with 200 slots less ")
+}
+
+func TestExplainEndpoint(t *testing.T) {
+	currentConfig.Store(&Config{AdminApiToken: "secret", HostnameToServe: "fsd.connect.vatsim.net", DefaultFSDServer: "fsd.ger.vatsim.net"})
+	previousDb := db
+	db = staticLocator{"192.0.2.10": {country: "GB", lat: 51.5072, lon: -0.1276}}
+	uk := common.NewMockFSDServer(&common.FSDServer{Name: "fsd.uk.vatsim.net", IpAddress: "198.51.100.1", Country: "GB", Latitude: 51.5, Longitude: -0.1, MaxUsers: 300, RemainingSlots: 10, AbleToUpdate: true})
+	fsdServers.Store(uk.Name, uk)
+	fsdServers.Store("fsd.ger.vatsim.net", common.NewMockFSDServer(&common.FSDServer{Name: "fsd.ger.vatsim.net", IpAddress: "198.51.100.2", Country: "DE", Latitude: 50.1, Longitude: 8.7, AbleToUpdate: true}))
+	t.Cleanup(func() {
+		currentConfig.Store(nil)
+		db = previousDb
+		fsdServers.Delete("fsd.uk.vatsim.net")
+		fsdServers.Delete("fsd.ger.vatsim.net")
+	})
+	mux := http.NewServeMux()
+	registerAdminHandlers(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	explain := func(query string, token string) (int, Explanation) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/explain?"+query, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		explanation := Explanation{}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&explanation))
+		}
+		return resp.StatusCode, explanation
+	}
+
+	status, explanation := explain("ip=192.0.2.10", "secret")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "fsd.connect.vatsim.net.", explanation.Qname)
+	assert.Equal(t, "GB", explanation.GeoIP.Country)
+	assert.Equal(t, "fsd.uk.vatsim.net", explanation.Winner)
+	assert.Equal(t, "198.51.100.1", explanation.WinnerIp)
+	require.Len(t, explanation.Candidates, 2)
+	assert.Equal(t, 1, explanation.Candidates[0].Rank)
+	assert.False(t, explanation.Candidates[1].Accepting)
+	assert.Empty(t, explanation.Overrides)
+	assert.Equal(t, 10, uk.RemainingSlots, "explaining doesn't reserve a slot")
+
+	// With nobody accepting the default server is an override
+	uk.AbleToUpdate = false
+	status, explanation = explain("ip=192.0.2.10", "secret")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "fsd.ger.vatsim.net", explanation.Winner)
+	assert.Equal(t, []string{`DEFAULT_FSD_SERVER "fsd.ger.vatsim.net"`}, explanation.Overrides)
+
+	status, explanation = explain("ip=192.0.2.10&qname=fsd-http.connect.vatsim.net", "secret")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "dnshaiku", explanation.Winner)
+	assert.Len(t, explanation.Overrides, 1)
+
+	status, _ = explain("ip=not-an-ip", "secret")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = explain("ip=192.0.2.10", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
@@ -0,0 +1,56 @@
+package dnshaiku
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// QueryOptions configures a query against a running dnshaiku
+type QueryOptions struct {
+	// Server is the host:port of the dnshaiku to query
+	Server string
+	Name   string
+	Qtype  uint16
+	// SourceIp, if set, asks for the answer as if the query came from it. It is only honoured
+	// when the querying host is in the server's DNS_OVERRIDE_ALLOWED_SOURCES.
+	SourceIp net.IP
+	// UseECS sends SourceIp as an ECS option rather than the EDNS0SourceIpOverride local option
+	UseECS  bool
+	TCP     bool
+	Timeout time.Duration
+}
+
+// Query resolves a name against a running dnshaiku
+func Query(options QueryOptions) (*dns.Msg, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(options.Name), options.Qtype)
+	if options.SourceIp != nil {
+		m.SetEdns0(4096, false)
+		opt := m.IsEdns0()
+		sourceIp := options.SourceIp
+		if sourceIp.To4() != nil {
+			sourceIp = sourceIp.To4()
+		}
+		if options.UseECS {
+			ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: sourceIp}
+			if len(sourceIp) == net.IPv6len {
+				ecs.Family = 2
+				ecs.SourceNetmask = 128
+			}
+			opt.Option = append(opt.Option, ecs)
+		} else {
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: EDNS0SourceIpOverride, Data: sourceIp})
+		}
+	}
+	client := dns.Client{Timeout: options.Timeout}
+	if options.TCP {
+		client.Net = "tcp"
+	}
+	in, rtt, err := client.Exchange(m, options.Server)
+	if err != nil {
+		return nil, 0, fmt.Errorf("querying %s: %w", options.Server, err)
+	}
+	return in, rtt, nil
+}
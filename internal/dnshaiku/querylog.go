@@ -0,0 +1,108 @@
+package dnshaiku
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/querylog"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Records answered queries when QUERY_LOG_FILE or DNSTAP_OUTPUT are set, nil otherwise
+var queryLog *querylog.Logger
+
+// newQueryLog starts the query log with the sinks configured in c, returning nil if there are none
+func newQueryLog(c *Config) (*querylog.Logger, error) {
+	sinks := make([]querylog.Sink, 0)
+	if c.QueryLogFile != "" {
+		sinks = append(sinks, querylog.NewJSONFileSink(c.QueryLogFile, c.QueryLogMaxSizeMB, c.QueryLogMaxBackups, c.QueryLogMaxAgeDays))
+	}
+	if c.DnstapOutput != "" {
+		identity := c.DnstapIdentity
+		if identity == "" {
+			identity, _ = os.Hostname()
+		}
+		sink, err := querylog.NewDnstapSink(c.DnstapOutput, identity, fmt.Sprintf("dnshaiku %s", Version))
+		if err != nil {
+			return nil, fmt.Errorf("DNSTAP_OUTPUT: %w", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 0 {
+		logger.Info("No QUERY_LOG_FILE or DNSTAP_OUTPUT set, query log disabled")
+		return nil, nil
+	}
+	logger.Info(fmt.Sprintf("Query log writing to %d sinks, sampling %.2f%% of queries", len(sinks), c.QueryLogSampleRate*100))
+	return querylog.New(querylog.Config{SampleRate: c.QueryLogSampleRate, BufferSize: c.QueryLogBufferSize}, sinks...), nil
+}
+
+// closeQueryLog writes out buffered entries, giving up after timeout
+func closeQueryLog(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := queryLog.Close(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Closing query log: %s", err))
+	}
+}
+
+// logDnsQuery records a DNS query answered by HandleDnsRequest
+func logDnsQuery(start time.Time, w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, sourceIp net.IP, ecs *dns.EDNS0_SUBNET, server *common.FSDServer) {
+	if queryLog == nil {
+		return
+	}
+	entry := &querylog.Entry{
+		Time:      start,
+		Transport: w.RemoteAddr().Network(),
+		Rcode:     dns.RcodeToString[m.Rcode],
+		Latency:   time.Since(start),
+		Query:     r,
+		Response:  m,
+		LocalAddr: w.LocalAddr(),
+	}
+	if host, port, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		entry.ClientIp = host
+		entry.ClientPort, _ = strconv.Atoi(port)
+	}
+	if len(r.Question) > 0 {
+		entry.Qname = r.Question[0].Name
+		entry.Qtype = dns.TypeToString[r.Question[0].Qtype]
+	}
+	if sourceIp != nil && sourceIp.String() != entry.ClientIp {
+		entry.GeoIp = sourceIp.String()
+	}
+	if ecs != nil {
+		entry.ECS = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+	}
+	if server != nil {
+		entry.Server = server.Name
+		entry.ServerIp = server.IpAddress
+	}
+	queryLog.Log(entry)
+}
+
+// logHttpQuery records a request answered by the HTTP endpoint
+func logHttpQuery(start time.Time, r *http.Request, sourceIp net.IP, status int, server string, serverIp string) {
+	if queryLog == nil {
+		return
+	}
+	entry := &querylog.Entry{
+		Time:       start,
+		Transport:  "http",
+		ClientIp:   GetUserIPAddressHTTP(r),
+		Qname:      r.URL.Path,
+		HttpStatus: status,
+		Server:     server,
+		ServerIp:   serverIp,
+		Latency:    time.Since(start),
+	}
+	if sourceIp != nil && sourceIp.String() != entry.ClientIp {
+		entry.GeoIp = sourceIp.String()
+	}
+	queryLog.Log(entry)
+}
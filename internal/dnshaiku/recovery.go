@@ -0,0 +1,114 @@
+package dnshaiku
+
+import (
+	"errors"
+	"fmt"
+	"github.com/getsentry/sentry-go"
+	"github.com/miekg/dns"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// clientPrefix truncates ip to its /24 or /48 so full client addresses aren't sent to Sentry
+func clientPrefix(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// reportFailure sends a request that could not be answered to Sentry with its query context.
+// recovered is the value from recover() if the handler panicked, otherwise err is reported.
+func reportFailure(handler string, qname string, clientIp net.IP, recovered interface{}, err error) {
+	summary := registrySummary()
+	hub := sentry.CurrentHub().Clone()
+	hub.ConfigureScope(func(scope *sentry.Scope) {
+		scope.SetTag("handler", handler)
+		scope.SetTag("qname", qname)
+		scope.SetTag("client_prefix", clientPrefix(clientIp))
+		scope.SetContext("registry", sentry.Context{
+			"servers":   summary.Total,
+			"accepting": summary.Accepting,
+		})
+	})
+	if recovered != nil {
+		panicsRecovered.WithLabelValues(handler).Inc()
+		logger.Error(fmt.Sprintf("Recovered from panic in %s handler for %s from %s: %v\n%s", handler, qname, clientPrefix(clientIp), recovered, debug.Stack()))
+		hub.Recover(recovered)
+		return
+	}
+	logger.Error(fmt.Sprintf("Failed to answer %s for %s from %s: %s", handler, qname, clientPrefix(clientIp), err))
+	hub.CaptureException(err)
+}
+
+// remoteIp returns the IP of a host:port address, without trusting anything in the request
+func remoteIp(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// recoverDns answers SERVFAIL if handler panics, rather than leaving the client to time out
+func recoverDns(handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			qname := ""
+			if len(r.Question) > 0 {
+				qname = r.Question[0].Name
+			}
+			reportFailure("dns", qname, remoteIp(w.RemoteAddr().String()), recovered, nil)
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+			_ = w.WriteMsg(m)
+		}()
+		handler(w, r)
+	}
+}
+
+// headerRecorder notes whether a response has been started so a panic can still be answered
+type headerRecorder struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *headerRecorder) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// recoverHttp answers 503 if handler panics before starting its response
+func recoverHttp(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &headerRecorder{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(recovered)
+			}
+			reportFailure("http", r.URL.Path, remoteIp(r.RemoteAddr), recovered, nil)
+			if !recorder.wroteHeader {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			}
+		}()
+		handler.ServeHTTP(recorder, r)
+	})
+}
@@ -0,0 +1,113 @@
+package dnshaiku
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/paulbellamy/ratecounter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFallbackServerChain(t *testing.T) {
+	currentConfig.Store(&Config{DefaultFSDServer: "fsd.default.vatsim.net"})
+	t.Cleanup(func() { currentConfig.Store(nil) })
+
+	server, fallback := fallbackServer(&sync.Map{})
+	assert.Nil(t, server)
+	assert.Equal(t, "none", fallback)
+
+	registry := mockServers(
+		common.FSDServer{Name: "fsd.b.vatsim.net", IpAddress: "192.0.2.2", MaxUsers: 300, RemainingSlots: 5, AbleToUpdate: false},
+		common.FSDServer{Name: "fsd.a.vatsim.net", IpAddress: "192.0.2.1", MaxUsers: 300, RemainingSlots: 3, AbleToUpdate: false},
+	)
+	server, fallback = fallbackServer(registry)
+	assert.Equal(t, "fsd.a.vatsim.net", server.Name)
+	assert.Equal(t, "any", fallback)
+
+	registry.Store("fsd.c.vatsim.net", common.NewMockFSDServer(&common.FSDServer{Name: "fsd.c.vatsim.net", IpAddress: "192.0.2.3", RemainingSlots: 1, AbleToUpdate: true}))
+	registry.Store("fsd.d.vatsim.net", common.NewMockFSDServer(&common.FSDServer{Name: "fsd.d.vatsim.net", IpAddress: "192.0.2.4", RemainingSlots: 0, AbleToUpdate: true}))
+	server, fallback = fallbackServer(registry)
+	assert.Equal(t, "fsd.c.vatsim.net", server.Name)
+	assert.Equal(t, "most_slots", fallback)
+
+	registry.Store("fsd.default.vatsim.net", common.NewMockFSDServer(&common.FSDServer{Name: "fsd.default.vatsim.net", IpAddress: "192.0.2.5"}))
+	server, fallback = fallbackServer(registry)
+	assert.Equal(t, "fsd.default.vatsim.net", server.Name)
+	assert.Equal(t, "default", fallback)
+}
+
+func TestPickServerWithEmptyRegistry(t *testing.T) {
+	server, err := pickServer(context.Background(), &sync.Map{}, london)
+	assert.Nil(t, server)
+	assert.ErrorIs(t, err, errNoServers)
+}
+
+func TestHandleDnsRequestFailures(t *testing.T) {
+	previousDb, previousCounter := db, dnsRateCounter
+	db = staticLocator{}
+	dnsRateCounter = ratecounter.NewRateCounter(time.Second)
+	t.Cleanup(func() {
+		db, dnsRateCounter = previousDb, previousCounter
+		fsdServers.Delete("fsd.uk.vatsim.net")
+	})
+	r := new(dns.Msg)
+	r.SetQuestion("fsd.connect.vatsim.net.", dns.TypeA)
+
+	// No servers at all is SERVFAIL rather than a panic
+	w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353}}
+	HandleDnsRequest(w, r)
+	require.NotNil(t, w.msg)
+	assert.Equal(t, dns.RcodeServerFailure, w.msg.Rcode)
+
+	// A client GeoIP can't place still gets a server
+	fsdServers.Store("fsd.uk.vatsim.net", common.NewMockFSDServer(&common.FSDServer{
+		Name: "fsd.uk.vatsim.net", IpAddress: "198.51.100.1", MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: true,
+	}))
+	w = &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353}}
+	HandleDnsRequest(w, r)
+	require.NotNil(t, w.msg)
+	assert.Equal(t, dns.RcodeSuccess, w.msg.Rcode)
+	require.Len(t, w.msg.Answer, 1)
+	assert.Equal(t, "198.51.100.1", w.msg.Answer[0].(*dns.A).A.String())
+}
+
+func TestRecoverDns(t *testing.T) {
+	handler := recoverDns(func(w dns.ResponseWriter, r *dns.Msg) {
+		panic("lookup failed")
+	})
+	r := new(dns.Msg)
+	r.SetQuestion("fsd.connect.vatsim.net.", dns.TypeA)
+	w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353}}
+	assert.NotPanics(t, func() { handler(w, r) })
+	require.NotNil(t, w.msg)
+	assert.Equal(t, dns.RcodeServerFailure, w.msg.Rcode)
+	assert.Equal(t, r.Id, w.msg.Id)
+}
+
+func TestRecoverHttp(t *testing.T) {
+	handler := recoverHttp(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("lookup failed")
+	}))
+	recorder := httptest.NewRecorder()
+	assert.NotPanics(t, func() { handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil)) })
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	// Aborting a response is left to net/http
+	aborting := recoverHttp(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	assert.Panics(t, func() { aborting.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)) })
+}
+
+func TestClientPrefix(t *testing.T) {
+	assert.Equal(t, "192.0.2.0/24", clientPrefix(net.ParseIP("192.0.2.10")))
+	assert.Equal(t, "2001:db8:1::/48", clientPrefix(net.ParseIP("2001:db8:1:2::10")))
+	assert.Equal(t, "", clientPrefix(nil))
+}
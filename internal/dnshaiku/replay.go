@@ -0,0 +1,259 @@
+package dnshaiku
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"github.com/jftuga/geodist"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayQuery is a query from a query log, a client IP and when it asked
+type ReplayQuery struct {
+	Time time.Time
+	Ip   string
+}
+
+// TimelineEntry is the state of every FSD server from At until the next entry
+type TimelineEntry struct {
+	At      time.Time
+	Servers []common.FSDServer
+}
+
+type timelineEntryYaml struct {
+	At      string             `yaml:"at"`
+	Servers []common.FSDServer `yaml:"servers"`
+}
+
+// ReplayBucket is how many queries a server was given during a bucket and how full it got
+type ReplayBucket struct {
+	Start       time.Time
+	Server      string
+	Country     string
+	Assignments int
+	PeakFill    float64
+}
+
+// ReplayServerSummary totals a server's assignments over the whole replay
+type ReplayServerSummary struct {
+	Server      string
+	Country     string
+	Assignments int
+	PeakFill    float64
+	PeakFillAt  time.Time
+	// SpilledIn counts queries from clients whose closest server is in another country
+	SpilledIn int
+}
+
+type ReplayResult struct {
+	Buckets []ReplayBucket
+	Servers []ReplayServerSummary
+	Queries int
+	// Spilled counts queries given a server outside the country of the client's closest server
+	Spilled int
+	// Failed counts queries that could not be located or had no server to go to
+	Failed int
+}
+
+// parseReplayTime parses an RFC 3339 timestamp or unix seconds
+func parseReplayTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))).UTC(), nil
+	}
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not an RFC 3339 timestamp or unix seconds", value)
+	}
+	return parsed.UTC(), nil
+}
+
+// ReadQueryLog reads a CSV query log of timestamp,ip rows. A header row is skipped.
+func ReadQueryLog(r io.Reader) ([]ReplayQuery, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	queries := make([]ReplayQuery, 0)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d: expected timestamp,ip", line)
+		}
+		queryTime, err := parseReplayTime(record[0])
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		queries = append(queries, ReplayQuery{Time: queryTime, Ip: strings.TrimSpace(record[1])})
+	}
+	return queries, nil
+}
+
+// ReadTimeline reads a YAML list of server states, each with an at timestamp and servers in the
+// same form as the mockFsdServers of test_data fixtures
+func ReadTimeline(r io.Reader) ([]TimelineEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	entriesYaml := make([]timelineEntryYaml, 0)
+	if err := yaml.Unmarshal(data, &entriesYaml); err != nil {
+		return nil, err
+	}
+	timeline := make([]TimelineEntry, 0, len(entriesYaml))
+	for i, entryYaml := range entriesYaml {
+		at, err := parseReplayTime(entryYaml.At)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i, err)
+		}
+		timeline = append(timeline, TimelineEntry{At: at, Servers: entryYaml.Servers})
+	}
+	return timeline, nil
+}
+
+// Replay runs a query log through server selection using config c, reserving slots as a running
+// instance would. The registry is replaced by each timeline entry as its time is reached, as polling
+// would update it, and results are counted per bucket.
+func Replay(c *Config, timeline []TimelineEntry, queries []ReplayQuery, bucket time.Duration) (*ReplayResult, error) {
+	if bucket <= 0 {
+		return nil, errors.New("bucket must be positive")
+	}
+	if len(timeline) == 0 {
+		return nil, errors.New("timeline has no entries")
+	}
+	applyConfig(c)
+	reader, err := geoip2.Open(c.GeoIPDatabase)
+	if err != nil {
+		return nil, fmt.Errorf("opening GeoIP database: %w", err)
+	}
+	defer reader.Close()
+	return replay(reader, timeline, queries, bucket), nil
+}
+
+func replay(locator geoLocator, timeline []TimelineEntry, queries []ReplayQuery, bucket time.Duration) *ReplayResult {
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].At.Before(timeline[j].At)
+	})
+	sort.SliceStable(queries, func(i, j int) bool {
+		return queries[i].Time.Before(queries[j].Time)
+	})
+
+	result := &ReplayResult{Queries: len(queries)}
+	buckets := make(map[time.Time]map[string]*ReplayBucket)
+	summaries := make(map[string]*ReplayServerSummary)
+	var registry *sync.Map
+	next := 0
+	for _, query := range queries {
+		// Apply every timeline entry reached by this query, the first applies from the start
+		for next < len(timeline) && (registry == nil || !timeline[next].At.After(query.Time)) {
+			registry = &sync.Map{}
+			for _, mockFsdServer := range timeline[next].Servers {
+				mockFsdServer := mockFsdServer
+				registry.Store(mockFsdServer.Name, common.NewMockFSDServer(&mockFsdServer))
+			}
+			next++
+		}
+
+		ip := IpToIpNET(query.Ip)
+		if ip == nil {
+			result.Failed++
+			continue
+		}
+		record, err := locator.City(ip)
+		if err != nil {
+			result.Failed++
+			continue
+		}
+		sourceIpLatLng := geodist.Coord{Lat: record.Location.Latitude, Lon: record.Location.Longitude}
+		homeCountry := closestCountry(registry, sourceIpLatLng)
+		server, err := pickServer(context.Background(), registry, sourceIpLatLng)
+		if err != nil {
+			result.Failed++
+			continue
+		}
+
+		fill := 0.0
+		if server.MaxUsers > 0 {
+			fill = float64(server.MaxUsers-server.RemainingSlots) / float64(server.MaxUsers)
+		}
+		start := query.Time.Truncate(bucket)
+		if buckets[start] == nil {
+			buckets[start] = make(map[string]*ReplayBucket)
+		}
+		serverBucket, found := buckets[start][server.Name]
+		if !found {
+			serverBucket = &ReplayBucket{Start: start, Server: server.Name, Country: server.Country}
+			buckets[start][server.Name] = serverBucket
+		}
+		serverBucket.Assignments++
+		if fill > serverBucket.PeakFill {
+			serverBucket.PeakFill = fill
+		}
+		summary, found := summaries[server.Name]
+		if !found {
+			summary = &ReplayServerSummary{Server: server.Name, Country: server.Country}
+			summaries[server.Name] = summary
+		}
+		summary.Assignments++
+		if fill > summary.PeakFill {
+			summary.PeakFill = fill
+			summary.PeakFillAt = query.Time
+		}
+		if server.Country != homeCountry {
+			summary.SpilledIn++
+			result.Spilled++
+		}
+	}
+
+	for _, serverBuckets := range buckets {
+		for _, serverBucket := range serverBuckets {
+			result.Buckets = append(result.Buckets, *serverBucket)
+		}
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool {
+		if !result.Buckets[i].Start.Equal(result.Buckets[j].Start) {
+			return result.Buckets[i].Start.Before(result.Buckets[j].Start)
+		}
+		return result.Buckets[i].Server < result.Buckets[j].Server
+	})
+	for _, summary := range summaries {
+		result.Servers = append(result.Servers, *summary)
+	}
+	sort.Slice(result.Servers, func(i, j int) bool {
+		return result.Servers[i].Server < result.Servers[j].Server
+	})
+	return result
+}
+
+// closestCountry returns the country of the closest server to a location, whether it is accepting connections or not
+func closestCountry(servers *sync.Map, sourceIpLatLng geodist.Coord) string {
+	country := ""
+	closest := -1.0
+	servers.Range(func(k, v interface{}) bool {
+		fsdServerStruct := v.(*common.FSDServer)
+		miles, _, _ := geodist.VincentyDistance(sourceIpLatLng, geodist.Coord{Lat: fsdServerStruct.Latitude, Lon: fsdServerStruct.Longitude})
+		if closest < 0 || miles < closest {
+			closest = miles
+			country = fsdServerStruct.Country
+		}
+		return true
+	})
+	return country
+}
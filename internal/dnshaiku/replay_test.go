@@ -0,0 +1,72 @@
+package dnshaiku
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadQueryLogAndTimeline(t *testing.T) {
+	queries, err := ReadQueryLog(strings.NewReader("timestamp,ip\n2024-01-01T00:00:00Z,192.0.2.10\n1704067260,192.0.2.20\n"))
+	assert.NoError(t, err)
+	assert.Len(t, queries, 2)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC), queries[1].Time)
+
+	_, err = ReadQueryLog(strings.NewReader("2024-01-01T00:00:00Z,192.0.2.10\nyesterday,192.0.2.20\n"))
+	assert.ErrorContains(t, err, "line 2")
+
+	timeline, err := ReadTimeline(strings.NewReader(`
+- at: "2024-01-01T00:00:00Z"
+  servers:
+    - name: "fsd.uk.vatsim.net"
+      ip_address: "198.51.100.1"
+      max_users: 10
+      remaining_slots: 10
+      able_to_update: true
+`))
+	assert.NoError(t, err)
+	assert.Len(t, timeline, 1)
+	assert.Equal(t, "fsd.uk.vatsim.net", timeline[0].Servers[0].Name)
+}
+
+func TestReplay(t *testing.T) {
+	t.Cleanup(func() { currentConfig.Store(nil) })
+	applyConfig(&Config{FSDSlotBuffer: 1})
+	locator := staticLocator{
+		"192.0.2.10": {country: "GB", lat: 51.5072, lon: -0.1276},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeline, err := ReadTimeline(strings.NewReader(`
+- at: "2024-01-01T00:00:00Z"
+  servers:
+    - {name: "fsd.uk.vatsim.net", ip_address: "198.51.100.1", max_users: 4, remaining_slots: 2, able_to_update: true}
+    - {name: "fsd.ger.vatsim.net", ip_address: "198.51.100.2", max_users: 10, remaining_slots: 10, able_to_update: true}
+- at: "2024-01-01T00:01:00Z"
+  servers:
+    - {name: "fsd.uk.vatsim.net", ip_address: "198.51.100.1", max_users: 4, remaining_slots: 4, able_to_update: true}
+    - {name: "fsd.ger.vatsim.net", ip_address: "198.51.100.2", max_users: 10, remaining_slots: 10, able_to_update: true}
+`))
+	assert.NoError(t, err)
+	queries := []ReplayQuery{
+		{Time: start.Add(10 * time.Second), Ip: "192.0.2.10"},
+		{Time: start.Add(20 * time.Second), Ip: "192.0.2.10"},
+		{Time: start.Add(30 * time.Second), Ip: "192.0.2.10"},
+		{Time: start.Add(70 * time.Second), Ip: "192.0.2.10"},
+		{Time: start.Add(80 * time.Second), Ip: "192.0.2.99"},
+	}
+
+	result := replay(locator, timeline, queries, time.Minute)
+	assert.Equal(t, 5, result.Queries)
+	assert.Equal(t, 1, result.Failed)
+	// The UK server is full after two queries so the third spills to Germany
+	assert.Equal(t, 1, result.Spilled)
+	assert.Equal(t, []ReplayBucket{
+		{Start: start, Server: "fsd.ger.vatsim.net", Country: "ger", Assignments: 1, PeakFill: 0.1},
+		{Start: start, Server: "fsd.uk.vatsim.net", Country: "uk", Assignments: 2, PeakFill: 1},
+		{Start: start.Add(time.Minute), Server: "fsd.uk.vatsim.net", Country: "uk", Assignments: 1, PeakFill: 0.25},
+	}, result.Buckets)
+	assert.Equal(t, 3, result.Servers[1].Assignments)
+	assert.Equal(t, 1.0, result.Servers[1].PeakFill)
+	assert.Equal(t, 1, result.Servers[0].SpilledIn)
+}
@@ -0,0 +1,83 @@
+package dnshaiku
+
+import (
+	"context"
+	"fmt"
+	"github.com/jftuga/geodist"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"sync"
+)
+
+// SimulatedQuery is the server a client IP would have been given by simulate
+type SimulatedQuery struct {
+	Ip            string
+	Country       string
+	City          string
+	Server        string
+	ServerIp      string
+	DistanceMiles float64
+	Expected      string
+	Error         string
+}
+
+// Matched reports whether the server handed out was the one the fixture expected, true if it expected none
+func (q SimulatedQuery) Matched() bool {
+	return q.Error == "" && (q.Expected == "" || q.Expected == q.ServerIp)
+}
+
+// Simulate loads a registry fixture and runs each client IP through server selection using config c,
+// without opening any listener. If ips is empty the fixture's mockDnsQueries are used.
+// Slots are reserved as queries are answered, as they would be by a running instance.
+func Simulate(c *Config, fixture common.TestingDataYaml, ips []string) ([]SimulatedQuery, error) {
+	applyConfig(c)
+	reader, err := geoip2.Open(c.GeoIPDatabase)
+	if err != nil {
+		return nil, fmt.Errorf("opening GeoIP database: %w", err)
+	}
+	defer reader.Close()
+	return simulate(reader, fixture, ips), nil
+}
+
+func simulate(locator geoLocator, fixture common.TestingDataYaml, ips []string) []SimulatedQuery {
+	registry := &sync.Map{}
+	for _, mockFsdServer := range fixture.MockFsdServers {
+		mockFsdServer := mockFsdServer
+		registry.Store(mockFsdServer.Name, common.NewMockFSDServer(&mockFsdServer))
+	}
+	queries := make([]SimulatedQuery, 0)
+	if len(ips) == 0 {
+		for _, mockDnsQuery := range fixture.MockDnsQueries {
+			queries = append(queries, SimulatedQuery{Ip: mockDnsQuery.SourceIpAddress, Expected: mockDnsQuery.ExpectedIpReturned})
+		}
+	}
+	for _, ip := range ips {
+		queries = append(queries, SimulatedQuery{Ip: ip})
+	}
+
+	for i := range queries {
+		query := &queries[i]
+		ip := IpToIpNET(query.Ip)
+		if ip == nil {
+			query.Error = "not an IP address"
+			continue
+		}
+		record, err := locator.City(ip)
+		if err != nil {
+			query.Error = fmt.Sprintf("GeoIP lookup failed: %s", err)
+			continue
+		}
+		query.Country = record.Country.IsoCode
+		query.City = record.City.Names["en"]
+		sourceIpLatLng := geodist.Coord{Lat: record.Location.Latitude, Lon: record.Location.Longitude}
+		server, err := pickServer(context.Background(), registry, sourceIpLatLng)
+		if err != nil {
+			query.Error = "no servers in the fixture"
+			continue
+		}
+		query.Server = server.Name
+		query.ServerIp = server.IpAddress
+		query.DistanceMiles, _, _ = geodist.VincentyDistance(sourceIpLatLng, geodist.Coord{Lat: server.Latitude, Lon: server.Longitude})
+	}
+	return queries
+}
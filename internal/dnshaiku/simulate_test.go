@@ -0,0 +1,62 @@
+package dnshaiku
+
+import (
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net"
+	"testing"
+)
+
+// staticLocator places IPs at fixed locations instead of reading a GeoIP database
+type staticLocator map[string]geodistLocation
+
+type geodistLocation struct {
+	country string
+	lat     float64
+	lon     float64
+}
+
+func (l staticLocator) City(ipAddress net.IP) (*geoip2.City, error) {
+	location, found := l[ipAddress.String()]
+	if !found {
+		return nil, fmt.Errorf("no location for %s", ipAddress)
+	}
+	record := &geoip2.City{}
+	record.Country.IsoCode = location.country
+	record.Location.Latitude = location.lat
+	record.Location.Longitude = location.lon
+	return record, nil
+}
+
+func TestSimulate(t *testing.T) {
+	common.SetPollingSettings(common.PollingSettings{SlotBuffer: 1})
+	t.Cleanup(func() { common.SetPollingSettings(common.PollingSettings{}) })
+	locator := staticLocator{
+		"192.0.2.10": {country: "GB", lat: 51.5072, lon: -0.1276},
+		"192.0.2.20": {country: "CA", lat: 43.6532, lon: -79.3832},
+	}
+	fixture := common.TestingDataYaml{
+		MockFsdServers: []common.FSDServer{
+			{Name: "fsd.uk.vatsim.net", IpAddress: "198.51.100.1", MaxUsers: 300, RemainingSlots: 1, AbleToUpdate: true},
+			{Name: "fsd.ger.vatsim.net", IpAddress: "198.51.100.2", MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: true},
+			{Name: "fsd.can.vatsim.net", IpAddress: "198.51.100.3", MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: true},
+		},
+		MockDnsQueries: []common.MockDnsQuery{
+			{SourceIpAddress: "192.0.2.20", ExpectedIpReturned: "198.51.100.3"},
+		},
+	}
+
+	queries := simulate(locator, fixture, nil)
+	assert.Len(t, queries, 1)
+	assert.True(t, queries[0].Matched())
+	assert.Equal(t, "fsd.can.vatsim.net", queries[0].Server)
+
+	// The first query takes the UK server under the slot buffer so the second spills to Germany
+	queries = simulate(locator, fixture, []string{"192.0.2.10", "192.0.2.10", "192.0.2.99", "nonsense"})
+	assert.Equal(t, "fsd.uk.vatsim.net", queries[0].Server)
+	assert.Equal(t, "fsd.ger.vatsim.net", queries[1].Server)
+	assert.Contains(t, queries[2].Error, "GeoIP lookup failed")
+	assert.Equal(t, "not an IP address", queries[3].Error)
+}
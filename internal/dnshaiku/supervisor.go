@@ -0,0 +1,189 @@
+package dnshaiku
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Set once shutdown starts so /readyz fails while in-flight requests drain
+var draining atomic.Bool
+
+// listener is a server owned by the supervisor. Listen binds it so bind errors surface before
+// anything is served, Serve blocks until it is shut down.
+type listener interface {
+	Name() string
+	Listen() error
+	Serve() error
+	Shutdown(ctx context.Context) error
+}
+
+type httpListener struct {
+	name      string
+	server    *http.Server
+	tlsConfig *tls.Config
+	listener  net.Listener
+}
+
+func newHttpListener(name string, addr string, handler http.Handler, tlsConfig *tls.Config) *httpListener {
+	return &httpListener{
+		name: name,
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (l *httpListener) Name() string {
+	return l.name
+}
+
+func (l *httpListener) Listen() error {
+	listener, err := net.Listen("tcp", l.server.Addr)
+	if err != nil {
+		return err
+	}
+	if l.tlsConfig != nil {
+		listener = tls.NewListener(listener, l.tlsConfig)
+	}
+	l.listener = listener
+	markListenerBound(l.name)
+	return nil
+}
+
+func (l *httpListener) Serve() error {
+	defer markListenerClosed(l.name)
+	if err := l.server.Serve(l.listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (l *httpListener) Shutdown(ctx context.Context) error {
+	return l.server.Shutdown(ctx)
+}
+
+type dnsListener struct {
+	name   string
+	server *dns.Server
+}
+
+func newDnsListener(name string, addr string, network string, handler dns.Handler) *dnsListener {
+	return &dnsListener{
+		name: name,
+		server: &dns.Server{
+			Addr:    addr,
+			Net:     network,
+			Handler: handler,
+		},
+	}
+}
+
+func (l *dnsListener) Name() string {
+	return l.name
+}
+
+func (l *dnsListener) Listen() error {
+	var err error
+	if l.server.Net == "udp" {
+		l.server.PacketConn, err = net.ListenPacket("udp", l.server.Addr)
+	} else {
+		l.server.Listener, err = net.Listen("tcp", l.server.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	markListenerBound(l.name)
+	return nil
+}
+
+func (l *dnsListener) Serve() error {
+	defer markListenerClosed(l.name)
+	return l.server.ActivateAndServe()
+}
+
+func (l *dnsListener) Shutdown(ctx context.Context) error {
+	return l.server.ShutdownContext(ctx)
+}
+
+// supervisor owns every listener dnshaiku serves on. It starts them, notices if one dies and shuts
+// them all down together, draining in-flight requests first.
+type supervisor struct {
+	listeners []listener
+	errs      chan error
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		errs: make(chan error, 16),
+	}
+}
+
+// start binds and serves listeners. If any fails to bind the error is returned and nothing more is started.
+func (s *supervisor) start(listeners ...listener) error {
+	for _, l := range listeners {
+		if err := l.Listen(); err != nil {
+			return fmt.Errorf("%s: %w", l.Name(), err)
+		}
+		logger.Info(fmt.Sprintf("Listening for %s", l.Name()))
+		s.listeners = append(s.listeners, l)
+		go func(l listener) {
+			if err := l.Serve(); err != nil {
+				s.errs <- fmt.Errorf("%s: %w", l.Name(), err)
+			}
+		}(l)
+	}
+	return nil
+}
+
+// wait blocks until ctx is cancelled or a listener fails, then shuts everything down. Readiness is
+// failed first, then after SHUTDOWN_DRAIN_PERIOD listeners are given SHUTDOWN_TIMEOUT to finish in-flight requests.
+func (s *supervisor) wait(ctx context.Context) error {
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		logger.Info("Received shutdown signal")
+	case serveErr = <-s.errs:
+		logger.Error(fmt.Sprintf("Listener failed, shutting down: %s", serveErr))
+	}
+	return errors.Join(serveErr, s.shutdown(cfg().drainPeriod(), cfg().shutdownTimeout()))
+}
+
+func (s *supervisor) shutdown(drainPeriod time.Duration, shutdownTimeout time.Duration) error {
+	draining.Store(true)
+	if drainPeriod > 0 {
+		logger.Info(fmt.Sprintf("Not ready, draining for %s before shutting down listeners", drainPeriod))
+		time.Sleep(drainPeriod)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var shutdownErr error
+	for _, l := range s.listeners {
+		wg.Add(1)
+		go func(l listener) {
+			defer wg.Done()
+			if err := l.Shutdown(ctx); err != nil {
+				mu.Lock()
+				shutdownErr = errors.Join(shutdownErr, fmt.Errorf("shutting down %s: %w", l.Name(), err))
+				mu.Unlock()
+				return
+			}
+			logger.Info(fmt.Sprintf("Shut down %s", l.Name()))
+		}(l)
+	}
+	wg.Wait()
+	return shutdownErr
+}
@@ -0,0 +1,61 @@
+package dnshaiku
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSupervisorDrainsBeforeShutdown(t *testing.T) {
+	applyConfig(&Config{ShutdownDrainPeriod: 0, ShutdownTimeout: 1})
+	t.Cleanup(func() {
+		draining.Store(false)
+		currentConfig.Store(nil)
+	})
+	served := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(served)
+		<-release
+		w.Write([]byte("done"))
+	})
+	l := newHttpListener("test", "127.0.0.1:0", handler, nil)
+	sup := newSupervisor()
+	assert.NoError(t, sup.start(l))
+
+	// An in-flight request started before shutdown must complete
+	result := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + l.listener.Addr().String())
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		result <- resp.Status
+	}()
+	<-served
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	waitErr := make(chan error)
+	go func() {
+		waitErr <- sup.wait(ctx)
+	}()
+	assert.Eventually(t, draining.Load, time.Second, time.Millisecond)
+	assert.Contains(t, readiness(), "shutting down")
+	close(release)
+	assert.Equal(t, "200 OK", <-result)
+	assert.NoError(t, <-waitErr)
+}
+
+func TestSupervisorStartReturnsBindErrors(t *testing.T) {
+	first := newHttpListener("first", "127.0.0.1:0", http.NotFoundHandler(), nil)
+	sup := newSupervisor()
+	assert.NoError(t, sup.start(first))
+	second := newHttpListener("second", first.listener.Addr().String(), http.NotFoundHandler(), nil)
+	assert.ErrorContains(t, sup.start(second), "second")
+	assert.NoError(t, sup.shutdown(0, time.Second))
+}
@@ -0,0 +1,62 @@
+package dnshaiku
+
+import (
+	"context"
+	"github.com/oschwald/geoip2-golang"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"net"
+)
+
+var tracer = otel.Tracer("github.com/vatsimnetwork/vatdns/internal/dnshaiku")
+
+// geoLocate looks up ip in the GeoIP database, recording the outcome on the span in ctx
+func geoLocate(ctx context.Context, ip net.IP) (*geoip2.City, error) {
+	span := trace.SpanFromContext(ctx)
+	record, err := db.City(ip)
+	if err != nil {
+		geoipFailures.Inc()
+		span.SetAttributes(attribute.Bool("geoip.found", false))
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(
+		attribute.Bool("geoip.found", record.Location.Latitude != 0 || record.Location.Longitude != 0),
+		attribute.String("geoip.country", record.Country.IsoCode),
+	)
+	return record, nil
+}
+
+// setSelectionAttributes records the candidates considered for a request on span
+func setSelectionAttributes(span trace.Span, ranked []Candidate) {
+	sameCountry := 0
+	for _, candidate := range ranked {
+		if candidate.Tier == 0 {
+			sameCountry++
+		}
+	}
+	span.SetAttributes(
+		attribute.Int("vatdns.candidates", len(ranked)),
+		attribute.Int("vatdns.same_country_candidates", sameCountry),
+	)
+	if len(ranked) > 0 {
+		span.SetAttributes(attribute.Float64("vatdns.distance_miles", ranked[0].DistanceMiles))
+	}
+}
+
+// setServerAttributes records the server handed out on span
+func setServerAttributes(span trace.Span, name string, ip string) {
+	span.SetAttributes(
+		attribute.String("vatdns.server", name),
+		attribute.String("vatdns.server_ip", ip),
+	)
+}
+
+// endSpanWithError marks span as failed before ending it
+func endSpanWithError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.End()
+}
@@ -0,0 +1,107 @@
+package dnshaiku
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/paulbellamy/ratecounter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/internal/telemetry"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeResponseWriter records the reply to a DNS request from a fixed client
+type fakeResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 10053}
+}
+func (w *fakeResponseWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *fakeResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *fakeResponseWriter) Close() error                { return nil }
+func (w *fakeResponseWriter) TsigStatus() error           { return nil }
+func (w *fakeResponseWriter) TsigTimersOnly(bool)         {}
+func (w *fakeResponseWriter) Hijack()                     {}
+
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestHandleDnsRequestTraces(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := telemetry.NewProvider(telemetry.Config{SampleRatio: 1, ServiceName: "dnshaiku"}, exporter)
+	otel.SetTracerProvider(provider)
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	previousDb, previousCounter := db, dnsRateCounter
+	db = staticLocator{"192.0.2.10": {country: "GB", lat: 51.5072, lon: -0.1276}}
+	dnsRateCounter = ratecounter.NewRateCounter(time.Second)
+	fsdServers.Store("fsd.uk.vatsim.net", common.NewMockFSDServer(&common.FSDServer{
+		Name: "fsd.uk.vatsim.net", IpAddress: "198.51.100.1", Country: "GB", Latitude: 51.5, Longitude: -0.1,
+		MaxUsers: 300, RemainingSlots: 300, AbleToUpdate: true,
+	}))
+	t.Cleanup(func() {
+		db, dnsRateCounter = previousDb, previousCounter
+		otel.SetTextMapPropagator(previousPropagator)
+		fsdServers.Delete("fsd.uk.vatsim.net")
+		_ = provider.Shutdown(context.Background())
+	})
+
+	r := new(dns.Msg)
+	r.SetQuestion("fsd.connect.vatsim.net.", dns.TypeA)
+	w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 5353}}
+	HandleDnsRequest(w, r)
+	require.NotNil(t, w.msg)
+	require.NoError(t, provider.ForceFlush(context.Background()))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	selection, query := spans[0], spans[1]
+	assert.Equal(t, "select_server", selection.Name)
+	assert.Equal(t, "dns.query", query.Name)
+	assert.Equal(t, query.SpanContext.SpanID(), selection.Parent.SpanID())
+
+	queryAttributes := spanAttributes(query)
+	assert.Equal(t, "fsd.connect.vatsim.net.", queryAttributes["dns.qname"].AsString())
+	assert.Equal(t, "NOERROR", queryAttributes["dns.rcode"].AsString())
+	assert.Equal(t, "GB", queryAttributes["geoip.country"].AsString())
+	assert.True(t, queryAttributes["geoip.found"].AsBool())
+	assert.Equal(t, "fsd.uk.vatsim.net", queryAttributes["vatdns.server"].AsString())
+
+	selectionAttributes := spanAttributes(selection)
+	assert.Equal(t, int64(1), selectionAttributes["vatdns.candidates"].AsInt64())
+	assert.Equal(t, int64(1), selectionAttributes["vatdns.same_country_candidates"].AsInt64())
+	assert.Equal(t, "198.51.100.1", selectionAttributes["vatdns.server_ip"].AsString())
+
+	// HTTP requests continue the caller's trace
+	exporter.Reset()
+	handler := instrumentHttp(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}), "/")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, provider.ForceFlush(context.Background()))
+	spans = exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "GET /", spans[0].Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String())
+	assert.Equal(t, int64(http.StatusServiceUnavailable), spanAttributes(spans[0])["http.response.status_code"].AsInt64())
+}
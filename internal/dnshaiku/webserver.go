@@ -1,69 +1,76 @@
 package dnshaiku
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/jftuga/geodist"
-	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
 	"github.com/vatsimnetwork/vatdns/pkg/common"
-	"io"
-	"log"
-	"net"
 	"net/http"
+	"time"
 )
 
-func StartWebServer() {
-	logger.Info(fmt.Sprintf("Starting IP endpoint server at port %s", viper.GetString("HTTP_ENDPOINT_PORT")))
+// newWebServer returns the HTTP server handing out IPs to connect to
+func newWebServer() (listener, error) {
+	logger.Info(fmt.Sprintf("Starting IP endpoint server at port %s", cfg().HttpEndpointPort))
 	endpointHttp := http.NewServeMux()
 	// This is for getting an IP to connect to using plain HTTP, no DOH
 	endpointHttp.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
 		dnsRateCounter.Incr(1)
-		sourceIpParsed := net.IP{}
-		if dnsIpOverride == "" {
-			sourceIpParsed = IpToIpNET(GetUserIPAddressHTTP(r))
+		sourceIpParsed := httpClientIp(r)
+		var server *common.FSDServer
+		var country string
+		record, err := geoLocate(r.Context(), sourceIpParsed)
+		if err != nil {
+			logger.Error(fmt.Sprintf("GeoIP lookup for %s failed: %s", sourceIpParsed, err))
+			server, err = pickFallback(r.Context(), &fsdServers, fallbackGeoIPFailed)
 		} else {
-			sourceIpParsed = net.ParseIP(dnsIpOverride)
+			country = record.Country.IsoCode
+			sourceIpLatLng := geodist.Coord{Lat: record.Location.Latitude, Lon: record.Location.Longitude}
+			server, err = PickServerToReturn(r.Context(), sourceIpLatLng)
 		}
-		record, err := db.City(sourceIpParsed)
 		if err != nil {
-			log.Panic(err)
+			reportFailure("http", r.URL.Path, sourceIpParsed, nil, err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			logHttpQuery(start, r, sourceIpParsed, http.StatusServiceUnavailable, "", "")
+			return
 		}
-		sourceIpLatLng := geodist.Coord{Lat: record.Location.Latitude, Lon: record.Location.Longitude}
-		server := PickServerToReturn(sourceIpLatLng)
-		logger.Info(fmt.Sprintf("HTTP | IP: %s Served: %s", sourceIpParsed.String(), server.Name))
+		serverSelections.WithLabelValues(server.Name, country).Inc()
 		w.Write([]byte(server.IpAddress))
+		logHttpQuery(start, r, sourceIpParsed, http.StatusOK, server.Name, server.IpAddress)
 	})
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", viper.GetString("HTTP_ENDPOINT_PORT")), endpointHttp); err != nil {
-		log.Fatal(err)
-	}
+	// JSON version of the above with ranked alternates, schema is in pkg/connect
+	endpointHttp.HandleFunc("/v1/connect", handleConnect)
+	return newHttpListener("http-endpoint", fmt.Sprintf(":%s", cfg().HttpEndpointPort), instrumentHttp(recoverHttp(endpointHttp), "/", "/v1/connect"), nil), nil
 }
 
-func StartDataWebServer() {
-	logger.Info(fmt.Sprintf("Starting data web server at port %s", viper.GetString("HTTP_DATA_PORT")))
-	testingHttp := http.NewServeMux()
-	// This is for submitting data during testing
-	testingHttp.HandleFunc("/submit_data", func(w http.ResponseWriter, r *http.Request) {
-		fsdServerJson := &common.FSDServer{}
-		err := json.NewDecoder(r.Body).Decode(&fsdServerJson)
-		if err != nil {
-			return
-		}
-		fsdServer := common.NewMockFSDServer(fsdServerJson)
-		fsdServers.Store(fsdServerJson.Name, fsdServer)
-		logger.Info(fmt.Sprintf("%s | %d | %d | %d", fsdServer.Name, fsdServer.CurrentUsers, fsdServer.MaxUsers, fsdServer.AcceptingConnections()))
-		w.Write([]byte(fmt.Sprintf("Updated server %s", fsdServerJson.Name)))
-	})
+// newDataWebServer returns the HTTP server for the admin API and test data submission
+func newDataWebServer() (listener, error) {
+	logger.Info(fmt.Sprintf("Starting data web server at port %s", cfg().HttpDataPort))
+	dataHttp := http.NewServeMux()
+	// Registered either way, so setting ADMIN_API_TOKEN on a reload enables it
+	registerAdminHandlers(dataHttp)
+	if !adminAuthConfigured() {
+		logger.Info("No ADMIN_API_TOKEN or ADMIN_TLS_CLIENT_CA_FILE set, admin API disabled")
+	}
 
-	// Allows setting an IP override for DNS requests. Really only needed for testing.
-	testingHttp.HandleFunc("/dns_ip_override", func(w http.ResponseWriter, r *http.Request) {
-		httpBody, _ := io.ReadAll(r.Body)
-		dnsIpOverride = string(httpBody)
-		logger.Info(fmt.Sprintf("Set DNS IP override to %s", httpBody))
-		w.Write([]byte(fmt.Sprintf("Set DNS IP override to %s", httpBody)))
+	if cfg().TestMode {
+		// This is for submitting data during testing
+		dataHttp.HandleFunc("/submit_data", func(w http.ResponseWriter, r *http.Request) {
+			fsdServerJson, err := decodeFSDServer(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fsdServer := storeFSDServer(fsdServerJson)
+			logger.Info(fmt.Sprintf("%s | %d | %d | %d", fsdServer.Name, fsdServer.CurrentUsers, fsdServer.MaxUsers, fsdServer.AcceptingConnections()))
+			w.Write([]byte(fmt.Sprintf("Updated server %s", fsdServerJson.Name)))
+		})
+	}
 
-	})
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", viper.GetString("HTTP_DATA_PORT")), testingHttp); err != nil {
-		log.Fatal(err)
+	tlsConfig, err := adminTLSConfig()
+	if err != nil {
+		return nil, err
 	}
+	return newHttpListener("http-data", fmt.Sprintf(":%s", cfg().HttpDataPort), dataHttp, tlsConfig), nil
 }
@@ -0,0 +1,205 @@
+// Package querylog records the queries dnshaiku answers without slowing down answering them.
+// Entries are sampled, queued on a bounded buffer and written to sinks by a background goroutine.
+// When the buffer is full entries are dropped rather than blocking the handler.
+package querylog
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is one answered query
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Transport is udp, tcp or http
+	Transport  string `json:"transport"`
+	ClientIp   string `json:"client_ip"`
+	ClientPort int    `json:"client_port,omitempty"`
+	// GeoIp is the IP the client was located as when it differs from ClientIp, from ECS or an override
+	GeoIp string `json:"geo_ip,omitempty"`
+	// ECS is the client subnet option of the query, e.g. 203.0.113.0/24
+	ECS        string        `json:"ecs,omitempty"`
+	Qname      string        `json:"qname"`
+	Qtype      string        `json:"qtype,omitempty"`
+	Rcode      string        `json:"rcode,omitempty"`
+	HttpStatus int           `json:"http_status,omitempty"`
+	Server     string        `json:"server,omitempty"`
+	ServerIp   string        `json:"server_ip,omitempty"`
+	Latency    time.Duration `json:"-"`
+
+	// The wire messages for sinks like dnstap that want them, nil for HTTP
+	Query     *dns.Msg `json:"-"`
+	Response  *dns.Msg `json:"-"`
+	LocalAddr net.Addr `json:"-"`
+}
+
+// Sink is somewhere entries are written. Sinks are only called from the Logger's writer goroutine.
+type Sink interface {
+	Name() string
+	Write(e *Entry) error
+	Close() error
+}
+
+// flusher is implemented by sinks that buffer writes
+type flusher interface {
+	Flush() error
+}
+
+type Config struct {
+	// SampleRate is the fraction of entries kept, from 0 to 1
+	SampleRate float64
+	// BufferSize is how many entries can be waiting to be written before new ones are dropped
+	BufferSize int
+}
+
+// Logger queues entries for its sinks
+type Logger struct {
+	sinks      []Sink
+	entries    chan *Entry
+	sampleRate atomic.Uint64
+	mu         sync.RWMutex
+	closed     bool
+	done       chan struct{}
+
+	sampledOut atomic.Uint64
+	dropped    atomic.Uint64
+	written    atomic.Uint64
+	errors     atomic.Uint64
+}
+
+// New starts a Logger writing to sinks
+func New(config Config, sinks ...Sink) *Logger {
+	if config.BufferSize < 1 {
+		config.BufferSize = 1
+	}
+	l := &Logger{
+		sinks:   sinks,
+		entries: make(chan *Entry, config.BufferSize),
+		done:    make(chan struct{}),
+	}
+	l.SetSampleRate(config.SampleRate)
+	go l.run()
+	return l
+}
+
+// SetSampleRate changes the fraction of entries kept, clamped to 0 to 1
+func (l *Logger) SetSampleRate(rate float64) {
+	l.sampleRate.Store(math.Float64bits(math.Max(0, math.Min(1, rate))))
+}
+
+// Log queues e to be written. It never blocks: entries are dropped when sampled out, when the
+// buffer is full or after Close. A nil Logger discards everything.
+func (l *Logger) Log(e *Entry) {
+	if l == nil {
+		return
+	}
+	if rate := math.Float64frombits(l.sampleRate.Load()); rate < 1 && rand.Float64() >= rate {
+		l.sampledOut.Add(1)
+		return
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		l.dropped.Add(1)
+		return
+	}
+	select {
+	case l.entries <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+func (l *Logger) run() {
+	defer close(l.done)
+	failing := make([]bool, len(l.sinks))
+	for e := range l.entries {
+		for i, sink := range l.sinks {
+			if err := sink.Write(e); err != nil {
+				l.errors.Add(1)
+				// Only log when a sink starts failing, not for every entry
+				if !failing[i] {
+					logger.Error(fmt.Sprintf("Query log sink %s failed: %s", sink.Name(), err))
+					failing[i] = true
+				}
+				continue
+			}
+			if failing[i] {
+				logger.Info(fmt.Sprintf("Query log sink %s recovered", sink.Name()))
+				failing[i] = false
+			}
+		}
+		l.written.Add(1)
+		if len(l.entries) == 0 {
+			l.flush()
+		}
+	}
+}
+
+func (l *Logger) flush() {
+	for _, sink := range l.sinks {
+		if f, ok := sink.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				l.errors.Add(1)
+			}
+		}
+	}
+}
+
+// Close stops accepting entries, writes out those buffered until ctx is done and closes the sinks
+func (l *Logger) Close(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.entries)
+	l.mu.Unlock()
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return fmt.Errorf("query log: %d entries not written: %w", len(l.entries), ctx.Err())
+	}
+	var closeErr error
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("closing query log sink %s: %w", sink.Name(), err)
+		}
+	}
+	return closeErr
+}
+
+// Stats counts what has happened to entries passed to Log
+type Stats struct {
+	SampledOut uint64
+	Dropped    uint64
+	Written    uint64
+	Errors     uint64
+	Buffered   int
+}
+
+func (l *Logger) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	return Stats{
+		SampledOut: l.sampledOut.Load(),
+		Dropped:    l.dropped.Load(),
+		Written:    l.written.Load(),
+		Errors:     l.errors.Load(),
+		Buffered:   len(l.entries),
+	}
+}
@@ -0,0 +1,191 @@
+package querylog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blockingSink holds up the writer goroutine until released
+type blockingSink struct {
+	release chan struct{}
+	entries []*Entry
+}
+
+func (s *blockingSink) Name() string { return "blocking" }
+func (s *blockingSink) Close() error { return nil }
+func (s *blockingSink) Write(e *Entry) error {
+	<-s.release
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func TestLoggerDropsInsteadOfBlocking(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	l := New(Config{SampleRate: 1, BufferSize: 2}, sink)
+	// Wait for the writer to pick up the first entry and block in the sink
+	l.Log(&Entry{Qname: "fsd.connect.vatsim.net."})
+	require.Eventually(t, func() bool { return l.Stats().Buffered == 0 }, time.Second, time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 9; i++ {
+			l.Log(&Entry{Qname: "fsd.connect.vatsim.net."})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Log blocked on a full buffer")
+	}
+	close(sink.release)
+	require.NoError(t, l.Close(context.Background()))
+	stats := l.Stats()
+	// One entry is held by the sink, two fill the buffer, the rest are dropped
+	assert.Equal(t, uint64(3), stats.Written)
+	assert.Equal(t, uint64(7), stats.Dropped)
+	assert.Len(t, sink.entries, 3)
+
+	// Entries after Close are dropped rather than panicking
+	l.Log(&Entry{})
+	assert.Equal(t, uint64(8), l.Stats().Dropped)
+}
+
+func TestLoggerSampling(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	close(sink.release)
+	l := New(Config{SampleRate: 0, BufferSize: 10}, sink)
+	for i := 0; i < 5; i++ {
+		l.Log(&Entry{})
+	}
+	l.SetSampleRate(1)
+	l.Log(&Entry{})
+	require.NoError(t, l.Close(context.Background()))
+	assert.Equal(t, uint64(5), l.Stats().SampledOut)
+	assert.Equal(t, uint64(1), l.Stats().Written)
+}
+
+func testEntry() *Entry {
+	query := new(dns.Msg)
+	query.SetQuestion("fsd.connect.vatsim.net.", dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(query)
+	rr, _ := dns.NewRR("fsd.connect.vatsim.net. 10 IN A 198.51.100.1")
+	response.Answer = append(response.Answer, rr)
+	return &Entry{
+		Time:       time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Transport:  "udp",
+		ClientIp:   "192.0.2.10",
+		ClientPort: 5353,
+		ECS:        "203.0.113.0/24",
+		GeoIp:      "203.0.113.0",
+		Qname:      "fsd.connect.vatsim.net.",
+		Qtype:      "A",
+		Rcode:      "NOERROR",
+		Server:     "fsd.uk.vatsim.net",
+		ServerIp:   "198.51.100.1",
+		Latency:    1500 * time.Microsecond,
+		Query:      query,
+		Response:   response,
+		LocalAddr:  &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53},
+	}
+}
+
+func TestJSONFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.log")
+	l := New(Config{SampleRate: 1, BufferSize: 10}, NewJSONFileSink(path, 1, 1, 1))
+	l.Log(testEntry())
+	require.NoError(t, l.Close(context.Background()))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	require.True(t, scanner.Scan())
+	line := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+	assert.Equal(t, "203.0.113.0/24", line["ecs"])
+	assert.Equal(t, "NOERROR", line["rcode"])
+	assert.Equal(t, "fsd.uk.vatsim.net", line["server"])
+	assert.Equal(t, 1.5, line["latency_ms"])
+	assert.False(t, scanner.Scan())
+}
+
+func TestDnstapFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.dnstap")
+	sink, err := NewDnstapSink(path, "dnshaiku-test", "dev")
+	require.NoError(t, err)
+	l := New(Config{SampleRate: 1, BufferSize: 10}, sink)
+	l.Log(testEntry())
+	// HTTP entries have no wire messages and are skipped
+	l.Log(&Entry{Transport: "http", Qname: "/v1/connect"})
+	require.NoError(t, l.Close(context.Background()))
+
+	frames := readDnstap(t, path)
+	require.Len(t, frames, 2)
+	assert.Equal(t, "dnshaiku-test", string(frames[0].Identity))
+	assert.Equal(t, dnstap.Message_CLIENT_QUERY, frames[0].Message.GetType())
+	assert.Equal(t, net.ParseIP("192.0.2.10").To4(), net.IP(frames[0].Message.QueryAddress))
+	assert.Equal(t, uint32(53), frames[0].Message.GetResponsePort())
+	assert.Equal(t, dnstap.Message_AUTH_RESPONSE, frames[1].Message.GetType())
+
+	response := new(dns.Msg)
+	require.NoError(t, response.Unpack(frames[1].Message.ResponseMessage))
+	assert.Equal(t, "198.51.100.1", response.Answer[0].(*dns.A).A.String())
+}
+
+func readDnstap(t *testing.T, path string) []*dnstap.Dnstap {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	reader, err := dnstap.NewReader(file, nil)
+	require.NoError(t, err)
+	decoder := dnstap.NewDecoder(reader, 64*1024)
+
+	frames := make([]*dnstap.Dnstap, 0)
+	for {
+		frame := &dnstap.Dnstap{}
+		if err := decoder.Decode(frame); err != nil {
+			return frames
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func TestDnstapFileSinkKeepsPreviousCapture(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "queries.dnstap")
+	capture := func(n int) {
+		sink, err := NewDnstapSink(path, "dnshaiku-test", "dev")
+		require.NoError(t, err)
+		l := New(Config{SampleRate: 1, BufferSize: 10}, sink)
+		for i := 0; i < n; i++ {
+			l.Log(testEntry())
+		}
+		require.NoError(t, l.Close(context.Background()))
+	}
+
+	capture(1)
+	lastWritten := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(path, lastWritten, lastWritten))
+	// The restart keeps the first capture whole rather than truncating or appending to it
+	capture(2)
+	assert.Len(t, readDnstap(t, filepath.Join(dir, "queries-2024-01-01T12-00-00.000.dnstap")), 2)
+	assert.Len(t, readDnstap(t, path), 4)
+
+	// An empty file isn't worth keeping
+	require.NoError(t, os.WriteFile(path, nil, 0o644))
+	capture(1)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -0,0 +1,240 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	dnstap "github.com/dnstap/golang-dnstap"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONSink writes entries as JSON lines
+type JSONSink struct {
+	name    string
+	w       *bufio.Writer
+	closer  io.Closer
+	encoder *json.Encoder
+}
+
+type jsonEntry struct {
+	*Entry
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// NewJSONFileSink writes JSON lines to path, rotating it when it reaches maxSizeMB and keeping
+// maxBackups old files for up to maxAgeDays. A path of - writes to stdout.
+func NewJSONFileSink(path string, maxSizeMB int, maxBackups int, maxAgeDays int) *JSONSink {
+	if path == "-" {
+		return NewJSONSink("stdout", os.Stdout)
+	}
+	sink := NewJSONSink(path, &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSizeMB,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAgeDays,
+		Compress:   true,
+	})
+	return sink
+}
+
+// NewJSONSink writes JSON lines to w, closing it on Close if it is an io.Closer other than stdout
+func NewJSONSink(name string, w io.Writer) *JSONSink {
+	sink := &JSONSink{name: name, w: bufio.NewWriter(w)}
+	if closer, ok := w.(io.Closer); ok && w != os.Stdout {
+		sink.closer = closer
+	}
+	sink.encoder = json.NewEncoder(sink.w)
+	return sink
+}
+
+func (s *JSONSink) Name() string {
+	return s.name
+}
+
+func (s *JSONSink) Write(e *Entry) error {
+	return s.encoder.Encode(jsonEntry{Entry: e, LatencyMs: float64(e.Latency) / float64(time.Millisecond)})
+}
+
+// Flush writes out buffered lines, the Logger calls it whenever it has caught up
+func (s *JSONSink) Flush() error {
+	return s.w.Flush()
+}
+
+func (s *JSONSink) Close() error {
+	err := s.w.Flush()
+	if s.closer != nil {
+		if closeErr := s.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// DnstapSink writes a CLIENT_QUERY and an AUTH_RESPONSE dnstap frame for each DNS entry.
+// Entries without wire messages, such as HTTP ones, are skipped.
+type DnstapSink struct {
+	name     string
+	identity []byte
+	version  []byte
+	writer   dnstap.Writer
+	file     *os.File
+}
+
+// dnstapBackupFormat timestamps a previous capture moved aside, like lumberjack names its backups
+const dnstapBackupFormat = "2006-01-02T15-04-05.000"
+
+// NewDnstapSink writes Frame Streams to output, either unix:<path> for a socket, which is
+// reconnected to as needed, or a file path. A file left by an earlier start is kept as
+// <name>-<time it was last written><ext> rather than appended to, since readers stop at the
+// end of the first stream.
+func NewDnstapSink(output string, identity string, version string) (*DnstapSink, error) {
+	sink := &DnstapSink{name: output, identity: []byte(identity), version: []byte(version)}
+	if socketPath, isSocket := strings.CutPrefix(output, "unix:"); isSocket {
+		socketPath = strings.TrimPrefix(socketPath, "//")
+		sink.writer = dnstap.NewSocketWriter(&net.UnixAddr{Name: socketPath, Net: "unix"}, &dnstap.SocketWriterOptions{
+			Timeout:       5 * time.Second,
+			FlushTimeout:  time.Second,
+			RetryInterval: 5 * time.Second,
+			Dialer:        &net.Dialer{Timeout: 5 * time.Second},
+		})
+		return sink, nil
+	}
+	if err := keepDnstapFile(output); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	sink.file = file
+	sink.writer, err = dnstap.NewWriter(file, nil)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("starting frame stream: %w", err)
+	}
+	return sink, nil
+}
+
+// keepDnstapFile moves a non-empty capture at path aside, removing an empty one
+func keepDnstapFile(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return os.Remove(path)
+	}
+	ext := filepath.Ext(path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), info.ModTime().UTC().Format(dnstapBackupFormat), ext)
+	if err := os.Rename(path, backup); err != nil {
+		return fmt.Errorf("keeping the previous capture: %w", err)
+	}
+	return nil
+}
+
+func (s *DnstapSink) Name() string {
+	return fmt.Sprintf("dnstap %s", s.name)
+}
+
+func (s *DnstapSink) Write(e *Entry) error {
+	if e.Query == nil || e.Response == nil {
+		return nil
+	}
+	query, err := e.Query.Pack()
+	if err != nil {
+		return fmt.Errorf("packing query: %w", err)
+	}
+	response, err := e.Response.Pack()
+	if err != nil {
+		return fmt.Errorf("packing response: %w", err)
+	}
+	queryTime := e.Time
+	responseTime := e.Time.Add(e.Latency)
+
+	message := &dnstap.Message{
+		Type:          dnstap.Message_CLIENT_QUERY.Enum(),
+		QueryTimeSec:  proto.Uint64(uint64(queryTime.Unix())),
+		QueryTimeNsec: proto.Uint32(uint32(queryTime.Nanosecond())),
+		QueryMessage:  query,
+	}
+	s.setAddresses(message, e)
+	if err := s.writeMessage(message); err != nil {
+		return err
+	}
+
+	message = &dnstap.Message{
+		Type:             dnstap.Message_AUTH_RESPONSE.Enum(),
+		QueryTimeSec:     proto.Uint64(uint64(queryTime.Unix())),
+		QueryTimeNsec:    proto.Uint32(uint32(queryTime.Nanosecond())),
+		ResponseTimeSec:  proto.Uint64(uint64(responseTime.Unix())),
+		ResponseTimeNsec: proto.Uint32(uint32(responseTime.Nanosecond())),
+		ResponseMessage:  response,
+	}
+	s.setAddresses(message, e)
+	return s.writeMessage(message)
+}
+
+func (s *DnstapSink) setAddresses(message *dnstap.Message, e *Entry) {
+	if e.Transport == "tcp" {
+		message.SocketProtocol = dnstap.SocketProtocol_TCP.Enum()
+	} else {
+		message.SocketProtocol = dnstap.SocketProtocol_UDP.Enum()
+	}
+	clientIp := net.ParseIP(e.ClientIp)
+	if clientIp4 := clientIp.To4(); clientIp4 != nil {
+		message.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		message.QueryAddress = clientIp4
+	} else if clientIp != nil {
+		message.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		message.QueryAddress = clientIp
+	}
+	message.QueryPort = proto.Uint32(uint32(e.ClientPort))
+	if e.LocalAddr != nil {
+		if host, port, err := net.SplitHostPort(e.LocalAddr.String()); err == nil {
+			if localIp := net.ParseIP(host); localIp != nil {
+				if localIp4 := localIp.To4(); localIp4 != nil {
+					localIp = localIp4
+				}
+				message.ResponseAddress = localIp
+			}
+			if localPort, err := strconv.ParseUint(port, 10, 16); err == nil {
+				message.ResponsePort = proto.Uint32(uint32(localPort))
+			}
+		}
+	}
+}
+
+func (s *DnstapSink) writeMessage(message *dnstap.Message) error {
+	frame, err := proto.Marshal(&dnstap.Dnstap{
+		Type:     dnstap.Dnstap_MESSAGE.Enum(),
+		Identity: s.identity,
+		Version:  s.version,
+		Message:  message,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.writer.WriteFrame(frame)
+	return err
+}
+
+func (s *DnstapSink) Close() error {
+	err := s.writer.Close()
+	if s.file != nil {
+		if closeErr := s.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
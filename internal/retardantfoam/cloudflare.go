@@ -0,0 +1,316 @@
+package retardantfoam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// What a failover profile does
+const (
+	// actionFiles uploads the protocol's IP server files and purges them from Cloudflare's cache
+	actionFiles = "files"
+	// actionDnsRecords replaces DNS records in CLOUDFLARE_ZONE_ID with A records for the FSD servers
+	actionDnsRecords = "dnsRecords"
+)
+
+// How much of Cloudflare's cache a failover purges
+const (
+	purgeEverything = "everything"
+	// purgeFiles purges each uploaded file's url
+	purgeFiles = "files"
+	// purgePrefixes purges the directory of each uploaded file's url
+	purgePrefixes = "prefixes"
+	purgeNone     = "none"
+)
+
+// failoverProfile is how a protocol fails over. Without one, files are uploaded and everything purged.
+type failoverProfile struct {
+	Actions    []string        `yaml:"actions"`
+	Purge      string          `yaml:"purge"`
+	DnsRecords []dnsRecordSpec `yaml:"dnsRecords"`
+}
+
+// dnsRecordSpec is a name whose records are replaced with A records for FSD servers when failing over
+type dnsRecordSpec struct {
+	Name string `yaml:"name"`
+	// Source, FsdRegions and Servers choose the servers like a templated file's
+	Source     string           `yaml:"source"`
+	FsdRegions []string         `yaml:"fsdRegions"`
+	Servers    []templateServer `yaml:"servers"`
+	// TTL defaults to 60 seconds
+	TTL int `yaml:"ttl"`
+	// MaxRecords limits how many servers are used, those with the most remaining slots. 0 uses every one.
+	MaxRecords int `yaml:"maxRecords"`
+}
+
+var defaultProfile = failoverProfile{Actions: []string{actionFiles}, Purge: purgeEverything}
+
+// profileFor is protocol's failover profile
+func profileFor(data retardantFoamDataFile, protocol string) failoverProfile {
+	profile, ok := data.FailoverProfiles[protocol]
+	if !ok {
+		return defaultProfile
+	}
+	if len(profile.Actions) == 0 {
+		profile.Actions = defaultProfile.Actions
+	}
+	if profile.Purge == "" {
+		profile.Purge = purgeEverything
+	}
+	return profile
+}
+
+func (p failoverProfile) has(action string) bool {
+	return contains(p.Actions, action)
+}
+
+// validate checks p and that files, those it uploads, can be purged as it says
+func (p failoverProfile) validate(files []ipServerFile) error {
+	var errs error
+	for _, action := range p.Actions {
+		if action != actionFiles && action != actionDnsRecords {
+			errs = errors.Join(errs, fmt.Errorf("unknown action %q", action))
+		}
+	}
+	switch p.Purge {
+	case purgeEverything, purgeNone:
+	case purgeFiles, purgePrefixes:
+		for _, f := range files {
+			if _, err := fileURL(f); err != nil {
+				errs = errors.Join(errs, fmt.Errorf("purging %s: %w", p.Purge, err))
+			}
+		}
+	default:
+		errs = errors.Join(errs, fmt.Errorf("unknown purge %q", p.Purge))
+	}
+	if p.has(actionDnsRecords) && len(p.DnsRecords) == 0 {
+		errs = errors.Join(errs, errors.New("the dnsRecords action has no dnsRecords"))
+	}
+	for _, r := range p.DnsRecords {
+		if r.Name == "" {
+			errs = errors.Join(errs, errors.New("a DNS record has no name"))
+		}
+		switch r.Source {
+		case sourceTag, sourceDnshaiku, sourceStatic, "":
+		default:
+			errs = errors.Join(errs, fmt.Errorf("%s: unknown source %q", r.Name, r.Source))
+		}
+	}
+	return errs
+}
+
+// recordNames are the DNS record names p replaces
+func (p failoverProfile) recordNames() []string {
+	if !p.has(actionDnsRecords) {
+		return nil
+	}
+	names := make([]string, 0, len(p.DnsRecords))
+	for _, r := range p.DnsRecords {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func fileURL(f ipServerFile) (*url.URL, error) {
+	u, err := url.Parse(f.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%s has no url", f.Name)
+	}
+	return u, nil
+}
+
+// purgeRequest is what to purge after uploading files, empty if nothing is to be
+func purgeRequest(mode string, files []ipServerFile) cloudflare.PurgeCacheRequest {
+	req := cloudflare.PurgeCacheRequest{}
+	if len(files) == 0 {
+		return req
+	}
+	switch mode {
+	case purgeEverything:
+		req.Everything = true
+	case purgeFiles:
+		for _, f := range files {
+			if u, err := fileURL(f); err == nil {
+				req.Files = append(req.Files, u.String())
+			}
+		}
+	case purgePrefixes:
+		for _, f := range files {
+			if u, err := fileURL(f); err == nil {
+				prefix := u.Host + path.Dir(u.Path)
+				if !contains(req.Prefixes, prefix) {
+					req.Prefixes = append(req.Prefixes, prefix)
+				}
+			}
+		}
+	}
+	return req
+}
+
+func purgeEmpty(req cloudflare.PurgeCacheRequest) bool {
+	return !req.Everything && len(req.Files) == 0 && len(req.Prefixes) == 0
+}
+
+// describePurge says what purging req asks Cloudflare to do, for plans
+func describePurge(c *Config, req cloudflare.PurgeCacheRequest) []string {
+	switch {
+	case req.Everything:
+		return []string{fmt.Sprintf("purge everything cached in Cloudflare zone %s", c.CloudflareZoneId)}
+	case len(req.Files) > 0:
+		return []string{fmt.Sprintf("purge %s from Cloudflare zone %s", strings.Join(req.Files, ", "), c.CloudflareZoneId)}
+	case len(req.Prefixes) > 0:
+		return []string{fmt.Sprintf("purge prefixes %s from Cloudflare zone %s", strings.Join(req.Prefixes, ", "), c.CloudflareZoneId)}
+	}
+	return nil
+}
+
+// newCloudflareAPI connects to Cloudflare, or CLOUDFLARE_API_URL if set
+func newCloudflareAPI(c *Config) (*cloudflare.API, error) {
+	opts := make([]cloudflare.Option, 0)
+	if c.CloudflareApiURL != "" {
+		opts = append(opts, cloudflare.BaseURL(c.CloudflareApiURL))
+	}
+	return cloudflare.NewWithAPIToken(c.CloudflareApiKey, opts...)
+}
+
+func (a *storeActions) purgeCloudflareCache(ctx context.Context, req cloudflare.PurgeCacheRequest) error {
+	api, err := a.cloudflare()
+	if err != nil {
+		return err
+	}
+	_, err = api.PurgeCache(ctx, a.config.CloudflareZoneId, req)
+	return err
+}
+
+// savedRecord is a DNS record as it was before failing over
+type savedRecord struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Proxied bool   `json:"proxied"`
+}
+
+func (a *storeActions) listRecords(ctx context.Context, name string) ([]cloudflare.DNSRecord, error) {
+	api, err := a.cloudflare()
+	if err != nil {
+		return nil, err
+	}
+	records, _, err := api.ListDNSRecords(ctx, cloudflare.ZoneIdentifier(a.config.CloudflareZoneId), cloudflare.ListDNSRecordsParams{Name: name})
+	return records, err
+}
+
+// saveRecords lists names' records to restore when failing back
+func (a *storeActions) saveRecords(ctx context.Context, names []string) ([]savedRecord, error) {
+	saved := make([]savedRecord, 0)
+	for _, name := range names {
+		records, err := a.listRecords(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", name, err)
+		}
+		for _, r := range records {
+			saved = append(saved, savedRecord{Type: r.Type, Name: r.Name, Content: r.Content, TTL: r.TTL, Proxied: r.Proxied != nil && *r.Proxied})
+		}
+	}
+	return saved, nil
+}
+
+// replaceRecords deletes name's records and creates replacements. Deleting first is a moment without records,
+// but Cloudflare won't have an A record alongside the NS or CNAME records usually there.
+func (a *storeActions) replaceRecords(ctx context.Context, name string, replacements []savedRecord) error {
+	api, err := a.cloudflare()
+	if err != nil {
+		return err
+	}
+	rc := cloudflare.ZoneIdentifier(a.config.CloudflareZoneId)
+	existing, err := a.listRecords(ctx, name)
+	if err != nil {
+		return fmt.Errorf("listing %s: %w", name, err)
+	}
+	for _, r := range existing {
+		if err := api.DeleteDNSRecord(ctx, rc, r.ID); err != nil {
+			return fmt.Errorf("deleting %s %s %s: %w", r.Name, r.Type, r.Content, err)
+		}
+	}
+	for _, r := range replacements {
+		proxied := r.Proxied
+		_, err := api.CreateDNSRecord(ctx, rc, cloudflare.CreateDNSRecordParams{
+			Type:    r.Type,
+			Name:    r.Name,
+			Content: r.Content,
+			TTL:     r.TTL,
+			Proxied: &proxied,
+		})
+		if err != nil {
+			return fmt.Errorf("creating %s %s %s: %w", r.Name, r.Type, r.Content, err)
+		}
+	}
+	logger.Info(fmt.Sprintf("Replaced %d records for %s with %d in Cloudflare", len(existing), name, len(replacements)))
+	return nil
+}
+
+// failoverRecords are the A records r is replaced with
+func (a *storeActions) failoverRecords(ctx context.Context, r dnsRecordSpec, listed map[string][]templateServer) ([]savedRecord, error) {
+	servers, err := a.selectServers(ctx, r.Name, r.Source, r.FsdRegions, r.Servers, listed)
+	if err != nil {
+		return nil, err
+	}
+	if r.MaxRecords > 0 && len(servers) > r.MaxRecords {
+		servers = servers[:r.MaxRecords]
+	}
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = 60
+	}
+	records := make([]savedRecord, 0, len(servers))
+	for _, s := range servers {
+		records = append(records, savedRecord{Type: "A", Name: r.Name, Content: s.IpAddress, TTL: ttl})
+	}
+	return records, nil
+}
+
+// restoreRecords puts back the records saved for names
+func (a *storeActions) restoreRecords(ctx context.Context, names []string, saved []savedRecord) error {
+	for _, name := range names {
+		records := make([]savedRecord, 0)
+		for _, r := range saved {
+			if r.Name == name {
+				records = append(records, r)
+			}
+		}
+		if err := a.replaceRecords(ctx, name, records); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeRecords says how failing over would change r's records, for plans
+func (a *storeActions) describeRecords(ctx context.Context, r dnsRecordSpec, listed map[string][]templateServer) string {
+	replacements, err := a.failoverRecords(ctx, r, listed)
+	if err != nil {
+		return fmt.Sprintf("leave %s alone, choosing servers failed: %s", r.Name, err)
+	}
+	existing, err := a.listRecords(ctx, r.Name)
+	if err != nil {
+		return fmt.Sprintf("replace the records for %s, listing them failed: %s", r.Name, err)
+	}
+	from := make([]string, 0, len(existing))
+	for _, e := range existing {
+		from = append(from, fmt.Sprintf("%s %s", e.Type, e.Content))
+	}
+	to := make([]string, 0, len(replacements))
+	for _, e := range replacements {
+		to = append(to, fmt.Sprintf("%s %s", e.Type, e.Content))
+	}
+	if len(from) == 0 {
+		from = append(from, "nothing")
+	}
+	return fmt.Sprintf("replace %s %s with %s (ttl %d)", r.Name, strings.Join(from, ", "), strings.Join(to, ", "), replacements[0].TTL)
+}
@@ -0,0 +1,232 @@
+package retardantfoam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCloudflare stands in for the parts of Cloudflare's API retardantfoam uses, for one zone
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	records map[string]cloudflare.DNSRecord
+	nextId  int
+	purges  []cloudflare.PurgeCacheRequest
+	// listErrors is how many record listings fail before they work again
+	listErrors int
+}
+
+func (f *fakeCloudflare) start(t *testing.T) *cloudflare.API {
+	server := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(server.Close)
+	api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(server.URL), cloudflare.UsingRetryPolicy(0, 0, 0), cloudflare.UsingRateLimit(1000))
+	require.NoError(t, err)
+	return api
+}
+
+func (f *fakeCloudflare) add(r cloudflare.DNSRecord) {
+	f.nextId++
+	r.ID = fmt.Sprintf("record-%d", f.nextId)
+	f.records[r.ID] = r
+}
+
+// named are the records for name as "TYPE content", sorted
+func (f *fakeCloudflare) named(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	records := make([]string, 0)
+	for _, r := range f.records {
+		if r.Name == name {
+			records = append(records, fmt.Sprintf("%s %s", r.Type, r.Content))
+		}
+	}
+	sort.Strings(records)
+	return records
+}
+
+func (f *fakeCloudflare) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reply := func(result interface{}, extra map[string]interface{}) {
+		body := map[string]interface{}{"success": true, "errors": []string{}, "messages": []string{}, "result": result}
+		for k, v := range extra {
+			body[k] = v
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(body)
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/zones/zone/purge_cache":
+		req := cloudflare.PurgeCacheRequest{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.purges = append(f.purges, req)
+		reply(map[string]string{"id": "zone"}, nil)
+	case r.Method == http.MethodGet && r.URL.Path == "/zones/zone/dns_records" && f.listErrors > 0:
+		f.listErrors--
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"success": false, "errors": [{"code": 10000, "message": "Internal error"}]}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/zones/zone/dns_records":
+		records := make([]cloudflare.DNSRecord, 0)
+		for _, record := range f.records {
+			if name := r.URL.Query().Get("name"); name == "" || record.Name == name {
+				records = append(records, record)
+			}
+		}
+		reply(records, map[string]interface{}{"result_info": map[string]int{"page": 1, "per_page": 100, "count": len(records), "total_count": len(records), "total_pages": 1}})
+	case r.Method == http.MethodPost && r.URL.Path == "/zones/zone/dns_records":
+		record := cloudflare.DNSRecord{}
+		_ = json.NewDecoder(r.Body).Decode(&record)
+		f.add(record)
+		reply(f.records[fmt.Sprintf("record-%d", f.nextId)], nil)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/zones/zone/dns_records/"):
+		id := strings.TrimPrefix(r.URL.Path, "/zones/zone/dns_records/")
+		if _, ok := f.records[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"success": false, "errors": [{"code": 81044, "message": "Record does not exist."}]}`))
+			return
+		}
+		delete(f.records, id)
+		reply(map[string]string{"id": id}, nil)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"success": false, "errors": [{"code": 7003, "message": "No route for that URI"}]}`))
+	}
+}
+
+const profiledDataFile = `ipServerFiles:
+  - name: "servers.txt"
+    bucket: "vatsim-vatdns"
+    region: "nyc3"
+    url: "https://files.vatsim.net/vatdns/servers.txt"
+    contents: "192.0.2.1"
+  - name: "http.txt"
+    bucket: "vatsim-vatdns"
+    region: "nyc3"
+    url: "https://files.vatsim.net/http/http.txt"
+    protocols: ["http"]
+    contents: "192.0.2.1"
+failoverProfiles:
+  dns:
+    actions: ["files", "dnsRecords"]
+    purge: "files"
+    dnsRecords:
+      - name: "fsd.connect.vatsim.net"
+        maxRecords: 2
+        ttl: 30
+        servers:
+          - {name: "fsd.usa-e.vatsim.net", ip_address: "192.0.2.1", remaining_slots: 10}
+          - {name: "fsd.uk.vatsim.net", ip_address: "192.0.2.2", remaining_slots: 30}
+          - {name: "fsd.ams.vatsim.net", ip_address: "192.0.2.3", remaining_slots: 20}
+  http:
+    purge: "prefixes"
+`
+
+// testCloudflareActions fails over with profiledDataFile against a fakeCloudflare for zone
+func testCloudflareActions(t *testing.T) (*storeActions, *fakeCloudflare) {
+	a, _ := testStoreActions(t)
+	require.NoError(t, os.WriteFile(a.config.DataFile, []byte(profiledDataFile), 0o644))
+	a.config.CloudflareZoneId = "zone"
+	fake := &fakeCloudflare{records: map[string]cloudflare.DNSRecord{}}
+	fake.add(cloudflare.DNSRecord{Type: "NS", Name: "fsd.connect.vatsim.net", Content: "ns1.dnshaiku.vatsim.net", TTL: 3600})
+	fake.add(cloudflare.DNSRecord{Type: "NS", Name: "fsd.connect.vatsim.net", Content: "ns2.dnshaiku.vatsim.net", TTL: 3600})
+	fake.add(cloudflare.DNSRecord{Type: "A", Name: "www.vatsim.net", Content: "198.51.100.1", TTL: 1})
+	api := fake.start(t)
+	a.cloudflare = func() (*cloudflare.API, error) { return api, nil }
+	a.purgeCache = a.purgeCloudflareCache
+	return a, fake
+}
+
+func TestCloudflareDnsRecordFailover(t *testing.T) {
+	ctx := context.Background()
+	a, fake := testCloudflareActions(t)
+
+	require.NoError(t, a.Failover(ctx, protocolDNS))
+	// Only the uploaded files are purged
+	require.Len(t, fake.purges, 1)
+	assert.Equal(t, []string{"https://files.vatsim.net/vatdns/servers.txt", "https://files.vatsim.net/http/http.txt"}, fake.purges[0].Files)
+	assert.False(t, fake.purges[0].Everything)
+	// The delegation is replaced with the two servers with the most remaining slots
+	assert.Equal(t, []string{"A 192.0.2.2", "A 192.0.2.3"}, fake.named("fsd.connect.vatsim.net"))
+	for _, r := range fake.records {
+		if r.Name == "fsd.connect.vatsim.net" {
+			assert.Equal(t, 30, r.TTL)
+		}
+	}
+	assert.Equal(t, []string{"A 198.51.100.1"}, fake.named("www.vatsim.net"))
+
+	require.NoError(t, a.Failback(ctx, protocolDNS))
+	assert.Equal(t, []string{"NS ns1.dnshaiku.vatsim.net", "NS ns2.dnshaiku.vatsim.net"}, fake.named("fsd.connect.vatsim.net"))
+	require.Len(t, fake.purges, 2)
+	assert.Equal(t, fake.purges[0], fake.purges[1], "failing back purges what failing over did")
+}
+
+func TestCloudflareDnsRecordsNotSaved(t *testing.T) {
+	ctx := context.Background()
+	a, fake := testCloudflareActions(t)
+	fake.listErrors = 1
+
+	err := a.Failover(ctx, protocolDNS)
+	assert.ErrorContains(t, err, "not rewriting fsd.connect.vatsim.net, its records couldn't be saved")
+	assert.Equal(t, []string{"NS ns1.dnshaiku.vatsim.net", "NS ns2.dnshaiku.vatsim.net"}, fake.named("fsd.connect.vatsim.net"))
+	blocked, err := a.Blocked(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.False(t, blocked, "the failover didn't finish, so it is tried again")
+
+	// The retry keeps the saved files and adds the records to them
+	require.NoError(t, a.Failover(ctx, protocolDNS))
+	assert.Equal(t, []string{"A 192.0.2.2", "A 192.0.2.3"}, fake.named("fsd.connect.vatsim.net"))
+	require.NoError(t, a.Failback(ctx, protocolDNS))
+	assert.Equal(t, []string{"NS ns1.dnshaiku.vatsim.net", "NS ns2.dnshaiku.vatsim.net"}, fake.named("fsd.connect.vatsim.net"))
+}
+
+func TestCloudflarePurgePrefixes(t *testing.T) {
+	ctx := context.Background()
+	a, fake := testCloudflareActions(t)
+
+	require.NoError(t, a.Failover(ctx, protocolHTTP))
+	require.Len(t, fake.purges, 1)
+	assert.Equal(t, []string{"files.vatsim.net/http"}, fake.purges[0].Prefixes)
+	assert.Len(t, fake.named("fsd.connect.vatsim.net"), 2, "HTTP's profile doesn't touch DNS records")
+	assert.Equal(t, "NS ns1.dnshaiku.vatsim.net", fake.named("fsd.connect.vatsim.net")[0])
+}
+
+func TestCloudflarePlan(t *testing.T) {
+	a, fake := testCloudflareActions(t)
+	plan, err := a.PlanFailover(context.Background(), protocolDNS)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"purge https://files.vatsim.net/vatdns/servers.txt, https://files.vatsim.net/http/http.txt from Cloudflare zone zone"}, plan.Purges)
+	require.Len(t, plan.Records, 1)
+	assert.Contains(t, plan.Records[0], "replace fsd.connect.vatsim.net NS ns")
+	assert.Contains(t, plan.Records[0], "with A 192.0.2.2, A 192.0.2.3 (ttl 30)")
+	assert.Empty(t, fake.purges)
+	assert.Len(t, fake.named("fsd.connect.vatsim.net"), 2)
+}
+
+func TestFailoverProfileValidation(t *testing.T) {
+	a, _ := testStoreActions(t)
+	require.NoError(t, os.WriteFile(a.config.DataFile, []byte(`ipServerFiles:
+  - name: "servers.txt"
+    contents: "192.0.2.1"
+failoverProfiles:
+  dns:
+    actions: ["files", "dnsRecords", "carrierPigeon"]
+    purge: "files"
+  smtp:
+    purge: "none"
+`), 0o644))
+	_, err := readDataFile(a.config.DataFile)
+	assert.ErrorContains(t, err, `unknown action "carrierPigeon"`)
+	assert.ErrorContains(t, err, "purging files: servers.txt has no url")
+	assert.ErrorContains(t, err, "the dnsRecords action has no dnsRecords")
+	assert.ErrorContains(t, err, `unknown protocol "smtp"`)
+}
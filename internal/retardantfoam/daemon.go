@@ -0,0 +1,395 @@
+package retardantfoam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Daemon probes DNS every PROBE_INTERVAL and fails over once fewer than HEALTH_QUORUM droplets have answered
+// correctly for FAILOVER_CONSECUTIVE_FAILURES rounds in a row spanning at least FAILOVER_WINDOW. Rounds where
+// the droplets couldn't be listed are kept in the history but don't count either way.
+//
+// With FAILBACK_ENABLED it fails back after a failover of its own once FAILBACK_QUORUM of the droplets
+// have answered for FAILBACK_CONSECUTIVE_SUCCESSES rounds spanning at least FAILBACK_WINDOW. Neither
+// happens within TRANSITION_COOLDOWN of the last one, so a flapping service doesn't flap the failover.
+//
+// HTTP, DoH and DoT are tracked the same way but separately, failing over only their own files. They are
+// left alone while DNS is failed over, since that pushes every file.
+type Daemon struct {
+	*runner
+
+	mu        sync.Mutex
+	history   []Round
+	lastRound time.Time
+	started   time.Time
+	streaks   map[string]*streak
+	// transitions are the recorded transitions, loaded from storage on the first round
+	transitions       []Transition
+	transitionsLoaded bool
+}
+
+// streak is the run of failing or passing rounds of one protocol
+type streak struct {
+	failures     int
+	failingSince time.Time
+	successes    int
+	healthySince time.Time
+	blocked      bool
+	// ours is whether the blocker was left by failing over, rather than put there by an operator
+	ours bool
+	// lastTransition is the protocol's last failover or failback that succeeded
+	lastTransition *Transition
+}
+
+// update counts a conclusive round of the protocol
+func (s *streak) update(p ProtocolRound, failbackQuorum float64, at time.Time) {
+	if p.Passed() {
+		s.failures = 0
+		s.failingSince = time.Time{}
+	} else {
+		if s.failures == 0 {
+			s.failingSince = at
+		}
+		s.failures++
+	}
+	if p.Quorate(failbackQuorum) {
+		if s.successes == 0 {
+			s.healthySince = at
+		}
+		s.successes++
+	} else {
+		s.successes = 0
+		s.healthySince = time.Time{}
+	}
+}
+
+// ProtocolStatus is the state of one protocol
+type ProtocolStatus struct {
+	Blocked              bool        `json:"blocked"`
+	ConsecutiveFailures  int         `json:"consecutive_failures"`
+	FailingSince         time.Time   `json:"failing_since,omitempty"`
+	ConsecutiveSuccesses int         `json:"consecutive_successes"`
+	HealthySince         time.Time   `json:"healthy_since,omitempty"`
+	LastTransition       *Transition `json:"last_transition,omitempty"`
+}
+
+// Status is what /healthz reports. The top level protocol fields are DNS.
+type Status struct {
+	Healthy bool `json:"healthy"`
+	ProtocolStatus
+	LastRound   time.Time                 `json:"last_round,omitempty"`
+	LastHealthy int                       `json:"last_healthy"`
+	Protocols   map[string]ProtocolStatus `json:"protocols,omitempty"`
+	History     []Round                   `json:"history,omitempty"`
+}
+
+// pending is a transition that is due
+type pending struct {
+	kind     string
+	protocol string
+}
+
+func NewDaemon(c *Config) (*Daemon, error) {
+	r, err := newRunner(c)
+	if err != nil {
+		return nil, err
+	}
+	return newDaemon(r), nil
+}
+
+func newDaemon(r *runner) *Daemon {
+	return &Daemon{runner: r, history: make([]Round, 0, r.config.HistorySize), streaks: map[string]*streak{}}
+}
+
+// Run probes until ctx is done, serving /metrics and /healthz on PROMETHEUS_METRICS_PORT
+func (d *Daemon) Run(ctx context.Context) error {
+	defer d.close()
+	defer d.releaseLease()
+	d.started = d.now()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/healthz", d.handleHealthz)
+	server := &http.Server{Addr: fmt.Sprintf(":%s", d.config.MetricsPort), Handler: mux}
+	serverErr := make(chan error, 1)
+	go func() {
+		logger.Info(fmt.Sprintf("Serving /metrics and /healthz on port %s", d.config.MetricsPort))
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info(fmt.Sprintf("retardantfoam daemon probing every %s, failing over after %d failed rounds over %s",
+		d.config.ProbeInterval, d.config.FailoverFailures, d.config.FailoverWindow))
+	if d.config.FailbackEnabled {
+		logger.Info(fmt.Sprintf("Failing back after %d healthy rounds over %s, at most once every %s",
+			d.config.FailbackSuccesses, d.config.FailbackWindow, d.config.TransitionCooldown))
+	}
+	ticker := time.NewTicker(d.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		d.runRound(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-serverErr:
+			return fmt.Errorf("metrics server: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// runRound probes once, writes the heartbeat if DNS is working and fails over or back if it is time to
+func (d *Daemon) runRound(ctx context.Context) {
+	if !d.transitionsLoaded {
+		d.loadTransitions(ctx)
+	}
+	start := time.Now()
+	round := d.prober.Probe(ctx)
+	probeDuration.Observe(time.Since(start).Seconds())
+	d.saveRound(ctx, round)
+
+	blocked := make(map[string]bool)
+	ours := make(map[string]bool)
+	var blockedErr error
+	for _, p := range round.All() {
+		b, err := d.actions.Blocked(ctx, p.Protocol)
+		if err == nil && b {
+			var note *BlockerNote
+			note, err = d.actions.BlockerNote(ctx, p.Protocol)
+			ours[p.Protocol] = note.leftByFailover()
+		}
+		if err != nil {
+			blockedErr = err
+			b = true
+		}
+		blocked[p.Protocol] = b
+	}
+	if blockedErr != nil {
+		// Carry on probing, but don't act without knowing whether we're allowed to
+		logger.Error(fmt.Sprintf("Unable contact Spaces: %s", blockedErr))
+	}
+	due := d.record(round, blocked, ours)
+	if blockedErr != nil {
+		return
+	}
+	// The lease is renewed every round so it doesn't lapse between failures
+	leader := d.leader(ctx)
+
+	if !blocked[protocolDNS] && round.Conclusive() {
+		if err := d.heartbeat(ctx, round); err != nil {
+			heartbeatWriteErrors.Inc()
+		}
+	}
+	for _, p := range due {
+		if !leader {
+			logger.Info(fmt.Sprintf("%s of %s is due, but another instance holds the lease.", p.kind, strings.ToUpper(p.protocol)))
+			continue
+		}
+		d.mu.Lock()
+		s := *d.streaks[p.protocol]
+		d.mu.Unlock()
+		name := strings.ToUpper(p.protocol)
+		var t *Transition
+		var err error
+		switch p.kind {
+		case transitionFailover:
+			failingFor := d.now().Sub(s.failingSince).Truncate(time.Second)
+			logger.Error(fmt.Sprintf("%s has failed its health check for %d rounds over %s, pushing IP server list and flushing Cloudflare cache.", name, s.failures, failingFor))
+			t, err = d.failover(ctx, p.protocol, fmt.Sprintf("%s has failed its health check for %d probe rounds over %s. Failing over to the IP server list.", name, s.failures, failingFor),
+				map[string]string{
+					"failed_rounds": strconv.Itoa(s.failures),
+					"failing_for":   failingFor.String(),
+				})
+		case transitionFailback:
+			healthyFor := d.now().Sub(s.healthySince).Truncate(time.Second)
+			logger.Info(fmt.Sprintf("%s has been healthy for %d rounds over %s, restoring the server files and removing the heartbeat blocker.", name, s.successes, healthyFor))
+			t, err = d.failback(ctx, p.protocol, fmt.Sprintf("%s has been healthy for %d probe rounds over %s. Failing back.", name, s.successes, healthyFor),
+				map[string]string{
+					"healthy_rounds": strconv.Itoa(s.successes),
+					"healthy_for":    healthyFor.String(),
+				})
+		}
+		d.transitioned(t, err)
+	}
+}
+
+// loadTransitions reads the past failovers and failbacks, which the cooldown and failback are based on
+func (d *Daemon) loadTransitions(ctx context.Context) {
+	transitions, err := d.actions.Transitions(ctx)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to read past transitions, trying again next round: %s", err))
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.transitions = transitions
+	d.transitionsLoaded = true
+	for protocol, s := range d.streaks {
+		s.lastTransition = lastSucceeded(transitions, protocol)
+	}
+}
+
+// streak returns protocol's streak, creating it if needed. d.mu must be held.
+func (d *Daemon) streak(protocol string) *streak {
+	s, ok := d.streaks[protocol]
+	if !ok {
+		s = &streak{lastTransition: lastSucceeded(d.transitions, protocol)}
+		d.streaks[protocol] = s
+	}
+	return s
+}
+
+// transitioned counts a failover or failback and, if it succeeded, starts the cooldown
+func (d *Daemon) transitioned(t *Transition, err error) {
+	counter := failovers
+	if t.Kind == transitionFailback {
+		counter = failbacks
+	}
+	if err != nil {
+		counter.WithLabelValues(t.Protocol, "error").Inc()
+		logger.Error(fmt.Sprintf("%s of %s failed, retrying next round: %s", t.Kind, t.Protocol, err))
+		return
+	}
+	counter.WithLabelValues(t.Protocol, "ok").Inc()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.streak(t.Protocol)
+	s.lastTransition = t
+	s.blocked = t.Kind == transitionFailover
+	s.ours = s.blocked
+}
+
+// record adds round to the history and returns the transitions that are due. ours has the protocols
+// whose blockers were left by failing over.
+func (d *Daemon) record(round Round, blocked map[string]bool, ours map[string]bool) []pending {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.history) == d.config.HistorySize {
+		copy(d.history, d.history[1:])
+		d.history = d.history[:len(d.history)-1]
+	}
+	d.history = append(d.history, round)
+	d.lastRound = round.Time
+
+	for _, p := range round.All() {
+		s := d.streak(p.Protocol)
+		s.blocked = blocked[p.Protocol]
+		s.ours = ours[p.Protocol]
+		switch {
+		case !round.Conclusive():
+			probeRounds.WithLabelValues(p.Protocol, "inconclusive").Inc()
+		case p.Passed():
+			probeRounds.WithLabelValues(p.Protocol, "pass").Inc()
+		default:
+			probeRounds.WithLabelValues(p.Protocol, "fail").Inc()
+		}
+		if round.Conclusive() {
+			s.update(p, d.config.FailbackQuorum, round.Time)
+		}
+		probedServers.WithLabelValues(p.Protocol).Set(float64(len(p.Servers)))
+		healthyServers.WithLabelValues(p.Protocol).Set(float64(p.Healthy))
+		consecutiveFailures.WithLabelValues(p.Protocol).Set(float64(s.failures))
+		consecutiveSuccesses.WithLabelValues(p.Protocol).Set(float64(s.successes))
+		if s.blocked {
+			blockedGauge.WithLabelValues(p.Protocol).Set(1)
+		} else {
+			blockedGauge.WithLabelValues(p.Protocol).Set(0)
+		}
+	}
+
+	// DNS comes first. While it is failed over, or about to be, every file is already taken care of.
+	due := make([]pending, 0)
+	for _, p := range round.All() {
+		if kind := d.due(p.Protocol); kind != "" {
+			due = append(due, pending{kind: kind, protocol: p.Protocol})
+		}
+		if p.Protocol == protocolDNS && (d.streak(protocolDNS).blocked || len(due) > 0) {
+			break
+		}
+	}
+	return due
+}
+
+// due returns the transition protocol is due, if any. d.mu must be held.
+func (d *Daemon) due(protocol string) string {
+	s := d.streak(protocol)
+	now := d.now()
+	if s.lastTransition != nil && now.Sub(s.lastTransition.Time) < d.config.TransitionCooldown {
+		return ""
+	}
+	if !s.blocked && s.failures >= d.config.FailoverFailures && now.Sub(s.failingSince) >= d.config.FailoverWindow {
+		return transitionFailover
+	}
+	// Only fail back from a failover of our own whose blocker is still in place. A blocker put there by hand,
+	// or by disarming after the failover was armed, stays until it is removed by hand.
+	if s.blocked && s.ours && d.config.FailbackEnabled && s.lastTransition != nil && s.lastTransition.Kind == transitionFailover &&
+		s.successes >= d.config.FailbackSuccesses && now.Sub(s.healthySince) >= d.config.FailbackWindow {
+		return transitionFailback
+	}
+	return ""
+}
+
+func (s *streak) status() ProtocolStatus {
+	return ProtocolStatus{
+		Blocked:              s.blocked,
+		ConsecutiveFailures:  s.failures,
+		FailingSince:         s.failingSince,
+		ConsecutiveSuccesses: s.successes,
+		HealthySince:         s.healthySince,
+		LastTransition:       s.lastTransition,
+	}
+}
+
+// Status reports the daemon's state. It is unhealthy if no round has finished in three intervals.
+func (d *Daemon) Status(withHistory bool) Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	since := d.lastRound
+	if since.IsZero() {
+		since = d.started
+	}
+	status := Status{
+		Healthy:        d.now().Sub(since) < 3*d.config.ProbeInterval,
+		ProtocolStatus: d.streak(protocolDNS).status(),
+		LastRound:      d.lastRound,
+	}
+	for protocol, s := range d.streaks {
+		if protocol == protocolDNS {
+			continue
+		}
+		if status.Protocols == nil {
+			status.Protocols = make(map[string]ProtocolStatus)
+		}
+		status.Protocols[protocol] = s.status()
+	}
+	if len(d.history) > 0 {
+		status.LastHealthy = d.history[len(d.history)-1].Healthy
+	}
+	if withHistory {
+		status.History = append([]Round{}, d.history...)
+	}
+	return status
+}
+
+// handleHealthz serves the daemon's Status, with the probe history if ?history is set
+func (d *Daemon) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	status := d.Status(r.URL.Query().Has("history"))
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,378 @@
+package retardantfoam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeActions records what retardantfoam did instead of touching Spaces and Cloudflare
+type fakeActions struct {
+	blocked       map[string]bool
+	blockedErr    error
+	lastHeartbeat time.Time
+	heartbeats    int
+	renders       int
+	plans         []string
+	failovers     int
+	failoverErr   error
+	failbacks     int
+	transitions   []Transition
+	notes         map[string]BlockerNote
+	rounds        int
+	lastRound     *Round
+	audits        []AuditRecord
+}
+
+func (a *fakeActions) Blocked(ctx context.Context, protocol string) (bool, error) {
+	return a.blocked[protocol], a.blockedErr
+}
+
+func (a *fakeActions) LastHeartbeat(ctx context.Context) (time.Time, error) {
+	return a.lastHeartbeat, nil
+}
+
+func (a *fakeActions) WriteHeartbeat(ctx context.Context) error {
+	a.heartbeats++
+	a.lastHeartbeat = time.Now()
+	return nil
+}
+
+func (a *fakeActions) RenderFiles(ctx context.Context) error {
+	a.renders++
+	return nil
+}
+
+func (a *fakeActions) PlanFailover(ctx context.Context, protocol string) (*FailoverPlan, error) {
+	a.plans = append(a.plans, protocol)
+	return &FailoverPlan{Protocol: protocol}, nil
+}
+
+func (a *fakeActions) Failover(ctx context.Context, protocol string) error {
+	a.failovers++
+	if a.failoverErr != nil {
+		return a.failoverErr
+	}
+	return a.Disarm(ctx, protocol, BlockerNote{Operator: failoverOperator, Reason: "failed over"})
+}
+
+func (a *fakeActions) Failback(ctx context.Context, protocol string) error {
+	a.failbacks++
+	return a.Arm(ctx, protocol)
+}
+
+func (a *fakeActions) Transitions(ctx context.Context) ([]Transition, error) {
+	return a.transitions, nil
+}
+
+func (a *fakeActions) RecordTransition(ctx context.Context, t Transition) error {
+	a.transitions = append(a.transitions, t)
+	return nil
+}
+
+func (a *fakeActions) BlockerNote(ctx context.Context, protocol string) (*BlockerNote, error) {
+	if note, ok := a.notes[protocol]; ok {
+		return &note, nil
+	}
+	return nil, nil
+}
+
+func (a *fakeActions) Disarm(ctx context.Context, protocol string, note BlockerNote) error {
+	if a.notes == nil {
+		a.notes = map[string]BlockerNote{}
+	}
+	a.notes[protocol] = note
+	a.blocked[protocol] = true
+	return nil
+}
+
+func (a *fakeActions) Arm(ctx context.Context, protocol string) error {
+	delete(a.notes, protocol)
+	a.blocked[protocol] = false
+	return nil
+}
+
+func (a *fakeActions) FailedOver(ctx context.Context, protocol string) (bool, error) {
+	return a.failovers > a.failbacks, nil
+}
+
+func (a *fakeActions) SaveRound(ctx context.Context, round Round) error {
+	a.rounds++
+	a.lastRound = &round
+	return nil
+}
+
+func (a *fakeActions) LastRound(ctx context.Context) (*Round, error) {
+	return a.lastRound, nil
+}
+
+func (a *fakeActions) RecordAudit(ctx context.Context, record AuditRecord) error {
+	a.audits = append(a.audits, record)
+	return nil
+}
+
+// fakeProber returns queued rounds, timestamped by the daemon's clock
+type fakeProber struct {
+	now    func() time.Time
+	rounds []Round
+}
+
+func (p *fakeProber) Probe(ctx context.Context) Round {
+	round := p.rounds[0]
+	p.rounds = p.rounds[1:]
+	round.Time = p.now()
+	return round
+}
+
+var (
+	passed       = Round{Healthy: 2, Servers: []DnsServer{{Name: "a", Pass: true}, {Name: "b", Pass: true}}}
+	partial      = Round{Healthy: 1, Servers: []DnsServer{{Name: "a", Pass: true}, {Name: "b"}}}
+	failed       = Round{Servers: []DnsServer{{Name: "a"}, {Name: "b"}}}
+	inconclusive = Round{Error: "listing droplets: 503"}
+)
+
+func testDaemon(rounds ...Round) (*Daemon, *fakeActions, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	actions := &fakeActions{blocked: map[string]bool{}}
+	r := &runner{
+		config:  &Config{ProbeInterval: 30 * time.Second, FailoverFailures: 3, FailoverWindow: time.Minute, HistorySize: 4},
+		actions: actions,
+		prober:  &fakeProber{now: clock, rounds: rounds},
+		now:     clock,
+	}
+	return newDaemon(r), actions, &now
+}
+
+func TestDaemonFailsOverAfterSustainedFailures(t *testing.T) {
+	d, actions, now := testDaemon(failed, failed, inconclusive, passed, failed, failed, failed, failed)
+	step := func() {
+		d.runRound(context.Background())
+		*now = now.Add(30 * time.Second)
+	}
+
+	// An inconclusive round doesn't count either way
+	step()
+	step()
+	step()
+	assert.Equal(t, 2, d.Status(false).ConsecutiveFailures)
+	// A passing round resets the streak
+	step()
+	assert.Equal(t, 0, d.Status(false).ConsecutiveFailures)
+	assert.Equal(t, 1, actions.heartbeats)
+	assert.Equal(t, 0, actions.failovers)
+
+	// Three failures spanning a minute
+	step()
+	step()
+	assert.Equal(t, 0, actions.failovers)
+	step()
+	assert.Equal(t, 1, actions.failovers)
+	// The blocker is now in place, so failing rounds are recorded but nothing more is done
+	step()
+	assert.Equal(t, 1, actions.failovers)
+	status := d.Status(true)
+	assert.True(t, status.Blocked)
+	assert.Equal(t, 4, status.ConsecutiveFailures)
+	assert.Len(t, status.History, 4)
+}
+
+func TestDaemonRetriesFailedFailover(t *testing.T) {
+	d, actions, now := testDaemon(failed, failed, failed, failed)
+	d.config.FailoverFailures = 2
+	d.config.FailoverWindow = 0
+	actions.failoverErr = errors.New("Cloudflare is down")
+	for i := 0; i < 4; i++ {
+		d.runRound(context.Background())
+		*now = now.Add(30 * time.Second)
+	}
+	assert.Equal(t, 3, actions.failovers)
+	// Failed attempts are recorded too
+	require.Len(t, actions.transitions, 3)
+	assert.Equal(t, "Cloudflare is down", actions.transitions[0].Error)
+}
+
+func TestDaemonFailsBackAfterSustainedRecovery(t *testing.T) {
+	d, actions, now := testDaemon(failed, failed, failed, passed, partial, passed, passed, passed, passed, passed)
+	d.config.FailbackEnabled = true
+	d.config.FailbackSuccesses = 2
+	d.config.FailbackWindow = 30 * time.Second
+	d.config.FailbackQuorum = 1
+	d.config.TransitionCooldown = 3 * time.Minute
+	step := func() {
+		d.runRound(context.Background())
+		*now = now.Add(30 * time.Second)
+	}
+
+	// Fail over at 1m
+	step()
+	step()
+	step()
+	assert.Equal(t, 1, actions.failovers)
+	// A round where not every droplet answered breaks the streak
+	step()
+	step()
+	assert.Equal(t, 0, d.Status(false).ConsecutiveSuccesses)
+	// Healthy for long enough at 3m, but within the cooldown until 4m
+	step()
+	step()
+	step()
+	assert.Equal(t, 0, actions.failbacks)
+	step()
+	assert.Equal(t, 1, actions.failbacks)
+	status := d.Status(false)
+	require.NotNil(t, status.LastTransition)
+	assert.Equal(t, transitionFailback, status.LastTransition.Kind)
+	require.Len(t, actions.transitions, 2)
+	assert.Equal(t, transitionFailover, actions.transitions[0].Kind)
+	assert.Equal(t, transitionFailback, actions.transitions[1].Kind)
+
+	// Back to normal, writing heartbeats
+	step()
+	assert.False(t, d.Status(false).Blocked)
+	assert.Equal(t, 1, actions.heartbeats)
+}
+
+func TestDaemonLeavesAnOperatorsBlocker(t *testing.T) {
+	d, actions, now := testDaemon(failed, failed, failed, passed, passed, passed, passed)
+	d.config.FailbackEnabled = true
+	d.config.FailbackSuccesses = 2
+	d.config.FailbackWindow = 30 * time.Second
+	d.config.FailbackQuorum = 1
+	ctx := context.Background()
+	step := func() {
+		d.runRound(ctx)
+		*now = now.Add(30 * time.Second)
+	}
+
+	step()
+	step()
+	step()
+	require.Equal(t, 1, actions.failovers)
+	// An operator arms it while failed over, then disarms it for maintenance
+	out := bytes.Buffer{}
+	require.Equal(t, operatorOK, d.operate(ctx, "arm", OperatorOptions{Operator: "jdoe", Reason: "looking into it"}, &out))
+	step()
+	require.Equal(t, operatorOK, d.operate(ctx, "disarm", OperatorOptions{Operator: "jdoe", Reason: "maintenance"}, &out))
+	step()
+	step()
+	step()
+	assert.Equal(t, 0, actions.failbacks, "the last transition was a failover, but the blocker is the operator's")
+	assert.True(t, actions.blocked[protocolDNS])
+	assert.Equal(t, "maintenance", actions.notes[protocolDNS].Reason)
+}
+
+func TestDaemonDoesNotFailBackFromManualBlocker(t *testing.T) {
+	d, actions, now := testDaemon(passed, passed, passed)
+	d.config.FailbackEnabled = true
+	d.config.FailbackSuccesses = 1
+	actions.blocked[protocolDNS] = true
+	// The last transition was a failback, so the blocker was put there by hand
+	actions.transitions = []Transition{
+		{Time: now.Add(-time.Hour), Kind: transitionFailover, Protocol: protocolDNS},
+		{Time: now.Add(-time.Hour), Kind: transitionFailback, Protocol: protocolDNS},
+	}
+	for i := 0; i < 3; i++ {
+		d.runRound(context.Background())
+		*now = now.Add(30 * time.Second)
+	}
+	assert.Equal(t, 0, actions.failbacks)
+	assert.True(t, d.Status(false).Blocked)
+}
+
+func TestDaemonFailsOverOneProtocol(t *testing.T) {
+	httpFailing := passed
+	httpFailing.Protocols = []ProtocolRound{
+		{Protocol: protocolHTTP, Servers: []DnsServer{{Name: "a"}, {Name: "b"}}, Required: 1},
+		{Protocol: protocolDoT, Servers: []DnsServer{{Name: "dot", Pass: true}}, Healthy: 1, Required: 1},
+	}
+	d, actions, now := testDaemon(httpFailing, httpFailing, httpFailing, httpFailing)
+	for i := 0; i < 4; i++ {
+		d.runRound(context.Background())
+		*now = now.Add(30 * time.Second)
+	}
+
+	// HTTP fails over alone, DNS stays healthy and keeps its heartbeat
+	assert.Equal(t, 1, actions.failovers)
+	assert.True(t, actions.blocked[protocolHTTP])
+	assert.False(t, actions.blocked[protocolDNS])
+	assert.False(t, actions.blocked[protocolDoT])
+	assert.Equal(t, 4, actions.heartbeats)
+	require.Len(t, actions.transitions, 1)
+	assert.Equal(t, protocolHTTP, actions.transitions[0].Protocol)
+	status := d.Status(false)
+	assert.True(t, status.Healthy)
+	assert.True(t, status.Protocols[protocolHTTP].Blocked)
+	assert.Equal(t, 4, status.Protocols[protocolHTTP].ConsecutiveFailures)
+}
+
+func TestDaemonDoesNothingWhenSpacesIsUnreachable(t *testing.T) {
+	d, actions, _ := testDaemon(failed, failed, failed)
+	d.config.FailoverFailures = 1
+	actions.blockedErr = errors.New("connection refused")
+	d.runRound(context.Background())
+	assert.Equal(t, 0, actions.failovers)
+	assert.Equal(t, 1, d.Status(false).ConsecutiveFailures)
+}
+
+func TestDaemonHealthz(t *testing.T) {
+	d, _, now := testDaemon(passed)
+	d.started = *now
+	d.runRound(context.Background())
+
+	recorder := httptest.NewRecorder()
+	d.handleHealthz(recorder, httptest.NewRequest(http.MethodGet, "/healthz?history", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	status := Status{}
+	require.NoError(t, json.NewDecoder(recorder.Body).Decode(&status))
+	assert.Equal(t, 2, status.LastHealthy)
+	assert.Len(t, status.History, 1)
+
+	// No round for three intervals means the loop is stuck
+	*now = now.Add(2 * time.Minute)
+	recorder = httptest.NewRecorder()
+	d.handleHealthz(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
+
+func TestRunOnce(t *testing.T) {
+	newOnce := func(lastHeartbeat time.Time, rounds ...Round) (*runner, *fakeActions) {
+		actions := &fakeActions{lastHeartbeat: lastHeartbeat, blocked: map[string]bool{}}
+		return &runner{
+			config:  &Config{FailoverTimeLimit: 5 * time.Minute},
+			actions: actions,
+			prober:  &fakeProber{now: time.Now, rounds: rounds},
+			now:     time.Now,
+		}, actions
+	}
+
+	// First run, DNS working
+	r, actions := newOnce(time.Time{}, passed)
+	assert.Equal(t, 0, r.runOnce(context.Background()))
+	assert.Equal(t, 1, actions.heartbeats)
+	assert.Equal(t, 1, actions.renders)
+
+	// Recent heartbeat, DNS failing: nothing written, no failover yet
+	r, actions = newOnce(time.Now().Add(-time.Minute), failed)
+	assert.Equal(t, 0, r.runOnce(context.Background()))
+	assert.Equal(t, 0, actions.heartbeats)
+	assert.Equal(t, 0, actions.renders)
+	assert.Equal(t, 0, actions.failovers)
+
+	// Stale heartbeat fails over without probing
+	r, actions = newOnce(time.Now().Add(-10 * time.Minute))
+	assert.Equal(t, 0, r.runOnce(context.Background()))
+	assert.Equal(t, 1, actions.failovers)
+
+	// Blocked
+	r, actions = newOnce(time.Time{})
+	actions.blocked[protocolDNS] = true
+	assert.Equal(t, 1, r.runOnce(context.Background()))
+}
@@ -0,0 +1,264 @@
+package retardantfoam
+
+import (
+	"context"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/digitalocean/godo"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"path/filepath"
+	"time"
+)
+
+type retardantFoamDataFile struct {
+	IpServerFiles []ipServerFile `yaml:"ipServerFiles"`
+	// FailoverProfiles are how each protocol fails over, by protocol
+	FailoverProfiles map[string]failoverProfile `yaml:"failoverProfiles"`
+}
+
+type ipServerFile struct {
+	Name     string `yaml:"name"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	Contents string `yaml:"contents"`
+	// URL is where the file is downloaded through Cloudflare, for purging only it
+	URL string `yaml:"url"`
+	// Template renders the file from Source's servers instead of using Contents
+	Template string `yaml:"template"`
+	// Source is where the template's servers come from: tag, dnshaiku or static
+	Source string `yaml:"source"`
+	// FsdRegions limits the template's servers to these FSD regions, e.g. usa-e
+	FsdRegions []string `yaml:"fsdRegions"`
+	// Servers are the static source's servers, and what the template falls back to if another source fails
+	Servers []templateServer `yaml:"servers"`
+	// Protocols are the non-DNS protocols whose failure pushes this file, e.g. http. A DNS failover pushes every file.
+	Protocols []string `yaml:"protocols"`
+}
+
+// filesFor are the files pushed when protocol fails
+func filesFor(files []ipServerFile, protocol string) []ipServerFile {
+	if protocol == protocolDNS {
+		return files
+	}
+	matching := make([]ipServerFile, 0)
+	for _, v := range files {
+		for _, p := range v.Protocols {
+			if p == protocol {
+				matching = append(matching, v)
+				break
+			}
+		}
+	}
+	return matching
+}
+
+// scopedKey is key for protocol. DNS failing over fails everything over, so it uses the plain key.
+func scopedKey(key string, protocol string) string {
+	if protocol == protocolDNS {
+		return key
+	}
+	return fmt.Sprintf("%s-%s", key, protocol)
+}
+
+// actions are what retardantfoam does to the outside world. Failing over is per protocol: DNS pushes every
+// IP server file and disables retardantfoam, the others push only their own files and disable only themselves.
+type actions interface {
+	// Blocked is whether the heartbeat blocker for protocol exists. The DNS one disables retardantfoam.
+	Blocked(ctx context.Context, protocol string) (bool, error)
+	// LastHeartbeat returns when the heartbeat was last written, zero if it never has been
+	LastHeartbeat(ctx context.Context) (time.Time, error)
+	WriteHeartbeat(ctx context.Context) error
+	// Failover does what protocol's profile says, by default pushing its IP server files and flushing
+	// Cloudflare's cache, then writes its heartbeat blocker
+	Failover(ctx context.Context, protocol string) error
+	// RenderFiles keeps the templated IP server files rendered from the current servers, ready to fail over
+	RenderFiles(ctx context.Context) error
+	// Failback restores protocol's IP server files and DNS records as they were before Failover, flushes
+	// Cloudflare's cache and removes its blocker, writing the heartbeat first for DNS
+	Failback(ctx context.Context, protocol string) error
+	// PlanFailover reads what Failover would change for protocol without changing anything
+	PlanFailover(ctx context.Context, protocol string) (*FailoverPlan, error)
+	// Transitions returns the recorded failovers and failbacks, oldest first
+	Transitions(ctx context.Context) ([]Transition, error)
+	RecordTransition(ctx context.Context, t Transition) error
+	// BlockerNote is who wrote protocol's blocker and why, nil if it has no note
+	BlockerNote(ctx context.Context, protocol string) (*BlockerNote, error)
+	// Disarm writes protocol's blocker with note, Arm removes it
+	Disarm(ctx context.Context, protocol string, note BlockerNote) error
+	Arm(ctx context.Context, protocol string) error
+	// FailedOver is whether protocol has failover state saved to fail back to
+	FailedOver(ctx context.Context, protocol string) (bool, error)
+	// SaveRound keeps the latest probe round, which LastRound returns, nil if there is none
+	SaveRound(ctx context.Context, round Round) error
+	LastRound(ctx context.Context) (*Round, error)
+	RecordAudit(ctx context.Context, record AuditRecord) error
+}
+
+// storeActions keeps the heartbeat in the Store for DO_SPACES_BUCKET_NAME and fails over as each protocol's
+// profile says, writing the IP server files to their buckets and purging Cloudflare's cache or rewriting
+// Cloudflare DNS records
+type storeActions struct {
+	config *Config
+	store  storage.Store
+	// openStore opens the Store for an IP server file's bucket
+	openStore  func(region, bucket string) (storage.Store, error)
+	cloudflare func() (*cloudflare.API, error)
+	purgeCache func(ctx context.Context, req cloudflare.PurgeCacheRequest) error
+	// sources list the servers templated files are rendered from, by name
+	sources map[string]serverSource
+	now     func() time.Time
+	// rendered is when the templated files were last rendered
+	rendered time.Time
+}
+
+func newStoreActions(c *Config) (*storeActions, error) {
+	store, err := openStore(c, c.DoSpacesRegion, c.DoSpacesBucketName)
+	if err != nil {
+		return nil, err
+	}
+	client := godo.NewFromToken(c.DoApiKey)
+	a := &storeActions{
+		config: c,
+		store:  store,
+		openStore: func(region, bucket string) (storage.Store, error) {
+			return openStore(c, region, bucket)
+		},
+		cloudflare: func() (*cloudflare.API, error) {
+			return newCloudflareAPI(c)
+		},
+		sources: map[string]serverSource{
+			sourceTag:      tagSource(c, client),
+			sourceDnshaiku: dnshaikuSource(c, client),
+		},
+		now: time.Now,
+	}
+	a.purgeCache = a.purgeCloudflareCache
+	return a, nil
+}
+
+// openStore opens bucket with STORAGE_BACKEND. S3 buckets are in the Spaces region unless
+// STORAGE_ENDPOINT is set, and file backed buckets are directories in STORAGE_DIR.
+func openStore(c *Config, region, bucket string) (storage.Store, error) {
+	switch c.StorageBackend {
+	case "file":
+		return storage.NewFileStore(filepath.Join(c.StorageDir, bucket))
+	case "s3":
+		endpoint := c.StorageEndpoint
+		if endpoint == "" {
+			endpoint = storage.SpacesEndpoint(region)
+		}
+		return storage.NewS3Store(storage.S3Config{
+			Endpoint:  endpoint,
+			Region:    region,
+			Bucket:    bucket,
+			AccessKey: c.DoSpacesKey,
+			SecretKey: c.DoSpacesSecret,
+			PathStyle: c.StoragePathStyle,
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", c.StorageBackend)
+}
+
+// failoverProfile is protocol's profile in RETARDANTFOAM_DATA_FILE and the IP server files it uploads
+func (a *storeActions) failoverProfile(protocol string) (failoverProfile, []ipServerFile, error) {
+	retardantFoamData, err := readDataFile(a.config.DataFile)
+	if err != nil {
+		return failoverProfile{}, nil, err
+	}
+	profile := profileFor(retardantFoamData, protocol)
+	if !profile.has(actionFiles) {
+		return profile, nil, nil
+	}
+	return profile, filesFor(retardantFoamData.IpServerFiles, protocol), nil
+}
+
+func (a *storeActions) Blocked(ctx context.Context, protocol string) (bool, error) {
+	_, err := a.store.Head(ctx, scopedKey(heartbeatBlockerKey, protocol))
+	if err == nil {
+		return true, nil
+	}
+	if storage.IsNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (a *storeActions) LastHeartbeat(ctx context.Context) (time.Time, error) {
+	info, err := a.store.Head(ctx, heartbeatKey)
+	if err != nil {
+		if storage.IsNotFound(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return info.LastModified, nil
+}
+
+func (a *storeActions) WriteHeartbeat(ctx context.Context) error {
+	return a.store.Put(ctx, heartbeatKey, []byte{})
+}
+
+func (a *storeActions) Failover(ctx context.Context, protocol string) error {
+	profile, files, err := a.failoverProfile(protocol)
+	if err != nil {
+		return err
+	}
+	purge := purgeRequest(profile.Purge, files)
+	savedRecords, recordsErr := a.saveFailoverState(ctx, protocol, files, profile.recordNames(), purge)
+	listed := make(map[string][]templateServer)
+	// Push IP files to Spaces
+	for _, v := range files {
+		contents, err := a.contents(ctx, v, listed)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to render %s: %s", v.Name, err))
+			continue
+		}
+		store, err := a.openStore(v.Region, v.Bucket)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to upload %s to Spaces: %s", v.Name, err))
+			continue
+		}
+		if err := store.Put(ctx, v.Name, contents); err != nil {
+			logger.Error(fmt.Sprintf("Failed to upload %s to Spaces: %s", v.Name, err))
+		} else {
+			logger.Info(fmt.Sprintf("Uploaded %s to Spaces", v.Name))
+		}
+	}
+
+	if !purgeEmpty(purge) {
+		if err := a.purgeCache(ctx, purge); err != nil {
+			logger.Error("Failed to flush Cloudflare cache.")
+			return fmt.Errorf("flushing Cloudflare cache: %w", err)
+		}
+		logger.Info("Flushed Cloudflare cache.")
+	}
+
+	if profile.has(actionDnsRecords) {
+		for _, r := range profile.DnsRecords {
+			if !contains(savedRecords, r.Name) {
+				// Failing back couldn't put them back
+				return fmt.Errorf("not rewriting %s, its records couldn't be saved: %w", r.Name, recordsErr)
+			}
+			records, err := a.failoverRecords(ctx, r, listed)
+			if err != nil {
+				return fmt.Errorf("choosing servers for %s: %w", r.Name, err)
+			}
+			if err := a.replaceRecords(ctx, r.Name, records); err != nil {
+				return fmt.Errorf("rewriting %s: %w", r.Name, err)
+			}
+		}
+	}
+
+	blockerKey := scopedKey(heartbeatBlockerKey, protocol)
+	if err := a.writeBlocker(ctx, protocol, BlockerNote{Time: a.now().UTC(), Operator: failoverOperator, Reason: "failed over"}); err != nil {
+		logger.Error(fmt.Sprintf("Failed to upload %s to Spaces", blockerKey))
+		return fmt.Errorf("writing heartbeat blocker: %w", err)
+	}
+	if protocol == protocolDNS {
+		logger.Info("Heartbeat blocker file written to Spaces. Remove it to enable this tool again. Chances you will need to delete vatdns-heartbeat as well.")
+	} else {
+		logger.Info(fmt.Sprintf("%s written to Spaces. Remove it to check %s again.", blockerKey, protocol))
+	}
+	return nil
+}
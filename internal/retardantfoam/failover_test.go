@@ -0,0 +1,202 @@
+package retardantfoam
+
+import (
+	"context"
+	"errors"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testDataFile = `ipServerFiles:
+  - name: "servers.txt"
+    bucket: "vatsim-vatdns"
+    region: "nyc3"
+    contents: |
+      192.0.2.1
+  - name: "servers.json"
+    bucket: "vatsim-vatdns-eu"
+    region: "ams3"
+    contents: '["192.0.2.1"]'
+  - name: "http.txt"
+    bucket: "vatsim-vatdns"
+    region: "nyc3"
+    protocols: ["http"]
+    contents: |
+      192.0.2.1
+`
+
+// testStoreActions fails over into file stores under a temporary directory
+func testStoreActions(t *testing.T) (*storeActions, *int) {
+	dir := t.TempDir()
+	dataFile := filepath.Join(dir, "retardantfoam.yaml")
+	require.NoError(t, os.WriteFile(dataFile, []byte(testDataFile), 0o644))
+	c := &Config{
+		DoSpacesBucketName: "vatsim-vatdns",
+		DataFile:           dataFile,
+		StorageBackend:     "file",
+		StorageDir:         filepath.Join(dir, "buckets"),
+	}
+	a, err := newStoreActions(c)
+	require.NoError(t, err)
+	purges := 0
+	a.purgeCache = func(ctx context.Context, req cloudflare.PurgeCacheRequest) error {
+		purges++
+		return nil
+	}
+	return a, &purges
+}
+
+func getObject(t *testing.T, c *Config, bucket, key string) string {
+	store, err := openStore(c, "", bucket)
+	require.NoError(t, err)
+	body, _, err := store.Get(context.Background(), key)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestStoreActionsHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testStoreActions(t)
+
+	lastHeartbeat, err := a.LastHeartbeat(ctx)
+	require.NoError(t, err)
+	assert.True(t, lastHeartbeat.IsZero())
+	require.NoError(t, a.WriteHeartbeat(ctx))
+	lastHeartbeat, err = a.LastHeartbeat(ctx)
+	require.NoError(t, err)
+	assert.False(t, lastHeartbeat.IsZero())
+
+	blocked, err := a.Blocked(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestStoreActionsFailover(t *testing.T) {
+	ctx := context.Background()
+	a, purges := testStoreActions(t)
+
+	require.NoError(t, a.Failover(ctx, protocolDNS))
+	assert.Equal(t, 1, *purges)
+	assert.Equal(t, "192.0.2.1\n", getObject(t, a.config, "vatsim-vatdns", "servers.txt"))
+	assert.Equal(t, `["192.0.2.1"]`, getObject(t, a.config, "vatsim-vatdns-eu", "servers.json"))
+	blocked, err := a.Blocked(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.True(t, blocked)
+}
+
+func TestStoreActionsFailoverProtocol(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testStoreActions(t)
+
+	// Only the files listing the protocol are pushed, behind the protocol's own blocker
+	require.NoError(t, a.Failover(ctx, protocolHTTP))
+	assert.Equal(t, "192.0.2.1\n", getObject(t, a.config, "vatsim-vatdns", "http.txt"))
+	nyc, err := a.openStore("nyc3", "vatsim-vatdns")
+	require.NoError(t, err)
+	_, err = nyc.Head(ctx, "servers.txt")
+	assert.True(t, storage.IsNotFound(err))
+	blocked, err := a.Blocked(ctx, protocolHTTP)
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	blocked, err = a.Blocked(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	_, err = a.store.Head(ctx, "vatdns-heartbeat-blocker-http")
+	assert.NoError(t, err)
+
+	require.NoError(t, a.Failback(ctx, protocolHTTP))
+	_, err = nyc.Head(ctx, "http.txt")
+	assert.True(t, storage.IsNotFound(err))
+	blocked, err = a.Blocked(ctx, protocolHTTP)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	// Failing back HTTP says nothing about DNS, so no heartbeat is written
+	lastHeartbeat, err := a.LastHeartbeat(ctx)
+	require.NoError(t, err)
+	assert.True(t, lastHeartbeat.IsZero())
+}
+
+func TestStoreActionsFailoverPurgeFails(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testStoreActions(t)
+	a.purgeCache = func(ctx context.Context, req cloudflare.PurgeCacheRequest) error {
+		return errors.New("Cloudflare is down")
+	}
+
+	// The files are pushed, but without the blocker so the next round tries again
+	assert.Error(t, a.Failover(ctx, protocolDNS))
+	assert.Equal(t, "192.0.2.1\n", getObject(t, a.config, "vatsim-vatdns", "servers.txt"))
+	blocked, err := a.Blocked(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+}
+
+func TestStoreActionsUnreachable(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testStoreActions(t)
+	a.store = storage.NewS3Store(storage.S3Config{Endpoint: "http://127.0.0.1:1", Bucket: "vatsim-vatdns", PathStyle: true})
+
+	// An unreachable store is neither blocked nor unblocked
+	_, err := a.Blocked(ctx, protocolDNS)
+	assert.Error(t, err)
+	_, err = a.LastHeartbeat(ctx)
+	assert.Error(t, err)
+}
+
+func TestStoreActionsFailback(t *testing.T) {
+	ctx := context.Background()
+	a, purges := testStoreActions(t)
+	assert.Error(t, a.Failback(ctx, protocolDNS), "nothing to restore without a failover")
+
+	original, err := a.openStore("nyc3", "vatsim-vatdns")
+	require.NoError(t, err)
+	require.NoError(t, original.Put(ctx, "servers.txt", []byte("fsd.connect.vatsim.net\n")))
+	require.NoError(t, a.Failover(ctx, protocolDNS))
+	// A retried failover keeps the contents from before the first
+	require.NoError(t, a.Failover(ctx, protocolDNS))
+	assert.Equal(t, "192.0.2.1\n", getObject(t, a.config, "vatsim-vatdns", "servers.txt"))
+
+	require.NoError(t, a.Failback(ctx, protocolDNS))
+	assert.Equal(t, 3, *purges)
+	assert.Equal(t, "fsd.connect.vatsim.net\n", getObject(t, a.config, "vatsim-vatdns", "servers.txt"))
+	eu, err := a.openStore("ams3", "vatsim-vatdns-eu")
+	require.NoError(t, err)
+	_, err = eu.Head(ctx, "servers.json")
+	assert.True(t, storage.IsNotFound(err), "files that didn't exist are removed")
+	blocked, err := a.Blocked(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	lastHeartbeat, err := a.LastHeartbeat(ctx)
+	require.NoError(t, err)
+	assert.False(t, lastHeartbeat.IsZero())
+	_, err = a.store.Head(ctx, failoverStateKey)
+	assert.True(t, storage.IsNotFound(err))
+}
+
+func TestStoreActionsTransitions(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testStoreActions(t)
+	transitions, err := a.Transitions(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, transitions)
+
+	for i := 0; i < maxTransitions+5; i++ {
+		kind := transitionFailover
+		if i%2 == 1 {
+			kind = transitionFailback
+		}
+		require.NoError(t, a.RecordTransition(ctx, Transition{Kind: kind, Protocol: protocolDNS, Reason: "test"}))
+	}
+	require.NoError(t, a.RecordTransition(ctx, Transition{Kind: transitionFailback, Protocol: protocolDNS, Error: "Cloudflare is down"}))
+	transitions, err = a.Transitions(ctx)
+	require.NoError(t, err)
+	assert.Len(t, transitions, maxTransitions)
+	last := lastSucceeded(transitions, protocolDNS)
+	require.NotNil(t, last)
+	assert.Equal(t, transitionFailover, last.Kind)
+}
@@ -0,0 +1,458 @@
+package retardantfoam
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quorum is how many droplets must be healthy, either a count or a percentage of those probed
+type Quorum struct {
+	Count   int
+	Percent float64
+}
+
+// ParseQuorum reads a quorum such as 2 or 50%
+func ParseQuorum(s string) (Quorum, error) {
+	s = strings.TrimSpace(s)
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return Quorum{}, fmt.Errorf("%q is not a percentage between 0 and 100", s)
+		}
+		return Quorum{Percent: p}, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return Quorum{}, fmt.Errorf("%q is not a count of at least 1 or a percentage", s)
+	}
+	return Quorum{Count: n}, nil
+}
+
+// Required is how many of total droplets must be healthy. It is always at least one.
+func (q Quorum) Required(total int) int {
+	required := q.Count
+	if q.Percent > 0 {
+		required = int(math.Ceil(q.Percent / 100 * float64(total)))
+	}
+	if required < 1 {
+		required = 1
+	}
+	return required
+}
+
+func (q Quorum) String() string {
+	if q.Percent > 0 {
+		return fmt.Sprintf("%g%%", q.Percent)
+	}
+	return strconv.Itoa(q.Count)
+}
+
+// instance is a dnshaiku droplet, or a DoH or DoT endpoint, to probe
+type instance struct {
+	Name string
+	// Address is the DNS server's host:port, or the DoH URL
+	Address     string
+	HttpAddress string
+}
+
+// healthChecker decides whether each dnshaiku instance is answering correctly. An instance passes DNS when
+// PROBE_HOSTNAME resolves over UDP, and TCP with PROBE_TCP, within PROBE_LATENCY_THRESHOLD to a known
+// FSD server that is accepting connections, and its SOA and NS for PROBE_ZONE match the other instances.
+// It passes HTTP when the IP endpoint returns such an IP in time. DoH and DoT endpoints pass when they
+// resolve PROBE_HOSTNAME to one, and only one of them needs to.
+type healthChecker struct {
+	hostname string
+	zone     string
+	tcp      bool
+	latency  time.Duration
+	quorum   Quorum
+	timeout  time.Duration
+	// httpHost is the Host the IP endpoint is asked for, empty to not probe it
+	httpHost     string
+	dohEndpoints []string
+	dotEndpoints []string
+	httpClient   *http.Client
+	// tlsConfig is used for DoT, nil for the system roots
+	tlsConfig *tls.Config
+}
+
+func newHealthChecker(c *Config) *healthChecker {
+	h := &healthChecker{
+		hostname:     dns.Fqdn(c.ProbeHostname),
+		zone:         c.ProbeZone,
+		tcp:          c.ProbeTCP,
+		latency:      c.LatencyThreshold,
+		quorum:       c.Quorum,
+		timeout:      time.Second,
+		dohEndpoints: c.DohEndpoints,
+		dotEndpoints: c.DotEndpoints,
+		httpClient:   &http.Client{Timeout: time.Second},
+	}
+	if c.ProbeHTTP {
+		h.httpHost = c.ProbeHTTPHost
+	}
+	return h
+}
+
+// evaluate probes every instance over every protocol and applies the quorum. known is the FSD servers by IP,
+// nil to accept any answer.
+func (h *healthChecker) evaluate(ctx context.Context, instances []instance, known map[string]*common.FSDServer) Round {
+	servers := h.probeAll(protocolDNS, instances, func(in instance) DnsServer {
+		return h.check(ctx, in, known)
+	})
+	h.checkZoneConsistency(servers)
+	dnsRound := h.verdict(protocolDNS, servers, h.quorum.Required(len(servers)))
+	dnsRound.Reason = fmt.Sprintf("%s by quorum %s", dnsRound.Reason, h.quorum)
+	round := Round{Servers: dnsRound.Servers, Healthy: dnsRound.Healthy, Required: dnsRound.Required, Reason: dnsRound.Reason}
+
+	if h.httpHost != "" {
+		servers := h.probeAll(protocolHTTP, instances, func(in instance) DnsServer {
+			return h.checkHttp(ctx, in, known)
+		})
+		round.Protocols = append(round.Protocols, h.verdict(protocolHTTP, servers, h.quorum.Required(len(servers))))
+	}
+	if len(h.dohEndpoints) > 0 {
+		servers := h.probeAll(protocolDoH, endpoints(h.dohEndpoints), func(in instance) DnsServer {
+			return h.checkDoh(ctx, in, known)
+		})
+		round.Protocols = append(round.Protocols, h.verdict(protocolDoH, servers, 1))
+	}
+	if len(h.dotEndpoints) > 0 {
+		servers := h.probeAll(protocolDoT, endpoints(h.dotEndpoints), func(in instance) DnsServer {
+			return h.checkDot(ctx, in, known)
+		})
+		round.Protocols = append(round.Protocols, h.verdict(protocolDoT, servers, 1))
+	}
+	return round
+}
+
+// endpoints are DoH or DoT endpoints to probe, named by their address
+func endpoints(addresses []string) []instance {
+	instances := make([]instance, 0, len(addresses))
+	for _, address := range addresses {
+		instances = append(instances, instance{Name: address, Address: address})
+	}
+	return instances
+}
+
+// probeAll runs check against every instance at once, returning the results sorted by name
+func (h *healthChecker) probeAll(protocol string, instances []instance, check func(in instance) DnsServer) []DnsServer {
+	servers := make([]DnsServer, len(instances))
+	var wg sync.WaitGroup
+	for i, in := range instances {
+		logger.Info(fmt.Sprintf("Checking %s health of %s", protocol, in.Name))
+		wg.Add(1)
+		go func(i int, in instance) {
+			defer wg.Done()
+			servers[i] = check(in)
+		}(i, in)
+	}
+	wg.Wait()
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Name < servers[j].Name
+	})
+	return servers
+}
+
+// verdict counts the healthy servers and logs why the others failed
+func (h *healthChecker) verdict(protocol string, servers []DnsServer, required int) ProtocolRound {
+	p := ProtocolRound{Protocol: protocol, Servers: servers, Required: required}
+	for _, server := range servers {
+		if server.Pass {
+			p.Healthy++
+			logger.Info(fmt.Sprintf("Successfully queried %s over %s: %dms", server.Name, protocol, server.Latency))
+		} else {
+			logger.Error(fmt.Sprintf("Error when checking %s over %s: %s", server.Name, protocol, server.Reason))
+		}
+	}
+	p.Reason = fmt.Sprintf("%d of %d healthy, %d required", p.Healthy, len(servers), p.Required)
+	return p
+}
+
+// check probes one instance
+func (h *healthChecker) check(ctx context.Context, in instance, known map[string]*common.FSDServer) DnsServer {
+	server := DnsServer{Name: in.Name}
+	transports := []string{"udp"}
+	if h.tcp {
+		transports = append(transports, "tcp")
+	}
+	for _, transport := range transports {
+		ip, rtt, err := h.lookup(ctx, transport, in.Address)
+		if err == nil {
+			err = h.checkAnswer(ip, rtt, known)
+		}
+		if err != nil {
+			server.Reason = fmt.Sprintf("%s: %s", transport, err)
+			return server
+		}
+		if latency := rtt.Milliseconds(); latency > server.Latency {
+			server.Latency = latency
+		}
+		server.Result = ip
+	}
+	if h.zone != "" {
+		zone, err := h.zoneFingerprint(ctx, in.Address)
+		if err != nil {
+			server.Reason = err.Error()
+			return server
+		}
+		server.Zone = zone
+	}
+	server.Pass = true
+	server.Reason = "ok"
+	return server
+}
+
+func (h *healthChecker) exchange(ctx context.Context, transport string, address string, name string, qtype uint16) (*dns.Msg, time.Duration, error) {
+	client := &dns.Client{Net: transport, Timeout: h.timeout, TLSConfig: h.tlsConfig}
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+	r, rtt, err := client.ExchangeContext(ctx, m, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("answered %s", dns.RcodeToString[r.Rcode])
+	}
+	return r, rtt, nil
+}
+
+// lookup returns the first A record for PROBE_HOSTNAME
+func (h *healthChecker) lookup(ctx context.Context, transport string, address string) (string, time.Duration, error) {
+	r, rtt, err := h.exchange(ctx, transport, address, h.hostname, dns.TypeA)
+	if err != nil {
+		return "", 0, err
+	}
+	ip, err := firstA(r)
+	return ip, rtt, err
+}
+
+func firstA(r *dns.Msg) (string, error) {
+	for _, rr := range r.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String(), nil
+		}
+	}
+	return "", errors.New("no A record in the answer")
+}
+
+// checkHttp asks the instance's IP endpoint for an IP to connect to
+func (h *healthChecker) checkHttp(ctx context.Context, in instance, known map[string]*common.FSDServer) DnsServer {
+	server := DnsServer{Name: in.Name}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/", in.HttpAddress), nil)
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	req.Host = h.httpHost
+	start := time.Now()
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	_ = resp.Body.Close()
+	rtt := time.Since(start)
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	if resp.StatusCode != http.StatusOK {
+		server.Reason = fmt.Sprintf("returned %s", resp.Status)
+		return server
+	}
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		server.Reason = fmt.Sprintf("returned %q, which is not an IP", ip)
+		return server
+	}
+	return h.answered(server, ip, rtt, known)
+}
+
+// checkDoh resolves PROBE_HOSTNAME with an RFC 8484 GET to the DoH endpoint
+func (h *healthChecker) checkDoh(ctx context.Context, in instance, known map[string]*common.FSDServer) DnsServer {
+	server := DnsServer{Name: in.Name}
+	m := new(dns.Msg)
+	m.SetQuestion(h.hostname, dns.TypeA)
+	// The ID should be 0 so responses can be cached
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, in.Address, nil)
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	query := req.URL.Query()
+	query.Set("dns", base64.RawURLEncoding.EncodeToString(packed))
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("Accept", "application/dns-message")
+	start := time.Now()
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	_ = resp.Body.Close()
+	rtt := time.Since(start)
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	if resp.StatusCode != http.StatusOK {
+		server.Reason = fmt.Sprintf("returned %s", resp.Status)
+		return server
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		server.Reason = fmt.Sprintf("invalid DNS message: %s", err)
+		return server
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		server.Reason = fmt.Sprintf("answered %s", dns.RcodeToString[r.Rcode])
+		return server
+	}
+	ip, err := firstA(r)
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	return h.answered(server, ip, rtt, known)
+}
+
+// checkDot resolves PROBE_HOSTNAME over DNS over TLS
+func (h *healthChecker) checkDot(ctx context.Context, in instance, known map[string]*common.FSDServer) DnsServer {
+	server := DnsServer{Name: in.Name}
+	ip, rtt, err := h.lookup(ctx, "tcp-tls", in.Address)
+	if err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	return h.answered(server, ip, rtt, known)
+}
+
+// answered fills in server from the IP it answered with, passing it if the answer checks out
+func (h *healthChecker) answered(server DnsServer, ip string, rtt time.Duration, known map[string]*common.FSDServer) DnsServer {
+	server.Result = ip
+	server.Latency = rtt.Milliseconds()
+	if err := h.checkAnswer(ip, rtt, known); err != nil {
+		server.Reason = err.Error()
+		return server
+	}
+	server.Pass = true
+	server.Reason = "ok"
+	return server
+}
+
+// checkAnswer checks an answer is quick enough and, if the FSD servers are known, one of them that is accepting.
+// When none is accepting dnshaiku hands out a fallback server, so any known server is right.
+func (h *healthChecker) checkAnswer(ip string, rtt time.Duration, known map[string]*common.FSDServer) error {
+	if h.latency > 0 && rtt > h.latency {
+		return fmt.Errorf("took %dms, over the %dms threshold", rtt.Milliseconds(), h.latency.Milliseconds())
+	}
+	if known == nil {
+		return nil
+	}
+	fsd, ok := known[ip]
+	if !ok {
+		return fmt.Errorf("answered %s, which is not a known FSD server", ip)
+	}
+	if reason := fsd.NotAcceptingReason(); reason != "" && anyAccepting(known) {
+		return fmt.Errorf("answered %s (%s), which is not accepting connections: %s", ip, fsd.Name, reason)
+	}
+	return nil
+}
+
+func anyAccepting(known map[string]*common.FSDServer) bool {
+	for _, fsd := range known {
+		if fsd.NotAcceptingReason() == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneFingerprint describes the instance's SOA and NS records for PROBE_ZONE so they can be compared
+func (h *healthChecker) zoneFingerprint(ctx context.Context, address string) (string, error) {
+	zone := dns.Fqdn(h.zone)
+	r, _, err := h.exchange(ctx, "udp", address, zone, dns.TypeSOA)
+	if err != nil {
+		return "", fmt.Errorf("soa: %w", err)
+	}
+	var soa *dns.SOA
+	for _, rr := range r.Answer {
+		if record, ok := rr.(*dns.SOA); ok {
+			soa = record
+		}
+	}
+	if soa == nil {
+		return "", errors.New("soa: no SOA record in the answer")
+	}
+	r, _, err = h.exchange(ctx, "udp", address, zone, dns.TypeNS)
+	if err != nil {
+		return "", fmt.Errorf("ns: %w", err)
+	}
+	nameservers := make([]string, 0, len(r.Answer))
+	for _, rr := range r.Answer {
+		if record, ok := rr.(*dns.NS); ok {
+			nameservers = append(nameservers, strings.ToLower(record.Ns))
+		}
+	}
+	if len(nameservers) == 0 {
+		return "", errors.New("ns: no NS records in the answer")
+	}
+	sort.Strings(nameservers)
+	return fmt.Sprintf("serial %d, ns %s", soa.Serial, strings.Join(nameservers, " ")), nil
+}
+
+// checkZoneConsistency fails passing instances whose SOA and NS differ from what most passing instances answer.
+// Ties are broken alphabetically so the verdict is stable.
+func (h *healthChecker) checkZoneConsistency(servers []DnsServer) {
+	counts := make(map[string]int)
+	for _, server := range servers {
+		if server.Pass && server.Zone != "" {
+			counts[server.Zone]++
+		}
+	}
+	if len(counts) < 2 {
+		return
+	}
+	zones := make([]string, 0, len(counts))
+	for zone := range counts {
+		zones = append(zones, zone)
+	}
+	sort.Slice(zones, func(i, j int) bool {
+		if counts[zones[i]] != counts[zones[j]] {
+			return counts[zones[i]] > counts[zones[j]]
+		}
+		return zones[i] < zones[j]
+	})
+	majority := zones[0]
+	for i := range servers {
+		if servers[i].Pass && servers[i].Zone != majority {
+			servers[i].Pass = false
+			servers[i].Reason = fmt.Sprintf("zone: %s differs from the other instances' %s", servers[i].Zone, majority)
+		}
+	}
+}
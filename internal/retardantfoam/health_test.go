@@ -0,0 +1,264 @@
+package retardantfoam
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeDnshaiku answers like dnshaiku, with an A record of ip and an SOA of serial
+type fakeDnshaiku struct {
+	ip     string
+	serial uint32
+	// tcp is false to refuse queries over TCP
+	tcp   bool
+	delay time.Duration
+}
+
+func (f *fakeDnshaiku) handler(transport string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if transport == "tcp" && !f.tcp {
+			m.Rcode = dns.RcodeRefused
+			_ = w.WriteMsg(m)
+			return
+		}
+		time.Sleep(f.delay)
+		q := r.Question[0]
+		switch q.Qtype {
+		case dns.TypeA:
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A %s", q.Name, f.ip))
+			m.Answer = append(m.Answer, rr)
+		case dns.TypeSOA:
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 1 IN SOA ns1.vatsim.net. hostmaster.vatsim.net. %d 3600 600 1209600 1", q.Name, f.serial))
+			m.Answer = append(m.Answer, rr)
+		case dns.TypeNS:
+			for _, ns := range []string{"ns1.vatsim.net.", "ns2.vatsim.net."} {
+				rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN NS %s", q.Name, ns))
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		_ = w.WriteMsg(m)
+	}
+}
+
+// start serves f over UDP and TCP on the same port, returning the address
+func (f *fakeDnshaiku) start(t *testing.T) string {
+	for attempt := 0; attempt < 10; attempt++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			_ = udp.Close()
+			continue
+		}
+		for _, server := range []*dns.Server{
+			{PacketConn: udp, Handler: f.handler("udp")},
+			{Listener: tcp, Handler: f.handler("tcp")},
+		} {
+			server := server
+			started := make(chan struct{})
+			server.NotifyStartedFunc = func() { close(started) }
+			go func() { _ = server.ActivateAndServe() }()
+			<-started
+			t.Cleanup(func() { _ = server.Shutdown() })
+		}
+		return udp.LocalAddr().String()
+	}
+	t.Fatal("unable to listen on the same UDP and TCP port")
+	return ""
+}
+
+func testChecker(quorum string) *healthChecker {
+	q, _ := ParseQuorum(quorum)
+	return &healthChecker{
+		hostname: "fsd.connect.vatsim.net.",
+		zone:     "connect.vatsim.net",
+		tcp:      true,
+		latency:  200 * time.Millisecond,
+		quorum:   q,
+		timeout:  time.Second,
+	}
+}
+
+func TestParseQuorum(t *testing.T) {
+	q, err := ParseQuorum("2")
+	require.NoError(t, err)
+	assert.Equal(t, 2, q.Required(5))
+	q, err = ParseQuorum("50%")
+	require.NoError(t, err)
+	assert.Equal(t, 3, q.Required(5))
+	assert.Equal(t, 1, q.Required(0))
+	assert.Equal(t, "50%", q.String())
+
+	for _, invalid := range []string{"", "0", "-1", "two", "0%", "101%"} {
+		_, err := ParseQuorum(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHealthCheckerReasons(t *testing.T) {
+	known := map[string]*common.FSDServer{
+		"192.0.2.1": {Name: "fsd.usa-e", IpAddress: "192.0.2.1", MaxUsers: 100, RemainingSlots: 50, AbleToUpdate: true},
+		"192.0.2.2": {Name: "fsd.uk", IpAddress: "192.0.2.2", MaxUsers: 100, RemainingSlots: 50, AbleToUpdate: false},
+	}
+	instances := []instance{
+		{Name: "a-ok", Address: (&fakeDnshaiku{ip: "192.0.2.1", serial: 1, tcp: true}).start(t)},
+		{Name: "b-ok", Address: (&fakeDnshaiku{ip: "192.0.2.1", serial: 1, tcp: true}).start(t)},
+		{Name: "c-unknown", Address: (&fakeDnshaiku{ip: "198.51.100.1", serial: 1, tcp: true}).start(t)},
+		{Name: "d-not-accepting", Address: (&fakeDnshaiku{ip: "192.0.2.2", serial: 1, tcp: true}).start(t)},
+		{Name: "e-no-tcp", Address: (&fakeDnshaiku{ip: "192.0.2.1", serial: 1}).start(t)},
+		{Name: "f-slow", Address: (&fakeDnshaiku{ip: "192.0.2.1", serial: 1, tcp: true, delay: 300 * time.Millisecond}).start(t)},
+		{Name: "g-stale-zone", Address: (&fakeDnshaiku{ip: "192.0.2.1", serial: 2, tcp: true}).start(t)},
+	}
+
+	round := testChecker("3").evaluate(context.Background(), instances, known)
+	reasons := map[string]string{}
+	for _, server := range round.Servers {
+		reasons[server.Name] = server.Reason
+	}
+	assert.Equal(t, "ok", reasons["a-ok"])
+	assert.Equal(t, "ok", reasons["b-ok"])
+	assert.Contains(t, reasons["c-unknown"], "not a known FSD server")
+	assert.Contains(t, reasons["d-not-accepting"], "not accepting connections: unable to update metrics")
+	assert.Equal(t, "tcp: answered REFUSED", reasons["e-no-tcp"])
+	assert.Contains(t, reasons["f-slow"], "over the 200ms threshold")
+	assert.Contains(t, reasons["g-stale-zone"], "zone: serial 2")
+	assert.Equal(t, 2, round.Healthy)
+	assert.Equal(t, 3, round.Required)
+	assert.False(t, round.Passed())
+	assert.Equal(t, "2 of 7 healthy, 3 required by quorum 3", round.Reason)
+
+	// Without the FSD servers any answer goes, and a lower quorum passes
+	round = testChecker("25%").evaluate(context.Background(), instances[:3], nil)
+	assert.Equal(t, 3, round.Healthy)
+	assert.Equal(t, 1, round.Required)
+	assert.True(t, round.Passed())
+}
+
+func TestHealthCheckerAllServersFull(t *testing.T) {
+	// With every server full dnshaiku hands out a fallback, which mustn't fail the instance
+	known := map[string]*common.FSDServer{
+		"192.0.2.1": {Name: "fsd.usa-e", IpAddress: "192.0.2.1", MaxUsers: 100, RemainingSlots: 0, AbleToUpdate: true},
+		"192.0.2.2": {Name: "fsd.uk", IpAddress: "192.0.2.2", MaxUsers: 100, RemainingSlots: 0, AbleToUpdate: false},
+	}
+	common.SetPollingSettings(common.PollingSettings{SlotBuffer: 1})
+	t.Cleanup(func() { common.SetPollingSettings(common.PollingSettings{}) })
+	instances := []instance{
+		{Name: "a-fallback", Address: (&fakeDnshaiku{ip: "192.0.2.1", serial: 1, tcp: true}).start(t)},
+		{Name: "b-fallback", Address: (&fakeDnshaiku{ip: "192.0.2.2", serial: 1, tcp: true}).start(t)},
+		{Name: "c-unknown", Address: (&fakeDnshaiku{ip: "198.51.100.1", serial: 1, tcp: true}).start(t)},
+	}
+
+	round := testChecker("2").evaluate(context.Background(), instances, known)
+	reasons := map[string]string{}
+	for _, server := range round.Servers {
+		reasons[server.Name] = server.Reason
+	}
+	assert.Equal(t, "ok", reasons["a-fallback"])
+	assert.Equal(t, "ok", reasons["b-fallback"])
+	assert.Contains(t, reasons["c-unknown"], "not a known FSD server")
+	assert.True(t, round.Passed())
+}
+
+func TestHealthCheckerUnreachable(t *testing.T) {
+	checker := testChecker("1")
+	checker.timeout = 100 * time.Millisecond
+	round := checker.evaluate(context.Background(), []instance{{Name: "gone", Address: "127.0.0.1:1"}}, nil)
+	assert.False(t, round.Passed())
+	assert.Contains(t, round.Servers[0].Reason, "udp: ")
+}
+
+// ipEndpoint serves ip like dnshaiku's HTTP endpoint, checking it was asked for the right host
+func ipEndpoint(t *testing.T, status int, body string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "fsd-http.connect.vatsim.net", r.Host)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+func TestHealthCheckerHttp(t *testing.T) {
+	known := map[string]*common.FSDServer{
+		"192.0.2.1": {Name: "fsd.usa-e", IpAddress: "192.0.2.1", MaxUsers: 100, RemainingSlots: 50, AbleToUpdate: true},
+	}
+	dnsAddress := (&fakeDnshaiku{ip: "192.0.2.1", serial: 1, tcp: true}).start(t)
+	instances := []instance{
+		{Name: "a-ok", Address: dnsAddress, HttpAddress: ipEndpoint(t, http.StatusOK, "192.0.2.1")},
+		{Name: "b-unavailable", Address: dnsAddress, HttpAddress: ipEndpoint(t, http.StatusServiceUnavailable, "Service Unavailable")},
+		{Name: "c-garbage", Address: dnsAddress, HttpAddress: ipEndpoint(t, http.StatusOK, "<html>")},
+		{Name: "d-unknown", Address: dnsAddress, HttpAddress: ipEndpoint(t, http.StatusOK, "198.51.100.1")},
+	}
+	checker := testChecker("2")
+	checker.httpHost = "fsd-http.connect.vatsim.net"
+	checker.httpClient = &http.Client{Timeout: time.Second}
+
+	round := checker.evaluate(context.Background(), instances, known)
+	assert.True(t, round.Passed(), "DNS is fine")
+	require.Len(t, round.Protocols, 1)
+	httpRound := round.Protocols[0]
+	assert.Equal(t, protocolHTTP, httpRound.Protocol)
+	assert.False(t, httpRound.Passed())
+	assert.Equal(t, 1, httpRound.Healthy)
+	assert.Equal(t, "ok", httpRound.Servers[0].Reason)
+	assert.Equal(t, "192.0.2.1", httpRound.Servers[0].Result)
+	assert.Equal(t, "returned 503 Service Unavailable", httpRound.Servers[1].Reason)
+	assert.Contains(t, httpRound.Servers[2].Reason, "not an IP")
+	assert.Contains(t, httpRound.Servers[3].Reason, "not a known FSD server")
+}
+
+func TestHealthCheckerDohAndDot(t *testing.T) {
+	fake := &fakeDnshaiku{ip: "192.0.2.1", serial: 1, tcp: true}
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		packed, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		require.NoError(t, err)
+		q := new(dns.Msg)
+		require.NoError(t, q.Unpack(packed))
+		m := new(dns.Msg)
+		m.SetReply(q)
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 60 IN A %s", q.Question[0].Name, fake.ip))
+		m.Answer = append(m.Answer, rr)
+		answer, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(answer)
+	}))
+	defer doh.Close()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	require.NoError(t, err)
+	dot := &dns.Server{Listener: listener, Net: "tcp-tls", Handler: fake.handler("tcp")}
+	started := make(chan struct{})
+	dot.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = dot.ActivateAndServe() }()
+	<-started
+	defer func() { _ = dot.Shutdown() }()
+
+	checker := testChecker("1")
+	checker.httpClient = doh.Client()
+	checker.tlsConfig = doh.Client().Transport.(*http.Transport).TLSClientConfig
+	checker.dohEndpoints = []string{doh.URL + "/dns-query"}
+	checker.dotEndpoints = []string{listener.Addr().String(), "127.0.0.1:1"}
+
+	round := checker.evaluate(context.Background(), nil, nil)
+	require.Len(t, round.Protocols, 2)
+	assert.Equal(t, protocolDoH, round.Protocols[0].Protocol)
+	assert.True(t, round.Protocols[0].Passed(), round.Protocols[0].Reason)
+	assert.Equal(t, "192.0.2.1", round.Protocols[0].Servers[0].Result)
+	assert.Equal(t, protocolDoT, round.Protocols[1].Protocol)
+	// One endpoint answering is enough
+	assert.True(t, round.Protocols[1].Passed(), round.Protocols[1].Reason)
+	assert.Equal(t, "1 of 2 healthy, 1 required", round.Protocols[1].Reason)
+}
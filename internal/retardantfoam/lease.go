@@ -0,0 +1,236 @@
+package retardantfoam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"time"
+)
+
+// How LEASE_MODE takes the lease
+const (
+	// leaseConditional writes the lease with If-Match or If-None-Match, so of two instances racing for it
+	// only one write lands
+	leaseConditional = "conditional"
+	// leaseFencing writes the lease plainly and reads it back after leaseSettle, for stores without
+	// conditional writes. Its token is checked again before every failover and failback.
+	leaseFencing = "fencing"
+	// leaseOff lets every instance fail over and back, for running only one
+	leaseOff = "off"
+)
+
+// leaseSettle is how long fencing waits before reading back a lease it took, for a racing write to land
+var leaseSettle = 2 * time.Second
+
+// Lease is held by the one instance allowed to fail over and back. Every instance probes, saves its
+// rounds and writes the heartbeat whether or not it holds it.
+type Lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+	// Token goes up each time the lease changes hands. Failing over or back checks the lease still has
+	// the token it was taken with, fencing off an instance that stalled past its expiry.
+	Token int64 `json:"token"`
+}
+
+func (l Lease) heldBy(owner string, at time.Time) bool {
+	return l.Owner == owner && at.Before(l.Expires)
+}
+
+// leaser decides which instance may fail over and back. A nil leaser means LEASE_MODE is off.
+type leaser interface {
+	// Acquire takes the lease if it is free or expired, or renews it if already held. force takes it
+	// from another instance regardless. It returns the lease as it stands and whether it is held.
+	Acquire(ctx context.Context, force bool) (Lease, bool, error)
+	// Holder returns the lease as it stands, zero if it has never been taken
+	Holder(ctx context.Context) (Lease, error)
+	// Check returns an error unless the lease acquired is still held with the same token
+	Check(ctx context.Context) error
+	// Release expires the lease if it is held, so another instance needn't wait
+	Release(ctx context.Context) error
+}
+
+// storeLease keeps the lease in leaseKey
+type storeLease struct {
+	store    storage.Store
+	owner    string
+	duration time.Duration
+	mode     string
+	now      func() time.Time
+	// held is the lease last acquired, zero if it isn't held
+	held Lease
+}
+
+func newLeaser(c *Config, store storage.Store) leaser {
+	if c.LeaseMode == leaseOff {
+		return nil
+	}
+	return &storeLease{store: store, owner: c.LeaseOwner, duration: c.LeaseDuration, mode: c.LeaseMode, now: time.Now}
+}
+
+// read returns the lease and its ETag, zero and empty if it has never been taken
+func (l *storeLease) read(ctx context.Context) (Lease, string, error) {
+	body, info, err := l.store.Get(ctx, leaseKey)
+	if storage.IsNotFound(err) {
+		return Lease{}, "", nil
+	}
+	if err != nil {
+		return Lease{}, "", err
+	}
+	lease := Lease{}
+	if err := json.Unmarshal(body, &lease); err != nil {
+		return Lease{}, "", fmt.Errorf("parsing %s: %w", leaseKey, err)
+	}
+	return lease, info.ETag, nil
+}
+
+func (l *storeLease) Holder(ctx context.Context) (Lease, error) {
+	lease, _, err := l.read(ctx)
+	return lease, err
+}
+
+func (l *storeLease) Acquire(ctx context.Context, force bool) (Lease, bool, error) {
+	current, etag, err := l.read(ctx)
+	if err != nil {
+		return Lease{}, false, fmt.Errorf("reading the lease: %w", err)
+	}
+	now := l.now()
+	if !force && current.Owner != l.owner && now.Before(current.Expires) {
+		l.held = Lease{}
+		return current, false, nil
+	}
+	next := Lease{Owner: l.owner, Expires: now.Add(l.duration), Token: current.Token}
+	renewing := current.heldBy(l.owner, now)
+	if !renewing {
+		next.Token++
+	}
+	won, err := l.write(ctx, next, etag, !renewing)
+	if err != nil {
+		return Lease{}, false, fmt.Errorf("writing the lease: %w", err)
+	}
+	if !won {
+		l.held = Lease{}
+		current, _, err := l.read(ctx)
+		return current, false, err
+	}
+	if !renewing {
+		logger.Info(fmt.Sprintf("Took the lease from %q with token %d, it expires at %s", current.Owner, next.Token, next.Expires.UTC().Format(time.RFC3339)))
+	}
+	l.held = next
+	return next, true, nil
+}
+
+// write puts lease in leaseKey if it is still at etag, reporting whether it landed. Renewals don't race,
+// since nobody else takes an unexpired lease, so only takeovers settle before reading the lease back.
+func (l *storeLease) write(ctx context.Context, lease Lease, etag string, settle bool) (bool, error) {
+	body, _ := json.Marshal(lease)
+	conditional, ok := l.store.(storage.ConditionalStore)
+	if l.mode == leaseConditional && !ok {
+		logger.Error("The storage backend can't write conditionally, using a fencing token for the lease")
+		l.mode = leaseFencing
+	}
+	if l.mode == leaseConditional {
+		err := conditional.PutIf(ctx, leaseKey, body, etag)
+		switch {
+		case errors.Is(err, storage.ErrPreconditionFailed):
+			return false, nil
+		case errors.Is(err, storage.ErrConditionalUnsupported):
+			logger.Error("The storage service rejected a conditional write, using a fencing token for the lease")
+			l.mode = leaseFencing
+		case err != nil:
+			return false, err
+		default:
+			settle = false
+		}
+	}
+	if l.mode == leaseFencing {
+		if err := l.store.Put(ctx, leaseKey, body); err != nil {
+			return false, err
+		}
+	}
+	if settle {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(leaseSettle):
+		}
+	}
+	// Reading back catches services that ignore the condition, and whichever write landed last in fencing
+	got, _, err := l.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	return got.Owner == lease.Owner && got.Token == lease.Token && got.Expires.Equal(lease.Expires), nil
+}
+
+func (l *storeLease) Check(ctx context.Context) error {
+	if l.held.Owner == "" {
+		return errors.New("this instance doesn't hold the lease")
+	}
+	current, _, err := l.read(ctx)
+	if err != nil {
+		return fmt.Errorf("reading the lease: %w", err)
+	}
+	if current.Owner != l.held.Owner || current.Token != l.held.Token {
+		return fmt.Errorf("the lease was taken by %q with token %d", current.Owner, current.Token)
+	}
+	if !l.now().Before(current.Expires) {
+		return fmt.Errorf("the lease expired at %s", current.Expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Release writes the lease expired rather than deleting it, so the next holder's token is still higher
+func (l *storeLease) Release(ctx context.Context) error {
+	if l.held.Owner == "" {
+		return nil
+	}
+	if err := l.Check(ctx); err != nil {
+		l.held = Lease{}
+		return nil
+	}
+	_, etag, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	released := l.held
+	released.Expires = l.now()
+	l.held = Lease{}
+	_, err = l.write(ctx, released, etag, false)
+	return err
+}
+
+// leader takes or renews the lease, returning whether this instance may fail over and back
+func (r *runner) leader(ctx context.Context) bool {
+	if r.lease == nil {
+		return true
+	}
+	lease, held, err := r.lease.Acquire(ctx, false)
+	if err != nil {
+		leaseHeld.Set(0)
+		logger.Error(fmt.Sprintf("Unable to take the lease, not failing over or back: %s", err))
+		return false
+	}
+	if !held {
+		leaseHeld.Set(0)
+		logger.Info(fmt.Sprintf("%q holds the lease until %s, leaving failing over and back to it", lease.Owner, lease.Expires.UTC().Format(time.RFC3339)))
+		return false
+	}
+	leaseHeld.Set(1)
+	return true
+}
+
+// releaseLease gives the lease up when the daemon stops
+func (r *runner) releaseLease() {
+	if r.lease == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := r.lease.Release(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Unable to release the lease, it will expire: %s", err))
+	}
+	leaseHeld.Set(0)
+}
@@ -0,0 +1,228 @@
+package retardantfoam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"testing"
+	"time"
+)
+
+// plainStore hides PutIf, like a store without conditional writes
+type plainStore struct {
+	storage.Store
+}
+
+// racingStore lets rival's lease land just after each lease this instance writes
+type racingStore struct {
+	storage.Store
+	rival Lease
+}
+
+func (s *racingStore) Put(ctx context.Context, key string, body []byte) error {
+	if err := s.Store.Put(ctx, key, body); err != nil || key != leaseKey {
+		return err
+	}
+	body, _ = json.Marshal(s.rival)
+	return s.Store.Put(ctx, key, body)
+}
+
+// unsupportedStore rejects conditional writes like a service that doesn't implement them
+type unsupportedStore struct {
+	storage.Store
+}
+
+func (s unsupportedStore) PutIf(ctx context.Context, key string, body []byte, etag string) error {
+	return storage.ErrConditionalUnsupported
+}
+
+func testLease(store storage.Store, owner string, mode string, now *time.Time) *storeLease {
+	return &storeLease{store: store, owner: owner, duration: time.Minute, mode: mode, now: func() time.Time { return *now }}
+}
+
+// noSettle stops fencing waiting for racing writes, there are none
+func noSettle(t *testing.T) {
+	settle := leaseSettle
+	leaseSettle = 0
+	t.Cleanup(func() { leaseSettle = settle })
+}
+
+func testLeaseStore(t *testing.T) storage.Store {
+	store, err := storage.NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	return store
+}
+
+func TestStoreLease(t *testing.T) {
+	noSettle(t)
+	for _, mode := range []string{leaseConditional, leaseFencing} {
+		t.Run(mode, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			store := testLeaseStore(t)
+			if mode == leaseFencing {
+				store = plainStore{store}
+			}
+			a := testLease(store, "cron-1", mode, &now)
+			b := testLease(store, "cron-2", mode, &now)
+
+			lease, held, err := a.Acquire(ctx, false)
+			require.NoError(t, err)
+			assert.True(t, held)
+			assert.Equal(t, Lease{Owner: "cron-1", Expires: now.Add(time.Minute), Token: 1}, lease)
+			lease, held, err = b.Acquire(ctx, false)
+			require.NoError(t, err)
+			assert.False(t, held)
+			assert.Equal(t, "cron-1", lease.Owner)
+			assert.Error(t, b.Check(ctx))
+
+			// Renewing keeps the token
+			now = now.Add(30 * time.Second)
+			lease, held, err = a.Acquire(ctx, false)
+			require.NoError(t, err)
+			assert.True(t, held)
+			assert.Equal(t, int64(1), lease.Token)
+			assert.Equal(t, now.Add(time.Minute), lease.Expires)
+			require.NoError(t, a.Check(ctx))
+
+			// cron-1 stalls past its expiry and cron-2 takes over with a higher token
+			now = now.Add(2 * time.Minute)
+			assert.ErrorContains(t, a.Check(ctx), "the lease expired")
+			lease, held, err = b.Acquire(ctx, false)
+			require.NoError(t, err)
+			assert.True(t, held)
+			assert.Equal(t, int64(2), lease.Token)
+			assert.ErrorContains(t, a.Check(ctx), `the lease was taken by "cron-2" with token 2`)
+			_, held, err = a.Acquire(ctx, false)
+			require.NoError(t, err)
+			assert.False(t, held)
+
+			// Releasing expires it rather than resetting the token
+			require.NoError(t, b.Release(ctx))
+			lease, held, err = a.Acquire(ctx, false)
+			require.NoError(t, err)
+			assert.True(t, held)
+			assert.Equal(t, int64(3), lease.Token)
+
+			// Forcing takes it from a holder
+			lease, held, err = b.Acquire(ctx, true)
+			require.NoError(t, err)
+			assert.True(t, held)
+			assert.Equal(t, int64(4), lease.Token)
+			assert.Error(t, a.Check(ctx))
+		})
+	}
+}
+
+func TestStoreLeaseRace(t *testing.T) {
+	noSettle(t)
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rival := Lease{Owner: "cron-2", Expires: now.Add(time.Minute), Token: 1}
+	a := testLease(&racingStore{Store: testLeaseStore(t), rival: rival}, "cron-1", leaseFencing, &now)
+
+	lease, held, err := a.Acquire(ctx, false)
+	require.NoError(t, err)
+	assert.False(t, held, "the rival's write landed last")
+	assert.Equal(t, rival, lease)
+	assert.Error(t, a.Check(ctx))
+}
+
+func TestStoreLeaseFallsBackToFencing(t *testing.T) {
+	noSettle(t)
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := testLease(unsupportedStore{testLeaseStore(t)}, "cron-1", leaseConditional, &now)
+
+	_, held, err := a.Acquire(ctx, false)
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, leaseFencing, a.mode)
+}
+
+func TestDaemonLeavesFailoverToTheLeaseholder(t *testing.T) {
+	ctx := context.Background()
+	d, actions, now := testDaemon(failed, failed, failed, failed)
+	d.config.FailoverFailures = 2
+	d.config.LeaseDuration = time.Minute
+	store := testLeaseStore(t)
+	d.lease = testLease(store, "cron-1", leaseConditional, now)
+	other := testLease(store, "cron-2", leaseConditional, now)
+	_, held, err := other.Acquire(ctx, false)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	d.runRound(ctx)
+	*now = now.Add(30 * time.Second)
+	d.runRound(ctx)
+	assert.Equal(t, 0, actions.failovers, "cron-2 holds the lease")
+	assert.Equal(t, 2, actions.rounds, "the rounds are still saved")
+
+	// cron-2 stops renewing, so this instance takes over and fails over
+	*now = now.Add(time.Minute)
+	d.runRound(ctx)
+	assert.Equal(t, 1, actions.failovers)
+	require.Len(t, actions.transitions, 1)
+	assert.Equal(t, int64(2), actions.transitions[0].Lease)
+}
+
+func TestRunnerFencedOff(t *testing.T) {
+	ctx := context.Background()
+	d, actions, now := testDaemon()
+	store := testLeaseStore(t)
+	d.lease = testLease(store, "cron-1", leaseConditional, now)
+	require.True(t, d.leader(ctx))
+	_, _, err := testLease(store, "cron-2", leaseConditional, now).Acquire(ctx, true)
+	require.NoError(t, err)
+
+	_, err = d.failover(ctx, protocolDNS, "test", nil)
+	assert.ErrorContains(t, err, `fenced off: the lease was taken by "cron-2"`)
+	assert.Equal(t, 0, actions.failovers)
+	require.Len(t, actions.transitions, 1)
+	assert.False(t, actions.transitions[0].Succeeded())
+}
+
+func TestOnceLeavesFailoverToTheLeaseholder(t *testing.T) {
+	ctx := context.Background()
+	d, actions, now := testDaemon(passed)
+	d.config.FailoverTimeLimit = 5 * time.Minute
+	actions.lastHeartbeat = time.Now().Add(-10 * time.Minute)
+	store := testLeaseStore(t)
+	d.lease = testLease(store, "cron-1", leaseConditional, now)
+	_, _, err := testLease(store, "cron-2", leaseConditional, now).Acquire(ctx, false)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, d.runOnce(ctx))
+	assert.Equal(t, 0, actions.failovers)
+	assert.Equal(t, 1, actions.heartbeats, "it still probes and writes the heartbeat")
+}
+
+func TestOperatorTakesTheLease(t *testing.T) {
+	ctx := context.Background()
+	r, actions := testOperator()
+	now := r.now()
+	store := testLeaseStore(t)
+	r.lease = testLease(store, "cron-1 (operator jdoe)", leaseConditional, &now)
+	daemon := testLease(store, "cron-2", leaseConditional, &now)
+	_, _, err := daemon.Acquire(ctx, false)
+	require.NoError(t, err)
+
+	out := bytes.Buffer{}
+	assert.Equal(t, operatorOK, r.operate(ctx, "force-failover", OperatorOptions{Operator: "jdoe", Reason: "test", Confirm: true}, &out))
+	assert.Contains(t, out.String(), "Took the lease from cron-2")
+	assert.Equal(t, 1, actions.failovers)
+	assert.Equal(t, int64(2), actions.transitions[0].Lease)
+	// The daemon is fenced off, and the lease is free once the command is done
+	assert.Error(t, daemon.Check(ctx))
+	lease, held, err := daemon.Acquire(ctx, false)
+	require.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, int64(3), lease.Token)
+
+	out.Reset()
+	assert.Equal(t, operatorOK, r.operate(ctx, "status", OperatorOptions{Operator: "jdoe"}, &out))
+	assert.Contains(t, out.String(), "Lease: held by cron-2 until 2024-01-01T00:11:00Z, token 3\n")
+}
@@ -0,0 +1,86 @@
+package retardantfoam
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+// The daemon's metrics are registered here rather than the global registry, served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	probeRounds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_retardantfoam_probe_rounds_total",
+		Help: "Probe rounds, by protocol and whether it passed, failed or the round was inconclusive because droplets couldn't be listed.",
+	}, []string{"protocol", "result"})
+	probeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "vatdns_retardantfoam_probe_duration_seconds",
+		Help:    "Time taken to probe every droplet.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10},
+	})
+	probedServers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vatdns_retardantfoam_probed_servers",
+		Help: "Droplets or endpoints probed in the last round, by protocol.",
+	}, []string{"protocol"})
+	healthyServers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vatdns_retardantfoam_healthy_servers",
+		Help: "Droplets or endpoints that answered correctly in the last round, by protocol.",
+	}, []string{"protocol"})
+	consecutiveFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vatdns_retardantfoam_consecutive_failures",
+		Help: "Probe rounds in a row that the protocol failed its health check.",
+	}, []string{"protocol"})
+	consecutiveSuccesses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vatdns_retardantfoam_consecutive_successes",
+		Help: "Probe rounds in a row that enough droplets answered the protocol to fail back.",
+	}, []string{"protocol"})
+	blockedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vatdns_retardantfoam_blocked",
+		Help: "1 while the protocol's heartbeat blocker exists and its failover is disabled.",
+	}, []string{"protocol"})
+	failovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_retardantfoam_failovers_total",
+		Help: "Failovers attempted, by protocol and whether they succeeded.",
+	}, []string{"protocol", "result"})
+	failbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vatdns_retardantfoam_failbacks_total",
+		Help: "Failbacks attempted, by protocol and whether they succeeded.",
+	}, []string{"protocol", "result"})
+	heartbeatWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vatdns_retardantfoam_heartbeat_write_errors_total",
+		Help: "Failed writes of the heartbeat file.",
+	})
+	renderErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "vatdns_retardantfoam_render_errors_total",
+		Help: "Heartbeats where rendering the templated IP server files failed.",
+	})
+	leaseHeld = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "vatdns_retardantfoam_lease_held",
+		Help: "1 while this instance holds the lease and may fail over and back.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		probeRounds,
+		probeDuration,
+		probedServers,
+		healthyServers,
+		consecutiveFailures,
+		consecutiveSuccesses,
+		blockedGauge,
+		failovers,
+		failbacks,
+		heartbeatWriteErrors,
+		renderErrors,
+		leaseHeld,
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
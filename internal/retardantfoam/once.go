@@ -0,0 +1,178 @@
+package retardantfoam
+
+import (
+	"context"
+	"fmt"
+	"github.com/vatsimnetwork/vatdns/internal/alerting"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"time"
+)
+
+// runner holds what both the one-shot and daemon modes work with
+type runner struct {
+	config  *Config
+	actions actions
+	prober  prober
+	alerts  *alerting.Notifier
+	// lease is nil when LEASE_MODE is off
+	lease leaser
+	now   func() time.Time
+}
+
+func newRunner(c *Config) (*runner, error) {
+	alerts, err := alerting.NewFromSettings("retardantfoam", c.Alerts)
+	if err != nil {
+		return nil, fmt.Errorf("starting alerts: %w", err)
+	}
+	actions, err := newStoreActions(c)
+	if err != nil {
+		return nil, fmt.Errorf("opening storage: %w", err)
+	}
+	return &runner{config: c, actions: actions, prober: newDropletProber(c), alerts: alerts, lease: newLeaser(c, actions.store), now: time.Now}, nil
+}
+
+// close sends any queued alerts
+func (r *runner) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := r.alerts.Close(ctx); err != nil {
+		logger.Error(fmt.Sprintf("Closing alerts: %s", err))
+	}
+}
+
+func (r *runner) failover(ctx context.Context, protocol string, summary string, fields map[string]string) (*Transition, error) {
+	r.alerts.Notify(alerting.Event{
+		Kind:     alerting.FailoverTriggered,
+		Severity: alerting.Critical,
+		Subject:  protocol,
+		Summary:  summary,
+		Fields:   withProtocol(fields, protocol),
+	})
+	return r.transition(ctx, transitionFailover, protocol, summary, r.actions.Failover)
+}
+
+func (r *runner) failback(ctx context.Context, protocol string, summary string, fields map[string]string) (*Transition, error) {
+	r.alerts.Notify(alerting.Event{
+		Kind:     alerting.FailbackTriggered,
+		Severity: alerting.Warning,
+		Subject:  protocol,
+		Summary:  summary,
+		Fields:   withProtocol(fields, protocol),
+	})
+	return r.transition(ctx, transitionFailback, protocol, summary, r.actions.Failback)
+}
+
+func withProtocol(fields map[string]string, protocol string) map[string]string {
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	fields["protocol"] = protocol
+	return fields
+}
+
+// transition runs action for protocol if the lease is still held and records it, whether or not it succeeded
+func (r *runner) transition(ctx context.Context, kind string, protocol string, reason string, action func(context.Context, string) error) (*Transition, error) {
+	t := Transition{Time: r.now().UTC(), Kind: kind, Protocol: protocol, Reason: reason}
+	var err error
+	if r.lease != nil {
+		if err = r.lease.Check(ctx); err != nil {
+			err = fmt.Errorf("fenced off: %w", err)
+		} else if lease, _ := r.lease.Holder(ctx); lease.Owner != "" {
+			t.Lease = lease.Token
+		}
+	}
+	if err == nil {
+		err = action(ctx, protocol)
+	}
+	if err != nil {
+		t.Error = err.Error()
+	}
+	if err := r.actions.RecordTransition(ctx, t); err != nil {
+		logger.Error(fmt.Sprintf("Unable to record %s of %s: %s", kind, protocol, err))
+	}
+	return &t, err
+}
+
+// heartbeat writes the heartbeat and renders the IP server files if round passed
+func (r *runner) heartbeat(ctx context.Context, round Round) error {
+	if !round.Passed() {
+		logger.Info(fmt.Sprintf("DNS is not working: %s.", round.Reason))
+		return nil
+	}
+	logger.Info(fmt.Sprintf("DNS is working: %s. Writing heartbeat file to Spaces.", round.Reason))
+	err := r.actions.WriteHeartbeat(ctx)
+	if err != nil {
+		logger.Info("Failed writing heartbeat file to Spaces")
+		r.alerts.Notify(alerting.Event{
+			Kind:    alerting.HeartbeatWriteFailed,
+			Summary: fmt.Sprintf("Writing the heartbeat file to Spaces failed with %d DNS servers healthy: %s", round.Healthy, err),
+			Fields:  map[string]string{"healthy": fmt.Sprintf("%d", round.Healthy)},
+		})
+		return err
+	}
+	logger.Info("Wrote heartbeat file to Spaces")
+	// Render while the sources are reachable, so failing over has current server lists to push
+	if err := r.actions.RenderFiles(ctx); err != nil {
+		renderErrors.Inc()
+		logger.Error(fmt.Sprintf("Rendering IP server files failed, failing over will push the last rendered: %s", err))
+	}
+	return nil
+}
+
+// RunOnce checks the heartbeat written by the previous run, failing over if it is older than
+// FAILOVER_TIME_LIMIT, then probes DNS and writes a new heartbeat if it is working. It returns
+// the exit code.
+func RunOnce(c *Config) int {
+	r, err := newRunner(c)
+	if err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+	defer r.close()
+	return r.runOnce(context.Background())
+}
+
+func (r *runner) runOnce(ctx context.Context) int {
+	blocked, err := r.actions.Blocked(ctx, protocolDNS)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable contact Spaces: %s", err))
+		return 1
+	}
+	if blocked {
+		logger.Error("Heartbeat blocker file exists in Spaces. Operation disabled. Please remove to enable.")
+		return 1
+	}
+
+	// Check for heartbeat file
+	lastHeartbeat, err := r.actions.LastHeartbeat(ctx)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable contact Spaces: %s", err))
+		return 1
+	}
+	if lastHeartbeat.IsZero() {
+		logger.Info("Initial file check 404, first run? This is usually fine.")
+	} else {
+		timeSinceLastHeartbeat := time.Since(lastHeartbeat).Truncate(time.Second)
+		if timeSinceLastHeartbeat >= r.config.FailoverTimeLimit && !r.leader(ctx) {
+			logger.Error(fmt.Sprintf("No heartbeat for %s, over the %s limit, but another instance holds the lease.", timeSinceLastHeartbeat, r.config.FailoverTimeLimit))
+		} else if timeSinceLastHeartbeat >= r.config.FailoverTimeLimit {
+			logger.Error("Over failover time limit reached, pushing IP server list and flushing Cloudflare cache.")
+			_, err := r.failover(ctx, protocolDNS, fmt.Sprintf("No heartbeat for %s, over the %s limit. Failing over to the IP server list.", timeSinceLastHeartbeat, r.config.FailoverTimeLimit),
+				map[string]string{
+					"since_heartbeat": timeSinceLastHeartbeat.String(),
+					"limit":           r.config.FailoverTimeLimit.String(),
+				})
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failover failed: %s", err))
+				return 1
+			}
+			return 0
+		}
+		logger.Info(fmt.Sprintf("Failover time limit not reached. Currently %d seconds since last heartbeat.", int64(timeSinceLastHeartbeat.Seconds())))
+	}
+
+	round := r.prober.Probe(ctx)
+	r.saveRound(ctx, round)
+	_ = r.heartbeat(ctx, round)
+	return 0
+}
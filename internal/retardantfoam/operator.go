@@ -0,0 +1,444 @@
+package retardantfoam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"go.uber.org/zap"
+	"io"
+	"strings"
+	"time"
+)
+
+// maxAuditRecords is how many operator commands are kept in auditKey
+const maxAuditRecords = 500
+
+// Exit codes of RunOperator
+const (
+	operatorOK     = 0
+	operatorFailed = 1
+	operatorUsage  = 2
+)
+
+// BlockerNote is kept in a heartbeat blocker, saying who put it there and why. Blockers written by hand
+// in the Spaces console have none.
+type BlockerNote struct {
+	Time     time.Time `json:"time"`
+	Operator string    `json:"operator"`
+	Reason   string    `json:"reason"`
+}
+
+// failoverOperator is the Operator in the note of a blocker written by failing over
+const failoverOperator = "retardantfoam"
+
+// leftByFailover reports whether note is from a blocker that failing over wrote, rather than an operator
+func (n *BlockerNote) leftByFailover() bool {
+	return n != nil && n.Operator == failoverOperator
+}
+
+// AuditRecord is an operator command, recorded whatever its outcome
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Operator string    `json:"operator"`
+	Action   string    `json:"action"`
+	Protocol string    `json:"protocol,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// OperatorOptions are the flags given to an operator command
+type OperatorOptions struct {
+	Operator string
+	Reason   string
+	Protocol string
+	// Confirm must be set to force a failover or fail back
+	Confirm bool
+	// JSON prints status as JSON
+	JSON bool
+}
+
+// ProtocolReport is a protocol's blocker and failover state in a StatusReport
+type ProtocolReport struct {
+	Protocol string `json:"protocol"`
+	Blocked  bool   `json:"blocked"`
+	// Note is nil for a blocker without one
+	Note *BlockerNote `json:"note,omitempty"`
+	// FailedOver is whether there is saved state to fail back to
+	FailedOver bool `json:"failed_over"`
+}
+
+// StatusReport is what the status command shows
+type StatusReport struct {
+	LastHeartbeat     *time.Time       `json:"last_heartbeat,omitempty"`
+	HeartbeatAge      string           `json:"heartbeat_age,omitempty"`
+	FailoverTimeLimit string           `json:"failover_time_limit"`
+	Protocols         []ProtocolReport `json:"protocols"`
+	LastRound         *Round           `json:"last_round,omitempty"`
+	// Lease is nil when LEASE_MODE is off
+	Lease       *Lease       `json:"lease,omitempty"`
+	Transitions []Transition `json:"transitions"`
+}
+
+func (a *storeActions) writeBlocker(ctx context.Context, protocol string, note BlockerNote) error {
+	body, _ := json.Marshal(note)
+	return a.store.Put(ctx, scopedKey(heartbeatBlockerKey, protocol), body)
+}
+
+func (a *storeActions) BlockerNote(ctx context.Context, protocol string) (*BlockerNote, error) {
+	body, _, err := a.store.Get(ctx, scopedKey(heartbeatBlockerKey, protocol))
+	if err != nil {
+		return nil, err
+	}
+	note := &BlockerNote{}
+	if len(body) == 0 || json.Unmarshal(body, note) != nil {
+		return nil, nil
+	}
+	return note, nil
+}
+
+func (a *storeActions) Disarm(ctx context.Context, protocol string, note BlockerNote) error {
+	return a.writeBlocker(ctx, protocol, note)
+}
+
+func (a *storeActions) Arm(ctx context.Context, protocol string) error {
+	if protocol == protocolDNS {
+		// A fresh heartbeat stops the one-shot mode failing straight over on its next run
+		if err := a.WriteHeartbeat(ctx); err != nil {
+			return fmt.Errorf("writing heartbeat: %w", err)
+		}
+	}
+	return a.store.Delete(ctx, scopedKey(heartbeatBlockerKey, protocol))
+}
+
+func (a *storeActions) FailedOver(ctx context.Context, protocol string) (bool, error) {
+	_, err := a.store.Head(ctx, scopedKey(failoverStateKey, protocol))
+	if err == nil {
+		return true, nil
+	}
+	if storage.IsNotFound(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (a *storeActions) SaveRound(ctx context.Context, round Round) error {
+	body, _ := json.Marshal(round)
+	return a.store.Put(ctx, lastRoundKey, body)
+}
+
+func (a *storeActions) LastRound(ctx context.Context) (*Round, error) {
+	body, _, err := a.store.Get(ctx, lastRoundKey)
+	if storage.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	round := &Round{}
+	if err := json.Unmarshal(body, round); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", lastRoundKey, err)
+	}
+	return round, nil
+}
+
+func (a *storeActions) RecordAudit(ctx context.Context, record AuditRecord) error {
+	records := make([]AuditRecord, 0)
+	body, _, err := a.store.Get(ctx, auditKey)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(body, &records); err != nil {
+			return fmt.Errorf("parsing %s: %w", auditKey, err)
+		}
+	case !storage.IsNotFound(err):
+		return err
+	}
+	records = append(records, record)
+	if len(records) > maxAuditRecords {
+		records = records[len(records)-maxAuditRecords:]
+	}
+	body, _ = json.Marshal(records)
+	return a.store.Put(ctx, auditKey, body)
+}
+
+// RunOperator runs an operator command: status, arm, disarm, force-failover or failback. It returns 0 if
+// it succeeded, 1 if it failed and 2 if the options were wrong.
+func RunOperator(c *Config, command string, opts OperatorOptions, out io.Writer) int {
+	// Operators take the lease under their own name, so a retardantfoam instance on the same host isn't
+	// mistaken for them
+	operatorConfig := *c
+	operatorConfig.LeaseOwner = fmt.Sprintf("%s (operator %s)", c.LeaseOwner, opts.Operator)
+	r, err := newRunner(&operatorConfig)
+	if err != nil {
+		logger.Error(err.Error())
+		return operatorFailed
+	}
+	defer r.close()
+	return r.operate(context.Background(), command, opts, out)
+}
+
+func (r *runner) operate(ctx context.Context, command string, opts OperatorOptions, out io.Writer) int {
+	if opts.Protocol == "" {
+		opts.Protocol = protocolDNS
+	}
+	if !contains([]string{protocolDNS, protocolHTTP, protocolDoH, protocolDoT}, opts.Protocol) {
+		fmt.Fprintf(out, "Unknown protocol %q, expected dns, http, doh or dot\n", opts.Protocol)
+		return operatorUsage
+	}
+	if opts.Operator == "" {
+		fmt.Fprintln(out, "Who is running this is needed, set -operator")
+		return operatorUsage
+	}
+	if opts.Operator == failoverOperator {
+		fmt.Fprintf(out, "%q is kept for blockers left by failing over, set -operator to who you are\n", failoverOperator)
+		return operatorUsage
+	}
+	if command != "status" && strings.TrimSpace(opts.Reason) == "" {
+		fmt.Fprintf(out, "%s needs a -reason\n", command)
+		return operatorUsage
+	}
+	if (command == "force-failover" || command == "failback") && !opts.Confirm {
+		fmt.Fprintf(out, "%s changes what clients are sent, run plan to see what it would do and add -confirm to go ahead\n", command)
+		return operatorUsage
+	}
+
+	var detail string
+	var err error
+	switch command {
+	case "status":
+		err = r.status(ctx, opts, out)
+	case "disarm":
+		detail, err = r.disarm(ctx, opts)
+	case "arm":
+		detail, err = r.arm(ctx, opts)
+	case "force-failover":
+		if err = r.takeLease(ctx, out); err != nil {
+			break
+		}
+		_, err = r.failover(ctx, opts.Protocol, fmt.Sprintf("Failover forced by %s: %s", opts.Operator, opts.Reason), map[string]string{"operator": opts.Operator})
+		detail = fmt.Sprintf("Failed over %s", opts.Protocol)
+	case "failback":
+		if err = r.takeLease(ctx, out); err != nil {
+			break
+		}
+		_, err = r.failback(ctx, opts.Protocol, fmt.Sprintf("Failback by %s: %s", opts.Operator, opts.Reason), map[string]string{"operator": opts.Operator})
+		detail = fmt.Sprintf("Failed back %s", opts.Protocol)
+	default:
+		fmt.Fprintf(out, "Unknown command %q\n", command)
+		return operatorUsage
+	}
+
+	record := AuditRecord{Time: r.now().UTC(), Operator: opts.Operator, Action: command, Protocol: opts.Protocol, Reason: opts.Reason, Outcome: "ok", Detail: detail}
+	if err != nil {
+		record.Outcome = "failed"
+		record.Detail = err.Error()
+	}
+	r.audit(ctx, record)
+	if command == "force-failover" || command == "failback" {
+		r.releaseLease()
+	}
+	if err != nil {
+		fmt.Fprintf(out, "%s failed: %s\n", command, err)
+		return operatorFailed
+	}
+	if detail != "" {
+		fmt.Fprintln(out, detail)
+	}
+	return operatorOK
+}
+
+// takeLease takes the lease from whichever instance holds it, fencing it off until the command is done
+// and the lease released
+func (r *runner) takeLease(ctx context.Context, out io.Writer) error {
+	if r.lease == nil {
+		return nil
+	}
+	previous, err := r.lease.Holder(ctx)
+	if err != nil {
+		return fmt.Errorf("reading the lease: %w", err)
+	}
+	lease, held, err := r.lease.Acquire(ctx, true)
+	if err != nil {
+		return err
+	}
+	if !held {
+		return fmt.Errorf("%q took the lease at the same time", lease.Owner)
+	}
+	if previous.Owner != "" && previous.Owner != lease.Owner && r.now().Before(previous.Expires) {
+		fmt.Fprintf(out, "Took the lease from %s, which won't fail over or back until it is released\n", previous.Owner)
+	}
+	return nil
+}
+
+// audit logs record like dnshaiku's admin audit and keeps it in auditKey
+func (r *runner) audit(ctx context.Context, record AuditRecord) {
+	logger.Info(fmt.Sprintf("Operator audit | %s %s %s | %s", record.Action, record.Protocol, record.Outcome, record.Detail),
+		zap.Bool("audit", true),
+		zap.String("actor", record.Operator),
+		zap.String("action", record.Action),
+		zap.String("protocol", record.Protocol),
+		zap.String("reason", record.Reason),
+		zap.String("outcome", record.Outcome),
+	)
+	if err := r.actions.RecordAudit(ctx, record); err != nil {
+		logger.Error(fmt.Sprintf("Unable to record the audit of %s: %s", record.Action, err))
+	}
+}
+
+func (r *runner) disarm(ctx context.Context, opts OperatorOptions) (string, error) {
+	blocked, err := r.actions.Blocked(ctx, opts.Protocol)
+	if err != nil {
+		return "", err
+	}
+	if blocked {
+		return "", fmt.Errorf("%s is already disarmed, see status", opts.Protocol)
+	}
+	note := BlockerNote{Time: r.now().UTC(), Operator: opts.Operator, Reason: opts.Reason}
+	if err := r.actions.Disarm(ctx, opts.Protocol, note); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Disarmed %s, %s written", opts.Protocol, scopedKey(heartbeatBlockerKey, opts.Protocol)), nil
+}
+
+func (r *runner) arm(ctx context.Context, opts OperatorOptions) (string, error) {
+	blocked, err := r.actions.Blocked(ctx, opts.Protocol)
+	if err != nil {
+		return "", err
+	}
+	if !blocked {
+		return fmt.Sprintf("%s is already armed", opts.Protocol), nil
+	}
+	failedOver, err := r.actions.FailedOver(ctx, opts.Protocol)
+	if err != nil {
+		return "", err
+	}
+	if err := r.actions.Arm(ctx, opts.Protocol); err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("Armed %s, %s removed", opts.Protocol, scopedKey(heartbeatBlockerKey, opts.Protocol))
+	if failedOver {
+		detail += ". The IP server files and DNS records still hold the failover, failback restores them."
+	}
+	return detail, nil
+}
+
+func (r *runner) status(ctx context.Context, opts OperatorOptions, out io.Writer) error {
+	report := StatusReport{FailoverTimeLimit: r.config.FailoverTimeLimit.String()}
+	lastHeartbeat, err := r.actions.LastHeartbeat(ctx)
+	if err != nil {
+		return err
+	}
+	if !lastHeartbeat.IsZero() {
+		report.LastHeartbeat = &lastHeartbeat
+		report.HeartbeatAge = r.now().Sub(lastHeartbeat).Truncate(time.Second).String()
+	}
+	for _, protocol := range []string{protocolDNS, protocolHTTP, protocolDoH, protocolDoT} {
+		p := ProtocolReport{Protocol: protocol}
+		if p.Blocked, err = r.actions.Blocked(ctx, protocol); err != nil {
+			return err
+		}
+		if p.Blocked {
+			if p.Note, err = r.actions.BlockerNote(ctx, protocol); err != nil && !storage.IsNotFound(err) {
+				return err
+			}
+		}
+		if p.FailedOver, err = r.actions.FailedOver(ctx, protocol); err != nil {
+			return err
+		}
+		report.Protocols = append(report.Protocols, p)
+	}
+	if report.LastRound, err = r.actions.LastRound(ctx); err != nil {
+		return err
+	}
+	if r.lease != nil {
+		lease, err := r.lease.Holder(ctx)
+		if err != nil {
+			return fmt.Errorf("reading the lease: %w", err)
+		}
+		report.Lease = &lease
+	}
+	transitions, err := r.actions.Transitions(ctx)
+	if err != nil {
+		return err
+	}
+	if len(transitions) > 5 {
+		transitions = transitions[len(transitions)-5:]
+	}
+	report.Transitions = transitions
+
+	if opts.JSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	printStatus(out, report, r.now())
+	return nil
+}
+
+func printStatus(out io.Writer, report StatusReport, now time.Time) {
+	if report.LastHeartbeat == nil {
+		fmt.Fprintln(out, "Heartbeat: never written")
+	} else {
+		fmt.Fprintf(out, "Heartbeat: %s ago at %s, the failover limit is %s\n", report.HeartbeatAge, report.LastHeartbeat.UTC().Format(time.RFC3339), report.FailoverTimeLimit)
+	}
+	for _, p := range report.Protocols {
+		state := "armed"
+		if p.Blocked {
+			state = "disarmed"
+			if p.Note != nil {
+				state += fmt.Sprintf(" by %s at %s: %s", p.Note.Operator, p.Note.Time.UTC().Format(time.RFC3339), p.Note.Reason)
+			} else {
+				state += ", the blocker has no note"
+			}
+		}
+		if p.FailedOver {
+			state += ", failed over"
+		}
+		fmt.Fprintf(out, "%s: %s\n", strings.ToUpper(p.Protocol), state)
+	}
+	switch {
+	case report.Lease == nil:
+	case report.Lease.Owner == "":
+		fmt.Fprintln(out, "Lease: never taken")
+	case report.Lease.Expires.After(now):
+		fmt.Fprintf(out, "Lease: held by %s until %s, token %d\n", report.Lease.Owner, report.Lease.Expires.UTC().Format(time.RFC3339), report.Lease.Token)
+	default:
+		fmt.Fprintf(out, "Lease: free, last held by %s until %s, token %d\n", report.Lease.Owner, report.Lease.Expires.UTC().Format(time.RFC3339), report.Lease.Token)
+	}
+	if report.LastRound == nil {
+		fmt.Fprintln(out, "Last round: none recorded")
+	} else if !report.LastRound.Conclusive() {
+		fmt.Fprintf(out, "Last round at %s: inconclusive, %s\n", report.LastRound.Time.UTC().Format(time.RFC3339), report.LastRound.Error)
+	} else {
+		fmt.Fprintf(out, "Last round at %s:\n", report.LastRound.Time.UTC().Format(time.RFC3339))
+		for _, p := range report.LastRound.All() {
+			verdict := "healthy"
+			if !p.Passed() {
+				verdict = "failing"
+			}
+			fmt.Fprintf(out, "  %s: %s, %s\n", strings.ToUpper(p.Protocol), verdict, p.Reason)
+			for _, s := range p.Servers {
+				fmt.Fprintf(out, "    %s: %s (%dms)\n", s.Name, s.Reason, s.Latency)
+			}
+		}
+	}
+	if len(report.Transitions) > 0 {
+		fmt.Fprintln(out, "Recent transitions:")
+		for _, t := range report.Transitions {
+			outcome := "ok"
+			if !t.Succeeded() {
+				outcome = "failed: " + t.Error
+			}
+			fmt.Fprintf(out, "  %s %s %s %s, %s\n", t.Time.UTC().Format(time.RFC3339), t.Kind, t.Protocol, outcome, t.Reason)
+		}
+	}
+}
+
+// saveRound keeps round for the status command
+func (r *runner) saveRound(ctx context.Context, round Round) {
+	if err := r.actions.SaveRound(ctx, round); err != nil {
+		logger.Error(fmt.Sprintf("Unable to save the probe round: %s", err))
+	}
+}
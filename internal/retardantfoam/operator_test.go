@@ -0,0 +1,170 @@
+package retardantfoam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestStoreActionsBlockerNotes(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testStoreActions(t)
+	note := BlockerNote{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Operator: "jdoe", Reason: "maintenance"}
+
+	require.NoError(t, a.Disarm(ctx, protocolHTTP, note))
+	blocked, err := a.Blocked(ctx, protocolHTTP)
+	require.NoError(t, err)
+	assert.True(t, blocked)
+	got, err := a.BlockerNote(ctx, protocolHTTP)
+	require.NoError(t, err)
+	assert.Equal(t, &note, got)
+
+	// A blocker made by hand has no note
+	require.NoError(t, a.store.Put(ctx, heartbeatBlockerKey, []byte{}))
+	got, err = a.BlockerNote(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	require.NoError(t, a.Arm(ctx, protocolDNS))
+	blocked, err = a.Blocked(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	lastHeartbeat, err := a.LastHeartbeat(ctx)
+	require.NoError(t, err)
+	assert.False(t, lastHeartbeat.IsZero(), "arming DNS writes a heartbeat")
+
+	// Failing over leaves a note saying so
+	require.NoError(t, a.Failover(ctx, protocolDNS))
+	got, err = a.BlockerNote(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.Equal(t, "retardantfoam", got.Operator)
+	failedOver, err := a.FailedOver(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.True(t, failedOver)
+}
+
+func TestStoreActionsAuditAndRounds(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testStoreActions(t)
+
+	round, err := a.LastRound(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, round)
+	require.NoError(t, a.SaveRound(ctx, partial))
+	round, err = a.LastRound(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, partial.Servers, round.Servers)
+
+	for i := 0; i < maxAuditRecords+1; i++ {
+		require.NoError(t, a.RecordAudit(ctx, AuditRecord{Operator: "jdoe", Action: "status", Detail: string(rune('a' + i%26))}))
+	}
+	records := []AuditRecord{}
+	require.NoError(t, json.Unmarshal([]byte(getObject(t, a.config, "vatsim-vatdns", auditKey)), &records))
+	assert.Len(t, records, maxAuditRecords)
+	assert.Equal(t, "b", records[0].Detail, "the oldest record is dropped")
+}
+
+func testOperator() (*runner, *fakeActions) {
+	actions := &fakeActions{blocked: map[string]bool{}}
+	now := time.Date(2024, 1, 1, 0, 10, 0, 0, time.UTC)
+	return &runner{
+		config:  &Config{FailoverTimeLimit: 5 * time.Minute},
+		actions: actions,
+		now:     func() time.Time { return now },
+	}, actions
+}
+
+func TestOperatorArmAndDisarm(t *testing.T) {
+	ctx := context.Background()
+	r, actions := testOperator()
+	out := bytes.Buffer{}
+
+	assert.Equal(t, operatorUsage, r.operate(ctx, "disarm", OperatorOptions{Operator: "jdoe"}, &out), "a reason is needed")
+	assert.Contains(t, out.String(), "disarm needs a -reason")
+	assert.Empty(t, actions.audits)
+
+	opts := OperatorOptions{Operator: "jdoe", Reason: "dnshaiku upgrade", Protocol: protocolDoH}
+	assert.Equal(t, operatorOK, r.operate(ctx, "disarm", opts, &out))
+	assert.True(t, actions.blocked[protocolDoH])
+	assert.Equal(t, "dnshaiku upgrade", actions.notes[protocolDoH].Reason)
+
+	// Disarming twice would lose who disarmed it first
+	assert.Equal(t, operatorFailed, r.operate(ctx, "disarm", OperatorOptions{Operator: "asmith", Reason: "again", Protocol: protocolDoH}, &out))
+	assert.Equal(t, "jdoe", actions.notes[protocolDoH].Operator)
+
+	assert.Equal(t, operatorOK, r.operate(ctx, "arm", opts, &out))
+	assert.False(t, actions.blocked[protocolDoH])
+
+	require.Len(t, actions.audits, 3)
+	assert.Equal(t, AuditRecord{Time: r.now(), Operator: "jdoe", Action: "disarm", Protocol: protocolDoH, Reason: "dnshaiku upgrade", Outcome: "ok", Detail: "Disarmed doh, vatdns-heartbeat-blocker-doh written"}, actions.audits[0])
+	assert.Equal(t, "failed", actions.audits[1].Outcome)
+	assert.Equal(t, "arm", actions.audits[2].Action)
+}
+
+func TestOperatorForcedTransitions(t *testing.T) {
+	ctx := context.Background()
+	r, actions := testOperator()
+	out := bytes.Buffer{}
+	opts := OperatorOptions{Operator: "jdoe", Reason: "Amsterdam is down"}
+
+	assert.Equal(t, operatorUsage, r.operate(ctx, "force-failover", opts, &out))
+	assert.Contains(t, out.String(), "add -confirm")
+	assert.Equal(t, 0, actions.failovers)
+
+	opts.Confirm = true
+	assert.Equal(t, operatorOK, r.operate(ctx, "force-failover", opts, &out))
+	assert.Equal(t, 1, actions.failovers)
+	require.Len(t, actions.transitions, 1)
+	assert.Equal(t, "Failover forced by jdoe: Amsterdam is down", actions.transitions[0].Reason)
+
+	assert.Equal(t, operatorUsage, r.operate(ctx, "failback", OperatorOptions{Operator: "jdoe", Reason: "fixed"}, &out))
+	assert.Equal(t, operatorOK, r.operate(ctx, "failback", OperatorOptions{Operator: "jdoe", Reason: "fixed", Confirm: true}, &out))
+	assert.Equal(t, 1, actions.failbacks)
+	require.Len(t, actions.audits, 2)
+	assert.Equal(t, "force-failover", actions.audits[0].Action)
+	assert.Equal(t, "failback", actions.audits[1].Action)
+}
+
+func TestOperatorStatus(t *testing.T) {
+	ctx := context.Background()
+	r, actions := testOperator()
+	actions.lastHeartbeat = r.now().Add(-2 * time.Minute)
+	round := passed
+	round.Time = r.now().Add(-time.Minute)
+	actions.lastRound = &round
+	require.NoError(t, actions.Disarm(ctx, protocolHTTP, BlockerNote{Time: r.now(), Operator: "jdoe", Reason: "moving the website"}))
+	actions.blocked[protocolDoT] = true
+	actions.transitions = []Transition{{Time: r.now(), Kind: transitionFailover, Protocol: protocolDNS, Reason: "forced", Error: "flushing Cloudflare cache: 500"}}
+
+	out := bytes.Buffer{}
+	assert.Equal(t, operatorOK, r.operate(ctx, "status", OperatorOptions{Operator: "jdoe"}, &out))
+	assert.Contains(t, out.String(), "Heartbeat: 2m0s ago at 2024-01-01T00:08:00Z, the failover limit is 5m0s\n")
+	assert.Contains(t, out.String(), "DNS: armed\n")
+	assert.Contains(t, out.String(), "HTTP: disarmed by jdoe at 2024-01-01T00:10:00Z: moving the website\n")
+	assert.Contains(t, out.String(), "DOT: disarmed, the blocker has no note\n")
+	assert.Contains(t, out.String(), "Last round at 2024-01-01T00:09:00Z:\n  DNS: healthy")
+	assert.Contains(t, out.String(), "    a: ")
+	assert.Contains(t, out.String(), "failover dns failed: flushing Cloudflare cache: 500, forced")
+
+	out.Reset()
+	assert.Equal(t, operatorOK, r.operate(ctx, "status", OperatorOptions{Operator: "jdoe", JSON: true}, &out))
+	report := StatusReport{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+	assert.Equal(t, "2m0s", report.HeartbeatAge)
+	require.Len(t, report.Protocols, 4)
+	assert.True(t, report.Protocols[1].Blocked)
+	assert.Equal(t, 2, report.LastRound.Healthy)
+	require.Len(t, actions.audits, 2)
+	assert.Equal(t, "status", actions.audits[0].Action)
+}
+
+func TestRunnerSavesRounds(t *testing.T) {
+	d, actions, _ := testDaemon(failed)
+	d.runRound(context.Background())
+	assert.Equal(t, 1, actions.rounds)
+	assert.Len(t, actions.lastRound.Servers, 2)
+}
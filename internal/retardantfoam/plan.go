@@ -0,0 +1,286 @@
+package retardantfoam
+
+import (
+	"context"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"io"
+	"strings"
+	"time"
+)
+
+// Exit codes of RunPlan
+const (
+	planHealthy       = 0
+	planError         = 1
+	planWouldFailover = 3
+)
+
+// PlannedUpload is an IP server file as failing over would leave it
+type PlannedUpload struct {
+	Region string
+	Bucket string
+	Name   string
+	// Exists is whether the file is there now, with Current contents
+	Exists   bool
+	Current  string
+	Contents string
+	// Error is why the file couldn't be rendered or read, failing over would skip it
+	Error string
+}
+
+// Changed is whether failing over would change the file
+func (u PlannedUpload) Changed() bool {
+	return !u.Exists || u.Current != u.Contents
+}
+
+// Diff is a unified diff from the file's current contents to what failing over uploads
+func (u PlannedUpload) Diff() string {
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        diffLines(u.Current),
+		B:        diffLines(u.Contents),
+		FromFile: "current",
+		ToFile:   "failover",
+		Context:  3,
+	})
+	return diff
+}
+
+// diffLines splits text into lines for difflib, each ending in a newline
+func diffLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+// FailoverPlan is what failing over a protocol would do
+type FailoverPlan struct {
+	Protocol string
+	// Actions are from the protocol's failover profile
+	Actions []string
+	Uploads []PlannedUpload
+	// Purges are the Cloudflare purge calls made
+	Purges []string
+	// Records are the changes to Cloudflare DNS records
+	Records []string
+	// Markers are what is written to DO_SPACES_BUCKET_NAME
+	Markers []string
+}
+
+// Print writes the plan out for a human
+func (p *FailoverPlan) Print(w io.Writer) {
+	fmt.Fprintf(w, "\nFailing over %s would:\n", p.Protocol)
+	if contains(p.Actions, actionFiles) && len(p.Uploads) == 0 {
+		fmt.Fprintln(w, "  upload no IP server files, none are listed for it")
+	}
+	for _, u := range p.Uploads {
+		path := fmt.Sprintf("%s/%s/%s", u.Region, u.Bucket, u.Name)
+		switch {
+		case u.Error != "":
+			fmt.Fprintf(w, "  skip %s: %s\n", path, u.Error)
+		case !u.Exists:
+			fmt.Fprintf(w, "  upload %s (new)\n", path)
+			fmt.Fprint(w, indent(u.Diff()))
+		case u.Changed():
+			fmt.Fprintf(w, "  upload %s (changed)\n", path)
+			fmt.Fprint(w, indent(u.Diff()))
+		default:
+			fmt.Fprintf(w, "  upload %s (unchanged)\n", path)
+		}
+	}
+	for _, purge := range p.Purges {
+		fmt.Fprintf(w, "  %s\n", purge)
+	}
+	for _, record := range p.Records {
+		fmt.Fprintf(w, "  %s\n", record)
+	}
+	for _, marker := range p.Markers {
+		fmt.Fprintf(w, "  %s\n", marker)
+	}
+}
+
+func indent(text string) string {
+	if text == "" {
+		return ""
+	}
+	return "    " + strings.ReplaceAll(strings.TrimSuffix(text, "\n"), "\n", "\n    ") + "\n"
+}
+
+func (a *storeActions) PlanFailover(ctx context.Context, protocol string) (*FailoverPlan, error) {
+	profile, files, err := a.failoverProfile(protocol)
+	if err != nil {
+		return nil, err
+	}
+	plan := &FailoverPlan{Protocol: protocol, Actions: profile.Actions, Purges: describePurge(a.config, purgeRequest(profile.Purge, files))}
+	listed := make(map[string][]templateServer)
+	for _, v := range files {
+		plan.Uploads = append(plan.Uploads, a.planUpload(ctx, v, listed))
+	}
+	if profile.has(actionDnsRecords) {
+		for _, r := range profile.DnsRecords {
+			plan.Records = append(plan.Records, a.describeRecords(ctx, r, listed))
+		}
+	}
+
+	stateKey := scopedKey(failoverStateKey, protocol)
+	_, err = a.store.Head(ctx, stateKey)
+	switch {
+	case err == nil:
+		plan.Markers = append(plan.Markers, fmt.Sprintf("keep %s saved by an earlier failover", stateKey))
+	case storage.IsNotFound(err):
+		plan.Markers = append(plan.Markers, fmt.Sprintf("write %s with the files' current contents, for failing back", stateKey))
+	default:
+		return nil, fmt.Errorf("checking %s: %w", stateKey, err)
+	}
+	plan.Markers = append(plan.Markers,
+		fmt.Sprintf("write %s", scopedKey(heartbeatBlockerKey, protocol)),
+		fmt.Sprintf("record the failover in %s", transitionsKey),
+	)
+	return plan, nil
+}
+
+// planUpload renders f as Failover would and reads what it holds now
+func (a *storeActions) planUpload(ctx context.Context, f ipServerFile, listed map[string][]templateServer) PlannedUpload {
+	u := PlannedUpload{Region: f.Region, Bucket: f.Bucket, Name: f.Name}
+	contents, err := a.contents(ctx, f, listed)
+	if err != nil {
+		u.Error = fmt.Sprintf("rendering failed: %s", err)
+		return u
+	}
+	u.Contents = string(contents)
+	store, err := a.openStore(f.Region, f.Bucket)
+	if err != nil {
+		u.Error = err.Error()
+		return u
+	}
+	current, _, err := store.Get(ctx, f.Name)
+	if err == nil {
+		u.Exists = true
+		u.Current = string(current)
+	} else if !storage.IsNotFound(err) {
+		u.Error = fmt.Sprintf("reading the current file failed: %s", err)
+	}
+	return u
+}
+
+// RunPlan reads everything and probes like RunOnce, then prints what would be done without doing it.
+// Failover plans are printed for DNS when the heartbeat is too old, the only time once mode fails over,
+// and for the protocols in show. It returns 0 if nothing would fail over, 3 if it would and 1 if
+// something couldn't be read or probed.
+func RunPlan(c *Config, out io.Writer, show []string) int {
+	for _, protocol := range show {
+		if !contains([]string{protocolDNS, protocolHTTP, protocolDoH, protocolDoT}, protocol) {
+			fmt.Fprintf(out, "Unknown protocol %q, expected dns, http, doh or dot\n", protocol)
+			return planError
+		}
+	}
+	r, err := newRunner(c)
+	if err != nil {
+		logger.Error(err.Error())
+		return planError
+	}
+	defer r.close()
+	return r.plan(context.Background(), out, show)
+}
+
+func (r *runner) plan(ctx context.Context, out io.Writer, show []string) int {
+	code := planHealthy
+	failing := make([]string, 0)
+	disabled, err := r.actions.Blocked(ctx, protocolDNS)
+	if err != nil {
+		fmt.Fprintf(out, "Unable to contact Spaces: %s\n", err)
+		return planError
+	}
+	if disabled {
+		fmt.Fprintf(out, "%s exists, retardantfoam is disabled and would do nothing.\n", heartbeatBlockerKey)
+	} else {
+		lastHeartbeat, err := r.actions.LastHeartbeat(ctx)
+		if err != nil {
+			fmt.Fprintf(out, "Unable to contact Spaces: %s\n", err)
+			return planError
+		}
+		if lastHeartbeat.IsZero() {
+			fmt.Fprintln(out, "No heartbeat has been written.")
+		} else {
+			since := r.now().Sub(lastHeartbeat).Truncate(time.Second)
+			fmt.Fprintf(out, "Last heartbeat %s ago, the limit is %s.\n", since, r.config.FailoverTimeLimit)
+			if since >= r.config.FailoverTimeLimit {
+				fmt.Fprintln(out, "The heartbeat is too old, once mode would fail over DNS without probing.")
+				failing = append(failing, protocolDNS)
+			}
+		}
+	}
+
+	round := r.prober.Probe(ctx)
+	if !round.Conclusive() {
+		fmt.Fprintf(out, "Probing was inconclusive: %s\n", round.Error)
+		code = planError
+	} else {
+		for _, p := range round.All() {
+			verdict := "healthy"
+			if !p.Passed() {
+				verdict = "failing"
+			}
+			fmt.Fprintf(out, "%s: %s, %s\n", strings.ToUpper(p.Protocol), verdict, p.Reason)
+			for _, s := range p.Servers {
+				if !s.Pass {
+					fmt.Fprintf(out, "  %s: %s\n", s.Name, s.Reason)
+				}
+			}
+			blocked := disabled
+			if p.Protocol != protocolDNS {
+				blocked, err = r.actions.Blocked(ctx, p.Protocol)
+				if err != nil {
+					fmt.Fprintf(out, "  unable to check its blocker: %s\n", err)
+					code = planError
+					continue
+				}
+			}
+			if blocked && p.Protocol != protocolDNS {
+				fmt.Fprintf(out, "  %s exists, it would not fail over\n", scopedKey(heartbeatBlockerKey, p.Protocol))
+			} else if !disabled && !p.Passed() {
+				// Once mode only fails over on the heartbeat's age and the daemon after a streak, so one
+				// failing round isn't counted as a failover
+				fmt.Fprintf(out, "  one failing round doesn't fail over, the daemon needs %d over %s. Add -protocol %s to see what it would do.\n",
+					r.config.FailoverFailures, r.config.FailoverWindow, p.Protocol)
+			}
+		}
+		if round.Passed() && !disabled {
+			fmt.Fprintf(out, "A heartbeat would be written to %s and the templated IP server files rendered.\n", heartbeatKey)
+		}
+	}
+
+	planned := append([]string{}, failing...)
+	for _, protocol := range show {
+		if !contains(planned, protocol) {
+			planned = append(planned, protocol)
+		}
+	}
+	for _, protocol := range planned {
+		plan, err := r.actions.PlanFailover(ctx, protocol)
+		if err != nil {
+			fmt.Fprintf(out, "\nUnable to plan failing over %s: %s\n", protocol, err)
+			code = planError
+			continue
+		}
+		plan.Print(out)
+	}
+	if len(failing) > 0 && code == planHealthy {
+		code = planWouldFailover
+	}
+	return code
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package retardantfoam
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestStoreActionsPlanFailover(t *testing.T) {
+	ctx := context.Background()
+	a, purges := testStoreActions(t)
+	a.config.CloudflareZoneId = "zone"
+	nyc, err := a.openStore("nyc3", "vatsim-vatdns")
+	require.NoError(t, err)
+	require.NoError(t, nyc.Put(ctx, "servers.txt", []byte("fsd.connect.vatsim.net\n")))
+
+	plan, err := a.PlanFailover(ctx, protocolDNS)
+	require.NoError(t, err)
+	require.Len(t, plan.Uploads, 3)
+	assert.True(t, plan.Uploads[0].Exists)
+	assert.True(t, plan.Uploads[0].Changed())
+	assert.Contains(t, plan.Uploads[0].Diff(), "-fsd.connect.vatsim.net\n+192.0.2.1\n")
+	assert.False(t, plan.Uploads[1].Exists)
+	assert.Equal(t, []string{"purge everything cached in Cloudflare zone zone"}, plan.Purges)
+	assert.Equal(t, []string{
+		"write vatdns-failover-state with the files' current contents, for failing back",
+		"write vatdns-heartbeat-blocker",
+		"record the failover in vatdns-transitions",
+	}, plan.Markers)
+	out := bytes.Buffer{}
+	plan.Print(&out)
+	assert.Contains(t, out.String(), "  upload nyc3/vatsim-vatdns/servers.txt (changed)\n    --- current\n    +++ failover\n")
+	assert.Contains(t, out.String(), "  upload ams3/vatsim-vatdns-eu/servers.json (new)\n")
+
+	// Nothing was changed
+	assert.Equal(t, 0, *purges)
+	assert.Equal(t, "fsd.connect.vatsim.net\n", getObject(t, a.config, "vatsim-vatdns", "servers.txt"))
+	blocked, err := a.Blocked(ctx, protocolDNS)
+	require.NoError(t, err)
+	assert.False(t, blocked)
+	_, err = a.store.Head(ctx, failoverStateKey)
+	assert.True(t, storage.IsNotFound(err))
+
+	// Planning a failover that already happened changes nothing further
+	require.NoError(t, a.Failover(ctx, protocolHTTP))
+	plan, err = a.PlanFailover(ctx, protocolHTTP)
+	require.NoError(t, err)
+	require.Len(t, plan.Uploads, 1)
+	assert.False(t, plan.Uploads[0].Changed())
+	assert.Equal(t, "keep vatdns-failover-state-http saved by an earlier failover", plan.Markers[0])
+	assert.Equal(t, "write vatdns-heartbeat-blocker-http", plan.Markers[1])
+}
+
+func TestRunnerPlan(t *testing.T) {
+	httpFailing := passed
+	httpFailing.Protocols = []ProtocolRound{{Protocol: protocolHTTP, Servers: []DnsServer{{Name: "a", Reason: "returned 503"}}, Required: 1}}
+	plan := func(lastHeartbeat time.Time, round Round, show ...string) (int, *fakeActions, string) {
+		actions := &fakeActions{lastHeartbeat: lastHeartbeat, blocked: map[string]bool{}}
+		r := &runner{
+			config:  &Config{FailoverTimeLimit: 5 * time.Minute, FailoverFailures: 5, FailoverWindow: 5 * time.Minute},
+			actions: actions,
+			prober:  &fakeProber{now: time.Now, rounds: []Round{round}},
+			now:     time.Now,
+		}
+		out := bytes.Buffer{}
+		code := r.plan(context.Background(), &out, show)
+		// Planning never acts
+		assert.Equal(t, 0, actions.heartbeats+actions.renders+actions.failovers+actions.failbacks)
+		return code, actions, out.String()
+	}
+
+	code, actions, out := plan(time.Now().Add(-time.Minute), passed)
+	assert.Equal(t, planHealthy, code)
+	assert.Empty(t, actions.plans)
+	assert.Contains(t, out, "A heartbeat would be written")
+
+	code, actions, _ = plan(time.Now().Add(-time.Minute), passed, protocolDNS)
+	assert.Equal(t, planHealthy, code, "showing a failover doesn't mean it would happen")
+	assert.Equal(t, []string{protocolDNS}, actions.plans)
+
+	code, actions, out = plan(time.Now().Add(-time.Minute), failed, protocolDNS)
+	assert.Equal(t, planHealthy, code, "one failing round isn't a failover in either mode")
+	assert.Equal(t, []string{protocolDNS}, actions.plans)
+	assert.Contains(t, out, "DNS: failing")
+	assert.Contains(t, out, "one failing round doesn't fail over, the daemon needs 5 over 5m0s")
+
+	code, actions, out = plan(time.Now().Add(-10*time.Minute), passed)
+	assert.Equal(t, 3, code, "2 is what a bad flag or a missing config file exits with")
+	assert.Equal(t, []string{protocolDNS}, actions.plans)
+	assert.Contains(t, out, "once mode would fail over DNS without probing")
+
+	code, actions, out = plan(time.Now().Add(-time.Minute), httpFailing)
+	assert.Equal(t, planHealthy, code)
+	assert.Empty(t, actions.plans)
+	assert.Contains(t, out, "HTTP: failing")
+	assert.Contains(t, out, "  a: returned 503\n")
+
+	code, _, out = plan(time.Now().Add(-time.Minute), inconclusive)
+	assert.Equal(t, planError, code)
+	assert.Contains(t, out, "Probing was inconclusive: listing droplets: 503")
+}
+
+func TestRunnerPlanDisabled(t *testing.T) {
+	actions := &fakeActions{blocked: map[string]bool{protocolDNS: true}}
+	r := &runner{
+		config:  &Config{FailoverTimeLimit: 5 * time.Minute},
+		actions: actions,
+		prober:  &fakeProber{now: time.Now, rounds: []Round{failed}},
+		now:     time.Now,
+	}
+	out := bytes.Buffer{}
+	assert.Equal(t, planHealthy, r.plan(context.Background(), &out, nil))
+	assert.Empty(t, actions.plans)
+	assert.Contains(t, out.String(), "retardantfoam is disabled")
+}
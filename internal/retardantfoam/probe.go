@@ -0,0 +1,186 @@
+package retardantfoam
+
+import (
+	"context"
+	"fmt"
+	"github.com/digitalocean/godo"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"math"
+	"net"
+	"net/http"
+	"time"
+)
+
+type DnsServer struct {
+	Name    string `json:"name"`
+	Latency int64  `json:"latency"`
+	Result  string `json:"result"`
+	Pass    bool   `json:"pass"`
+	// Reason is why the instance failed, or ok
+	Reason string `json:"reason"`
+	// Zone is the instance's SOA serial and nameservers, which should match across instances
+	Zone string `json:"zone,omitempty"`
+}
+
+// The protocols clients reach dnshaiku over. DNS failing fails everything over, the others only their own files.
+const (
+	protocolDNS  = "dns"
+	protocolHTTP = "http"
+	protocolDoH  = "doh"
+	protocolDoT  = "dot"
+)
+
+// ProtocolRound is the health of one protocol in a round
+type ProtocolRound struct {
+	Protocol string      `json:"protocol"`
+	Servers  []DnsServer `json:"servers"`
+	Healthy  int         `json:"healthy"`
+	// Required is how many must be healthy for the protocol to be working, at least one
+	Required int `json:"required"`
+	// Reason sums up the verdict
+	Reason string `json:"reason,omitempty"`
+}
+
+// Passed is whether enough answered correctly
+func (p ProtocolRound) Passed() bool {
+	return p.Healthy > 0 && p.Healthy >= p.Required
+}
+
+// Quorate is whether at least ratio of those probed answered
+func (p ProtocolRound) Quorate(ratio float64) bool {
+	return p.Healthy > 0 && float64(p.Healthy) >= math.Ceil(ratio*float64(len(p.Servers)))
+}
+
+// Round is the result of probing every dnshaiku droplet once. The top level fields are DNS,
+// the other protocols probed are in Protocols.
+type Round struct {
+	Time    time.Time   `json:"time"`
+	Servers []DnsServer `json:"servers"`
+	Healthy int         `json:"healthy"`
+	// Required is how many droplets must be healthy for DNS to be working, at least one
+	Required int `json:"required"`
+	// Reason sums up the verdict
+	Reason    string          `json:"reason,omitempty"`
+	Protocols []ProtocolRound `json:"protocols,omitempty"`
+	// Error is set when the droplets or FSD servers couldn't be listed, the round says nothing about DNS then
+	Error string `json:"error,omitempty"`
+}
+
+// DNS is the round's DNS health
+func (r Round) DNS() ProtocolRound {
+	return ProtocolRound{Protocol: protocolDNS, Servers: r.Servers, Healthy: r.Healthy, Required: r.Required, Reason: r.Reason}
+}
+
+// All is the health of every protocol probed, DNS first
+func (r Round) All() []ProtocolRound {
+	return append([]ProtocolRound{r.DNS()}, r.Protocols...)
+}
+
+// Conclusive is whether the round tells us anything about DNS health
+func (r Round) Conclusive() bool {
+	return r.Error == ""
+}
+
+// Passed is whether at least HEALTH_QUORUM droplets answered DNS correctly
+func (r Round) Passed() bool {
+	return r.DNS().Passed()
+}
+
+// Quorate is whether at least ratio of the droplets probed answered DNS
+func (r Round) Quorate(ratio float64) bool {
+	return r.DNS().Quorate(ratio)
+}
+
+// prober probes the dnshaiku droplets
+type prober interface {
+	Probe(ctx context.Context) Round
+}
+
+// dropletProber finds the dnshaiku droplets by DO_TAG and checks each with a healthChecker, along with any
+// DoH and DoT endpoints. With FSD_DO_TAG the FSD servers are listed and polled too, so answers can be
+// checked against them.
+type dropletProber struct {
+	client   *godo.Client
+	tag      string
+	fsdTag   string
+	dnsPort  string
+	httpPort string
+	checker  *healthChecker
+	fsdPolls *http.Client
+}
+
+func newDropletProber(c *Config) *dropletProber {
+	return &dropletProber{
+		client:   godo.NewFromToken(c.DoApiKey),
+		tag:      c.DoTag,
+		fsdTag:   c.FsdDoTag,
+		dnsPort:  c.DnsPort,
+		httpPort: c.HttpEndpointPort,
+		checker:  newHealthChecker(c),
+		fsdPolls: &http.Client{Timeout: 2 * time.Second},
+	}
+}
+
+func (p *dropletProber) Probe(ctx context.Context) Round {
+	now := time.Now()
+	opt := &godo.ListOptions{
+		Page:    1,
+		PerPage: 200,
+	}
+	droplets, _, err := p.client.Droplets.ListByTag(ctx, p.tag, opt)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Listing Droplets by tag failed: %s", err))
+		return Round{Time: now, Servers: make([]DnsServer, 0), Error: err.Error()}
+	}
+	logger.Info("Checked tag for Droplets")
+	instances := make([]instance, 0, len(droplets))
+	for _, d := range droplets {
+		publicIPv4, _ := d.PublicIPv4()
+		instances = append(instances, instance{
+			Name:        d.Name,
+			Address:     net.JoinHostPort(publicIPv4, p.dnsPort),
+			HttpAddress: net.JoinHostPort(publicIPv4, p.httpPort),
+		})
+	}
+
+	var known map[string]*common.FSDServer
+	if p.fsdTag != "" {
+		known, err = p.knownFsdServers(ctx)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Listing FSD servers by tag failed: %s", err))
+			return Round{Time: now, Servers: make([]DnsServer, 0), Error: err.Error()}
+		}
+	}
+	round := p.checker.evaluate(ctx, instances, known)
+	round.Time = now
+	return round
+}
+
+// knownFsdServers lists the FSD servers by FSD_DO_TAG and polls each once, keyed by IP
+func (p *dropletProber) knownFsdServers(ctx context.Context) (map[string]*common.FSDServer, error) {
+	return pollFsdServers(ctx, p.client, p.fsdTag, p.fsdPolls)
+}
+
+// pollFsdServers lists the FSD servers by tag and polls each once, keyed by IP
+func pollFsdServers(ctx context.Context, client *godo.Client, tag string, polls *http.Client) (map[string]*common.FSDServer, error) {
+	droplets, _, err := client.Droplets.ListByTag(ctx, tag, &godo.ListOptions{Page: 1, PerPage: 200})
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]*common.FSDServer, len(droplets))
+	done := make(chan struct{}, len(droplets))
+	for i := range droplets {
+		fsd := common.NewFSDServer(&droplets[i])
+		known[fsd.IpAddress] = fsd
+		go func() {
+			// A failed poll leaves the server not accepting, which is what the check wants
+			_ = fsd.Poll(ctx, polls)
+			done <- struct{}{}
+		}()
+	}
+	for range droplets {
+		<-done
+	}
+	return known, nil
+}
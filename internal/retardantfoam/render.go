@@ -0,0 +1,379 @@
+package retardantfoam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/digitalocean/godo"
+	"github.com/go-yaml/yaml"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// renderedPrefix is where the rendered IP server files are kept in DO_SPACES_BUCKET_NAME, ready to be
+// copied into place when failing over
+const renderedPrefix = "vatdns-rendered"
+
+// Where a templated file's servers come from
+const (
+	// sourceTag lists the FSD servers by FSD_DO_TAG and polls each
+	sourceTag = "tag"
+	// sourceDnshaiku reads the registry from a dnshaiku droplet's /status
+	sourceDnshaiku = "dnshaiku"
+	// sourceStatic is the file's own servers
+	sourceStatic = "static"
+)
+
+// templateServer is an FSD server as a template sees it
+type templateServer struct {
+	Name      string `yaml:"name" json:"name"`
+	IpAddress string `yaml:"ip_address" json:"ip_address"`
+	// Region is the FSD region, e.g. usa-e. Taken from the name if not given.
+	Region         string `yaml:"region" json:"region"`
+	RemainingSlots int    `yaml:"remaining_slots" json:"remaining_slots"`
+}
+
+// templateData is what a file's template is executed with. Servers are those accepting connections,
+// most remaining slots first.
+type templateData struct {
+	Generated time.Time
+	Servers   []templateServer
+	Regions   map[string][]templateServer
+}
+
+// IPs are the servers' IP addresses in order
+func (d templateData) IPs() []string {
+	ips := make([]string, 0, len(d.Servers))
+	for _, s := range d.Servers {
+		ips = append(ips, s.IpAddress)
+	}
+	return ips
+}
+
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+var regionPattern = regexp.MustCompile("[^a-zA-Z-]")
+
+// fsdRegion is the region in an FSD server's name, usa-e in fsd.usa-e1.vatsim.net
+func fsdRegion(name string) string {
+	parts := strings.Split(name, ".")
+	if len(parts) < 2 {
+		return ""
+	}
+	return regionPattern.ReplaceAllString(parts[1], "")
+}
+
+// serverSource lists the FSD servers accepting connections
+type serverSource func(ctx context.Context) ([]templateServer, error)
+
+// readDataFile reads the IP server files and failover profiles from RETARDANTFOAM_DATA_FILE, checking them
+func readDataFile(path string) (retardantFoamDataFile, error) {
+	retardantFoamData := retardantFoamDataFile{}
+	yamlData, err := os.ReadFile(path)
+	if err != nil {
+		return retardantFoamData, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if err := yaml.Unmarshal(yamlData, &retardantFoamData); err != nil {
+		return retardantFoamData, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	var errs error
+	for _, v := range retardantFoamData.IpServerFiles {
+		if v.Template == "" {
+			continue
+		}
+		switch v.Source {
+		case sourceTag, sourceDnshaiku, sourceStatic, "":
+		default:
+			errs = errors.Join(errs, fmt.Errorf("%s: unknown source %q", v.Name, v.Source))
+		}
+		if _, err := v.parseTemplate(); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", v.Name, err))
+		}
+	}
+	for protocol := range retardantFoamData.FailoverProfiles {
+		if !contains([]string{protocolDNS, protocolHTTP, protocolDoH, protocolDoT}, protocol) {
+			errs = errors.Join(errs, fmt.Errorf("failoverProfiles: unknown protocol %q", protocol))
+			continue
+		}
+		if err := profileFor(retardantFoamData, protocol).validate(filesFor(retardantFoamData.IpServerFiles, protocol)); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failoverProfiles %s: %w", protocol, err))
+		}
+	}
+	if errs != nil {
+		return retardantFoamData, fmt.Errorf("parsing %s: %w", path, errs)
+	}
+	return retardantFoamData, nil
+}
+
+func (f ipServerFile) parseTemplate() (*template.Template, error) {
+	return template.New(f.Name).Funcs(templateFuncs).Option("missingkey=error").Parse(f.Template)
+}
+
+// renderedKey is where f's rendered contents are kept
+func renderedKey(f ipServerFile) string {
+	return fmt.Sprintf("%s/%s/%s/%s", renderedPrefix, f.Region, f.Bucket, f.Name)
+}
+
+// render executes f's template with the servers from its source
+func (a *storeActions) render(ctx context.Context, f ipServerFile, listed map[string][]templateServer) ([]byte, error) {
+	servers, err := a.selectServers(ctx, f.Name, f.Source, f.FsdRegions, f.Servers, listed)
+	if err != nil {
+		return nil, err
+	}
+	data := templateData{Generated: a.now().UTC(), Servers: servers, Regions: make(map[string][]templateServer)}
+	for _, s := range servers {
+		data.Regions[s.Region] = append(data.Regions[s.Region], s)
+	}
+	t, err := f.parseTemplate()
+	if err != nil {
+		return nil, err
+	}
+	out := bytes.Buffer{}
+	if err := t.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// selectServers are source's servers accepting connections in regions, most remaining slots first. They
+// fall back to static if the source fails or has none. listed caches each source's servers, and name is
+// what they are for.
+func (a *storeActions) selectServers(ctx context.Context, name string, source string, regions []string, static []templateServer, listed map[string][]templateServer) ([]templateServer, error) {
+	isStatic := source == sourceStatic || source == ""
+	var servers []templateServer
+	var err error
+	if isStatic {
+		servers = withRegions(static)
+	} else {
+		servers, err = a.servers(ctx, source, listed)
+	}
+	if err == nil {
+		servers = inRegions(servers, regions)
+		if len(servers) == 0 {
+			err = errors.New("no servers accepting connections")
+		}
+	}
+	if err != nil {
+		if isStatic || len(static) == 0 {
+			return nil, err
+		}
+		logger.Error(fmt.Sprintf("Using the static servers for %s, %s source failed: %s", name, source, err))
+		servers = inRegions(withRegions(static), regions)
+		if len(servers) == 0 {
+			return nil, errors.New("no static servers in its regions")
+		}
+	}
+
+	sort.SliceStable(servers, func(i, j int) bool {
+		if servers[i].RemainingSlots != servers[j].RemainingSlots {
+			return servers[i].RemainingSlots > servers[j].RemainingSlots
+		}
+		return servers[i].Name < servers[j].Name
+	})
+	return servers, nil
+}
+
+// servers lists source once per render
+func (a *storeActions) servers(ctx context.Context, source string, listed map[string][]templateServer) ([]templateServer, error) {
+	if servers, ok := listed[source]; ok {
+		return append([]templateServer{}, servers...), nil
+	}
+	list, ok := a.sources[source]
+	if !ok {
+		return nil, fmt.Errorf("unknown source %q", source)
+	}
+	servers, err := list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	servers = withRegions(servers)
+	listed[source] = servers
+	return append([]templateServer{}, servers...), nil
+}
+
+// withRegions fills in any region missing from the server's name
+func withRegions(servers []templateServer) []templateServer {
+	filled := make([]templateServer, 0, len(servers))
+	for _, s := range servers {
+		if s.Region == "" {
+			s.Region = fsdRegion(s.Name)
+		}
+		filled = append(filled, s)
+	}
+	return filled
+}
+
+// inRegions keeps the servers in regions, or all of them if there are none
+func inRegions(servers []templateServer, regions []string) []templateServer {
+	if len(regions) == 0 {
+		return servers
+	}
+	matching := make([]templateServer, 0)
+	for _, s := range servers {
+		for _, r := range regions {
+			if s.Region == r {
+				matching = append(matching, s)
+				break
+			}
+		}
+	}
+	return matching
+}
+
+// contents is what f holds when failed over. Templated files use what was last rendered, so failing over
+// doesn't depend on the sources being reachable, and are only rendered now if that is missing.
+func (a *storeActions) contents(ctx context.Context, f ipServerFile, listed map[string][]templateServer) ([]byte, error) {
+	if f.Template == "" {
+		return []byte(f.Contents), nil
+	}
+	body, _, err := a.store.Get(ctx, renderedKey(f))
+	if err == nil {
+		return body, nil
+	}
+	if !storage.IsNotFound(err) {
+		logger.Error(fmt.Sprintf("Unable to read the rendered %s, rendering it now: %s", f.Name, err))
+	} else {
+		logger.Info(fmt.Sprintf("%s has not been rendered, rendering it now", f.Name))
+	}
+	return a.render(ctx, f, listed)
+}
+
+// RenderFiles renders the templated IP server files into renderedPrefix, at most every RENDER_INTERVAL
+func (a *storeActions) RenderFiles(ctx context.Context) error {
+	if !a.rendered.IsZero() && a.now().Sub(a.rendered) < a.config.RenderInterval {
+		return nil
+	}
+	retardantFoamData, err := readDataFile(a.config.DataFile)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string][]templateServer)
+	var errs error
+	for _, v := range retardantFoamData.IpServerFiles {
+		if v.Template == "" {
+			continue
+		}
+		body, err := a.render(ctx, v, listed)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("rendering %s: %w", v.Name, err))
+			continue
+		}
+		if err := a.store.Put(ctx, renderedKey(v), body); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("saving rendered %s: %w", v.Name, err))
+			continue
+		}
+		logger.Info(fmt.Sprintf("Rendered %s", v.Name))
+	}
+	if errs == nil {
+		a.rendered = a.now()
+	}
+	return errs
+}
+
+// tagSource lists the FSD servers by FSD_DO_TAG, polling each for its capacity
+func tagSource(c *Config, client *godo.Client) serverSource {
+	polls := &http.Client{Timeout: 2 * time.Second}
+	return func(ctx context.Context) ([]templateServer, error) {
+		if c.FsdDoTag == "" {
+			return nil, errors.New("FSD_DO_TAG is not set")
+		}
+		known, err := pollFsdServers(ctx, client, c.FsdDoTag, polls)
+		if err != nil {
+			return nil, err
+		}
+		servers := make([]templateServer, 0, len(known))
+		for _, fsd := range known {
+			if fsd.AcceptingConnections() != 1 {
+				continue
+			}
+			servers = append(servers, templateServer{Name: fsd.Name, IpAddress: fsd.IpAddress, Region: fsd.Country, RemainingSlots: fsd.RemainingSlots})
+		}
+		return servers, nil
+	}
+}
+
+// dnshaikuStatus is the part of dnshaiku's /status read here
+type dnshaikuStatus struct {
+	Servers []struct {
+		Name           string `json:"name"`
+		IpAddress      string `json:"ip_address"`
+		Accepting      bool   `json:"accepting"`
+		RemainingSlots int    `json:"remaining_slots"`
+	} `json:"servers"`
+}
+
+// dnshaikuSource reads the registry of the first dnshaiku droplet to answer on DNSHAIKU_STATUS_PORT
+func dnshaikuSource(c *Config, client *godo.Client) serverSource {
+	statuses := &http.Client{Timeout: 5 * time.Second}
+	return func(ctx context.Context) ([]templateServer, error) {
+		droplets, _, err := client.Droplets.ListByTag(ctx, c.DoTag, &godo.ListOptions{Page: 1, PerPage: 200})
+		if err != nil {
+			return nil, err
+		}
+		addresses := make([]string, 0, len(droplets))
+		for _, d := range droplets {
+			publicIPv4, _ := d.PublicIPv4()
+			addresses = append(addresses, net.JoinHostPort(publicIPv4, c.DnshaikuStatusPort))
+		}
+		return registrySnapshot(ctx, statuses, addresses)
+	}
+}
+
+// registrySnapshot is the accepting servers in the /status of the first address to answer
+func registrySnapshot(ctx context.Context, client *http.Client, addresses []string) ([]templateServer, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no dnshaiku droplets")
+	}
+	var errs error
+	for _, address := range addresses {
+		status, err := fetchStatus(ctx, client, address)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", address, err))
+			continue
+		}
+		servers := make([]templateServer, 0, len(status.Servers))
+		for _, s := range status.Servers {
+			if s.Accepting {
+				servers = append(servers, templateServer{Name: s.Name, IpAddress: s.IpAddress, RemainingSlots: s.RemainingSlots})
+			}
+		}
+		return servers, nil
+	}
+	return nil, errs
+}
+
+func fetchStatus(ctx context.Context, client *http.Client, address string) (*dnshaikuStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/status", address), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("returned %s", resp.Status)
+	}
+	status := &dnshaikuStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
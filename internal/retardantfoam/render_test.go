@@ -0,0 +1,152 @@
+package retardantfoam
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const templatedDataFile = `ipServerFiles:
+  - name: "servers.txt"
+    bucket: "vatsim-vatdns"
+    region: "nyc3"
+    source: "tag"
+    template: |-
+      {{range .Servers}}{{.IpAddress}}
+      {{end}}
+    servers:
+      - name: "fsd.usa-e1.vatsim.net"
+        ip_address: "203.0.113.1"
+  - name: "europe.json"
+    bucket: "vatsim-vatdns-eu"
+    region: "ams3"
+    source: "tag"
+    fsdRegions: ["uk", "ams"]
+    template: '{{json .IPs}}'
+  - name: "static.txt"
+    bucket: "vatsim-vatdns"
+    region: "nyc3"
+    template: '{{join .IPs ","}}'
+    servers:
+      - name: "fsd.can.vatsim.net"
+        ip_address: "203.0.113.2"
+        remaining_slots: 10
+      - name: "fsd.uk.vatsim.net"
+        ip_address: "203.0.113.3"
+        remaining_slots: 20
+`
+
+// testRenderActions renders templatedDataFile from a tag source returning servers, or err
+func testRenderActions(t *testing.T, servers []templateServer, err *error) (*storeActions, *int) {
+	a, _ := testStoreActions(t)
+	require.NoError(t, os.WriteFile(a.config.DataFile, []byte(templatedDataFile), 0o644))
+	listed := 0
+	a.sources = map[string]serverSource{
+		sourceTag: func(ctx context.Context) ([]templateServer, error) {
+			listed++
+			if *err != nil {
+				return nil, *err
+			}
+			return servers, nil
+		},
+	}
+	return a, &listed
+}
+
+var taggedServers = []templateServer{
+	{Name: "fsd.usa-e1.vatsim.net", IpAddress: "192.0.2.1", RemainingSlots: 50},
+	{Name: "fsd.uk.vatsim.net", IpAddress: "192.0.2.2", RemainingSlots: 80},
+	{Name: "fsd.ams.vatsim.net", IpAddress: "192.0.2.3", RemainingSlots: 80},
+	{Name: "fsd.usa-w.vatsim.net", IpAddress: "192.0.2.4", RemainingSlots: 5},
+}
+
+func TestRenderFiles(t *testing.T) {
+	ctx := context.Background()
+	var sourceErr error
+	a, listed := testRenderActions(t, taggedServers, &sourceErr)
+
+	require.NoError(t, a.RenderFiles(ctx))
+	assert.Equal(t, 1, *listed, "each source is listed once per render")
+	files, err := readDataFile(a.config.DataFile)
+	require.NoError(t, err)
+	rendered := func(i int) string {
+		body, _, err := a.store.Get(ctx, renderedKey(files.IpServerFiles[i]))
+		require.NoError(t, err)
+		return string(body)
+	}
+	assert.Equal(t, "192.0.2.3\n192.0.2.2\n192.0.2.1\n192.0.2.4\n", rendered(0), "most remaining slots first")
+	assert.Equal(t, `["192.0.2.3","192.0.2.2"]`, rendered(1))
+	assert.Equal(t, "203.0.113.3,203.0.113.2", rendered(2))
+
+	// Not rendered again within RENDER_INTERVAL
+	a.config.RenderInterval = time.Minute
+	require.NoError(t, a.RenderFiles(ctx))
+	assert.Equal(t, 1, *listed)
+
+	// Failing over pushes what was rendered, without listing the servers again
+	sourceErr = errors.New("DigitalOcean is down")
+	require.NoError(t, a.Failover(ctx, protocolDNS))
+	assert.Equal(t, 1, *listed)
+	assert.Equal(t, "192.0.2.3\n192.0.2.2\n192.0.2.1\n192.0.2.4\n", getObject(t, a.config, "vatsim-vatdns", "servers.txt"))
+	assert.Equal(t, `["192.0.2.3","192.0.2.2"]`, getObject(t, a.config, "vatsim-vatdns-eu", "europe.json"))
+}
+
+func TestRenderFallsBackToStaticServers(t *testing.T) {
+	ctx := context.Background()
+	sourceErr := errors.New("DigitalOcean is down")
+	a, _ := testRenderActions(t, nil, &sourceErr)
+
+	// Nothing rendered yet, so failing over renders now and falls back to the static servers
+	require.NoError(t, a.Failover(ctx, protocolDNS))
+	assert.Equal(t, "203.0.113.1\n", getObject(t, a.config, "vatsim-vatdns", "servers.txt"))
+	eu, err := a.openStore("ams3", "vatsim-vatdns-eu")
+	require.NoError(t, err)
+	_, err = eu.Head(ctx, "europe.json")
+	assert.Error(t, err, "a file with no servers to fall back to isn't pushed")
+
+	err = a.RenderFiles(ctx)
+	assert.ErrorContains(t, err, "rendering europe.json: DigitalOcean is down")
+	assert.True(t, a.rendered.IsZero(), "a failed render is retried on the next heartbeat")
+}
+
+func TestReadDataFileRejectsBadTemplates(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "retardantfoam.yaml")
+	require.NoError(t, os.WriteFile(dataFile, []byte(`ipServerFiles:
+  - name: "a.txt"
+    template: '{{range .Servers}'
+  - name: "b.txt"
+    source: "consul"
+    template: '{{join .IPs "\n"}}'
+`), 0o644))
+	_, err := readDataFile(dataFile)
+	assert.ErrorContains(t, err, "a.txt: template")
+	assert.ErrorContains(t, err, `b.txt: unknown source "consul"`)
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	dnshaiku := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/status", r.URL.Path)
+		_, _ = w.Write([]byte(`{"ready": true, "servers": [
+			{"name": "fsd.usa-e1.vatsim.net", "ip_address": "192.0.2.1", "accepting": true, "remaining_slots": 50},
+			{"name": "fsd.uk.vatsim.net", "ip_address": "192.0.2.2", "accepting": false, "remaining_slots": 80}
+		]}`))
+	}))
+	defer dnshaiku.Close()
+
+	client := &http.Client{Timeout: time.Second}
+	servers, err := registrySnapshot(context.Background(), client, []string{"127.0.0.1:1", dnshaiku.Listener.Addr().String()})
+	require.NoError(t, err)
+	assert.Equal(t, []templateServer{{Name: "fsd.usa-e1.vatsim.net", IpAddress: "192.0.2.1", RemainingSlots: 50}}, servers)
+
+	_, err = registrySnapshot(context.Background(), client, []string{"127.0.0.1:1"})
+	assert.ErrorContains(t, err, "127.0.0.1:1")
+	_, err = registrySnapshot(context.Background(), client, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,289 @@
+// Package retardantfoam is the external healthcheck for dnshaiku. It probes the dnshaiku droplets and,
+// when DNS has been failing for long enough, pushes IP based server lists to Spaces and flushes
+// Cloudflare's cache. It runs once from cron or as a daemon with its own schedule.
+package retardantfoam
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/spf13/viper"
+	"github.com/vatsimnetwork/vatdns/internal/alerting"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Object names in DO_SPACES_BUCKET_NAME
+const (
+	heartbeatKey        = "vatdns-heartbeat"
+	heartbeatBlockerKey = "vatdns-heartbeat-blocker"
+	// failoverStateKey holds what the IP server files contained before failing over, for failing back
+	failoverStateKey = "vatdns-failover-state"
+	transitionsKey   = "vatdns-transitions"
+	// lastRoundKey holds the latest probe round, for the status command
+	lastRoundKey = "vatdns-last-round"
+	// auditKey holds the operator commands run
+	auditKey = "vatdns-audit"
+	// leaseKey is held by the instance allowed to fail over and back
+	leaseKey = "vatdns-lease"
+)
+
+type Config struct {
+	DoApiKey           string
+	DoTag              string
+	DoSpacesKey        string
+	DoSpacesSecret     string
+	DoSpacesRegion     string
+	DoSpacesBucketName string
+	CloudflareApiKey   string
+	CloudflareZoneId   string
+	CloudflareApiURL   string
+	DnsPort            string
+	FsdDoTag           string
+	ProbeHostname      string
+	ProbeZone          string
+	ProbeTCP           bool
+	LatencyThreshold   time.Duration
+	Quorum             Quorum
+	ProbeHTTP          bool
+	HttpEndpointPort   string
+	ProbeHTTPHost      string
+	DohEndpoints       []string
+	DotEndpoints       []string
+	DataFile           string
+	DnshaikuStatusPort string
+	RenderInterval     time.Duration
+	StorageBackend     string
+	StorageEndpoint    string
+	StoragePathStyle   bool
+	StorageDir         string
+	FailoverTimeLimit  time.Duration
+	ProbeInterval      time.Duration
+	FailoverFailures   int
+	FailoverWindow     time.Duration
+	HistorySize        int
+	MetricsPort        string
+	FailbackEnabled    bool
+	FailbackSuccesses  int
+	FailbackWindow     time.Duration
+	FailbackQuorum     float64
+	TransitionCooldown time.Duration
+	LeaseMode          string
+	LeaseDuration      time.Duration
+	LeaseOwner         string
+	Alerts             alerting.Settings
+}
+
+// SetDefaults sets the default value of every config key on v
+func SetDefaults(v *viper.Viper) {
+	v.SetDefault("DO_API_KEY", "")
+	v.SetDefault("DO_TAG", "")
+	v.SetDefault("DO_SPACES_KEY", "")
+	v.SetDefault("DO_SPACES_SECRET", "")
+	v.SetDefault("DO_SPACES_REGION", "")
+	v.SetDefault("DO_SPACES_BUCKET_NAME", "")
+	v.SetDefault("CLOUDFLARE_API_KEY", "")
+	v.SetDefault("CLOUDFLARE_LB_ID", "")
+	v.SetDefault("CLOUDFLARE_ZONE_ID", "")
+	v.SetDefault("CLOUDFLARE_ACCOUNT_ID", "")
+	v.SetDefault("CLOUDFLARE_API_URL", "")
+	v.SetDefault("DNS_PORT", "53")
+	v.SetDefault("FSD_DO_TAG", "")
+	v.SetDefault("PROBE_HOSTNAME", "fsd.connect.vatsim.net")
+	v.SetDefault("PROBE_ZONE", "connect.vatsim.net")
+	v.SetDefault("PROBE_TCP", true)
+	v.SetDefault("PROBE_LATENCY_THRESHOLD", 500)
+	v.SetDefault("HEALTH_QUORUM", "1")
+	v.SetDefault("PROBE_HTTP", true)
+	v.SetDefault("HTTP_ENDPOINT_PORT", "8081")
+	v.SetDefault("PROBE_HTTP_HOST", "fsd-http.connect.vatsim.net")
+	v.SetDefault("DOH_ENDPOINTS", "")
+	v.SetDefault("DOT_ENDPOINTS", "")
+	v.SetDefault("RETARDANTFOAM_DATA_FILE", "retardantfoam.yaml")
+	v.SetDefault("DNSHAIKU_STATUS_PORT", "9102")
+	v.SetDefault("RENDER_INTERVAL", 300)
+	v.SetDefault("STORAGE_BACKEND", "s3")
+	v.SetDefault("STORAGE_ENDPOINT", "")
+	v.SetDefault("STORAGE_PATH_STYLE", false)
+	v.SetDefault("STORAGE_DIR", "retardantfoam-data")
+	v.SetDefault("FAILOVER_TIME_LIMIT", 300)
+	v.SetDefault("PROBE_INTERVAL", 30)
+	v.SetDefault("FAILOVER_CONSECUTIVE_FAILURES", 5)
+	v.SetDefault("FAILOVER_WINDOW", 300)
+	v.SetDefault("PROBE_HISTORY_SIZE", 120)
+	v.SetDefault("PROMETHEUS_METRICS_PORT", "9103")
+	v.SetDefault("FAILBACK_ENABLED", false)
+	v.SetDefault("FAILBACK_CONSECUTIVE_SUCCESSES", 10)
+	v.SetDefault("FAILBACK_WINDOW", 600)
+	v.SetDefault("FAILBACK_QUORUM", 1.0)
+	v.SetDefault("TRANSITION_COOLDOWN", 1800)
+	v.SetDefault("LEASE_MODE", leaseConditional)
+	v.SetDefault("LEASE_DURATION", 180)
+	v.SetDefault("LEASE_OWNER", "")
+	v.SetDefault("ALERT_WEBHOOK_URL", "")
+	v.SetDefault("ALERT_SLACK_WEBHOOK_URL", "")
+	v.SetDefault("ALERT_SLACK_CHANNEL", "")
+	v.SetDefault("ALERT_SLACK_USERNAME", "")
+	v.SetDefault("ALERT_DEDUP_WINDOW", 600)
+	v.SetDefault("ALERT_RATE_LIMIT", 10)
+	v.SetDefault("ALERT_TEMPLATE", "")
+	v.SetDefault("ALERT_TEMPLATES_FILE", "")
+}
+
+// LoadConfig reads and validates a Config from v. All problems found are returned together.
+func LoadConfig(v *viper.Viper) (*Config, error) {
+	c := &Config{
+		DoApiKey:           v.GetString("DO_API_KEY"),
+		DoTag:              v.GetString("DO_TAG"),
+		DoSpacesKey:        v.GetString("DO_SPACES_KEY"),
+		DoSpacesSecret:     v.GetString("DO_SPACES_SECRET"),
+		DoSpacesRegion:     v.GetString("DO_SPACES_REGION"),
+		DoSpacesBucketName: v.GetString("DO_SPACES_BUCKET_NAME"),
+		CloudflareApiKey:   v.GetString("CLOUDFLARE_API_KEY"),
+		CloudflareZoneId:   v.GetString("CLOUDFLARE_ZONE_ID"),
+		CloudflareApiURL:   v.GetString("CLOUDFLARE_API_URL"),
+		DnsPort:            v.GetString("DNS_PORT"),
+		FsdDoTag:           v.GetString("FSD_DO_TAG"),
+		ProbeHostname:      v.GetString("PROBE_HOSTNAME"),
+		ProbeZone:          v.GetString("PROBE_ZONE"),
+		ProbeTCP:           v.GetBool("PROBE_TCP"),
+		LatencyThreshold:   time.Duration(v.GetInt64("PROBE_LATENCY_THRESHOLD")) * time.Millisecond,
+		ProbeHTTP:          v.GetBool("PROBE_HTTP"),
+		HttpEndpointPort:   v.GetString("HTTP_ENDPOINT_PORT"),
+		ProbeHTTPHost:      v.GetString("PROBE_HTTP_HOST"),
+		DohEndpoints:       splitList(v.GetString("DOH_ENDPOINTS")),
+		DotEndpoints:       splitList(v.GetString("DOT_ENDPOINTS")),
+		DataFile:           v.GetString("RETARDANTFOAM_DATA_FILE"),
+		DnshaikuStatusPort: v.GetString("DNSHAIKU_STATUS_PORT"),
+		RenderInterval:     time.Duration(v.GetInt64("RENDER_INTERVAL")) * time.Second,
+		StorageBackend:     v.GetString("STORAGE_BACKEND"),
+		StorageEndpoint:    v.GetString("STORAGE_ENDPOINT"),
+		StoragePathStyle:   v.GetBool("STORAGE_PATH_STYLE"),
+		StorageDir:         v.GetString("STORAGE_DIR"),
+		FailoverTimeLimit:  time.Duration(v.GetInt64("FAILOVER_TIME_LIMIT")) * time.Second,
+		ProbeInterval:      time.Duration(v.GetInt64("PROBE_INTERVAL")) * time.Second,
+		FailoverFailures:   v.GetInt("FAILOVER_CONSECUTIVE_FAILURES"),
+		FailoverWindow:     time.Duration(v.GetInt64("FAILOVER_WINDOW")) * time.Second,
+		HistorySize:        v.GetInt("PROBE_HISTORY_SIZE"),
+		MetricsPort:        v.GetString("PROMETHEUS_METRICS_PORT"),
+		FailbackEnabled:    v.GetBool("FAILBACK_ENABLED"),
+		FailbackSuccesses:  v.GetInt("FAILBACK_CONSECUTIVE_SUCCESSES"),
+		FailbackWindow:     time.Duration(v.GetInt64("FAILBACK_WINDOW")) * time.Second,
+		FailbackQuorum:     v.GetFloat64("FAILBACK_QUORUM"),
+		TransitionCooldown: time.Duration(v.GetInt64("TRANSITION_COOLDOWN")) * time.Second,
+		LeaseMode:          v.GetString("LEASE_MODE"),
+		LeaseDuration:      time.Duration(v.GetInt64("LEASE_DURATION")) * time.Second,
+		LeaseOwner:         v.GetString("LEASE_OWNER"),
+		Alerts: alerting.Settings{
+			WebhookURL:         v.GetString("ALERT_WEBHOOK_URL"),
+			SlackWebhookURL:    v.GetString("ALERT_SLACK_WEBHOOK_URL"),
+			SlackChannel:       v.GetString("ALERT_SLACK_CHANNEL"),
+			SlackUsername:      v.GetString("ALERT_SLACK_USERNAME"),
+			DedupWindowSeconds: v.GetInt("ALERT_DEDUP_WINDOW"),
+			RateLimit:          v.GetInt("ALERT_RATE_LIMIT"),
+			Template:           v.GetString("ALERT_TEMPLATE"),
+			TemplatesFile:      v.GetString("ALERT_TEMPLATES_FILE"),
+		},
+	}
+	var errs error
+	quorum, err := ParseQuorum(v.GetString("HEALTH_QUORUM"))
+	if err != nil {
+		errs = errors.Join(errs, fmt.Errorf("HEALTH_QUORUM: %w", err))
+	}
+	c.Quorum = quorum
+	if _, ok := dns.IsDomainName(c.ProbeHostname); !ok || c.ProbeHostname == "" {
+		errs = errors.Join(errs, fmt.Errorf("PROBE_HOSTNAME: %q is not a domain name", c.ProbeHostname))
+	}
+	if _, ok := dns.IsDomainName(c.ProbeZone); !ok && c.ProbeZone != "" {
+		errs = errors.Join(errs, fmt.Errorf("PROBE_ZONE: %q is not a domain name", c.ProbeZone))
+	}
+	for _, endpoint := range c.DohEndpoints {
+		if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = errors.Join(errs, fmt.Errorf("DOH_ENDPOINTS: %q is not an https URL", endpoint))
+		}
+	}
+	for _, endpoint := range c.DotEndpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("DOT_ENDPOINTS: %q is not a host:port", endpoint))
+		}
+	}
+	if c.LatencyThreshold < 0 {
+		errs = errors.Join(errs, errors.New("PROBE_LATENCY_THRESHOLD: must not be negative"))
+	}
+	switch c.StorageBackend {
+	case "s3":
+	case "file":
+		if c.StorageDir == "" {
+			errs = errors.Join(errs, errors.New("STORAGE_DIR: must be set for the file backend"))
+		}
+	default:
+		errs = errors.Join(errs, fmt.Errorf("STORAGE_BACKEND: %q is not s3 or file", c.StorageBackend))
+	}
+	if c.RenderInterval < 0 {
+		errs = errors.Join(errs, errors.New("RENDER_INTERVAL: must not be negative"))
+	}
+	if c.ProbeInterval < time.Second {
+		errs = errors.Join(errs, errors.New("PROBE_INTERVAL: must be at least 1 second"))
+	}
+	if c.FailoverFailures < 1 {
+		errs = errors.Join(errs, errors.New("FAILOVER_CONSECUTIVE_FAILURES: must be at least 1"))
+	}
+	if c.FailoverWindow < 0 {
+		errs = errors.Join(errs, errors.New("FAILOVER_WINDOW: must not be negative"))
+	}
+	if c.FailoverTimeLimit < 0 {
+		errs = errors.Join(errs, errors.New("FAILOVER_TIME_LIMIT: must not be negative"))
+	}
+	if c.FailbackSuccesses < 1 {
+		errs = errors.Join(errs, errors.New("FAILBACK_CONSECUTIVE_SUCCESSES: must be at least 1"))
+	}
+	if c.FailbackWindow < 0 {
+		errs = errors.Join(errs, errors.New("FAILBACK_WINDOW: must not be negative"))
+	}
+	if c.FailbackQuorum <= 0 || c.FailbackQuorum > 1 {
+		errs = errors.Join(errs, errors.New("FAILBACK_QUORUM: must be more than 0 and at most 1"))
+	}
+	if c.TransitionCooldown < 0 {
+		errs = errors.Join(errs, errors.New("TRANSITION_COOLDOWN: must not be negative"))
+	}
+	switch c.LeaseMode {
+	case leaseConditional, leaseFencing:
+		if c.LeaseDuration <= c.ProbeInterval {
+			errs = errors.Join(errs, errors.New("LEASE_DURATION: must be longer than PROBE_INTERVAL, or the daemon's lease lapses between rounds"))
+		}
+	case leaseOff:
+	default:
+		errs = errors.Join(errs, fmt.Errorf("LEASE_MODE: %q is not conditional, fencing or off", c.LeaseMode))
+	}
+	if c.LeaseOwner == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("LEASE_OWNER: not set and the hostname is unknown: %w", err))
+		}
+		c.LeaseOwner = hostname
+	}
+	if c.HistorySize < 1 {
+		errs = errors.Join(errs, errors.New("PROBE_HISTORY_SIZE: must be at least 1"))
+	}
+	if _, err := alerting.ReadTemplates(c.Alerts.TemplatesFile); err != nil {
+		errs = errors.Join(errs, fmt.Errorf("ALERT_TEMPLATES_FILE: %w", err))
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(list string) []string {
+	entries := make([]string, 0)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,235 @@
+package retardantfoam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"github.com/vatsimnetwork/vatdns/internal/storage"
+	"time"
+)
+
+const (
+	transitionFailover = "failover"
+	transitionFailback = "failback"
+)
+
+// maxTransitions is how many transitions are kept in transitionsKey
+const maxTransitions = 200
+
+// Transition is a failover or failback, recorded whether or not it succeeded
+type Transition struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Protocol string    `json:"protocol"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error,omitempty"`
+	// Lease is the lease's token when the transition was made, 0 if LEASE_MODE is off
+	Lease int64 `json:"lease,omitempty"`
+}
+
+// Succeeded is whether the transition completed
+func (t Transition) Succeeded() bool {
+	return t.Error == ""
+}
+
+// lastSucceeded is the most recent transition for protocol that completed, nil if there is none
+func lastSucceeded(transitions []Transition, protocol string) *Transition {
+	for i := len(transitions) - 1; i >= 0; i-- {
+		if transitions[i].Protocol == protocol && transitions[i].Succeeded() {
+			t := transitions[i]
+			return &t
+		}
+	}
+	return nil
+}
+
+// failoverState is what the IP server files and DNS records held before failing over
+type failoverState struct {
+	Time  time.Time   `json:"time"`
+	Files []savedFile `json:"files"`
+	// RecordNames are the DNS records replaced, restored to Records
+	RecordNames []string      `json:"record_names,omitempty"`
+	Records     []savedRecord `json:"records,omitempty"`
+	// Purge is what was purged from Cloudflare's cache, purged again after restoring the files.
+	// States saved before it was recorded purged everything.
+	Purge *cloudflare.PurgeCacheRequest `json:"purge,omitempty"`
+}
+
+type savedFile struct {
+	Region string `json:"region"`
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	// Existed is false when there was no file to restore, failing back deletes it
+	Existed  bool   `json:"existed"`
+	Contents []byte `json:"contents,omitempty"`
+}
+
+// saveFailoverState records what files held before they are overwritten. A state left by an earlier
+// failover that didn't complete is kept, since the files may already hold the IP server lists. Failing
+// over matters more than failing back, so errors saving files are logged and the failover carries on.
+// DNS records are different, rewriting them deletes what was there, so it returns the record names
+// that are saved and an error if any of recordNames aren't. Only the saved ones may be rewritten.
+func (a *storeActions) saveFailoverState(ctx context.Context, protocol string, files []ipServerFile, recordNames []string, purge cloudflare.PurgeCacheRequest) ([]string, error) {
+	stateKey := scopedKey(failoverStateKey, protocol)
+	body, _, err := a.store.Get(ctx, stateKey)
+	if err == nil {
+		logger.Info("Keeping the failover state saved by an earlier failover")
+		return a.saveMissingRecords(ctx, stateKey, body, recordNames)
+	}
+	if !storage.IsNotFound(err) {
+		logger.Error(fmt.Sprintf("Unable to check for failover state, failing back will need a human: %s", err))
+		return nil, fmt.Errorf("checking for failover state: %w", err)
+	}
+	state := failoverState{Time: time.Now().UTC(), Files: make([]savedFile, 0, len(files)), Purge: &purge}
+	var recordsErr error
+	if len(recordNames) > 0 {
+		records, err := a.saveRecords(ctx, recordNames)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to save DNS records before failing over, they won't be rewritten: %s", err))
+			recordsErr = err
+		} else {
+			state.RecordNames = recordNames
+			state.Records = records
+		}
+	}
+	for _, v := range files {
+		store, err := a.openStore(v.Region, v.Bucket)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Unable to save %s before failing over, it won't be restored: %s", v.Name, err))
+			continue
+		}
+		contents, _, err := store.Get(ctx, v.Name)
+		if err != nil && !storage.IsNotFound(err) {
+			logger.Error(fmt.Sprintf("Unable to save %s before failing over, it won't be restored: %s", v.Name, err))
+			continue
+		}
+		state.Files = append(state.Files, savedFile{Region: v.Region, Bucket: v.Bucket, Name: v.Name, Existed: err == nil, Contents: contents})
+	}
+	body, _ = json.Marshal(state)
+	if err := a.store.Put(ctx, stateKey, body); err != nil {
+		logger.Error(fmt.Sprintf("Unable to save failover state, failing back will need a human: %s", err))
+		return nil, fmt.Errorf("saving failover state: %w", err)
+	}
+	return state.RecordNames, recordsErr
+}
+
+// saveMissingRecords adds the records of recordNames that an earlier failover couldn't save to its
+// state, which those records still hold since they weren't rewritten
+func (a *storeActions) saveMissingRecords(ctx context.Context, stateKey string, body []byte, recordNames []string) ([]string, error) {
+	state := failoverState{}
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, fmt.Errorf("parsing failover state: %w", err)
+	}
+	missing := make([]string, 0)
+	for _, name := range recordNames {
+		if !contains(state.RecordNames, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return state.RecordNames, nil
+	}
+	records, err := a.saveRecords(ctx, missing)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Unable to save DNS records before failing over, they won't be rewritten: %s", err))
+		return state.RecordNames, err
+	}
+	saved := state
+	saved.RecordNames = append(append([]string{}, state.RecordNames...), missing...)
+	saved.Records = append(append([]savedRecord{}, state.Records...), records...)
+	body, _ = json.Marshal(saved)
+	if err := a.store.Put(ctx, stateKey, body); err != nil {
+		return state.RecordNames, fmt.Errorf("saving failover state: %w", err)
+	}
+	return saved.RecordNames, nil
+}
+
+func (a *storeActions) Failback(ctx context.Context, protocol string) error {
+	stateKey := scopedKey(failoverStateKey, protocol)
+	body, _, err := a.store.Get(ctx, stateKey)
+	if storage.IsNotFound(err) {
+		return errors.New("no failover state saved, the IP server files must be restored by hand")
+	}
+	if err != nil {
+		return fmt.Errorf("reading failover state: %w", err)
+	}
+	state := failoverState{}
+	if err := json.Unmarshal(body, &state); err != nil {
+		return fmt.Errorf("parsing failover state: %w", err)
+	}
+	for _, v := range state.Files {
+		store, err := a.openStore(v.Region, v.Bucket)
+		if err != nil {
+			return fmt.Errorf("restoring %s: %w", v.Name, err)
+		}
+		if v.Existed {
+			err = store.Put(ctx, v.Name, v.Contents)
+		} else {
+			err = store.Delete(ctx, v.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("restoring %s: %w", v.Name, err)
+		}
+		logger.Info(fmt.Sprintf("Restored %s in Spaces", v.Name))
+	}
+
+	purge := cloudflare.PurgeCacheRequest{Everything: true}
+	if state.Purge != nil {
+		purge = *state.Purge
+	}
+	if !purgeEmpty(purge) {
+		if err := a.purgeCache(ctx, purge); err != nil {
+			return fmt.Errorf("flushing Cloudflare cache: %w", err)
+		}
+		logger.Info("Flushed Cloudflare cache.")
+	}
+	if err := a.restoreRecords(ctx, state.RecordNames, state.Records); err != nil {
+		return fmt.Errorf("restoring DNS records: %w", err)
+	}
+	if protocol == protocolDNS {
+		// A fresh heartbeat stops the one-shot mode failing straight back over on its next run
+		if err := a.WriteHeartbeat(ctx); err != nil {
+			return fmt.Errorf("writing heartbeat: %w", err)
+		}
+	}
+	blockerKey := scopedKey(heartbeatBlockerKey, protocol)
+	if err := a.store.Delete(ctx, blockerKey); err != nil {
+		return fmt.Errorf("removing heartbeat blocker: %w", err)
+	}
+	logger.Info(fmt.Sprintf("%s removed from Spaces.", blockerKey))
+	if err := a.store.Delete(ctx, stateKey); err != nil {
+		logger.Error(fmt.Sprintf("Unable to remove failover state: %s", err))
+	}
+	return nil
+}
+
+func (a *storeActions) Transitions(ctx context.Context) ([]Transition, error) {
+	body, _, err := a.store.Get(ctx, transitionsKey)
+	if storage.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	transitions := []Transition{}
+	if err := json.Unmarshal(body, &transitions); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", transitionsKey, err)
+	}
+	return transitions, nil
+}
+
+func (a *storeActions) RecordTransition(ctx context.Context, t Transition) error {
+	transitions, err := a.Transitions(ctx)
+	if err != nil {
+		return err
+	}
+	transitions = append(transitions, t)
+	if len(transitions) > maxTransitions {
+		transitions = transitions[len(transitions)-maxTransitions:]
+	}
+	body, _ := json.Marshal(transitions)
+	return a.store.Put(ctx, transitionsKey, body)
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// staleLock is how old a PutIf lock file must be before it is taken as left by a crashed process
+const staleLock = 10 * time.Second
+
+// FileStore keeps objects as files under a directory, for running without Spaces and in tests
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore stores objects under dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// path is where key is kept. Keys may contain slashes but not escape dir.
+func (s *FileStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if key == "" || clean == "/" || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *FileStore) notFound(key string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &NotFoundError{Bucket: s.dir, Key: key}
+	}
+	return err
+}
+
+func (s *FileStore) Get(ctx context.Context, key string) ([]byte, Info, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, Info{}, s.notFound(key, err)
+	}
+	info, err := s.Head(ctx, key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	return body, info, nil
+}
+
+// Put writes to a temporary file and renames it over key so readers never see a partial object
+func (s *FileStore) Put(ctx context.Context, key string, body []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileStore) Head(ctx context.Context, key string) (Info, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return Info{}, s.notFound(key, err)
+	}
+	if stat.IsDir() {
+		return Info{}, &NotFoundError{Bucket: s.dir, Key: key}
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return Info{}, s.notFound(key, err)
+	}
+	return Info{Key: key, Size: stat.Size(), LastModified: stat.ModTime(), ETag: etag(body)}, nil
+}
+
+// etag is the quoted MD5 of body, as S3 gives for objects not uploaded in parts
+func etag(body []byte) string {
+	return fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(body)))
+}
+
+// PutIf holds a lock file beside key while it compares ETags and writes, so other processes using the
+// same directory can't write in between
+func (s *FileStore) PutIf(ctx context.Context, key string, body []byte, etag string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(ctx, filepath.Join(filepath.Dir(path), ".lock-"+filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	info, err := s.Head(ctx, key)
+	switch {
+	case IsNotFound(err):
+		if etag != "" {
+			return fmt.Errorf("%s/%s: %w", s.dir, key, ErrPreconditionFailed)
+		}
+	case err != nil:
+		return err
+	case info.ETag != etag:
+		return fmt.Errorf("%s/%s: %w", s.dir, key, ErrPreconditionFailed)
+	}
+	return s.Put(ctx, key, body)
+}
+
+// lockFile creates path exclusively, waiting while another process holds it
+func lockFile(ctx context.Context, path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if stat, err := os.Stat(path); err == nil && time.Since(stat.ModTime()) > staleLock {
+			_ = os.Remove(path)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (s *FileStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"io"
+	"net/http"
+)
+
+// S3Config is where an S3Store keeps its objects
+type S3Config struct {
+	// Endpoint is the service URL, e.g. https://ams3.digitaloceanspaces.com or http://localhost:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses objects as endpoint/bucket/key rather than bucket.endpoint/key, which MinIO
+	// and other local stand-ins usually need
+	PathStyle bool
+}
+
+// S3Store keeps objects in an S3-compatible bucket
+type S3Store struct {
+	client *s3.Client
+	bucket string
+}
+
+// SpacesEndpoint is the S3 endpoint of a DigitalOcean Spaces region
+func SpacesEndpoint(region string) string {
+	return fmt.Sprintf("https://%s.digitaloceanspaces.com", region)
+}
+
+func NewS3Store(c S3Config) *S3Store {
+	region := c.Region
+	if region == "" {
+		// Requests must be signed for some region, S3-compatible services mostly ignore which
+		region = "us-east-1"
+	}
+	client := s3.New(s3.Options{
+		Region:       region,
+		BaseEndpoint: aws.String(c.Endpoint),
+		UsePathStyle: c.PathStyle,
+		Credentials:  credentials.NewStaticCredentialsProvider(c.AccessKey, c.SecretKey, ""),
+	})
+	return &S3Store{client: client, bucket: c.Bucket}
+}
+
+// notFound turns a 404 from the service into a NotFoundError. GetObject and HeadObject report missing keys
+// with different error types, and not every S3-compatible service sends the error code, so go by status.
+func (s *S3Store) notFound(key string, err error) error {
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotFound {
+		return &NotFoundError{Bucket: s.bucket, Key: key}
+	}
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, Info, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, Info{}, s.notFound(key, err)
+	}
+	defer out.Body.Close()
+	body, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	info := Info{Key: key, Size: int64(len(body)), ETag: aws.ToString(out.ETag)}
+	if out.LastModified != nil {
+		info.LastModified = *out.LastModified
+	}
+	return body, info, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+// PutIf sends If-Match, or If-None-Match when etag is empty. The SDK predates S3 supporting them on
+// PutObject, so the headers are added to the request directly.
+func (s *S3Store) PutIf(ctx context.Context, key string, body []byte, etag string) error {
+	header := smithyhttp.SetHeaderValue("If-Match", etag)
+	if etag == "" {
+		header = smithyhttp.SetHeaderValue("If-None-Match", "*")
+	}
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	}, s3.WithAPIOptions(header))
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		switch re.HTTPStatusCode() {
+		// S3 answers 409 when another conditional write to the key is in flight
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return fmt.Errorf("%s/%s: %w", s.bucket, key, ErrPreconditionFailed)
+		case http.StatusNotImplemented:
+			return fmt.Errorf("%s/%s: %w", s.bucket, key, ErrConditionalUnsupported)
+		}
+	}
+	return err
+}
+
+func (s *S3Store) Head(ctx context.Context, key string) (Info, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return Info{}, s.notFound(key, err)
+	}
+	info := Info{Key: key, Size: out.ContentLength, ETag: aws.ToString(out.ETag)}
+	if out.LastModified != nil {
+		info.LastModified = *out.LastModified
+	}
+	return info, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err = s.notFound(key, err); IsNotFound(err) {
+		return nil
+	}
+	return err
+}
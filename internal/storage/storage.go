@@ -0,0 +1,64 @@
+// Package storage is a small object store abstraction over S3-compatible services such as DigitalOcean Spaces
+// and MinIO, and the local filesystem.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is matched by every NotFoundError with errors.Is
+var ErrNotFound = errors.New("not found")
+
+// ErrPreconditionFailed is returned by PutIf when the object changed since it was read
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// ErrConditionalUnsupported is returned by PutIf when the service rejects conditional writes
+var ErrConditionalUnsupported = errors.New("conditional writes not supported")
+
+// NotFoundError is returned when the object doesn't exist
+type NotFoundError struct {
+	Bucket string
+	Key    string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s/%s: %s", e.Bucket, e.Key, ErrNotFound)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// IsNotFound is whether err is, or wraps, a NotFoundError
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// Info describes a stored object
+type Info struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// ETag identifies the object's contents, for PutIf
+	ETag string
+}
+
+// Store keeps objects in a single bucket
+type Store interface {
+	Get(ctx context.Context, key string) ([]byte, Info, error)
+	Put(ctx context.Context, key string, body []byte) error
+	Head(ctx context.Context, key string) (Info, error)
+	// Delete removes key. Deleting an object that doesn't exist isn't an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// ConditionalStore is a Store that can write an object only if nobody else has since it was read
+type ConditionalStore interface {
+	Store
+	// PutIf writes key if its ETag is still etag, or if etag is empty and key doesn't exist. Otherwise it
+	// returns an error matching ErrPreconditionFailed.
+	PutIf(ctx context.Context, key string, body []byte, etag string) error
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a path-style S3 stand-in, enough for S3Store
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+}
+
+func newFakeS3(t *testing.T) *httptest.Server {
+	f := &fakeS3{objects: map[string][]byte{}, modified: map[string]time.Time{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	body, exists := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(body)))
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != etag) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = body
+		f.modified[key] = time.Now().UTC().Truncate(time.Second)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				_, _ = io.WriteString(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			}
+			return
+		}
+		w.Header().Set("Last-Modified", f.modified[key].Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf("%q", fmt.Sprintf("%x", md5.Sum(body))))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(body)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// testStore checks the behaviour every Store must have
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+
+	_, _, err := store.Get(ctx, "vatdns-heartbeat")
+	assert.ErrorIs(t, err, ErrNotFound)
+	var notFound *NotFoundError
+	assert.ErrorAs(t, err, &notFound)
+	assert.Equal(t, "vatdns-heartbeat", notFound.Key)
+	_, err = store.Head(ctx, "vatdns-heartbeat")
+	assert.True(t, IsNotFound(err))
+
+	require.NoError(t, store.Put(ctx, "vatdns-heartbeat", []byte("alive")))
+	body, info, err := store.Get(ctx, "vatdns-heartbeat")
+	require.NoError(t, err)
+	assert.Equal(t, "alive", string(body))
+	assert.Equal(t, int64(5), info.Size)
+	assert.WithinDuration(t, time.Now(), info.LastModified, time.Minute)
+	info, err = store.Head(ctx, "vatdns-heartbeat")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+
+	require.NoError(t, store.Put(ctx, "lists/servers.txt", []byte("")))
+	info, err = store.Head(ctx, "lists/servers.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size)
+
+	require.NoError(t, store.Delete(ctx, "vatdns-heartbeat"))
+	_, err = store.Head(ctx, "vatdns-heartbeat")
+	assert.True(t, IsNotFound(err))
+	assert.NoError(t, store.Delete(ctx, "vatdns-heartbeat"))
+}
+
+// testConditionalStore checks PutIf only writes over what was read
+func testConditionalStore(t *testing.T, store ConditionalStore) {
+	ctx := context.Background()
+
+	require.NoError(t, store.PutIf(ctx, "vatdns-lease", []byte("a"), ""))
+	assert.ErrorIs(t, store.PutIf(ctx, "vatdns-lease", []byte("b"), ""), ErrPreconditionFailed, "it exists now")
+	info, err := store.Head(ctx, "vatdns-lease")
+	require.NoError(t, err)
+	assert.NotEmpty(t, info.ETag)
+	_, got, err := store.Get(ctx, "vatdns-lease")
+	require.NoError(t, err)
+	assert.Equal(t, info.ETag, got.ETag)
+
+	require.NoError(t, store.PutIf(ctx, "vatdns-lease", []byte("c"), info.ETag))
+	assert.ErrorIs(t, store.PutIf(ctx, "vatdns-lease", []byte("d"), info.ETag), ErrPreconditionFailed, "it changed since")
+	body, _, err := store.Get(ctx, "vatdns-lease")
+	require.NoError(t, err)
+	assert.Equal(t, "c", string(body))
+	assert.ErrorIs(t, store.PutIf(ctx, "missing", []byte("e"), info.ETag), ErrPreconditionFailed)
+}
+
+func TestFileStore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	require.NoError(t, err)
+	testStore(t, store)
+	testConditionalStore(t, store)
+
+	assert.Error(t, store.Put(context.Background(), "", []byte("x")))
+	// Keys can't escape the directory
+	require.NoError(t, store.Put(context.Background(), "../../escape", []byte("x")))
+	_, err = store.Head(context.Background(), "escape")
+	assert.NoError(t, err)
+}
+
+func TestS3Store(t *testing.T) {
+	server := newFakeS3(t)
+	store := NewS3Store(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "vatdns",
+		AccessKey: "key",
+		SecretKey: "secret",
+		PathStyle: true,
+	})
+	testStore(t, store)
+	testConditionalStore(t, store)
+}
+
+func TestS3StoreErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	store := NewS3Store(S3Config{Endpoint: server.URL, Bucket: "vatdns", PathStyle: true})
+	_, err := store.Head(context.Background(), "vatdns-heartbeat")
+	assert.Error(t, err)
+	assert.False(t, IsNotFound(err))
+	err = store.Delete(context.Background(), "vatdns-heartbeat")
+	assert.Error(t, err)
+	assert.False(t, IsNotFound(err))
+
+	unsupported := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer unsupported.Close()
+	store = NewS3Store(S3Config{Endpoint: unsupported.URL, Bucket: "vatdns", AccessKey: "key", SecretKey: "secret", PathStyle: true})
+	assert.ErrorIs(t, store.PutIf(context.Background(), "vatdns-lease", []byte("a"), ""), ErrConditionalUnsupported)
+}
@@ -0,0 +1,87 @@
+// Package telemetry sets up OpenTelemetry tracing for vatdns binaries
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+const (
+	ExporterNone     = "none"
+	ExporterOTLPGRPC = "otlp-grpc"
+	ExporterOTLPHTTP = "otlp-http"
+)
+
+type Config struct {
+	// Exporter is none, otlp-grpc or otlp-http
+	Exporter string
+	// Endpoint is the collector's host:port. If empty the OTLP exporter's default or
+	// OTEL_EXPORTER_OTLP_ENDPOINT is used.
+	Endpoint string
+	// Insecure disables TLS to the collector
+	Insecure bool
+	// SampleRatio is the fraction of traces started here that are sampled, from 0 to 1.
+	// Traces continued from a sampled parent are always sampled.
+	SampleRatio    float64
+	ServiceName    string
+	ServiceVersion string
+}
+
+// NewProvider returns a tracer provider sampling SampleRatio of traces and sending them to exporter
+func NewProvider(config Config, exporter sdktrace.SpanExporter, options ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(config.ServiceName),
+		semconv.ServiceVersion(config.ServiceVersion),
+	)
+	options = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	}, options...)
+	return sdktrace.NewTracerProvider(options...)
+}
+
+// Setup installs the global tracer provider and W3C trace context propagation. The returned
+// function flushes and stops the exporter. With the none exporter tracing is left disabled.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLPGRPC:
+		options := make([]otlptracegrpc.Option, 0)
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, options...)
+	case ExporterOTLPHTTP:
+		options := make([]otlptracehttp.Option, 0)
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("unknown exporter %q, expected %s, %s or %s", config.Exporter, ExporterNone, ExporterOTLPGRPC, ExporterOTLPHTTP)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s exporter: %w", config.Exporter, err)
+	}
+	provider := NewProvider(config, exporter)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
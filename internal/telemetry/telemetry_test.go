@@ -0,0 +1,44 @@
+package telemetry
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterNone})
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = Setup(context.Background(), Config{Exporter: "zipkin"})
+	assert.ErrorContains(t, err, "unknown exporter")
+}
+
+func TestNewProviderSampling(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := NewProvider(Config{SampleRatio: 0, ServiceName: "test"}, exporter)
+	tracer := provider.Tracer("test")
+
+	_, span := tracer.Start(context.Background(), "unsampled")
+	span.End()
+	require.NoError(t, provider.ForceFlush(context.Background()))
+	assert.Empty(t, exporter.GetSpans())
+
+	// A sampled parent keeps its children sampled whatever the ratio
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	_, span = tracer.Start(trace.ContextWithRemoteSpanContext(context.Background(), parent), "continued")
+	span.End()
+	require.NoError(t, provider.ForceFlush(context.Background()))
+	require.Len(t, exporter.GetSpans(), 1)
+	assert.Equal(t, "continued", exporter.GetSpans()[0].Name)
+	assert.NoError(t, provider.Shutdown(context.Background()))
+}
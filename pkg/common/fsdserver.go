@@ -1,13 +1,18 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"github.com/digitalocean/godo"
 	"github.com/go-yaml/yaml"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/expfmt"
-	"github.com/spf13/viper"
 	"github.com/vatsimnetwork/vatdns/internal/logger"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"os"
 	"regexp"
@@ -15,19 +20,22 @@ import (
 	"time"
 )
 
+var tracer = otel.Tracer("github.com/vatsimnetwork/vatdns/pkg/common")
+
 type FSDServer struct {
-	IpAddress           string  `json:"ip_address" yaml:"ip_address"`
-	Name                string  `json:"name" yaml:"name"`
-	Country             string  `json:"country" yaml:"country"`
-	Latitude            float64 `json:"latitude" yaml:"latitude"`
-	Longitude           float64 `json:"longitude" yaml:"longitude"`
-	CurrentUsers        int     `json:"current_users" yaml:"current_users"`
-	MaxUsers            int     `json:"max_users" yaml:"max_users"`
-	RemainingSlots      int     `json:"remaining_slots" yaml:"remaining_slots"`
-	Distance            float64 `json:"distance" yaml:"distance"`
-	AbleToUpdate        bool    `json:"able_to_update" yaml:"able_to_update"`
-	UpdateFailureCount  int     `json:"update_failure_count" yaml:"update_failure_count"`
-	PrometheusCollector prometheus.Collector
+	IpAddress           string               `json:"ip_address" yaml:"ip_address"`
+	Name                string               `json:"name" yaml:"name"`
+	Country             string               `json:"country" yaml:"country"`
+	Latitude            float64              `json:"latitude" yaml:"latitude"`
+	Longitude           float64              `json:"longitude" yaml:"longitude"`
+	CurrentUsers        int                  `json:"current_users" yaml:"current_users"`
+	MaxUsers            int                  `json:"max_users" yaml:"max_users"`
+	RemainingSlots      int                  `json:"remaining_slots" yaml:"remaining_slots"`
+	Distance            float64              `json:"distance" yaml:"distance"`
+	AbleToUpdate        bool                 `json:"able_to_update" yaml:"able_to_update"`
+	UpdateFailureCount  int                  `json:"update_failure_count" yaml:"update_failure_count"`
+	LastPolled          time.Time            `json:"last_polled" yaml:"last_polled"`
+	PrometheusCollector prometheus.Collector `json:"-" yaml:"-"`
 }
 
 func NewMockFSDServer(mockFsdServer *FSDServer) *FSDServer {
@@ -85,61 +93,72 @@ func NewFSDServer(droplet *godo.Droplet) *FSDServer {
 	}
 }
 func (fsd *FSDServer) AcceptingConnections() int {
-	if fsd.MaxUsers <= 0 {
+	if fsd.NotAcceptingReason() != "" {
 		return 0
+	} else {
+		return 1
+	}
+}
+
+// NotAcceptingReason explains why a server is out of rotation, or returns an empty string if it is accepting connections
+func (fsd *FSDServer) NotAcceptingReason() string {
+	if fsd.MaxUsers <= 0 {
+		return "max users is 0"
 	}
 	if fsd.AbleToUpdate == false {
-		return 0
+		return "unable to update metrics"
 	}
-	if viper.GetInt("FSD_SLOT_BUFFER") > fsd.RemainingSlots {
-		return 0
-	} else {
-		return 1
+	if slotBuffer := currentPollingSettings().SlotBuffer; slotBuffer > fsd.RemainingSlots {
+		return fmt.Sprintf("%d remaining slots is under the slot buffer of %d", fsd.RemainingSlots, slotBuffer)
 	}
+	return ""
 }
 
-func (fsd *FSDServer) Polling(enableFsdServerProm chan<- string, deregisterFsd chan<- string) {
+// endPollSpan records the outcome of a poll and the server's slots on span before ending it
+func endPollSpan(span trace.Span, fsd *FSDServer, err error) {
+	span.SetAttributes(
+		attribute.Int("vatdns.remaining_slots", fsd.RemainingSlots),
+		attribute.Int("vatdns.update_failures", fsd.UpdateFailureCount),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Polling updates the server until it fails too often, when it is sent to deregisterFsd, or stop is closed
+func (fsd *FSDServer) Polling(enableFsdServerProm chan<- string, deregisterFsd chan<- string, stop <-chan struct{}) {
 	enableFsdServerProm <- fsd.Name
-	var parser expfmt.TextParser
-	client := http.Client{
+	client := &http.Client{
 		Timeout: 2 * time.Second,
 	}
-	ticker := time.NewTicker(time.Duration(viper.GetInt("FSD_SERVER_POLLING_INTERVAL")) * time.Second)
-	for _ = range ticker.C {
-		fsdServerRemoveFailureCount := viper.GetInt("FSD_SERVER_REMOVE_FAILURE_COUNT")
+	pollingInterval := currentPollingSettings().PollingInterval
+	ticker := time.NewTicker(pollingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			logger.Info(fmt.Sprintf("Stopped polling %s", fsd.Name))
+			return
+		case <-ticker.C:
+		}
+		settings := currentPollingSettings()
+		if settings.PollingInterval != pollingInterval {
+			pollingInterval = settings.PollingInterval
+			ticker.Reset(pollingInterval)
+		}
+		fsdServerRemoveFailureCount := settings.RemoveFailureCount
 		if fsd.UpdateFailureCount >= fsdServerRemoveFailureCount {
 			logger.Info(fmt.Sprintf("%s has failed to update %d times. Removing from server list", fsd.Name, fsdServerRemoveFailureCount))
-			deregisterFsd <- fsd.Name
+			select {
+			case deregisterFsd <- fsd.Name:
+			case <-stop:
+			}
 			return
 		}
-		if viper.GetBool("TEST_MODE") == false {
-			resp, err := client.Get(fmt.Sprintf("http://%s:9001/metrics", fsd.IpAddress))
-			if err != nil {
-				logger.Error(fmt.Sprintf(fmt.Sprintf("%s", err)))
-				fsd.AbleToUpdate = false
-				fsd.UpdateFailureCount += 1
-			} else {
-				promData, err := parser.TextToMetricFamilies(resp.Body)
-				if err != nil {
-					fsd.UpdateFailureCount += 1
-					logger.Error(fmt.Sprintf("Bad prometheus data from FSD %s", fsd.Name))
-					continue
-				}
-				for k, v := range promData {
-					if k == "fsd_maxclients" {
-						fsd.MaxUsers = int(*v.Metric[0].GetGauge().Value)
-					}
-					if k == "interface_client_current" {
-						fsd.CurrentUsers = int(*v.Metric[0].GetGauge().Value)
-					}
-					if k == "fsd_remainingslots" {
-						fsd.RemainingSlots = int(*v.Metric[0].GetGauge().Value)
-					}
-				}
-				fsd.AbleToUpdate = true
-				fsd.UpdateFailureCount = 0
-				logger.Debug(fmt.Sprintf("Updated metrics for %s", fsd.Name))
-			}
+		if settings.TestMode == false {
+			_ = fsd.Poll(context.Background(), client)
 		} else {
 			testingData := TestingDataYaml{}
 			yamlData, err := os.ReadFile("testing.yaml")
@@ -153,6 +172,7 @@ func (fsd *FSDServer) Polling(enableFsdServerProm chan<- string, deregisterFsd c
 					fsd.CurrentUsers = v.CurrentUsers
 					fsd.RemainingSlots = v.RemainingSlots
 					fsd.AbleToUpdate = true
+					fsd.LastPolled = time.Now()
 				}
 			}
 		}
@@ -160,6 +180,52 @@ func (fsd *FSDServer) Polling(enableFsdServerProm chan<- string, deregisterFsd c
 	}
 }
 
+// Poll updates the server's users and slots from its metrics once
+func (fsd *FSDServer) Poll(ctx context.Context, client *http.Client) error {
+	var parser expfmt.TextParser
+	pollStart := time.Now()
+	ctx, span := tracer.Start(ctx, "poll_server", trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(attribute.String("vatdns.server", fsd.Name), attribute.String("vatdns.server_ip", fsd.IpAddress))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s:9001/metrics", fsd.IpAddress), nil)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Error(fmt.Sprintf(fmt.Sprintf("%s", err)))
+		fsd.AbleToUpdate = false
+		fsd.UpdateFailureCount += 1
+		observePoll(fsd.Name, pollStart, err)
+		endPollSpan(span, fsd, err)
+		return err
+	}
+	promData, err := parser.TextToMetricFamilies(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		fsd.UpdateFailureCount += 1
+		logger.Error(fmt.Sprintf("Bad prometheus data from FSD %s", fsd.Name))
+		observePoll(fsd.Name, pollStart, err)
+		endPollSpan(span, fsd, err)
+		return err
+	}
+	for k, v := range promData {
+		if k == "fsd_maxclients" {
+			fsd.MaxUsers = int(*v.Metric[0].GetGauge().Value)
+		}
+		if k == "interface_client_current" {
+			fsd.CurrentUsers = int(*v.Metric[0].GetGauge().Value)
+		}
+		if k == "fsd_remainingslots" {
+			fsd.RemainingSlots = int(*v.Metric[0].GetGauge().Value)
+		}
+	}
+	fsd.AbleToUpdate = true
+	fsd.UpdateFailureCount = 0
+	fsd.LastPolled = time.Now()
+	observePoll(fsd.Name, pollStart, nil)
+	endPollSpan(span, fsd, nil)
+	logger.Debug(fmt.Sprintf("Updated metrics for %s", fsd.Name))
+	return nil
+}
+
 type FSDServerLocation struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"Longitude"`
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PollingSettings are the parts of dnshaiku's config FSDServer uses. They can be changed while servers are polling.
+type PollingSettings struct {
+	// SlotBuffer is how many remaining slots a server must have to be accepting connections
+	SlotBuffer         int
+	PollingInterval    time.Duration
+	RemoveFailureCount int
+	TestMode           bool
+}
+
+var pollingSettings atomic.Pointer[PollingSettings]
+
+// PollObserver is told how long each poll of an FSD server's metrics took and whether it failed
+type PollObserver func(server string, duration time.Duration, err error)
+
+var pollObserver atomic.Pointer[PollObserver]
+
+func SetPollObserver(observer PollObserver) {
+	pollObserver.Store(&observer)
+}
+
+func observePoll(server string, start time.Time, err error) {
+	if observer := pollObserver.Load(); observer != nil {
+		(*observer)(server, time.Since(start), err)
+	}
+}
+
+func SetPollingSettings(settings PollingSettings) {
+	pollingSettings.Store(&settings)
+}
+
+func currentPollingSettings() PollingSettings {
+	if settings := pollingSettings.Load(); settings != nil {
+		return *settings
+	}
+	return PollingSettings{
+		PollingInterval:    5 * time.Second,
+		RemoveFailureCount: 2,
+	}
+}
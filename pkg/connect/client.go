@@ -0,0 +1,70 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Client queries dnshaiku's connect API, e.g. http://fsd-http.connect.vatsim.net
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// AdminToken is only needed to look up servers for another IP with ConnectAs
+	AdminToken string
+}
+
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL: baseURL,
+		HTTPClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// Connect returns the server to connect to for the calling machine and up to count-1 alternates
+func (c *Client) Connect(ctx context.Context, count int) (*Response, error) {
+	return c.ConnectAs(ctx, "", count)
+}
+
+// ConnectAs returns the server a client at ip would be sent to. ip is only honoured if
+// AdminToken is set and valid, an empty ip means the calling machine.
+func (c *Client) ConnectAs(ctx context.Context, ip string, count int) (*Response, error) {
+	query := url.Values{}
+	if count > 0 {
+		query.Set("count", strconv.Itoa(count))
+	}
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s/connect?%s", c.BaseURL, Version, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.AdminToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.AdminToken))
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errorResponse := ErrorResponse{}
+		if json.NewDecoder(resp.Body).Decode(&errorResponse) == nil && errorResponse.Error != "" {
+			return nil, fmt.Errorf("connect API returned %s: %s", resp.Status, errorResponse.Error)
+		}
+		return nil, fmt.Errorf("connect API returned %s", resp.Status)
+	}
+	response := &Response{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return nil, fmt.Errorf("decoding connect API response: %w", err)
+	}
+	return response, nil
+}
@@ -0,0 +1,45 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientConnect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/connect", r.URL.Path)
+		assert.Equal(t, "3", r.URL.Query().Get("count"))
+		assert.Equal(t, "1.2.3.4", r.URL.Query().Get("ip"))
+		assert.Equal(t, "Bearer s3cret", r.Header.Get("Authorization"))
+		_ = json.NewEncoder(w).Encode(Response{
+			Version:    Version,
+			Server:     Server{Name: "fsd.uk.vatsim.net", IpAddresses: []string{"178.62.56.106"}, Region: "uk"},
+			Alternates: []Server{{Name: "fsd.ams.vatsim.net"}, {Name: "fsd.ger.vatsim.net"}},
+			TTL:        10,
+		})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	client.AdminToken = "s3cret"
+	response, err := client.ConnectAs(context.Background(), "1.2.3.4", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "fsd.uk.vatsim.net", response.Server.Name)
+	assert.Equal(t, []string{"178.62.56.106"}, response.Server.IpAddresses)
+	assert.Len(t, response.Alternates, 2)
+}
+
+func TestClientConnectError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ErrorResponse{Error: "count must be between 1 and 10"})
+	}))
+	defer server.Close()
+
+	_, err := NewClient(server.URL).Connect(context.Background(), 50)
+	assert.ErrorContains(t, err, "count must be between 1 and 10")
+}
@@ -0,0 +1,43 @@
+// Package connect defines the schema of dnshaiku's versioned HTTP connect API and a small client for it.
+//
+// Fields may be added to these types within a version but are never removed or changed in meaning.
+package connect
+
+// Version is the API version served at /v1/connect
+const Version = "v1"
+
+// Response is returned by GET /v1/connect
+type Response struct {
+	Version string `json:"version"`
+	// Client is where dnshaiku thinks the requester is
+	Client ClientLocation `json:"client"`
+	// Server is the server the requester should connect to. A slot has been reserved on it.
+	Server Server `json:"server"`
+	// Alternates are the next best servers in order of preference, up to count-1 of them
+	Alternates []Server `json:"alternates"`
+	// TTL is how long in seconds the answer should be cached for
+	TTL int `json:"ttl"`
+}
+
+type ClientLocation struct {
+	Ip        string  `json:"ip"`
+	Country   string  `json:"country,omitempty"`
+	City      string  `json:"city,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type Server struct {
+	Name        string   `json:"name"`
+	IpAddresses []string `json:"ip_addresses"`
+	Region      string   `json:"region"`
+	// DistanceMiles is the distance between the client and the server
+	DistanceMiles float64 `json:"distance_miles"`
+	// Load is the fraction of the server's maximum users currently connected, from 0 to 1
+	Load float64 `json:"load"`
+}
+
+// ErrorResponse is returned with any non-200 status
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
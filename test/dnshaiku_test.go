@@ -2,63 +2,98 @@ package test
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/go-yaml/yaml"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"github.com/vatsimnetwork/vatdns/internal/dnshaiku"
+	"github.com/vatsimnetwork/vatdns/pkg/common"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"testing"
 	"time"
-	"vatdns/internal/logger"
-	"vatdns/pkg/common"
 )
 
-func dnsLookup() string {
-	r := &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: time.Millisecond * time.Duration(10000),
-			}
-			return d.DialContext(ctx, network, "127.0.0.1:10053")
-		},
+// These tests run against a dnshaiku started with TEST_MODE=true and
+// DNS_OVERRIDE_ALLOWED_SOURCES covering 127.0.0.1, see .github/workflows/main.yml
+const (
+	dnsServerAddr  = "127.0.0.1:10053"
+	dataServerAddr = "127.0.0.1:8080"
+)
+
+// dnsLookup resolves fsd.connect.vatsim.net as if the query came from sourceIp, using the
+// EDNS0 source IP override option rather than any server side state
+func dnsLookup(sourceIp string) (string, error) {
+	overrideIp := net.ParseIP(sourceIp)
+	if overrideIp == nil {
+		return "", fmt.Errorf("%q is not an IP address", sourceIp)
+	}
+	if overrideIp.To4() != nil {
+		overrideIp = overrideIp.To4()
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("fsd.connect.vatsim.net.", dns.TypeA)
+	m.SetEdns0(4096, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dnshaiku.EDNS0SourceIpOverride, Data: overrideIp})
+	client := dns.Client{Timeout: 10 * time.Second}
+	in, _, err := client.Exchange(m, dnsServerAddr)
+	if err != nil {
+		return "", err
+	}
+	for _, answer := range in.Answer {
+		if a, ok := answer.(*dns.A); ok {
+			return a.A.String(), nil
+		}
 	}
-	ip, _ := r.LookupHost(context.Background(), "fsd.connect.vatsim.net")
-	return ip[0]
+	return "", fmt.Errorf("no A record returned for %s", sourceIp)
 }
 
 func TestDNS(t *testing.T) {
-	os.Chdir("../test_data")
-	testFiles, _ := os.ReadDir(".")
+	c, err := net.DialTimeout("tcp", dataServerAddr, time.Second)
+	if err != nil {
+		t.Skipf("dnshaiku not running on %s: %s", dataServerAddr, err)
+	}
+	_ = c.Close()
+
+	testFiles, _ := os.ReadDir("../test_data")
 	for _, testFile := range testFiles {
-		yamlData, err := os.ReadFile(testFile.Name())
+		yamlData, err := os.ReadFile(fmt.Sprintf("../test_data/%s", testFile.Name()))
 		if err != nil {
-			logger.Fatal(fmt.Sprintf("Unable to read %s", testFile.Name()))
+			t.Fatalf("Unable to read %s", testFile.Name())
 		}
 		testingDataFile := common.TestingDataYaml{}
 		_ = yaml.Unmarshal(yamlData, &testingDataFile)
 
-		for _, v := range testingDataFile.MockFsdServers {
-			serverJson, _ := json.Marshal(v)
-			requestURL := fmt.Sprintf("http://127.0.0.1:8080/submit_data")
-			_, err := http.Post(requestURL, "application/json", bytes.NewBuffer(serverJson))
-			if err != nil {
-				logger.Error("Unable to submit data to DNS server")
+		// Each file replaces the server state, so files run one after another while the
+		// queries within a file run in parallel
+		t.Run(testFile.Name(), func(t *testing.T) {
+			for _, v := range testingDataFile.MockFsdServers {
+				serverJson, _ := json.Marshal(v)
+				requestURL := fmt.Sprintf("http://%s/submit_data", dataServerAddr)
+				resp, err := http.Post(requestURL, "application/json", bytes.NewBuffer(serverJson))
+				if err != nil {
+					t.Fatalf("Unable to submit data to DNS server: %s", err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				_ = resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("Submitting %s was rejected with %d: %s", v.Name, resp.StatusCode, body)
+				}
 			}
-		}
-		time.Sleep(1 * time.Second)
-		for _, v := range testingDataFile.MockDnsQueries {
-			body := []byte(v.SourceIpAddress)
-			bodyReader := bytes.NewReader(body)
-
-			requestURL := fmt.Sprintf("http://127.0.0.1:8080/dns_ip_override")
-			_, _ = http.Post(requestURL, "", bodyReader)
-			dnsResult := dnsLookup()
-			assert.Equal(t, v.ExpectedIpReturned, dnsResult, "Should be the same")
-		}
-
+			time.Sleep(1 * time.Second)
+			for _, v := range testingDataFile.MockDnsQueries {
+				v := v
+				t.Run(v.SourceIpAddress, func(t *testing.T) {
+					t.Parallel()
+					dnsResult, err := dnsLookup(v.SourceIpAddress)
+					assert.NoError(t, err)
+					assert.Equal(t, v.ExpectedIpReturned, dnsResult, "Should be the same")
+				})
+			}
+		})
 	}
 }